@@ -0,0 +1,360 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// apiPrefix is the path under which version 1 of the JSON API is served.
+const apiPrefix = "/api/v1"
+
+// specFile is the OpenAPI document describing the JSON API, served at
+// /api/openapi.json. TestAPISpec checks that it matches the handlers.
+const specFile = "openapi.json"
+
+// registerAPIHandlers adds the handlers of the JSON API to r:
+//
+//	GET    /api/openapi.json   get the OpenAPI document of the API
+//	GET    /api/v1/books       list books, taking the query parameters of
+//	                           the list page, plus cursor and pageSize
+//	POST   /api/v1/books       add a book
+//	GET    /api/v1/books/{id}  get a book
+//	PUT    /api/v1/books/{id}  replace a book's details
+//	PATCH  /api/v1/books/{id}  change some of a book's details
+//	DELETE /api/v1/books/{id}  move a book to the trash
+//
+// The API serves the books of the request's tenant, and acts for the user
+// signed in to the session, who may only change the books they may change in
+// the HTML pages. Books are sent and received as apiBook objects. Errors are
+// reported with their status code and an apiError object holding the code
+// and a message.
+func registerAPIHandlers(r *mux.Router) {
+	r.Methods("GET").Path("/api/openapi.json").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, specFile)
+		})
+
+	api := r.PathPrefix(apiPrefix).Subrouter()
+	api.Methods("GET").Path("/books").
+		Handler(apiHandler(apiListHandler))
+	api.Methods("POST").Path("/books").
+		Handler(apiHandler(apiCreateHandler))
+	api.Methods("GET").Path("/books/{id:[0-9]+}").
+		Handler(apiHandler(apiGetHandler))
+	api.Methods("PUT").Path("/books/{id:[0-9]+}").
+		Handler(apiHandler(apiUpdateHandler))
+	api.Methods("PATCH").Path("/books/{id:[0-9]+}").
+		Handler(apiHandler(apiPatchHandler))
+	api.Methods("DELETE").Path("/books/{id:[0-9]+}").
+		Handler(apiHandler(apiDeleteHandler))
+}
+
+// apiBook is the JSON form of a bookshelf.Book. The ID, creator, version and
+// creation time are set by the server, and ignored in requests, but for the
+// version of the book a PUT or PATCH request is based on.
+type apiBook struct {
+	ID            int64     `json:"id"`
+	Title         string    `json:"title"`
+	Author        string    `json:"author"`
+	PublishedDate string    `json:"publishedDate"`
+	ImageURL      string    `json:"imageURL"`
+	Description   string    `json:"description"`
+	ISBN          string    `json:"isbn"`
+	Tags          []string  `json:"tags"`
+	CreatedBy     string    `json:"createdBy"`
+	CreatedByID   string    `json:"createdByID"`
+	Version       int64     `json:"version"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+func newAPIBook(b *bookshelf.Book) *apiBook {
+	tags := b.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return &apiBook{
+		ID:            b.ID,
+		Title:         b.Title,
+		Author:        b.Author,
+		PublishedDate: b.PublishedDate,
+		ImageURL:      b.ImageURL,
+		Description:   b.Description,
+		ISBN:          b.ISBN,
+		Tags:          tags,
+		CreatedBy:     b.CreatedBy,
+		CreatedByID:   b.CreatedByID,
+		Version:       b.Version,
+		CreatedAt:     b.CreatedAt,
+	}
+}
+
+// apiBookPatch is the body of a PATCH request. Only the fields present in the
+// request are changed.
+type apiBookPatch struct {
+	Title         *string   `json:"title"`
+	Author        *string   `json:"author"`
+	PublishedDate *string   `json:"publishedDate"`
+	ImageURL      *string   `json:"imageURL"`
+	Description   *string   `json:"description"`
+	ISBN          *string   `json:"isbn"`
+	Tags          *[]string `json:"tags"`
+	Version       *int64    `json:"version"`
+}
+
+// apply changes the fields of b present in the patch.
+func (p *apiBookPatch) apply(b *bookshelf.Book) {
+	for _, f := range []struct {
+		from *string
+		to   *string
+	}{
+		{p.Title, &b.Title},
+		{p.Author, &b.Author},
+		{p.PublishedDate, &b.PublishedDate},
+		{p.ImageURL, &b.ImageURL},
+		{p.Description, &b.Description},
+		{p.ISBN, &b.ISBN},
+	} {
+		if f.from != nil {
+			*f.to = *f.from
+		}
+	}
+	if p.Tags != nil {
+		b.Tags = *p.Tags
+	}
+	if p.Version != nil {
+		b.Version = *p.Version
+	}
+}
+
+// apiBookList is the response to a list request.
+type apiBookList struct {
+	Books      []*apiBook `json:"books"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+	PrevCursor string     `json:"prevCursor,omitempty"`
+}
+
+// apiError is the body of an error response.
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiHandler is an appHandler for the JSON API. It reports errors as JSON
+// objects, in the shape used by docs/managed_vms/endpoints.
+type apiHandler func(http.ResponseWriter, *http.Request) *appError
+
+func (fn apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if e := fn(w, r); e != nil {
+		log.Printf("API handler error: status code: %d, message: %s, underlying err: %#v",
+			e.Code, e.Message, e.Error)
+		apiErrorf(w, e.Code, "%s", e.Message)
+	}
+}
+
+// apiErrorf writes an error response whose message is formatted according
+// to a format specifier.
+func apiErrorf(w http.ResponseWriter, code int, format string, a ...interface{}) {
+	b, err := json.Marshal(apiError{Code: code, Message: fmt.Sprintf(format, a...)})
+	if err != nil {
+		http.Error(w, `{"code": 500, "message": "Could not format JSON for original message."}`, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// writeJSON writes v as the JSON body of a response with the given status
+// code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) *appError {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return appErrorf(err, "could not encode response: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+	return nil
+}
+
+// decodeJSON decodes the JSON body of a request into v. A malformed body is
+// an error of kind ErrInvalidArgument.
+func decodeJSON(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return &bookshelf.Error{
+			Kind: bookshelf.ErrInvalidArgument,
+			Msg:  fmt.Sprintf("body is not a valid book: %v", err),
+		}
+	}
+	return nil
+}
+
+// apiBookURL returns the URL path of a book in the API.
+func apiBookURL(id int64) string {
+	return fmt.Sprintf("%s/books/%d", apiPrefix, id)
+}
+
+// writeBook writes the current details of the book with the given ID.
+func writeBook(w http.ResponseWriter, r *http.Request, code int, id int64) *appError {
+	book, err := bookshelf.DB.GetBook(r.Context(), id)
+	if err != nil {
+		return appErrorf(err, "could not find book: %v", err)
+	}
+	return writeJSON(w, code, newAPIBook(book))
+}
+
+// apiListHandler lists a page of books, selected and ordered by the query
+// parameters described by listQuery.
+func apiListHandler(w http.ResponseWriter, r *http.Request) *appError {
+	opts, err := listQueryFromForm(r).options()
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	pageSize := bookshelf.DefaultPageSize
+	if s := r.FormValue("pageSize"); s != "" {
+		if pageSize, err = strconv.Atoi(s); err != nil {
+			err = badListQuery("bad page size %q", s)
+			return appErrorf(err, "%v", err)
+		}
+	}
+
+	page, err := bookshelf.DB.ListBooksPage(r.Context(), opts, r.FormValue("cursor"), pageSize)
+	if err != nil {
+		return appErrorf(err, "could not list books: %v", err)
+	}
+	list := &apiBookList{
+		Books:      []*apiBook{},
+		NextCursor: page.NextCursor,
+		PrevCursor: page.PrevCursor,
+	}
+	for _, b := range page.Books {
+		list.Books = append(list.Books, newAPIBook(b))
+	}
+	return writeJSON(w, http.StatusOK, list)
+}
+
+// apiGetHandler gets a given book.
+func apiGetHandler(w http.ResponseWriter, r *http.Request) *appError {
+	book, err := bookFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	return writeJSON(w, http.StatusOK, newAPIBook(book))
+}
+
+// apiCreateHandler adds a book, created by the current user, and responds
+// with the book and its URL.
+func apiCreateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	var in apiBook
+	if err := decodeJSON(r, &in); err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	book := &bookshelf.Book{
+		Title:         in.Title,
+		Author:        in.Author,
+		PublishedDate: in.PublishedDate,
+		ImageURL:      in.ImageURL,
+		Description:   in.Description,
+		ISBN:          in.ISBN,
+		Tags:          in.Tags,
+	}
+	setCreator(r, book)
+
+	id, err := bookshelf.DB.AddBook(actorContext(r), book)
+	if err != nil {
+		return appErrorf(err, "could not save book: %v", err)
+	}
+	go publishUpdate(bookshelf.TenantFromContext(r.Context()), id)
+
+	w.Header().Set("Location", apiBookURL(id))
+	return writeBook(w, r, http.StatusCreated, id)
+}
+
+// apiUpdateHandler replaces the details of a given book with those in the
+// request, which must hold the version of the book they are based on.
+func apiUpdateHandler(w http.ResponseWriter, r *http.Request) *appError {
+	book, err := bookFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	if e := authorizeChange(r, book); e != nil {
+		return e
+	}
+	var in apiBook
+	if err := decodeJSON(r, &in); err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	if in.Version == 0 {
+		err := &bookshelf.Error{
+			Kind: bookshelf.ErrInvalidArgument,
+			Msg:  "the version of the book to replace is required",
+		}
+		return appErrorf(err, "%v", err)
+	}
+
+	book.Title = in.Title
+	book.Author = in.Author
+	book.PublishedDate = in.PublishedDate
+	book.ImageURL = in.ImageURL
+	book.Description = in.Description
+	book.ISBN = in.ISBN
+	book.Tags = in.Tags
+	book.Version = in.Version
+	return saveAPIBook(w, r, book)
+}
+
+// apiPatchHandler changes the details of a given book present in the
+// request. If the request holds a version, the change is rejected if the
+// book has been modified since.
+func apiPatchHandler(w http.ResponseWriter, r *http.Request) *appError {
+	book, err := bookFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	if e := authorizeChange(r, book); e != nil {
+		return e
+	}
+	var patch apiBookPatch
+	if err := decodeJSON(r, &patch); err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	patch.apply(book)
+	return saveAPIBook(w, r, book)
+}
+
+// saveAPIBook updates a book and responds with its new details.
+func saveAPIBook(w http.ResponseWriter, r *http.Request, book *bookshelf.Book) *appError {
+	if err := bookshelf.DB.UpdateBook(actorContext(r), book); err != nil {
+		return appErrorf(err, "could not save book: %v", err)
+	}
+	go publishUpdate(bookshelf.TenantFromContext(r.Context()), book.ID)
+	return writeBook(w, r, http.StatusOK, book.ID)
+}
+
+// apiDeleteHandler moves a given book to the trash.
+func apiDeleteHandler(w http.ResponseWriter, r *http.Request) *appError {
+	book, err := bookFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	if e := authorizeChange(r, book); e != nil {
+		return e
+	}
+	if err := bookshelf.DB.DeleteBook(actorContext(r), book.ID); err != nil {
+		return appErrorf(err, "could not delete book: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
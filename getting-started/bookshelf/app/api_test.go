@@ -0,0 +1,272 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf/bookshelfclient"
+)
+
+// apiDo makes a JSON API request and decodes the response's body into out,
+// if it is not nil. It returns the response, whose body is closed.
+func apiDo(t *testing.T, method, path, body string, out interface{}) *http.Response {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := wt.NewRequest(method, path, r)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := wt.Client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: could not decode response: %v", method, path, err)
+		}
+	}
+	return resp
+}
+
+// checkAPIError checks that an API request fails with the given status code,
+// reported in a JSON body.
+func checkAPIError(t *testing.T, method, path, body string, code int) {
+	var e apiError
+	resp := apiDo(t, method, path, body, &e)
+	if resp.StatusCode != code || e.Code != code || e.Message == "" {
+		t.Errorf("%s %s: got status %d and body %+v, want status %d with a message", method, path, resp.StatusCode, e, code)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("%s %s: got Content-Type %q, want application/json", method, path, got)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	// Add a book, created by the server's idea of the user, not the client's.
+	var created apiBook
+	resp := apiDo(t, "POST", "/api/v1/books",
+		`{"title": "api book", "author": "Ada", "tags": ["maths"], "createdByID": "someone-else", "version": 7}`, &created)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	loc := resp.Header.Get("Location")
+	if want := apiBookURL(created.ID); loc != want {
+		t.Errorf("POST: got Location %q, want %q", loc, want)
+	}
+	if created.Title != "api book" || created.CreatedByID != "anonymous" || created.Version != 1 {
+		t.Errorf("POST: got %+v, want an anonymous book at version 1", created)
+	}
+	defer apiDo(t, "DELETE", loc, "", nil)
+
+	var got apiBook
+	if resp := apiDo(t, "GET", loc, "", &got); resp.StatusCode != http.StatusOK || got.Title != "api book" {
+		t.Errorf("GET %s: got status %d and %+v", loc, resp.StatusCode, got)
+	}
+
+	var list apiBookList
+	apiDo(t, "GET", "/api/v1/books?author=Ada&pageSize=5", "", &list)
+	if len(list.Books) != 1 || list.Books[0].ID != created.ID {
+		t.Errorf("GET list by author: got %+v, want the added book", list)
+	}
+
+	// PUT replaces every field, and requires the current version.
+	var replaced apiBook
+	resp = apiDo(t, "PUT", loc, `{"title": "replaced", "version": 1}`, &replaced)
+	if resp.StatusCode != http.StatusOK || replaced.Title != "replaced" || replaced.Author != "" || replaced.Version != 2 {
+		t.Errorf("PUT: got status %d and %+v, want the replaced book at version 2", resp.StatusCode, replaced)
+	}
+	checkAPIError(t, "PUT", loc, `{"title": "stale", "version": 1}`, http.StatusConflict)
+	checkAPIError(t, "PUT", loc, `{"title": "no version"}`, http.StatusBadRequest)
+
+	// PATCH changes only the fields sent.
+	var patched apiBook
+	resp = apiDo(t, "PATCH", loc, `{"author": "Grace"}`, &patched)
+	if resp.StatusCode != http.StatusOK || patched.Title != "replaced" || patched.Author != "Grace" || patched.Version != 3 {
+		t.Errorf("PATCH: got status %d and %+v, want the patched book at version 3", resp.StatusCode, patched)
+	}
+	checkAPIError(t, "PATCH", loc, `{"author": "stale", "version": 2}`, http.StatusConflict)
+	checkAPIError(t, "PATCH", loc, `{"author": `, http.StatusBadRequest)
+
+	if resp := apiDo(t, "DELETE", loc, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE: got status %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+	checkAPIError(t, "GET", loc, "", http.StatusNotFound)
+	checkAPIError(t, "DELETE", loc, "", http.StatusNotFound)
+}
+
+func TestAPIErrors(t *testing.T) {
+	checkAPIError(t, "POST", "/api/v1/books", "not json", http.StatusBadRequest)
+	checkAPIError(t, "POST", "/api/v1/books", `{"title": "bad isbn", "isbn": "123"}`, http.StatusBadRequest)
+	checkAPIError(t, "GET", "/api/v1/books?sort=bogus", "", http.StatusBadRequest)
+	checkAPIError(t, "GET", "/api/v1/books?pageSize=many", "", http.StatusBadRequest)
+	checkAPIError(t, "GET", "/api/v1/books/999999", "", http.StatusNotFound)
+}
+
+// spec holds the parts of the OpenAPI document that TestAPISpec checks.
+type spec struct {
+	Paths      map[string]map[string]json.RawMessage
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage
+		}
+	}
+}
+
+// muxVar matches a variable of a mux path template, with its pattern.
+var muxVar = regexp.MustCompile(`{([^:}]+):[^}]*}`)
+
+// TestAPISpec checks that the routes under /api/ are those described by the
+// OpenAPI document, and that the JSON objects sent and received have the
+// properties of their schemas.
+func TestAPISpec(t *testing.T) {
+	b, err := ioutil.ReadFile(specFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc spec
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("%s: %v", specFile, err)
+	}
+
+	var want []string
+	for path, item := range doc.Paths {
+		for method := range item {
+			if method != "parameters" {
+				want = append(want, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+	var got []string
+	err = newRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/") || route.GetHandler() == nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Errorf("%s: route has no methods", path)
+			return nil
+		}
+		for _, m := range methods {
+			got = append(got, m+" "+muxVar.ReplaceAllString(path, "{$1}"))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("API routes:\n%s\nwant those in %s:\n%s", strings.Join(got, "\n"), specFile, strings.Join(want, "\n"))
+	}
+
+	schemas := []struct {
+		name string
+		v    interface{}
+	}{
+		{"Book", apiBook{}},
+		{"Book", bookshelfclient.Book{}},
+		{"BookPatch", apiBookPatch{}},
+		{"BookPatch", bookshelfclient.BookPatch{}},
+		{"BookList", apiBookList{}},
+		{"BookList", bookshelfclient.BookList{}},
+		{"Error", apiError{}},
+		{"Error", bookshelfclient.Error{}},
+	}
+	for _, s := range schemas {
+		var want []string
+		for p := range doc.Components.Schemas[s.name].Properties {
+			want = append(want, p)
+		}
+		sort.Strings(want)
+		if got := jsonFields(s.v); !reflect.DeepEqual(got, want) {
+			t.Errorf("%T has JSON fields %v, want the properties of schema %s: %v", s.v, got, s.name, want)
+		}
+	}
+}
+
+// jsonFields returns the sorted names of the JSON object v encodes to.
+func jsonFields(v interface{}) []string {
+	var names []string
+	typ := reflect.TypeOf(v)
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestAPISpecServed(t *testing.T) {
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+	}
+	resp := apiDo(t, "GET", "/api/openapi.json", "", &doc)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("GET /api/openapi.json: got status %d and version %q, want an OpenAPI 3 document", resp.StatusCode, doc.OpenAPI)
+	}
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := bookshelfclient.New(serverURL)
+
+	book, err := c.AddBook(ctx, &bookshelfclient.Book{Title: "client book", Author: "Ursula", Tags: []string{"sf"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.DeleteBook(ctx, book.ID)
+	if book.ID == 0 || book.Version != 1 || book.CreatedByID != "anonymous" {
+		t.Errorf("AddBook: got %+v, want a new anonymous book", book)
+	}
+
+	list, err := c.ListBooks(ctx, &bookshelfclient.ListOptions{Author: "Ursula", Descending: true, PageSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Books) != 1 || list.Books[0].ID != book.ID {
+		t.Errorf("ListBooks by author: got %+v, want the added book", list.Books)
+	}
+
+	book.Title = "client book, revised"
+	if book, err = c.UpdateBook(ctx, book); err != nil {
+		t.Fatal(err)
+	}
+	book.Version = 1
+	if _, err := c.UpdateBook(ctx, book); !bookshelfclient.IsConflict(err) {
+		t.Errorf("UpdateBook of stale version: got err %v, want a conflict", err)
+	}
+
+	patched, err := c.PatchBook(ctx, book.ID, &bookshelfclient.BookPatch{Author: bookshelfclient.String("Le Guin")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.Title != "client book, revised" || patched.Author != "Le Guin" || patched.Version != 3 {
+		t.Errorf("PatchBook: got %+v, want the revised book by Le Guin at version 3", patched)
+	}
+
+	if err := c.DeleteBook(ctx, book.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetBook(ctx, book.ID); !bookshelfclient.IsNotFound(err) {
+		t.Errorf("GetBook of deleted book: got err %v, want not found", err)
+	}
+}
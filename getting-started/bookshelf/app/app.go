@@ -16,6 +16,7 @@ import (
 	"os"
 	"path"
 	"strconv"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 	"cloud.google.com/go/storage"
@@ -33,17 +34,39 @@ import (
 
 var (
 	// See template.go
-	listTmpl   = parseTemplate("list.html")
-	editTmpl   = parseTemplate("edit.html")
-	detailTmpl = parseTemplate("detail.html")
+	listTmpl     = parseTemplate("list.html")
+	editTmpl     = parseTemplate("edit.html")
+	detailTmpl   = parseTemplate("detail.html")
+	searchTmpl   = parseTemplate("search.html")
+	conflictTmpl = parseTemplate("conflict.html")
+	errorTmpl    = parseTemplate("error.html")
+	trashTmpl    = parseTemplate("trash.html")
+	historyTmpl  = parseTemplate("history.html")
+	tagTmpl      = parseTemplate("tag.html")
+	loginTmpl    = parseTemplate("login.html")
 )
 
 func main() {
+	if err := bookshelf.Init(); err != nil {
+		log.Fatal(err)
+	}
 	registerHandlers()
+	go purgeTrash(time.Hour)
 	appengine.Main()
 }
 
 func registerHandlers() {
+	// [START request_logging]
+	// Delegate all of the HTTP routing and serving to the gorilla/mux router,
+	// scoped to the request's tenant (see tenant.go) and protected from
+	// cross-site request forgery (see csrf.go).
+	// Log all requests using the standard Apache format.
+	http.Handle("/", handlers.CombinedLoggingHandler(os.Stderr, tenantHandler(csrfHandler(newRouter()))))
+	// [END request_logging]
+}
+
+// newRouter returns a router serving the bookshelf's pages and API.
+func newRouter() *mux.Router {
 	// Use gorilla/mux for rich routing.
 	// See http://www.gorillatoolkit.org/pkg/mux
 	r := mux.NewRouter()
@@ -54,12 +77,22 @@ func registerHandlers() {
 		Handler(appHandler(listHandler))
 	r.Methods("GET").Path("/books/mine").
 		Handler(appHandler(listMineHandler))
+	r.Methods("GET").Path("/books/search").
+		Handler(appHandler(searchHandler))
+	r.Methods("GET").Path("/books/trash").
+		Handler(appHandler(trashHandler))
 	r.Methods("GET").Path("/books/{id:[0-9]+}").
 		Handler(appHandler(detailHandler))
 	r.Methods("GET").Path("/books/add").
 		Handler(appHandler(addFormHandler))
 	r.Methods("GET").Path("/books/{id:[0-9]+}/edit").
 		Handler(appHandler(editFormHandler))
+	r.Methods("GET").Path("/books/{id:[0-9]+}/history").
+		Handler(appHandler(historyHandler))
+	r.Methods("GET").Path("/tags/{tag}").
+		Handler(appHandler(tagHandler))
+	r.Methods("GET").Path("/isbn/{isbn}").
+		Handler(appHandler(isbnHandler))
 
 	r.Methods("POST").Path("/books").
 		Handler(appHandler(createHandler))
@@ -67,6 +100,13 @@ func registerHandlers() {
 		Handler(appHandler(updateHandler))
 	r.Methods("POST").Path("/books/{id:[0-9]+}:delete").
 		Handler(appHandler(deleteHandler)).Name("delete")
+	r.Methods("POST").Path("/books/{id:[0-9]+}:restore").
+		Handler(appHandler(restoreHandler))
+	r.Methods("POST").Path("/books/{id:[0-9]+}:revert").
+		Handler(appHandler(revertHandler))
+
+	// The JSON API is defined in api.go.
+	registerAPIHandlers(r)
 
 	// The following handlers are defined in auth.go and used in the
 	// "Authenticating Users" part of the Getting Started guide.
@@ -77,6 +117,10 @@ func registerHandlers() {
 	r.Methods("GET").Path("/oauth2callback").
 		Handler(appHandler(oauthCallbackHandler))
 
+	// Serve the database metrics, if they are kept in memory.
+	r.Methods("GET").Path("/debug/metrics").
+		Handler(appHandler(metricsHandler))
+
 	// Respond to App Engine and Compute Engine health checks.
 	// Indicate the server is healthy.
 	r.Methods("GET").Path("/_ah/health").HandlerFunc(
@@ -84,25 +128,32 @@ func registerHandlers() {
 			w.Write([]byte("ok"))
 		})
 
-	// [START request_logging]
-	// Delegate all of the HTTP routing and serving to the gorilla/mux router.
-	// Log all requests using the standard Apache format.
-	http.Handle("/", handlers.CombinedLoggingHandler(os.Stderr, r))
-	// [END request_logging]
+	return r
 }
 
-// listHandler displays a list with summaries of books in the database.
+// listHandler displays a page of summaries of books in the database,
+// selected and ordered by the query parameters described by listQuery.
+// The page is selected by the "cursor" query parameter.
 func listHandler(w http.ResponseWriter, r *http.Request) *appError {
-	books, err := bookshelf.DB.ListBooks()
+	q := listQueryFromForm(r)
+	opts, err := q.options()
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	page, err := bookshelf.DB.ListBooksPage(r.Context(), opts, r.FormValue("cursor"), bookshelf.DefaultPageSize)
 	if err != nil {
 		return appErrorf(err, "could not list books: %v", err)
 	}
+	tags, err := bookshelf.DB.ListTags(r.Context())
+	if err != nil {
+		return appErrorf(err, "could not list tags: %v", err)
+	}
 
-	return listTmpl.Execute(w, r, books)
+	return listTmpl.Execute(w, r, newListPage(page, q, tagCloud(tags)))
 }
 
 // listMineHandler displays a list of books created by the currently
-// authenticated user.
+// authenticated user, ordered and filtered as for listHandler.
 func listMineHandler(w http.ResponseWriter, r *http.Request) *appError {
 	user := profileFromSession(r)
 	if user == nil {
@@ -111,26 +162,70 @@ func listMineHandler(w http.ResponseWriter, r *http.Request) *appError {
 		return nil
 	}
 
-	books, err := bookshelf.DB.ListBooksCreatedBy(user.Id)
+	q := listQueryFromForm(r)
+	q.Creator = ""
+	opts, err := q.options()
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	opts.CreatedByID = user.ID
+	page, err := bookshelf.DB.ListBooksPage(r.Context(), opts, r.FormValue("cursor"), bookshelf.DefaultPageSize)
 	if err != nil {
 		return appErrorf(err, "could not list books: %v", err)
 	}
 
-	return listTmpl.Execute(w, r, books)
+	return listTmpl.Execute(w, r, newListPage(page, q, nil))
 }
 
-// bookFromRequest retrieves a book from the database given a book ID in the
-// URL's path.
-func bookFromRequest(r *http.Request) (*bookshelf.Book, error) {
+// searchHandler displays the books matching the query in the "q" parameter.
+func searchHandler(w http.ResponseWriter, r *http.Request) *appError {
+	query := r.FormValue("q")
+
+	var books []*bookshelf.Book
+	if query != "" {
+		var err error
+		books, err = bookshelf.DB.SearchBooks(r.Context(), query)
+		if err != nil {
+			return appErrorf(err, "could not search books: %v", err)
+		}
+	}
+
+	return searchTmpl.Execute(w, r, struct {
+		Query string
+		Books []*bookshelf.Book
+	}{query, books})
+}
+
+// actorContext returns the request's context, carrying the ID of the current
+// user (or "anonymous") as the actor of the changes made to books with it.
+func actorContext(r *http.Request) context.Context {
+	actor := "anonymous"
+	if user := profileFromSession(r); user != nil {
+		actor = user.ID
+	}
+	return bookshelf.WithActor(r.Context(), actor)
+}
+
+// bookIDFromRequest parses the book ID in the URL's path.
+func bookIDFromRequest(r *http.Request) (int64, error) {
 	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("bad book id: %v", err)
+		return 0, &bookshelf.Error{
+			Kind: bookshelf.ErrInvalidArgument,
+			Msg:  fmt.Sprintf("bad book id: %v", err),
+		}
 	}
-	book, err := bookshelf.DB.GetBook(id)
+	return id, nil
+}
+
+// bookFromRequest retrieves a book from the database given a book ID in the
+// URL's path.
+func bookFromRequest(r *http.Request) (*bookshelf.Book, error) {
+	id, err := bookIDFromRequest(r)
 	if err != nil {
-		return nil, fmt.Errorf("could not find book: %v", err)
+		return nil, err
 	}
-	return book, nil
+	return bookshelf.DB.GetBook(r.Context(), id)
 }
 
 // detailHandler displays the details of a given book.
@@ -143,6 +238,17 @@ func detailHandler(w http.ResponseWriter, r *http.Request) *appError {
 	return detailTmpl.Execute(w, r, book)
 }
 
+// isbnHandler redirects to the details of the book with the ISBN in the URL's
+// path, which may be an ISBN-10 or ISBN-13.
+func isbnHandler(w http.ResponseWriter, r *http.Request) *appError {
+	book, err := bookshelf.DB.GetBookByISBN(r.Context(), mux.Vars(r)["isbn"])
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", book.ID), http.StatusFound)
+	return nil
+}
+
 // addFormHandler displays a form that captures details of a new book to add to
 // the database.
 func addFormHandler(w http.ResponseWriter, r *http.Request) *appError {
@@ -156,12 +262,16 @@ func editFormHandler(w http.ResponseWriter, r *http.Request) *appError {
 	if err != nil {
 		return appErrorf(err, "%v", err)
 	}
+	if e := authorizeChange(r, book); e != nil {
+		return e
+	}
 
 	return editTmpl.Execute(w, r, book)
 }
 
 // bookFromForm populates the fields of a Book from form values
-// (see templates/edit.html).
+// (see templates/edit.html). The creator is not taken from the form: the
+// handlers set it themselves.
 func bookFromForm(r *http.Request) (*bookshelf.Book, error) {
 	imageURL, err := uploadFileFromForm(r)
 	if err != nil {
@@ -175,26 +285,11 @@ func bookFromForm(r *http.Request) (*bookshelf.Book, error) {
 		Title:         r.FormValue("title"),
 		Author:        r.FormValue("author"),
 		PublishedDate: r.FormValue("publishedDate"),
+		ISBN:          r.FormValue("isbn"),
+		Tags:          tagsFromForm(r.FormValue("tags")),
 		ImageURL:      imageURL,
 		Description:   r.FormValue("description"),
-		CreatedBy:     r.FormValue("createdBy"),
-		CreatedByID:   r.FormValue("createdByID"),
-	}
-
-	// If the form didn't carry the user information for the creator, populate it
-	// from the currently logged in user (or mark as anonymous).
-	if book.CreatedByID == "" {
-		user := profileFromSession(r)
-		if user != nil {
-			// Logged in.
-			book.CreatedBy = user.DisplayName
-			book.CreatedByID = user.Id
-		} else {
-			// Not logged in.
-			book.SetCreatorAnonymous()
-		}
 	}
-
 	return book, nil
 }
 
@@ -209,13 +304,17 @@ func uploadFileFromForm(r *http.Request) (url string, err error) {
 	}
 
 	if bookshelf.StorageBucket == nil {
-		return "", errors.New("storage bucket is missing - check config.go")
+		return "", errors.New("storage bucket is missing - set BOOKSHELF_STORAGE_BUCKET")
 	}
 
 	// random filename, retaining existing extension.
 	name := uuid.NewV4().String() + path.Ext(fh.Filename)
 
-	ctx := context.Background()
+	// Keep each tenant's images under a prefix of their own.
+	ctx := r.Context()
+	if tenant := bookshelf.TenantFromContext(ctx); tenant != bookshelf.DefaultTenant {
+		name = tenant + "/" + name
+	}
 	w := bookshelf.StorageBucket.Object(name).NewWriter(ctx)
 	w.ACL = []storage.ACLRule{{Entity: storage.AllUsers, Role: storage.RoleReader}}
 	w.ContentType = fh.Header.Get("Content-Type")
@@ -234,50 +333,89 @@ func uploadFileFromForm(r *http.Request) (url string, err error) {
 	return fmt.Sprintf(publicURL, bookshelf.StorageBucketName, name), nil
 }
 
-// createHandler adds a book to the database.
+// createHandler adds a book to the database, created by the current user.
 func createHandler(w http.ResponseWriter, r *http.Request) *appError {
 	book, err := bookFromForm(r)
 	if err != nil {
 		return appErrorf(err, "could not parse book from form: %v", err)
 	}
-	id, err := bookshelf.DB.AddBook(book)
+	setCreator(r, book)
+	id, err := bookshelf.DB.AddBook(actorContext(r), book)
 	if err != nil {
 		return appErrorf(err, "could not save book: %v", err)
 	}
-	go publishUpdate(id)
+	go publishUpdate(bookshelf.TenantFromContext(r.Context()), id)
 	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
 	return nil
 }
 
-// updateHandler updates the details of a given book.
+// updateHandler updates the details of a given book, if the current user
+// may change it.
 func updateHandler(w http.ResponseWriter, r *http.Request) *appError {
-	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	current, err := bookFromRequest(r)
 	if err != nil {
-		return appErrorf(err, "bad book id: %v", err)
+		return appErrorf(err, "%v", err)
+	}
+	if e := authorizeChange(r, current); e != nil {
+		return e
 	}
 
 	book, err := bookFromForm(r)
 	if err != nil {
 		return appErrorf(err, "could not parse book from form: %v", err)
 	}
-	book.ID = id
+	book.ID = current.ID
+	book.CreatedBy = current.CreatedBy
+	book.CreatedByID = current.CreatedByID
+
+	// The version is the one the user started editing. If the book has been
+	// modified since, UpdateBook rejects the update.
+	book.Version, err = strconv.ParseInt(r.FormValue("version"), 10, 64)
+	if err != nil {
+		err = &bookshelf.Error{
+			Kind: bookshelf.ErrInvalidArgument,
+			Msg:  fmt.Sprintf("bad book version: %v", err),
+		}
+		return appErrorf(err, "%v", err)
+	}
 
-	err = bookshelf.DB.UpdateBook(book)
+	err = bookshelf.DB.UpdateBook(actorContext(r), book)
+	if _, ok := err.(*bookshelf.ConflictError); ok {
+		return conflictHandler(w, r, book)
+	}
 	if err != nil {
 		return appErrorf(err, "could not save book: %v", err)
 	}
-	go publishUpdate(book.ID)
+	go publishUpdate(bookshelf.TenantFromContext(r.Context()), book.ID)
 	http.Redirect(w, r, fmt.Sprintf("/books/%d", book.ID), http.StatusFound)
 	return nil
 }
 
-// deleteHandler deletes a given book.
+// conflictHandler displays the current details of a book alongside the
+// user's rejected changes, after an update conflicted with another one.
+func conflictHandler(w http.ResponseWriter, r *http.Request, submitted *bookshelf.Book) *appError {
+	current, err := bookshelf.DB.GetBook(r.Context(), submitted.ID)
+	if err != nil {
+		return appErrorf(err, "could not find book: %v", err)
+	}
+
+	w.WriteHeader(http.StatusConflict)
+	return conflictTmpl.Execute(w, r, struct {
+		Current, Submitted *bookshelf.Book
+	}{current, submitted})
+}
+
+// deleteHandler moves a given book to the trash, if the current user may
+// change it. See trash.go.
 func deleteHandler(w http.ResponseWriter, r *http.Request) *appError {
-	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	book, err := bookFromRequest(r)
 	if err != nil {
-		return appErrorf(err, "bad book id: %v", err)
+		return appErrorf(err, "%v", err)
+	}
+	if e := authorizeChange(r, book); e != nil {
+		return e
 	}
-	err = bookshelf.DB.DeleteBook(id)
+	err = bookshelf.DB.DeleteBook(actorContext(r), book.ID)
 	if err != nil {
 		return appErrorf(err, "could not delete book: %v", err)
 	}
@@ -285,13 +423,15 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) *appError {
 	return nil
 }
 
-// publishUpdate notifies Pub/Sub subscribers that the book identified with
-// the given ID has been added/modified.
-func publishUpdate(bookID int64) {
+// publishUpdate notifies Pub/Sub subscribers that the book of a tenant
+// identified with the given ID has been added/modified.
+func publishUpdate(tenant string, bookID int64) {
 	if bookshelf.PubsubClient == nil {
 		return
 	}
 
+	// This runs after the response has been sent, so it must not use the
+	// request's context.
 	ctx := context.Background()
 
 	b, err := json.Marshal(bookID)
@@ -299,8 +439,11 @@ func publishUpdate(bookID int64) {
 		return
 	}
 	topic := bookshelf.PubsubClient.Topic(bookshelf.PubsubTopicID)
-	_, err = topic.Publish(ctx, &pubsub.Message{Data: b})
-	log.Printf("Published update to Pub/Sub for Book ID %d: %v", bookID, err)
+	_, err = topic.Publish(ctx, &pubsub.Message{
+		Data:       b,
+		Attributes: map[string]string{bookshelf.PubsubTenantAttribute: tenant},
+	})
+	log.Printf("Published update to Pub/Sub for Book ID %d of tenant %q: %v", bookID, tenant, err)
 }
 
 // http://blog.golang.org/error-handling-and-go
@@ -317,14 +460,39 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Handler error: status code: %d, message: %s, underlying err: %#v",
 			e.Code, e.Message, e.Error)
 
-		http.Error(w, e.Message, e.Code)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(e.Code)
+		data := struct {
+			Code    int
+			Status  string
+			Message string
+		}{e.Code, http.StatusText(e.Code), e.Message}
+		if err := errorTmpl.Execute(w, r, data); err != nil {
+			log.Printf("Could not render error page: %v", err.Error)
+		}
 	}
 }
 
+// appErrorf returns an appError with a message formatted according to a
+// format specifier. Its status code depends on the kind of err: see
+// errorStatus.
 func appErrorf(err error, format string, v ...interface{}) *appError {
 	return &appError{
 		Error:   err,
 		Message: fmt.Sprintf(format, v...),
-		Code:    500,
+		Code:    errorStatus(err),
+	}
+}
+
+// errorStatus returns the HTTP status code that reports err to the client.
+func errorStatus(err error) int {
+	switch bookshelf.ErrorKind(err) {
+	case bookshelf.ErrNotFound:
+		return http.StatusNotFound
+	case bookshelf.ErrInvalidArgument:
+		return http.StatusBadRequest
+	case bookshelf.ErrConflict, bookshelf.ErrAlreadyExists:
+		return http.StatusConflict
 	}
+	return http.StatusInternalServerError
 }
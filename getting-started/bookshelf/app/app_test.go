@@ -7,22 +7,43 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"log"
 	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
 	"github.com/GoogleCloudPlatform/golang-samples/internal/testutil"
 	"github.com/GoogleCloudPlatform/golang-samples/internal/webtest"
 )
 
-var wt *webtest.W
+var (
+	wt        *webtest.W
+	serverURL string // The URL of the server wt tests.
+)
 
 func TestMain(m *testing.M) {
+	if err := bookshelf.Configure(&bookshelf.Config{Database: "memory:"}); err != nil {
+		log.Fatal(err)
+	}
 	serv := httptest.NewServer(nil)
 	wt = webtest.New(nil, serv.Listener.Addr().String())
+	serverURL = serv.URL
+	// Keep the session, which holds the CSRF token.
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	wt.Client = &http.Client{Jar: jar}
 	registerHandlers()
 
 	os.Exit(m.Run())
@@ -43,8 +64,9 @@ func TestNoBooks(t *testing.T) {
 }
 
 func TestBookDetail(t *testing.T) {
+	ctx := context.Background()
 	const title = "book mcbook"
-	id, err := bookshelf.DB.AddBook(&bookshelf.Book{
+	id, err := bookshelf.DB.AddBook(ctx, &bookshelf.Book{
 		Title: title,
 	})
 	if err != nil {
@@ -56,7 +78,7 @@ func TestBookDetail(t *testing.T) {
 	bookPath := fmt.Sprintf("/books/%d", id)
 	bodyContains(t, wt, bookPath, title)
 
-	if err := bookshelf.DB.DeleteBook(id); err != nil {
+	if err := bookshelf.DB.DeleteBook(ctx, id); err != nil {
 		t.Fatal(err)
 	}
 
@@ -64,8 +86,9 @@ func TestBookDetail(t *testing.T) {
 }
 
 func TestEditBook(t *testing.T) {
+	ctx := context.Background()
 	const title = "book mcbook"
-	id, err := bookshelf.DB.AddBook(&bookshelf.Book{
+	id, err := bookshelf.DB.AddBook(ctx, &bookshelf.Book{
 		Title: title,
 	})
 	if err != nil {
@@ -81,10 +104,11 @@ func TestEditBook(t *testing.T) {
 	m := multipart.NewWriter(&body)
 	m.WriteField("title", "simpsons")
 	m.WriteField("author", "homer")
+	m.WriteField("version", "1")
 	m.CreateFormFile("image", "")
 	m.Close()
 
-	resp, err := wt.Post(bookPath, "multipart/form-data; boundary="+m.Boundary(), &body)
+	resp, err := csrfPost(t, bookPath, "multipart/form-data; boundary="+m.Boundary(), &body)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -95,7 +119,24 @@ func TestEditBook(t *testing.T) {
 	bodyContains(t, wt, bookPath, "simpsons")
 	bodyContains(t, wt, bookPath, "homer")
 
-	if err := bookshelf.DB.DeleteBook(id); err != nil {
+	// Submitting the same edit again conflicts, as the version is now stale.
+	body.Reset()
+	m = multipart.NewWriter(&body)
+	m.WriteField("title", "flanders")
+	m.WriteField("version", "1")
+	m.Close()
+
+	resp, err = csrfPost(t, bookPath, "multipart/form-data; boundary="+m.Boundary(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusConflict; got != want {
+		t.Errorf("stale edit: got status %d, want %d", got, want)
+	}
+	bodyContains(t, wt, bookPath, "simpsons")
+
+	if err := bookshelf.DB.DeleteBook(ctx, id); err != nil {
 		t.Fatalf("got err %v, want nil", err)
 	}
 }
@@ -112,7 +153,7 @@ func TestAddAndDelete(t *testing.T) {
 	m.CreateFormFile("image", "")
 	m.Close()
 
-	resp, err := wt.Post(bookPath, "multipart/form-data; boundary="+m.Boundary(), &body)
+	resp, err := csrfPost(t, bookPath, "multipart/form-data; boundary="+m.Boundary(), &body)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -125,10 +166,367 @@ func TestAddAndDelete(t *testing.T) {
 	bodyContains(t, wt, gotPath, "simpsons")
 	bodyContains(t, wt, gotPath, "homer")
 
-	_, err = wt.Post(gotPath+":delete", "", nil)
+	_, err = csrfPost(t, gotPath+":delete", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+	const title = "the trashed book"
+	id, err := bookshelf.DB.AddBook(ctx, &bookshelf.Book{Title: title})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.PurgeBooks(ctx, time.Now().Add(time.Hour))
+
+	bookPath := fmt.Sprintf("/books/%d", id)
+	resp, err := csrfPost(t, bookPath+":delete", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	bodyContains(t, wt, "/books/trash", title)
+	if _, resp, err := wt.GetBody(bookPath); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET %s of deleted book: got %v, %v; want status %d", bookPath, resp, err, http.StatusNotFound)
+	}
+
+	resp, err = csrfPost(t, bookPath+":restore", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.Request.URL.Path, bookPath; got != want {
+		t.Errorf("restore redirect: got %s, want %s", got, want)
+	}
+	bodyContains(t, wt, bookPath, title)
+	if body, _, err := wt.GetBody("/books/trash"); err != nil || strings.Contains(body, title) {
+		t.Errorf("trash after restore: got %q, %v; want no %q", body, err, title)
+	}
+
+	if err := bookshelf.DB.DeleteBook(ctx, id); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	b := &bookshelf.Book{Title: "the right title"}
+	id, err := bookshelf.DB.AddBook(bookshelf.WithActor(ctx, "user-1"), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(ctx, id)
+	b.ID = id
+	b.Title = "the wrong title"
+	if err := bookshelf.DB.UpdateBook(bookshelf.WithActor(ctx, bookshelf.WorkerActor), b); err != nil {
+		t.Fatal(err)
+	}
+
+	historyPath := fmt.Sprintf("/books/%d/history", id)
+	bodyContains(t, wt, historyPath, "the right title")
+	bodyContains(t, wt, historyPath, "update by worker")
+
+	form := url.Values{"revision": {"1"}, "version": {"2"}}
+	resp, err := csrfPost(t, fmt.Sprintf("/books/%d:revert", id), "application/x-www-form-urlencoded",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.Request.URL.Path, historyPath; got != want {
+		t.Errorf("revert redirect: got %s, want %s", got, want)
+	}
+	got, err := bookshelf.DB.GetBook(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "the right title" || got.Version != 3 {
+		t.Errorf("reverted book: got title %q, version %d; want %q, 3", got.Title, got.Version, "the right title")
+	}
+	bodyContains(t, wt, historyPath, "update by anonymous")
+}
+
+func TestListPagination(t *testing.T) {
+	ctx := context.Background()
+	var ids []int64
+	for i := 0; i <= bookshelf.DefaultPageSize; i++ {
+		id, err := bookshelf.DB.AddBook(ctx, &bookshelf.Book{
+			Title: fmt.Sprintf("book %03d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	defer func() {
+		for _, id := range ids {
+			if err := bookshelf.DB.DeleteBook(ctx, id); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	page, err := bookshelf.DB.ListBooksPage(ctx, bookshelf.ListOptions{}, "", bookshelf.DefaultPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.NextCursor == "" {
+		t.Fatal("want a next page")
+	}
+
+	bodyContains(t, wt, "/books", "Next")
+	lastTitle := fmt.Sprintf("book %03d", bookshelf.DefaultPageSize)
+	bodyContains(t, wt, "/books?cursor="+page.NextCursor, lastTitle)
+	bodyContains(t, wt, "/books?cursor="+page.NextCursor, "Previous")
+
+	// Page links keep the listing's order.
+	bodyContains(t, wt, "/books?order=desc", "&amp;order=desc")
+}
+
+func TestListOptions(t *testing.T) {
+	ctx := context.Background()
+	author := fmt.Sprintf("Author %d", time.Now().UnixNano())
+	for _, b := range []*bookshelf.Book{
+		{Title: "older listed book", Author: author, PublishedDate: "1990"},
+		{Title: "newer listed book", Author: author, PublishedDate: "2015"},
+	} {
+		id, err := bookshelf.DB.AddBook(ctx, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bookshelf.DB.DeleteBook(ctx, id)
+	}
+
+	path := "/books?sort=published&order=desc&author=" + url.QueryEscape(author)
+	body, _, err := wt.GetBody(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, older := strings.Index(body, "newer listed book"), strings.Index(body, "older listed book")
+	if newer < 0 || older < 0 || newer > older {
+		t.Errorf("GET %s: want the newer book listed before the older, got %s", path, body)
+	}
+	if !strings.Contains(body, `<option value="published" selected>`) {
+		t.Errorf("GET %s: want the sort control to show the sort, got %s", path, body)
+	}
+
+	path = "/books?from=2000&author=" + url.QueryEscape(author)
+	bodyContains(t, wt, path, "newer listed book")
+	if body, _, err := wt.GetBody(path); err != nil || strings.Contains(body, "older listed book") {
+		t.Errorf("GET %s: want the older book filtered out, got %s, %v", path, body, err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	id, err := bookshelf.DB.AddBook(ctx, &bookshelf.Book{
+		Title:  "the searchable book",
+		Author: "homer",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(ctx, id)
+
+	bodyContains(t, wt, "/books/search?q=searchable", "the searchable book")
+	bodyContains(t, wt, "/books/search?q=unfindable", "No books found")
+}
+
+func TestISBN(t *testing.T) {
+	ctx := context.Background()
+	id, err := bookshelf.DB.AddBook(ctx, &bookshelf.Book{
+		Title: "the numbered book",
+		ISBN:  "0-306-40615-2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(ctx, id)
+
+	body, resp, err := wt.GetBody("/isbn/978-0-306-40615-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.Request.URL.Path, fmt.Sprintf("/books/%d", id); got != want {
+		t.Errorf("GET /isbn/978-0-306-40615-7: redirected to %s, want %s", got, want)
+	}
+	if want := "ISBN 9780306406157 (ISBN-10 0306406152)"; !strings.Contains(body, want) {
+		t.Errorf("want %s to contain %s", body, want)
+	}
+}
+
+func TestTags(t *testing.T) {
+	ctx := context.Background()
+	id, err := bookshelf.DB.AddBook(ctx, &bookshelf.Book{Title: "the shelved book"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(ctx, id)
+	bookPath := fmt.Sprintf("/books/%d", id)
+
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	m.WriteField("title", "the shelved book")
+	m.WriteField("tags", "Poetry, to read,,")
+	m.WriteField("version", "1")
+	m.Close()
+	resp, err := csrfPost(t, bookPath, "multipart/form-data; boundary="+m.Boundary(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	bodyContains(t, wt, bookPath, `href="/tags/to%20read"`)
+	bodyContains(t, wt, bookPath+"/edit", `value="poetry, to read"`)
+	bodyContains(t, wt, "/tags/Poetry", "the shelved book")
+	bodyContains(t, wt, "/tags/fiction", `No books found tagged "fiction"`)
+	bodyContains(t, wt, "/books", `href="/tags/poetry"`)
+}
+
+func TestTagCloud(t *testing.T) {
+	cloud := tagCloud([]bookshelf.TagCount{{Tag: "a", Count: 1}, {Tag: "b", Count: 3}, {Tag: "c", Count: 5}})
+	var got []int
+	for _, c := range cloud {
+		got = append(got, c.Percent)
+	}
+	if want := []int{minCloudPercent, 140, maxCloudPercent}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tagCloud sizes: got %v, want %v", got, want)
+	}
+	if cloud := tagCloud([]bookshelf.TagCount{{Tag: "a", Count: 2}, {Tag: "b", Count: 2}}); cloud[0].Percent != minCloudPercent {
+		t.Errorf("tagCloud of equal counts: got %d%%, want %d%%", cloud[0].Percent, minCloudPercent)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		path     string
+		wantCode int
+	}{
+		{"/books/999999", http.StatusNotFound},
+		{"/books/999999/edit", http.StatusNotFound},
+		{"/books/99999999999999999999", http.StatusBadRequest},
+		{"/books?cursor=bogus", http.StatusBadRequest},
+		{"/isbn/0-306-40615-3", http.StatusBadRequest},
+		{"/isbn/9791090636071", http.StatusNotFound},
+		{"/tags/a,b", http.StatusBadRequest},
+		{"/books?sort=bogus", http.StatusBadRequest},
+		{"/books?order=up", http.StatusBadRequest},
+		{"/books?from=last+year", http.StatusBadRequest},
+		{"/books?from=2010&to=2000", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		body, resp, err := wt.GetBody(tt.path)
+		if err != nil {
+			t.Errorf("GET %s: %v", tt.path, err)
+			continue
+		}
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("GET %s: got status %d, want %d", tt.path, resp.StatusCode, tt.wantCode)
+		}
+		if want := http.StatusText(tt.wantCode); !strings.Contains(body, want) {
+			t.Errorf("GET %s: want error page to contain %q, got %s", tt.path, want, body)
+		}
+	}
+}
+
+func TestDebugMetrics(t *testing.T) {
+	if _, resp, err := wt.GetBody("/debug/metrics"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /debug/metrics while disabled: got %v, %v; want status %d", resp, err, http.StatusNotFound)
+	}
+
+	defer func(m *bookshelf.MemoryMetrics) { bookshelf.Metrics = m }(bookshelf.Metrics)
+	bookshelf.Metrics = bookshelf.NewMemoryMetrics()
+	bookshelf.Metrics.RecordCall("GetBook", 3*time.Millisecond, false)
+	bookshelf.Metrics.RecordCall("ListBooksPage", 12*time.Millisecond, true)
+
+	bodyContains(t, wt, "/debug/metrics", "GetBook")
+	bodyContains(t, wt, "/debug/metrics", "ListBooksPage")
+}
+
+func TestTenants(t *testing.T) {
+	defer func(domain string, tenants []string) {
+		bookshelf.TenantDomain, bookshelf.Tenants = domain, tenants
+	}(bookshelf.TenantDomain, bookshelf.Tenants)
+	bookshelf.TenantDomain = "books.example.com"
+	bookshelf.Tenants = []string{"acme", "other"}
+
+	ctx := bookshelf.WithTenant(context.Background(), "acme")
+	const title = "Book of Acme"
+	id, err := bookshelf.DB.AddBook(ctx, &bookshelf.Book{Title: title})
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer bookshelf.DB.DeleteBook(ctx, id)
+
+	get := func(host, path string) (string, int) {
+		r := wt.NewRequest("GET", path, nil)
+		r.Host = host
+		resp, err := wt.Client.Do(r)
+		if err != nil {
+			t.Fatalf("GET %s%s: %v", host, path, err)
+		}
+		defer resp.Body.Close()
+		var body bytes.Buffer
+		body.ReadFrom(resp.Body)
+		return body.String(), resp.StatusCode
+	}
+
+	if body, _ := get("ACME.books.example.com:8080", "/books"); !strings.Contains(body, title) {
+		t.Errorf("acme's listing does not contain its book: %s", body)
+	}
+	if body, _ := get("other.books.example.com", "/books"); strings.Contains(body, title) {
+		t.Errorf("another tenant's listing contains acme's book")
+	}
+	if body, _ := get("books.example.com", "/books"); strings.Contains(body, title) {
+		t.Errorf("the default tenant's listing contains acme's book")
+	}
+	if _, code := get("bad_name.books.example.com", "/books"); code != http.StatusBadRequest {
+		t.Errorf("GET with a bad tenant: got status %d, want %d", code, http.StatusBadRequest)
+	}
+	// Only the configured tenants are served.
+	if _, code := get("typo.books.example.com", "/books"); code != http.StatusNotFound {
+		t.Errorf("GET with an unknown tenant: got status %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestPurgedTenants(t *testing.T) {
+	defer func(tenants []string, served *tenantSet) {
+		bookshelf.Tenants, servedTenants = tenants, served
+	}(bookshelf.Tenants, servedTenants)
+	bookshelf.Tenants = []string{"acme"}
+	servedTenants = &tenantSet{tenants: map[string]bool{bookshelf.DefaultTenant: true}}
+	servedTenants.add("example.com")
+
+	// Configured tenants are purged even if this instance has not served
+	// them; other tenants, such as Google Apps domains, once it has.
+	got := strings.Join(purgedTenants(), ",")
+	if want := ",acme,example.com"; got != want {
+		t.Errorf("purgedTenants() = %q, want %q", got, want)
+	}
+}
+
+func TestTenantLabel(t *testing.T) {
+	defer func(domain string) { bookshelf.TenantDomain = domain }(bookshelf.TenantDomain)
+	bookshelf.TenantDomain = "books.example.com"
+
+	tests := []struct {
+		host   string
+		label  string
+		wantOK bool
+	}{
+		{"acme.books.example.com", "acme", true},
+		{"eng.acme.books.example.com:443", "eng.acme", true},
+		{"books.example.com", "", false},
+		{"acmebooks.example.com", "", false},
+		{"localhost:8080", "", false},
+	}
+	for _, tt := range tests {
+		if label, ok := tenantLabel(tt.host); label != tt.label || ok != tt.wantOK {
+			t.Errorf("tenantLabel(%q) = %q, %t; want %q, %t", tt.host, label, ok, tt.label, tt.wantOK)
+		}
+	}
 }
 
 func bodyContains(t *testing.T, wt *webtest.W, path, contains string) (ok bool) {
@@ -7,39 +7,89 @@ package main
 import (
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 
-	"golang.org/x/net/context"
-	"golang.org/x/oauth2"
-
 	"github.com/satori/go.uuid"
-	"google.golang.org/api/plus/v1"
 
 	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf/oidc"
 )
 
 const (
 	defaultSessionID = "default"
 	// The following keys are used for the default session. For example:
 	//  session, _ := bookshelf.SessionStore.New(r, defaultSessionID)
-	//  session.Values[oauthTokenSessionKey]
-	googleProfileSessionKey = "google_profile"
-	oauthTokenSessionKey    = "oauth_token"
+	//  session.Values[profileSessionKey]
+	profileSessionKey = "profile"
 
-	// This key is used in the OAuth flow session to store the URL to redirect the
-	// user to after the OAuth flow is complete.
+	// The following keys are used in the OAuth flow session to store the URL
+	// to redirect the user to after the OAuth flow is complete, the name of
+	// the provider the user signs in with, and the nonce its ID token must
+	// hold.
 	oauthFlowRedirectKey = "redirect"
+	oauthFlowProviderKey = "provider"
+	oauthFlowNonceKey    = "nonce"
 )
 
+// profile is the signed-in user, as stored in the default session.
+type profile struct {
+	ID          string // See userID.
+	DisplayName string
+	ImageURL    string
+	Domain      string // The user's Google Apps domain, which names their tenant; see tenant.go.
+}
+
 func init() {
 	// Gob encoding for gorilla/sessions
-	gob.Register(&oauth2.Token{})
-	gob.Register(&plus.Person{})
+	gob.Register(&profile{})
+}
+
+// signInEnabled reports whether users can sign in, with any provider.
+func signInEnabled() bool {
+	return len(bookshelf.OIDCProviders) > 0
 }
 
-// loginHandler initiates an OAuth flow to authenticate the user.
+// providerByName returns the configured provider with the given name, or nil
+// if there is none.
+func providerByName(name string) *oidc.Provider {
+	for _, p := range bookshelf.OIDCProviders {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// loginHandler initiates an OAuth flow to authenticate the user with the
+// provider named by the "provider" parameter. If it is missing and there is
+// more than one provider, the user is asked to choose one.
 func loginHandler(w http.ResponseWriter, r *http.Request) *appError {
+	redirectURL, err := validateRedirectURL(r.FormValue("redirect"))
+	if err != nil {
+		return appErrorf(err, "invalid redirect URL: %v", err)
+	}
+
+	name := r.FormValue("provider")
+	if name == "" && len(bookshelf.OIDCProviders) == 1 {
+		name = bookshelf.OIDCProviders[0].Name
+	}
+	if name == "" && signInEnabled() {
+		return loginTmpl.Execute(w, r, struct {
+			Providers []*oidc.Provider
+			Redirect  string
+		}{bookshelf.OIDCProviders, redirectURL})
+	}
+	provider := providerByName(name)
+	if provider == nil {
+		err := &bookshelf.Error{
+			Kind: bookshelf.ErrNotFound,
+			Msg:  fmt.Sprintf("no sign-in provider named %q", name),
+		}
+		return appErrorf(err, "%v", err)
+	}
+
 	sessionID := uuid.NewV4().String()
 
 	oauthFlowSession, err := bookshelf.SessionStore.New(r, sessionID)
@@ -48,11 +98,12 @@ func loginHandler(w http.ResponseWriter, r *http.Request) *appError {
 	}
 	oauthFlowSession.Options.MaxAge = 10 * 60 // 10 minutes
 
-	redirectURL, err := validateRedirectURL(r.FormValue("redirect"))
-	if err != nil {
-		return appErrorf(err, "invalid redirect URL: %v", err)
-	}
+	// The nonce ties the ID token to this flow, so that a token issued to
+	// someone else cannot be replayed to sign in as them.
+	nonce := uuid.NewV4().String()
 	oauthFlowSession.Values[oauthFlowRedirectKey] = redirectURL
+	oauthFlowSession.Values[oauthFlowProviderKey] = provider.Name
+	oauthFlowSession.Values[oauthFlowNonceKey] = nonce
 
 	if err := oauthFlowSession.Save(r, w); err != nil {
 		return appErrorf(err, "could not save session: %v", err)
@@ -61,9 +112,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) *appError {
 	// Use the session ID for the "state" parameter.
 	// This protects against CSRF (cross-site request forgery).
 	// See https://godoc.org/golang.org/x/oauth2#Config.AuthCodeURL for more detail.
-	url := bookshelf.OAuthConfig.AuthCodeURL(sessionID, oauth2.ApprovalForce,
-		oauth2.AccessTypeOnline)
-	http.Redirect(w, r, url, http.StatusFound)
+	http.Redirect(w, r, provider.AuthCodeURL(sessionID, nonce), http.StatusFound)
 	return nil
 }
 
@@ -87,8 +136,8 @@ func validateRedirectURL(path string) (string, error) {
 	return path, nil
 }
 
-// oauthCallbackHandler completes the OAuth flow, retreives the user's profile
-// information and stores it in a session.
+// oauthCallbackHandler completes the OAuth flow, verifies the user's ID token
+// and stores their profile in a session.
 func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) *appError {
 	oauthFlowSession, err := bookshelf.SessionStore.Get(r, r.FormValue("state"))
 	if err != nil {
@@ -96,32 +145,34 @@ func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) *appError {
 	}
 
 	redirectURL, ok := oauthFlowSession.Values[oauthFlowRedirectKey].(string)
+	providerName, _ := oauthFlowSession.Values[oauthFlowProviderKey].(string)
+	nonce, _ := oauthFlowSession.Values[oauthFlowNonceKey].(string)
+	provider := providerByName(providerName)
 	// Validate this callback request came from the app.
-	if !ok {
+	if !ok || provider == nil || nonce == "" {
 		return appErrorf(err, "invalid state parameter. try logging in again.")
 	}
 
-	code := r.FormValue("code")
-	tok, err := bookshelf.OAuthConfig.Exchange(context.Background(), code)
+	claims, err := provider.Exchange(r.Context(), r.FormValue("code"), nonce)
 	if err != nil {
-		return appErrorf(err, "could not get auth token: %v", err)
+		return appErrorf(err, "could not sign in with %s: %v", provider.Name, err)
 	}
 
 	session, err := bookshelf.SessionStore.New(r, defaultSessionID)
 	if err != nil {
 		return appErrorf(err, "could not get default session: %v", err)
 	}
-
-	ctx := context.Background()
-	profile, err := fetchProfile(ctx, tok)
-	if err != nil {
-		return appErrorf(err, "could not fetch Google profile: %v", err)
+	session.Values[profileSessionKey] = newProfile(provider, claims)
+	// A token planted in the session before sign-in, as by an attacker
+	// fixing the session, must not carry over; csrfHandler issues a new one.
+	delete(session.Values, csrfTokenSessionKey)
+	if err := session.Save(r, w); err != nil {
+		return appErrorf(err, "could not save session: %v", err)
 	}
 
-	session.Values[oauthTokenSessionKey] = tok
-	// Strip the profile to only the fields we need. Otherwise the struct is too big.
-	session.Values[googleProfileSessionKey] = stripProfile(profile)
-	if err := session.Save(r, w); err != nil {
+	// The flow is complete, so its state must not be used again.
+	oauthFlowSession.Options.MaxAge = -1
+	if err := oauthFlowSession.Save(r, w); err != nil {
 		return appErrorf(err, "could not save session: %v", err)
 	}
 
@@ -129,15 +180,36 @@ func oauthCallbackHandler(w http.ResponseWriter, r *http.Request) *appError {
 	return nil
 }
 
-// fetchProfile retrieves the Google+ profile of the user associated with the
-// provided OAuth token.
-func fetchProfile(ctx context.Context, tok *oauth2.Token) (*plus.Person, error) {
-	client := oauth2.NewClient(ctx, bookshelf.OAuthConfig.TokenSource(ctx, tok))
-	plusService, err := plus.New(client)
-	if err != nil {
-		return nil, err
+// newProfile returns the profile of the user described by the claims of an
+// ID token issued by p.
+func newProfile(p *oidc.Provider, c *oidc.Claims) *profile {
+	name := c.Name
+	if name == "" {
+		name = c.Email
 	}
-	return plusService.People.Get("me").Do()
+	u := &profile{
+		ID:          userID(p, c.Subject),
+		DisplayName: name,
+		ImageURL:    c.Picture,
+	}
+	// Only Google's word is taken for the Google Apps domain: another
+	// provider could claim any domain, and so any tenant.
+	if p.Issuer == bookshelf.GoogleIssuer {
+		u.Domain = c.HostedDomain
+	}
+	return u
+}
+
+// userID returns the ID in the app of the user with the given subject at p.
+// Users of Google keep their bare account IDs, which the books they added
+// were recorded with before other providers were supported. Subjects are
+// only unique at their issuer, so those of other providers are prefixed with
+// the provider's name.
+func userID(p *oidc.Provider, subject string) string {
+	if p.Issuer == bookshelf.GoogleIssuer {
+		return subject
+	}
+	return p.Name + ":" + subject
 }
 
 // logoutHandler clears the default session.
@@ -158,32 +230,18 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) *appError {
 	return nil
 }
 
-// profileFromSession retreives the Google+ profile from the default session.
+// profileFromSession retreives the user's profile from the default session.
 // Returns nil if the profile cannot be retreived (e.g. user is logged out).
-func profileFromSession(r *http.Request) *plus.Person {
+// The user stays signed in for as long as the session lasts (see
+// bookshelf.Config.SessionMaxAge), not just for the life of their ID token.
+func profileFromSession(r *http.Request) *profile {
 	session, err := bookshelf.SessionStore.Get(r, defaultSessionID)
 	if err != nil {
 		return nil
 	}
-	tok, ok := session.Values[oauthTokenSessionKey].(*oauth2.Token)
-	if !ok || !tok.Valid() {
-		return nil
-	}
-	profile, ok := session.Values[googleProfileSessionKey].(*plus.Person)
+	p, ok := session.Values[profileSessionKey].(*profile)
 	if !ok {
 		return nil
 	}
-	return profile
-}
-
-// stripProfile returns a subset of a plus.Person.
-func stripProfile(p *plus.Person) *plus.Person {
-	return &plus.Person{
-		Id:          p.Id,
-		DisplayName: p.DisplayName,
-		Image:       p.Image,
-		Etag:        p.Etag,
-		Name:        p.Name,
-		Url:         p.Url,
-	}
+	return p
 }
@@ -0,0 +1,221 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf/oidc"
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf/oidc/oidctest"
+)
+
+// fakeProviders configures sign-in with a fake issuer for each of the given
+// provider names, until the returned function is called.
+func fakeProviders(t *testing.T, names ...string) (issuers map[string]*oidctest.Issuer, restore func()) {
+	old := bookshelf.OIDCProviders
+	issuers = make(map[string]*oidctest.Issuer)
+	restore = func() {
+		bookshelf.OIDCProviders = old
+		for _, i := range issuers {
+			i.Close()
+		}
+	}
+
+	var providers []*oidc.Provider
+	for _, name := range names {
+		issuer, err := oidctest.NewIssuer(name+"-client", "secret")
+		if err != nil {
+			restore()
+			t.Fatal(err)
+		}
+		issuers[name] = issuer
+		p, err := oidc.Discover(context.Background(), name, issuer.URL, oauth2.Config{
+			ClientID:     issuer.ClientID,
+			ClientSecret: issuer.ClientSecret,
+			RedirectURL:  serverURL + "/oauth2callback",
+		})
+		if err != nil {
+			restore()
+			t.Fatal(err)
+		}
+		providers = append(providers, p)
+	}
+	bookshelf.OIDCProviders = providers
+	return issuers, restore
+}
+
+// browse gets path with client, following redirects, and returns the status
+// code and body of the last response.
+func browse(t *testing.T, client *http.Client, path string) (int, string) {
+	resp, err := client.Get(serverURL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func newBrowser(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func TestLogin(t *testing.T) {
+	_, restore := fakeProviders(t, "example")
+	defer restore()
+	ctx := context.Background()
+
+	// With a single provider, the login page goes straight to it.
+	client := newBrowser(t)
+	var callback string
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Path == "/oauth2callback" {
+			callback = req.URL.String()
+		}
+		return nil
+	}
+	code, body := browse(t, client, "/login?redirect=/books/mine")
+	if code != http.StatusOK || !strings.Contains(body, "Test User") {
+		t.Fatalf("login: got status %d and body %s, want the user's books, signed in", code, body)
+	}
+
+	// Books are added by the user, under the provider's name.
+	m := csrfFieldRE.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatal("signed-in page has no CSRF token")
+	}
+	s := &session{t: t, client: client, token: m[1]}
+	if got := s.postBook(0, map[string]string{"title": "signed-in book"}); got != http.StatusOK {
+		t.Fatalf("add book: got status %d", got)
+	}
+	books, err := bookshelf.DB.ListBooksCreatedBy(ctx, "example:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 1 || books[0].CreatedBy != "Test User" {
+		t.Fatalf("books created by example:1234: got %+v, want the signed-in book", books)
+	}
+	bookshelf.DB.DeleteBook(ctx, books[0].ID)
+
+	// The flow cannot be completed twice.
+	if callback == "" {
+		t.Fatal("login did not go through /oauth2callback")
+	}
+	resp, err := newBrowser(t).Get(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("replayed callback: got status 200, want an error")
+	}
+}
+
+func TestLoginOutlivesIDToken(t *testing.T) {
+	issuers, restore := fakeProviders(t, "example")
+	defer restore()
+
+	exp := time.Now().Add(2 * time.Second)
+	issuers["example"].Claims["exp"] = exp.Unix()
+	client := newBrowser(t)
+	if _, body := browse(t, client, "/login?redirect=/books"); !strings.Contains(body, "Test User") {
+		t.Fatalf("login: got body %s, want the user signed in", body)
+	}
+	time.Sleep(exp.Sub(time.Now()) + time.Second)
+	if _, body := browse(t, client, "/books"); !strings.Contains(body, "Test User") {
+		t.Error("signed out once the ID token expired, want the session to last")
+	}
+}
+
+func TestLoginRotatesCSRFToken(t *testing.T) {
+	_, restore := fakeProviders(t, "example")
+	defer restore()
+
+	client := newBrowser(t)
+	token := func(path string) string {
+		_, body := browse(t, client, path)
+		m := csrfFieldRE.FindStringSubmatch(body)
+		if m == nil {
+			t.Fatalf("%s: page has no CSRF token: %s", path, body)
+		}
+		return m[1]
+	}
+	before := token("/books/add")
+	after := token("/login?redirect=/books/add")
+	if after == before {
+		t.Error("CSRF token unchanged by sign-in, want a new one")
+	}
+}
+
+func TestLoginWrongNonce(t *testing.T) {
+	issuers, restore := fakeProviders(t, "example")
+	defer restore()
+
+	// The token would sign in whoever it was stolen from.
+	issuers["example"].Claims["nonce"] = "some other flow"
+	client := newBrowser(t)
+	code, body := browse(t, client, "/login?redirect=/books")
+	if code == http.StatusOK || !strings.Contains(body, "wrong nonce") {
+		t.Errorf("login: got status %d and body %s, want an error about the nonce", code, body)
+	}
+	if _, body := browse(t, client, "/books"); strings.Contains(body, "Test User") {
+		t.Error("signed in despite the wrong nonce")
+	}
+}
+
+func TestLoginProviders(t *testing.T) {
+	issuers, restore := fakeProviders(t, "alpha", "beta")
+	defer restore()
+	issuers["beta"].Claims["name"] = "Beta User"
+
+	// With several providers, the user chooses one.
+	client := newBrowser(t)
+	code, body := browse(t, client, "/login?redirect=/books")
+	if code != http.StatusOK || !strings.Contains(body, "provider=alpha") || !strings.Contains(body, "provider=beta") {
+		t.Fatalf("login: got status %d and body %s, want a choice of providers", code, body)
+	}
+	if _, body := browse(t, client, "/login?provider=beta&redirect=/books"); !strings.Contains(body, "Beta User") {
+		t.Errorf("login with beta: got body %s, want the user signed in", body)
+	}
+
+	if code, _ := browse(t, newBrowser(t), "/login?provider=gamma"); code != http.StatusNotFound {
+		t.Errorf("login with unknown provider: got status %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestNewProfile(t *testing.T) {
+	claims := &oidc.Claims{Subject: "1234", Email: "user@example.com", HostedDomain: "example.com"}
+	tests := []struct {
+		provider *oidc.Provider
+		want     profile
+	}{
+		// Google users keep the IDs they had before other providers.
+		{&oidc.Provider{Name: "google", Issuer: bookshelf.GoogleIssuer}, profile{ID: "1234", Domain: "example.com"}},
+		// Others do not get to name a tenant.
+		{&oidc.Provider{Name: "other", Issuer: "https://id.example.com"}, profile{ID: "other:1234"}},
+	}
+	for _, tt := range tests {
+		got := newProfile(tt.provider, claims)
+		if got.ID != tt.want.ID || got.Domain != tt.want.Domain || got.DisplayName != "user@example.com" {
+			t.Errorf("newProfile of %s: got %+v, want %+v named after the email", tt.provider.Name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// errForbidden is the error of an appError reporting that the user may not
+// change a book.
+var errForbidden = errors.New("bookshelf: forbidden")
+
+// canModify reports whether the user of the request may change and delete
+// book: that is, whether they added it or are one of bookshelf.Admins.
+// Without sign-in there is no telling users apart, so everyone may.
+func canModify(r *http.Request, book *bookshelf.Book) bool {
+	if !signInEnabled() {
+		return true
+	}
+	user := profileFromSession(r)
+	if user == nil {
+		return false
+	}
+	return user.ID == book.CreatedByID || isAdmin(user.ID)
+}
+
+func isAdmin(userID string) bool {
+	for _, id := range bookshelf.Admins {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeChange returns an appError with the status 403 Forbidden if the
+// user of the request may not change book.
+func authorizeChange(r *http.Request, book *bookshelf.Book) *appError {
+	if canModify(r, book) {
+		return nil
+	}
+	msg := fmt.Sprintf("only the user who added book %d may change it", book.ID)
+	if profileFromSession(r) == nil {
+		msg = fmt.Sprintf("sign in as the user who added book %d to change it", book.ID)
+	}
+	return &appError{Error: errForbidden, Message: msg, Code: http.StatusForbidden}
+}
+
+// setCreator sets the creator of a book being added to the user of the
+// request, or to anonymous if they are not signed in.
+func setCreator(r *http.Request, book *bookshelf.Book) {
+	if user := profileFromSession(r); user != nil {
+		book.CreatedBy = user.DisplayName
+		book.CreatedByID = user.ID
+	} else {
+		book.SetCreatorAnonymous()
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf/oidc"
+)
+
+// enableSignIn pretends sign-in is configured, with the given admins, until
+// the returned function is called.
+func enableSignIn(admins ...string) (restore func()) {
+	oldProviders, oldAdmins := bookshelf.OIDCProviders, bookshelf.Admins
+	bookshelf.OIDCProviders = []*oidc.Provider{{Name: "test"}}
+	bookshelf.Admins = admins
+	return func() {
+		bookshelf.OIDCProviders, bookshelf.Admins = oldProviders, oldAdmins
+	}
+}
+
+// session is a client of the test server with a session of its own.
+type session struct {
+	t      *testing.T
+	client *http.Client
+	token  string // The CSRF token.
+}
+
+// newSession starts a session signed in as the user with the given ID, or
+// not signed in if the ID is empty.
+func newSession(t *testing.T, userID string) *session {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != "" {
+		// Save a session as oauthCallbackHandler does.
+		r := httptest.NewRequest("GET", "/oauth2callback", nil)
+		w := httptest.NewRecorder()
+		s, err := bookshelf.SessionStore.New(r, defaultSessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Values[profileSessionKey] = &profile{
+			ID:          userID,
+			DisplayName: "User " + userID,
+		}
+		if err := s.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(serverURL)
+		jar.SetCookies(u, w.Result().Cookies())
+	}
+	s := &session{t: t, client: &http.Client{Jar: jar}}
+	m := csrfFieldRE.FindStringSubmatch(s.get("/books/add"))
+	if m == nil {
+		t.Fatalf("session of %q: add book page has no CSRF token", userID)
+	}
+	s.token = m[1]
+	return s
+}
+
+// get returns the body of the page at path.
+func (s *session) get(path string) string {
+	resp, err := s.client.Get(serverURL + path)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return string(b)
+}
+
+// do makes a request, carrying the session's CSRF token, and returns the
+// status code of the response.
+func (s *session) do(method, path, bodyType string, body []byte) int {
+	req, err := http.NewRequest(method, serverURL+path, bytes.NewReader(body))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", bodyType)
+	req.Header.Set(csrfHeader, s.token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// postBook submits the edit form of a book, or the add form if id is 0,
+// with the given fields.
+func (s *session) postBook(id int64, fields map[string]string) int {
+	var body bytes.Buffer
+	m := multipart.NewWriter(&body)
+	for k, v := range fields {
+		m.WriteField(k, v)
+	}
+	m.Close()
+	path := "/books"
+	if id != 0 {
+		path = fmt.Sprintf("/books/%d", id)
+	}
+	return s.do("POST", path, m.FormDataContentType(), body.Bytes())
+}
+
+func TestOwnership(t *testing.T) {
+	defer enableSignIn("admin")()
+	ctx := context.Background()
+
+	alice, bob, admin, anonymous := newSession(t, "alice"), newSession(t, "bob"), newSession(t, "admin"), newSession(t, "")
+
+	// The creator is the signed-in user, whatever the form says.
+	if got := bob.postBook(0, map[string]string{"title": "bob's book", "createdByID": "alice"}); got != http.StatusOK {
+		t.Fatalf("add book: got status %d", got)
+	}
+	books, err := bookshelf.DB.ListBooksCreatedBy(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 1 {
+		t.Fatalf("books created by bob: got %d, want 1", len(books))
+	}
+	id := books[0].ID
+	defer bookshelf.DB.DeleteBook(ctx, id)
+	bookPath := fmt.Sprintf("/books/%d", id)
+
+	// Others see no buttons, and can change nothing.
+	for name, s := range map[string]*session{"alice": alice, "anonymous": anonymous} {
+		if body := s.get(bookPath); strings.Contains(body, "Edit book") || strings.Contains(body, "Delete book") {
+			t.Errorf("%s: book page has edit or delete buttons", name)
+		}
+		requests := []struct {
+			method, path, bodyType, body string
+		}{
+			{"GET", bookPath + "/edit", "", ""},
+			{"POST", bookPath + ":delete", "", ""},
+			{"POST", bookPath + ":revert", "application/x-www-form-urlencoded", "revision=1&version=1"},
+			{"PATCH", apiBookURL(id), "application/json", `{"title": "taken"}`},
+			{"PUT", apiBookURL(id), "application/json", `{"title": "taken", "version": 1}`},
+			{"DELETE", apiBookURL(id), "application/json", ""},
+		}
+		for _, r := range requests {
+			if got := s.do(r.method, r.path, r.bodyType, []byte(r.body)); got != http.StatusForbidden {
+				t.Errorf("%s: %s %s: got status %d, want %d", name, r.method, r.path, got, http.StatusForbidden)
+			}
+		}
+		if got := s.postBook(id, map[string]string{"title": "taken", "version": "1"}); got != http.StatusForbidden {
+			t.Errorf("%s: edit: got status %d, want %d", name, got, http.StatusForbidden)
+		}
+	}
+
+	// The creator can change the book, but not give it away.
+	if body := bob.get(bookPath); !strings.Contains(body, "Edit book") || !strings.Contains(body, "Delete book") {
+		t.Error("bob: book page lacks edit or delete buttons")
+	}
+	if got := bob.postBook(id, map[string]string{"title": "bob's book, revised", "version": "1", "createdByID": "alice"}); got != http.StatusOK {
+		t.Errorf("bob: edit: got status %d, want %d", got, http.StatusOK)
+	}
+	book, err := bookshelf.DB.GetBook(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "bob's book, revised" || book.CreatedByID != "bob" || book.CreatedBy != "User bob" {
+		t.Errorf("edited book: got %+v, want the revised book, still created by bob", book)
+	}
+
+	// An admin can change any book.
+	if body := admin.get(bookPath); !strings.Contains(body, "Delete book") {
+		t.Error("admin: book page lacks delete button")
+	}
+	if got := admin.do("PATCH", apiBookURL(id), "application/json", []byte(`{"author": "the admin"}`)); got != http.StatusOK {
+		t.Errorf("admin: PATCH: got status %d, want %d", got, http.StatusOK)
+	}
+	if got := admin.do("POST", bookPath+":delete", "", nil); got != http.StatusOK {
+		t.Errorf("admin: delete: got status %d, want %d after the redirect", got, http.StatusOK)
+	}
+	if book, err := bookshelf.DB.GetBook(ctx, id); err == nil {
+		t.Errorf("GetBook after delete by admin: got %+v, want an error", book)
+	}
+}
+
+func TestOwnershipWithoutSignIn(t *testing.T) {
+	ctx := context.Background()
+	id, err := bookshelf.DB.AddBook(ctx, &bookshelf.Book{Title: "everyone's book", CreatedByID: "someone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(ctx, id)
+
+	// Without sign-in, there is no telling users apart, so anyone may edit.
+	bodyContains(t, wt, fmt.Sprintf("/books/%d", id), "Delete book")
+	bodyContains(t, wt, fmt.Sprintf("/books/%d/edit", id), "everyone&#39;s book")
+}
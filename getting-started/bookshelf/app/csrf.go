@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+const (
+	// csrfTokenSessionKey is the key of the CSRF token in the default session.
+	csrfTokenSessionKey = "csrf_token"
+
+	// csrfFieldName is the form field, and csrfHeader the header, in which a
+	// request sends the CSRF token.
+	csrfFieldName = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+type csrfKey struct{}
+
+// csrfHandler protects h from cross-site request forgery with the
+// synchronizer token pattern. Each session holds a random token, which the
+// pages render into their forms (see appTemplate.Execute), and requests that
+// could be forged must send it back; those that do not are rejected with
+// 403 Forbidden.
+//
+// A request could be forged if a page on another site can make the browser
+// send it without first asking the bookshelf's permission: that is, a POST
+// whose body is a form or plain text. PUT, PATCH and DELETE requests, and
+// POSTs of JSON to the API, need the browser's CORS preflight, which the
+// bookshelf never grants, so they need no token.
+func csrfHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An invalid session, such as one signed with an old secret, is
+		// replaced by a new one, without a token.
+		session, _ := bookshelf.SessionStore.Get(r, defaultSessionID)
+		token, _ := session.Values[csrfTokenSessionKey].(string)
+
+		if mayBeForged(r) && !validCSRFToken(r, token) {
+			log.Printf("CSRF check failed: %s %s", r.Method, r.URL.Path)
+			const msg = "the request did not come from a bookshelf page. Reload the page and try again."
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				apiErrorf(w, http.StatusForbidden, msg)
+			} else {
+				http.Error(w, msg, http.StatusForbidden)
+			}
+			return
+		}
+
+		if token == "" {
+			var err error
+			if token, err = newCSRFToken(); err == nil {
+				session.Values[csrfTokenSessionKey] = token
+				err = session.Save(r, w)
+			}
+			if err != nil {
+				appHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+					return appErrorf(err, "could not save session: %v", err)
+				}).ServeHTTP(w, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfKey{}, token)))
+	})
+}
+
+// mayBeForged reports whether r is a request another site could make a
+// browser send, and so must carry the CSRF token.
+func mayBeForged(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType != "application/json"
+}
+
+// validCSRFToken reports whether r sends the session's CSRF token, in its
+// header or its form.
+func validCSRFToken(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	sent := r.Header.Get(csrfHeader)
+	if sent == "" {
+		sent = r.PostFormValue(csrfFieldName)
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// csrfTokenFromContext returns the CSRF token of the session of the request
+// whose context is ctx, or "" if the request was not served by csrfHandler.
+func csrfTokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(csrfKey{}).(string)
+	return token
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+var csrfFieldRE = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// csrfToken returns the CSRF token of wt's session, as rendered into the
+// form of the add book page.
+func csrfToken(t *testing.T) string {
+	body, _, err := wt.GetBody("/books/add")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := csrfFieldRE.FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("add book page has no CSRF token: %s", body)
+	}
+	return m[1]
+}
+
+// csrfPost makes a POST request carrying the CSRF token of wt's session in
+// its header.
+func csrfPost(t *testing.T, path, bodyType string, body io.Reader) (*http.Response, error) {
+	req := wt.NewRequest("POST", path, body)
+	req.Header.Set("Content-Type", bodyType)
+	req.Header.Set(csrfHeader, csrfToken(t))
+	return wt.Client.Do(req)
+}
+
+func TestCSRFField(t *testing.T) {
+	ctx := context.Background()
+	id, err := bookshelf.DB.AddBook(ctx, &bookshelf.Book{Title: "the guarded book"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(ctx, id)
+
+	token := csrfToken(t)
+	field := fmt.Sprintf(`<input type="hidden" name="csrf_token" value="%s">`, token)
+	for _, path := range []string{
+		"/books/add",
+		fmt.Sprintf("/books/%d", id),
+		fmt.Sprintf("/books/%d/edit", id),
+	} {
+		bodyContains(t, wt, path, field)
+	}
+	if got := csrfToken(t); got != token {
+		t.Errorf("second page: got token %q, want the session's token %q", got, token)
+	}
+}
+
+func TestCSRFRejected(t *testing.T) {
+	ctx := context.Background()
+	id, err := bookshelf.DB.AddBook(ctx, &bookshelf.Book{Title: "the forged-at book"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bookshelf.DB.DeleteBook(ctx, id)
+	deletePath := fmt.Sprintf("/books/%d:delete", id)
+
+	post := func(path string, header http.Header, form url.Values) int {
+		req := wt.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := wt.Client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	token := csrfToken(t)
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		form   url.Values
+	}{
+		{"no token", deletePath, nil, nil},
+		{"wrong token", deletePath, nil, url.Values{csrfFieldName: {token + "x"}}},
+		{"wrong header", deletePath, http.Header{csrfHeader: {"x"}}, url.Values{csrfFieldName: {token}}},
+		{"token in query", deletePath + "?" + csrfFieldName + "=" + token, nil, nil},
+		{"logout", "/logout", nil, nil},
+		{"API form post", "/api/v1/books", nil, url.Values{"title": {"forged"}}},
+	}
+	for _, tt := range tests {
+		if got := post(tt.path, tt.header, tt.form); got != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want %d", tt.name, got, http.StatusForbidden)
+		}
+	}
+	if _, err := bookshelf.DB.GetBook(ctx, id); err != nil {
+		t.Fatalf("book deleted by rejected requests: %v", err)
+	}
+
+	// The token is no good without the session it belongs to.
+	req := wt.NewRequest("POST", deletePath, nil)
+	req.Header.Set(csrfHeader, token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("token of another session: got status %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	// The token in the form, as the detail page sends it, is accepted.
+	if got := post(deletePath, nil, url.Values{csrfFieldName: {token}}); got != http.StatusOK {
+		t.Errorf("with token: got status %d, want %d after the redirect", got, http.StatusOK)
+	}
+	if _, err := bookshelf.DB.GetBook(ctx, id); bookshelf.ErrorKind(err) != bookshelf.ErrNotFound {
+		t.Errorf("GetBook after delete: got err %v, want kind ErrNotFound", err)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// bookField is a user-editable field of a book, as shown in its history.
+type bookField struct {
+	Name  string
+	Value func(b *bookshelf.Book) string
+}
+
+var bookFields = []bookField{
+	{"Title", func(b *bookshelf.Book) string { return b.Title }},
+	{"Author", func(b *bookshelf.Book) string { return b.Author }},
+	{"Date Published", func(b *bookshelf.Book) string { return b.PublishedDate }},
+	{"ISBN", func(b *bookshelf.Book) string { return b.ISBN }},
+	{"Tags", func(b *bookshelf.Book) string { return strings.Join(b.Tags, ", ") }},
+	{"Cover Image URL", func(b *bookshelf.Book) string { return b.ImageURL }},
+	{"Description", func(b *bookshelf.Book) string { return b.Description }},
+}
+
+// fieldChange is a field whose value differs between two versions of a book.
+type fieldChange struct {
+	Field, Old, New string
+}
+
+// diffBooks returns the fields that differ between two versions of a book.
+// old may be nil, in which case every non-empty field of b is a change.
+func diffBooks(old, b *bookshelf.Book) []fieldChange {
+	if old == nil {
+		old = &bookshelf.Book{}
+	}
+	var changes []fieldChange
+	for _, f := range bookFields {
+		if o, n := f.Value(old), f.Value(b); o != n {
+			changes = append(changes, fieldChange{f.Name, o, n})
+		}
+	}
+	return changes
+}
+
+// revisionEntry is a revision as shown on the history page.
+type revisionEntry struct {
+	*bookshelf.Revision
+	Changes []fieldChange // Changes from the previous revision.
+
+	// CanRevert is set if the book's fields differ from those recorded in
+	// the revision, and the user may change the book.
+	CanRevert bool
+}
+
+// historyHandler displays the revisions of a given book, newest first, with
+// the changes each one made.
+func historyHandler(w http.ResponseWriter, r *http.Request) *appError {
+	book, err := bookFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	revs, err := bookshelf.DB.ListRevisions(r.Context(), book.ID)
+	if err != nil {
+		return appErrorf(err, "could not list revisions: %v", err)
+	}
+
+	mayChange := canModify(r, book)
+	entries := make([]revisionEntry, len(revs))
+	var prev *bookshelf.Book
+	for i, rev := range revs {
+		entries[len(revs)-1-i] = revisionEntry{
+			Revision:  rev,
+			Changes:   diffBooks(prev, &rev.Book),
+			CanRevert: mayChange && len(diffBooks(&rev.Book, book)) > 0,
+		}
+		prev = &rev.Book
+	}
+
+	return historyTmpl.Execute(w, r, struct {
+		Book      *bookshelf.Book
+		Revisions []revisionEntry
+	}{book, entries})
+}
+
+// revertHandler sets the fields of a given book back to their values at the
+// version in the "revision" form value. The "version" form value is the
+// version of the book the user saw, as for updateHandler.
+func revertHandler(w http.ResponseWriter, r *http.Request) *appError {
+	book, err := bookFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	if e := authorizeChange(r, book); e != nil {
+		return e
+	}
+	target, err := strconv.ParseInt(r.FormValue("revision"), 10, 64)
+	if err != nil {
+		err = &bookshelf.Error{
+			Kind: bookshelf.ErrInvalidArgument,
+			Msg:  fmt.Sprintf("bad revision: %v", err),
+		}
+		return appErrorf(err, "%v", err)
+	}
+	book.Version, err = strconv.ParseInt(r.FormValue("version"), 10, 64)
+	if err != nil {
+		err = &bookshelf.Error{
+			Kind: bookshelf.ErrInvalidArgument,
+			Msg:  fmt.Sprintf("bad book version: %v", err),
+		}
+		return appErrorf(err, "%v", err)
+	}
+
+	revs, err := bookshelf.DB.ListRevisions(r.Context(), book.ID)
+	if err != nil {
+		return appErrorf(err, "could not list revisions: %v", err)
+	}
+	var old *bookshelf.Book
+	for _, rev := range revs {
+		if rev.Book.Version == target {
+			old = &rev.Book
+		}
+	}
+	if old == nil {
+		err := &bookshelf.Error{
+			Kind: bookshelf.ErrNotFound,
+			Msg:  fmt.Sprintf("book %d has no version %d", book.ID, target),
+		}
+		return appErrorf(err, "%v", err)
+	}
+
+	book.Title = old.Title
+	book.Author = old.Author
+	book.PublishedDate = old.PublishedDate
+	book.ISBN = old.ISBN
+	book.Tags = old.Tags
+	book.ImageURL = old.ImageURL
+	book.Description = old.Description
+
+	err = bookshelf.DB.UpdateBook(actorContext(r), book)
+	if _, ok := err.(*bookshelf.ConflictError); ok {
+		return conflictHandler(w, r, book)
+	}
+	if err != nil {
+		return appErrorf(err, "could not revert book: %v", err)
+	}
+	// The Pub/Sub worker is not notified: it would look the book up again and
+	// might overwrite the details the user just went back to.
+	http.Redirect(w, r, fmt.Sprintf("/books/%d/history", book.ID), http.StatusFound)
+	return nil
+}
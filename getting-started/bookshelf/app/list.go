@@ -0,0 +1,142 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// listQuery holds the query parameters that select and order a book
+// listing, as typed into the list form:
+//
+//	sort     the field to sort by: title, author, published or created
+//	order    asc or desc
+//	author   list only the books by this author
+//	creator  list only the books added by the user with this ID
+//	from, to list only the books published within these years
+type listQuery struct {
+	Sort, Order     string
+	Author, Creator string
+	From, To        string
+}
+
+// listQueryFromForm reads the list parameters of a request.
+func listQueryFromForm(r *http.Request) listQuery {
+	return listQuery{
+		Sort:    r.FormValue("sort"),
+		Order:   r.FormValue("order"),
+		Author:  r.FormValue("author"),
+		Creator: r.FormValue("creator"),
+		From:    r.FormValue("from"),
+		To:      r.FormValue("to"),
+	}
+}
+
+// options returns the ListOptions the parameters denote. Malformed
+// parameters are an error of kind ErrInvalidArgument; the database checks
+// the options themselves.
+func (q listQuery) options() (bookshelf.ListOptions, error) {
+	opts := bookshelf.ListOptions{
+		SortBy:      bookshelf.SortField(q.Sort),
+		Author:      q.Author,
+		CreatedByID: q.Creator,
+	}
+	switch q.Order {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, badListQuery("bad order %q", q.Order)
+	}
+	var err error
+	if opts.MinYear, err = parseYear(q.From); err != nil {
+		return opts, badListQuery("bad year %q", q.From)
+	}
+	if opts.MaxYear, err = parseYear(q.To); err != nil {
+		return opts, badListQuery("bad year %q", q.To)
+	}
+	return opts, nil
+}
+
+// parseYear parses a year typed into the list form. An empty year is 0,
+// which ListOptions takes to mean no bound.
+func parseYear(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// badListQuery returns an error of kind ErrInvalidArgument for a malformed
+// list parameter.
+func badListQuery(format string, v ...interface{}) error {
+	return &bookshelf.Error{
+		Kind: bookshelf.ErrInvalidArgument,
+		Msg:  fmt.Sprintf(format, v...),
+	}
+}
+
+// values encodes the non-empty parameters, for links to other pages of the
+// same listing.
+func (q listQuery) values() url.Values {
+	v := url.Values{}
+	for name, value := range map[string]string{
+		"sort": q.Sort, "order": q.Order, "author": q.Author,
+		"creator": q.Creator, "from": q.From, "to": q.To,
+	} {
+		if value != "" {
+			v.Set(name, value)
+		}
+	}
+	return v
+}
+
+// listPage is the data of the list template: a page of books, the query
+// that listed them and, when all books are listed, the tag cloud.
+type listPage struct {
+	*bookshelf.BookPage
+	Query listQuery
+	Tags  []cloudTag
+
+	// SortChoices are the choices of the form's sort control.
+	SortChoices []sortChoice
+}
+
+// sortChoice is a choice of the list form's sort control.
+type sortChoice struct {
+	Field bookshelf.SortField
+	Label string
+}
+
+// sortChoices lists the fields books can be sorted by, as labelled in the
+// list form.
+var sortChoices = []sortChoice{
+	{bookshelf.SortByTitle, "title"},
+	{bookshelf.SortByAuthor, "author"},
+	{bookshelf.SortByPublishedDate, "date published"},
+	{bookshelf.SortByCreatedAt, "date added"},
+}
+
+// newListPage returns the list template's data for a page listed by q.
+func newListPage(page *bookshelf.BookPage, q listQuery, tags []cloudTag) listPage {
+	return listPage{
+		BookPage:    page,
+		Query:       q,
+		Tags:        tags,
+		SortChoices: sortChoices,
+	}
+}
+
+// PageURL returns the link to the page of the same listing at cursor.
+func (p listPage) PageURL(cursor string) string {
+	v := p.Query.values()
+	v.Set("cursor", cursor)
+	return "?" + v.Encode()
+}
@@ -0,0 +1,47 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"text/tabwriter"
+	"time"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// metricsHandler lists, as plain text, the calls this instance of the app has
+// made to the database, by method. The page is only served if the metrics
+// are kept in memory; see bookshelf.Config.DebugMetrics. They are those of
+// every tenant.
+func metricsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if bookshelf.Metrics == nil {
+		err := &bookshelf.Error{
+			Kind: bookshelf.ErrNotFound,
+			Msg:  "database metrics are not enabled",
+		}
+		return appErrorf(err, "%v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "method\tcalls\terrors\tmean\tp50\tp90\tp99\tmax\t")
+	for _, m := range bookshelf.Metrics.Snapshot() {
+		l := m.Latency
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%v\t%v\t%v\t%v\t\n", m.Method, m.Calls, m.Errors,
+			roundLatency(l.Mean()), roundLatency(l.Quantile(0.5)), roundLatency(l.Quantile(0.9)),
+			roundLatency(l.Quantile(0.99)), roundLatency(l.Max))
+	}
+	if err := tw.Flush(); err != nil {
+		return appErrorf(err, "could not write metrics: %v", err)
+	}
+	return nil
+}
+
+// roundLatency rounds a latency to the microsecond, for display.
+func roundLatency(d time.Duration) time.Duration {
+	return (d + time.Microsecond/2) / time.Microsecond * time.Microsecond
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// tagsFromForm splits the comma-separated tags typed into the book form. The
+// database normalizes them.
+func tagsFromForm(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// cloudTag is a tag as shown in the tag cloud, sized by its count.
+type cloudTag struct {
+	bookshelf.TagCount
+	Percent int // The tag's font size, relative to the page's.
+}
+
+// Font sizes of the tags in the cloud, in percent, for the rarest and the
+// most common tag.
+const (
+	minCloudPercent = 80
+	maxCloudPercent = 200
+)
+
+// tagCloud sizes tags for the tag cloud in proportion to their counts.
+func tagCloud(tags []bookshelf.TagCount) []cloudTag {
+	if len(tags) == 0 {
+		return nil
+	}
+	min, max := tags[0].Count, tags[0].Count
+	for _, t := range tags {
+		if t.Count < min {
+			min = t.Count
+		}
+		if t.Count > max {
+			max = t.Count
+		}
+	}
+	cloud := make([]cloudTag, len(tags))
+	for i, t := range tags {
+		cloud[i] = cloudTag{TagCount: t, Percent: minCloudPercent}
+		if max > min {
+			cloud[i].Percent += (maxCloudPercent - minCloudPercent) * (t.Count - min) / (max - min)
+		}
+	}
+	return cloud
+}
+
+// tagHandler displays the books with the tag in the URL's path.
+func tagHandler(w http.ResponseWriter, r *http.Request) *appError {
+	tag, err := bookshelf.NormalizeTag(mux.Vars(r)["tag"])
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	books, err := bookshelf.DB.ListBooksByTag(r.Context(), tag)
+	if err != nil {
+		return appErrorf(err, "could not list books: %v", err)
+	}
+
+	return tagTmpl.Execute(w, r, struct {
+		Tag   string
+		Books []*bookshelf.Book
+	}{tag, books})
+}
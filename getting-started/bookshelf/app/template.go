@@ -11,14 +11,17 @@ import (
 	"net/http"
 	"path/filepath"
 
-	"google.golang.org/api/plus/v1"
-
 	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
 )
 
 // parseTemplate applies a given file to the body of the base template.
 func parseTemplate(filename string) *appTemplate {
-	tmpl := template.Must(template.ParseFiles("templates/base.html"))
+	// These functions depend on the request, and are bound to it by Execute.
+	funcs := template.FuncMap{
+		"csrfField": func() template.HTML { return "" },
+		"canModify": func(*bookshelf.Book) bool { return false },
+	}
+	tmpl := template.Must(template.New("base.html").Funcs(funcs).ParseFiles("templates/base.html"))
 
 	// Put the named file into a template called "body"
 	path := filepath.Join("templates", filename)
@@ -37,28 +40,47 @@ type appTemplate struct {
 }
 
 // Execute writes the template using the provided data, adding login and user
-// information to the base template.
+// information to the base template. Forms that change anything must include
+// {{csrfField}}, the hidden field holding the session's CSRF token (see
+// csrfHandler), and {{canModify book}} reports whether the user may change
+// a book.
 func (tmpl *appTemplate) Execute(w http.ResponseWriter, r *http.Request, data interface{}) *appError {
 	d := struct {
 		Data        interface{}
 		AuthEnabled bool
-		Profile     *plus.Person
+		Profile     *profile
 		LoginURL    string
 		LogoutURL   string
+		CSRFToken   string
 	}{
 		Data:        data,
-		AuthEnabled: bookshelf.OAuthConfig != nil,
+		AuthEnabled: signInEnabled(),
 		LoginURL:    "/login?redirect=" + r.URL.RequestURI(),
 		LogoutURL:   "/logout?redirect=" + r.URL.RequestURI(),
+		CSRFToken:   csrfTokenFromContext(r.Context()),
+	}
+
+	// The body templates are given only the page's data, so what they need
+	// of the request is given by functions, bound to it in a copy of the
+	// template.
+	t, err := tmpl.t.Clone()
+	if err != nil {
+		return appErrorf(err, "could not copy template: %v", err)
 	}
+	t.Funcs(template.FuncMap{"csrfField": func() template.HTML {
+		return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+			csrfFieldName, template.HTMLEscapeString(d.CSRFToken)))
+	}, "canModify": func(book *bookshelf.Book) bool {
+		return canModify(r, book)
+	}})
 
 	if d.AuthEnabled {
 		// Ignore any errors.
 		d.Profile = profileFromSession(r)
 	}
 
-	if err := tmpl.t.Execute(w, d); err != nil {
-		return appErrorf(err, "could not write template: %v")
+	if err := t.Execute(w, d); err != nil {
+		return appErrorf(err, "could not write template: %v", err)
 	}
 	return nil
 }
@@ -0,0 +1,125 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// tenantHandler serves each request with h, scoped to the request's tenant
+// (see tenantFromRequest), so that the handlers only see the tenant's books.
+func tenantHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := tenantFromRequest(r)
+		if err != nil {
+			appHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+				return appErrorf(err, "could not find the organization: %v", err)
+			}).ServeHTTP(w, r)
+			return
+		}
+		servedTenants.add(tenant)
+		h.ServeHTTP(w, r.WithContext(bookshelf.WithTenant(r.Context(), tenant)))
+	})
+}
+
+// tenantFromRequest returns the tenant whose books a request is served. It is
+// named by the request's host name, if that is a subdomain of
+// bookshelf.TenantDomain, and is otherwise the signed-in user's Google Apps
+// domain. Requests by users without one, or without sign-in, are served the
+// books of bookshelf.DefaultTenant. Host names of tenants missing from
+// bookshelf.Tenants are an error of kind ErrNotFound.
+func tenantFromRequest(r *http.Request) (string, error) {
+	if label, ok := tenantLabel(r.Host); ok {
+		tenant, err := bookshelf.NormalizeTenant(label)
+		if err != nil {
+			return "", err
+		}
+		for _, t := range bookshelf.Tenants {
+			if t == tenant {
+				return tenant, nil
+			}
+		}
+		return "", &bookshelf.Error{
+			Kind: bookshelf.ErrNotFound,
+			Msg:  fmt.Sprintf("no organization is named %q", label),
+		}
+	}
+	if signInEnabled() {
+		if profile := profileFromSession(r); profile != nil {
+			return bookshelf.NormalizeTenant(profile.Domain)
+		}
+	}
+	return bookshelf.DefaultTenant, nil
+}
+
+// tenantLabel returns the part of host, which may include a port, before
+// "."+bookshelf.TenantDomain. ok is false if host is not under the domain.
+func tenantLabel(host string) (label string, ok bool) {
+	if bookshelf.TenantDomain == "" {
+		return "", false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	suffix := "." + bookshelf.TenantDomain
+	if !strings.HasSuffix(host, suffix) || len(host) == len(suffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(host, suffix), true
+}
+
+// tenantSet is a set of tenants, safe for concurrent use.
+type tenantSet struct {
+	mu      sync.Mutex
+	tenants map[string]bool
+}
+
+// servedTenants holds the tenants this instance of the app has served since
+// it started. purgeTrash empties their trash; see purgedTenants.
+var servedTenants = &tenantSet{tenants: map[string]bool{bookshelf.DefaultTenant: true}}
+
+func (s *tenantSet) add(tenant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenants[tenant] = true
+}
+
+// list returns the tenants in the set, in order.
+func (s *tenantSet) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tenants []string
+	for t := range s.tenants {
+		tenants = append(tenants, t)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// purgedTenants returns the tenants whose trash purgeTrash empties: the
+// default tenant, those of bookshelf.Tenants, and those this instance has
+// served since it started. The app cannot list the tenants named after
+// Google Apps domains, so the trash of such a tenant is only purged by the
+// instances that have served it since they started, if it is not listed in
+// bookshelf.Tenants.
+func purgedTenants() []string {
+	s := &tenantSet{tenants: make(map[string]bool)}
+	for _, t := range bookshelf.Tenants {
+		s.add(t)
+	}
+	for _, t := range servedTenants.list() {
+		s.add(t)
+	}
+	return s.list()
+}
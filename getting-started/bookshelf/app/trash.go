@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// trashOwner returns the ID of the user whose trash the request may see.
+// Without sign-in, every book is anonymous and the trash is shared, so the ID
+// is empty. If sign-in is enabled but the user is not signed in, trashOwner
+// redirects to the login page and ok is false.
+func trashOwner(w http.ResponseWriter, r *http.Request) (userID string, ok bool) {
+	if !signInEnabled() {
+		return "", true
+	}
+	user := profileFromSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/login?redirect=/books/trash", http.StatusFound)
+		return "", false
+	}
+	return user.ID, true
+}
+
+// trashHandler displays the deleted books of the current user, which can be
+// restored until they are purged.
+func trashHandler(w http.ResponseWriter, r *http.Request) *appError {
+	userID, ok := trashOwner(w, r)
+	if !ok {
+		return nil
+	}
+
+	books, err := bookshelf.DB.ListDeletedBooks(r.Context(), userID)
+	if err != nil {
+		return appErrorf(err, "could not list deleted books: %v", err)
+	}
+
+	return trashTmpl.Execute(w, r, struct {
+		Books         []*bookshelf.Book
+		RetentionDays int
+	}{books, int(bookshelf.TrashRetention / (24 * time.Hour))})
+}
+
+// restoreHandler takes a given book out of the current user's trash.
+func restoreHandler(w http.ResponseWriter, r *http.Request) *appError {
+	id, err := bookIDFromRequest(r)
+	if err != nil {
+		return appErrorf(err, "%v", err)
+	}
+	userID, ok := trashOwner(w, r)
+	if !ok {
+		return nil
+	}
+
+	// Only the book's creator may restore it, so look for it in their trash.
+	books, err := bookshelf.DB.ListDeletedBooks(r.Context(), userID)
+	if err != nil {
+		return appErrorf(err, "could not list deleted books: %v", err)
+	}
+	found := false
+	for _, b := range books {
+		if b.ID == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		err := &bookshelf.Error{
+			Kind: bookshelf.ErrNotFound,
+			Msg:  fmt.Sprintf("book %d is not in your trash", id),
+		}
+		return appErrorf(err, "%v", err)
+	}
+
+	if err := bookshelf.DB.RestoreBook(actorContext(r), id); err != nil {
+		return appErrorf(err, "could not restore book: %v", err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/books/%d", id), http.StatusFound)
+	return nil
+}
+
+// purgeTrash runs forever, removing the books that have been in the trash for
+// longer than bookshelf.TrashRetention once per interval. Purging is
+// idempotent, so every instance of the app can run it.
+//
+// Each instance purges the trash of the configured tenants and of those it has
+// served; see purgedTenants.
+func purgeTrash(interval time.Duration) {
+	if bookshelf.TrashRetention <= 0 {
+		return
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		before := time.Now().Add(-bookshelf.TrashRetention)
+		for _, tenant := range purgedTenants() {
+			n, err := bookshelf.DB.PurgeBooks(bookshelf.WithTenant(ctx, tenant), before)
+			if err != nil {
+				log.Printf("Could not purge trash of tenant %q: %v", tenant, err)
+			} else if n > 0 {
+				log.Printf("Purged %d books from the trash of tenant %q", n, tenant)
+			}
+		}
+		cancel()
+		time.Sleep(interval)
+	}
+}
@@ -4,6 +4,12 @@
 
 package bookshelf
 
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
 // Book holds metadata about a book.
 type Book struct {
 	ID            int64
@@ -14,6 +20,29 @@ type Book struct {
 	Description   string
 	CreatedBy     string
 	CreatedByID   string
+
+	// ISBN is the book's ISBN-13, or empty if it is not known. The
+	// BookDatabase normalizes it with NormalizeISBN, and no two books may
+	// have the same ISBN. An empty ISBN is left out of Mongo documents, so
+	// that the sparse unique index on it skips them.
+	ISBN string `bson:",omitempty"`
+
+	// Tags organize books into shelves. The BookDatabase normalizes each
+	// with NormalizeTag, and stores them sorted and without duplicates.
+	Tags []string
+
+	// Version is incremented each time the book is updated. It is used to
+	// detect concurrent modifications; see BookDatabase.UpdateBook.
+	Version int64
+
+	// CreatedAt is the time the book was added. It is set by
+	// BookDatabase.AddBook, kept by BookImporter.ImportBook, and left unchanged
+	// by BookDatabase.UpdateBook whatever the book passed to it holds.
+	CreatedAt time.Time
+
+	// DeletedAt is the time the book was moved to the trash by
+	// BookDatabase.DeleteBook, or the zero time if it is not in the trash.
+	DeletedAt time.Time
 }
 
 // CreatedByDisplayName returns a string appropriate for displaying the name of
@@ -25,34 +54,142 @@ func (b *Book) CreatedByDisplayName() string {
 	return b.CreatedBy
 }
 
+// ISBN10 returns the ISBN-10 form of the book's ISBN, or the empty string if
+// it has none.
+func (b *Book) ISBN10() string {
+	return ISBN10(b.ISBN)
+}
+
 // SetCreatorAnonymous sets the CreatedByID field to the "anonymous" ID.
 func (b *Book) SetCreatorAnonymous() {
 	b.CreatedBy = ""
 	b.CreatedByID = "anonymous"
 }
 
+// creationTime returns the CreatedAt time of a book added now. It is kept
+// to the millisecond, the precision of Mongo's timestamps, so that a book
+// reads back the same from every backend.
+func creationTime() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
 // BookDatabase provides thread-safe access to a database of books.
+//
+// Each method takes a context that bounds the lifetime of the call: if the
+// context is cancelled or its deadline passes, the database work is abandoned
+// and the context's error is returned. Other failures are reported with an
+// error whose ErrorKind is ErrNotFound, ErrInvalidArgument, ErrConflict or
+// ErrAlreadyExists where one of those applies.
+//
+// Books written with an invalid ISBN or tag fail with ErrInvalidArgument,
+// and books whose ISBN is taken by another book, even one in the trash, fail
+// with ErrAlreadyExists.
+//
+// Deleted books are kept in a trash, from which they can be restored until
+// they are purged. Books in the trash are not returned by the methods that
+// list, search or get books, and cannot be updated.
+//
+// Every add, update, delete and restore is recorded as a Revision, with the
+// actor carried by the call's context (see WithActor).
+//
+// AddBooks, UpdateBooks and DeleteBooks write a batch of books in a few round
+// trips rather than one per book. When some books cannot be written, they
+// return a BatchError reporting which books were written and why the others
+// were not. Each backend documents whether it writes a batch all or nothing.
 type BookDatabase interface {
 	// ListBooks returns a list of books, ordered by title.
-	ListBooks() ([]*Book, error)
+	ListBooks(ctx context.Context) ([]*Book, error)
 
 	// ListBooksCreatedBy returns a list of books, ordered by title, filtered by
 	// the user who created the book entry.
-	ListBooksCreatedBy(userID string) ([]*Book, error)
+	ListBooksCreatedBy(ctx context.Context, userID string) ([]*Book, error)
+
+	// ListBooksPage returns a page of at most pageSize books, selected and
+	// ordered by opts, starting at the given cursor. An empty cursor denotes
+	// the first page. A cursor can only be used with options ordering books
+	// the same way as those it came from, and invalid options or cursors fail
+	// with ErrInvalidArgument.
+	ListBooksPage(ctx context.Context, opts ListOptions, cursor string, pageSize int) (*BookPage, error)
+
+	// ListBooksByTag returns the books with a given tag, which is normalized
+	// first, ordered by title.
+	ListBooksByTag(ctx context.Context, tag string) ([]*Book, error)
 
-	// GetBook retrieves a book by its ID.
-	GetBook(id int64) (*Book, error)
+	// ListTags returns the tags of the books outside the trash, with the
+	// number of books that have each, ordered by tag.
+	ListTags(ctx context.Context) ([]TagCount, error)
 
-	// AddBook saves a given book, assigning it a new ID.
-	AddBook(b *Book) (id int64, err error)
+	// SearchBooks returns the books whose title, author or description match
+	// the query, most relevant first.
+	SearchBooks(ctx context.Context, query string) ([]*Book, error)
 
-	// DeleteBook removes a given book by its ID.
-	DeleteBook(id int64) error
+	// GetBook retrieves a book by its ID. If there is no such book, the error's
+	// kind is ErrNotFound.
+	GetBook(ctx context.Context, id int64) (*Book, error)
 
-	// UpdateBook updates the entry for a given book.
-	UpdateBook(b *Book) error
+	// GetBookByISBN retrieves a book by its ISBN, which is normalized first.
+	// If there is no such book outside the trash, the error's kind is
+	// ErrNotFound.
+	GetBookByISBN(ctx context.Context, isbn string) (*Book, error)
 
-	// Close closes the database, freeing up any available resources.
+	// AddBook saves a given book, assigning it a new ID. The book's Version
+	// is set to 1, its CreatedAt time to now, and it is not in the trash.
+	AddBook(ctx context.Context, b *Book) (id int64, err error)
+
+	// DeleteBook moves a given book to the trash by its ID, setting its
+	// DeletedAt time. If there is no such book outside the trash, the error's
+	// kind is ErrNotFound.
+	DeleteBook(ctx context.Context, id int64) error
+
+	// ListDeletedBooks returns the books in the trash, most recently deleted
+	// first. If userID is not empty, only books created by that user are
+	// listed.
+	ListDeletedBooks(ctx context.Context, userID string) ([]*Book, error)
+
+	// RestoreBook takes a given book out of the trash by its ID. If there is
+	// no such book in the trash, the error's kind is ErrNotFound.
+	RestoreBook(ctx context.Context, id int64) error
+
+	// PurgeBooks permanently removes the books moved to the trash before a
+	// given time, and returns how many were removed.
+	PurgeBooks(ctx context.Context, before time.Time) (n int, err error)
+
+	// ListRevisions returns the revisions of a given book by its ID, oldest
+	// first. Purged books, and IDs that were never assigned, have no
+	// revisions.
+	ListRevisions(ctx context.Context, id int64) ([]*Revision, error)
+
+	// UpdateBook updates the entry for a given book, and increments b.Version.
+	// If b.Version does not match the stored version, because the book was
+	// modified since it was read, UpdateBook returns a *ConflictError.
+	UpdateBook(ctx context.Context, b *Book) error
+
+	// AddBooks saves the given books as AddBook does, and returns their IDs
+	// in order. If the error is a BatchError, the IDs of the books that were
+	// not saved are 0.
+	AddBooks(ctx context.Context, bs []*Book) (ids []int64, err error)
+
+	// UpdateBooks updates the entries for the given books as UpdateBook does.
+	// A book whose version does not match has a *ConflictError in the
+	// BatchError.
+	UpdateBooks(ctx context.Context, bs []*Book) error
+
+	// DeleteBooks moves the books with the given IDs to the trash as
+	// DeleteBook does.
+	DeleteBooks(ctx context.Context, ids []int64) error
+
+	// Close closes the database, freeing up any available resources. It may
+	// be called more than once, and calls made after it fail.
 	// TODO(cbro): Close() should return an error.
 	Close()
 }
+
+// BookImporter is implemented by a BookDatabase that can store books with
+// IDs chosen by the caller, such as books copied from another database.
+type BookImporter interface {
+	// ImportBook saves a book under its existing ID, Version, CreatedAt and
+	// DeletedAt times, replacing any book with the same ID. A book without a
+	// CreatedAt time is given the current time. If the database cannot store
+	// a book under that ID, the error's kind is ErrInvalidArgument.
+	ImportBook(ctx context.Context, b *Book) error
+}
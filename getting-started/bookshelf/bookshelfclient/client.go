@@ -0,0 +1,253 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package bookshelfclient is a client of the bookshelf's JSON API, described
+// by the OpenAPI document the bookshelf serves at /api/openapi.json.
+//
+//	c := bookshelfclient.New("https://my-project.appspot.com")
+//	book, err := c.AddBook(ctx, &bookshelfclient.Book{Title: "Moby Dick"})
+//
+// Requests act for the user signed in to the bookshelf's session, whose
+// cookie the client's HTTPClient must send; without it, they are anonymous.
+package bookshelfclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// Book is a book on the bookshelf. The ID, creator and creation time are set
+// by the bookshelf, and ignored when sent. Version is set by the bookshelf
+// too, but UpdateBook sends it as the version of the book it replaces.
+type Book struct {
+	ID            int64     `json:"id"`
+	Title         string    `json:"title"`
+	Author        string    `json:"author"`
+	PublishedDate string    `json:"publishedDate"`
+	ImageURL      string    `json:"imageURL"`
+	Description   string    `json:"description"`
+	ISBN          string    `json:"isbn"`
+	Tags          []string  `json:"tags"`
+	CreatedBy     string    `json:"createdBy"`
+	CreatedByID   string    `json:"createdByID"`
+	Version       int64     `json:"version"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// BookPatch holds the details of a book changed by PatchBook. Nil fields
+// are left unchanged. If Version is not nil, the change is rejected with a
+// 409 Conflict error if the book has been modified since that version.
+type BookPatch struct {
+	Title         *string   `json:"title,omitempty"`
+	Author        *string   `json:"author,omitempty"`
+	PublishedDate *string   `json:"publishedDate,omitempty"`
+	ImageURL      *string   `json:"imageURL,omitempty"`
+	Description   *string   `json:"description,omitempty"`
+	ISBN          *string   `json:"isbn,omitempty"`
+	Tags          *[]string `json:"tags,omitempty"`
+	Version       *int64    `json:"version,omitempty"`
+}
+
+// String returns a pointer to s, for the fields of a BookPatch.
+func String(s string) *string { return &s }
+
+// BookList is a page of books.
+type BookList struct {
+	Books []*Book `json:"books"`
+
+	// NextCursor and PrevCursor, if not empty, are the cursors of the next
+	// and previous pages, to be passed in ListOptions.Cursor.
+	NextCursor string `json:"nextCursor"`
+	PrevCursor string `json:"prevCursor"`
+}
+
+// ListOptions select and order the books listed by ListBooks. The zero value
+// lists the first page of every book, ordered by title.
+type ListOptions struct {
+	Sort       string // "title", "author", "published" or "created".
+	Descending bool
+	Author     string // The author of the books, if not empty.
+	Creator    string // The ID of the user who added the books, if not empty.
+	From, To   int    // The years the books were published within, if not 0.
+
+	Cursor   string // The cursor of the page, from another BookList.
+	PageSize int    // The number of books in the page, or 0 for the default.
+}
+
+func (o *ListOptions) values() url.Values {
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	year := func(y int) string {
+		if y == 0 {
+			return ""
+		}
+		return strconv.Itoa(y)
+	}
+	set("sort", o.Sort)
+	if o.Descending {
+		v.Set("order", "desc")
+	}
+	set("author", o.Author)
+	set("creator", o.Creator)
+	set("from", year(o.From))
+	set("to", year(o.To))
+	set("cursor", o.Cursor)
+	if o.PageSize != 0 {
+		v.Set("pageSize", strconv.Itoa(o.PageSize))
+	}
+	return v
+}
+
+// Error is an error reported by the bookshelf.
+type Error struct {
+	Code    int    `json:"code"` // The HTTP status code.
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("bookshelf: %d %s: %s", e.Code, http.StatusText(e.Code), e.Message)
+}
+
+// IsNotFound reports whether err is an Error with the status 404 Not Found.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == http.StatusNotFound
+}
+
+// IsConflict reports whether err is an Error with the status 409 Conflict,
+// such as that of an update based on a stale version of a book.
+func IsConflict(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == http.StatusConflict
+}
+
+// Client makes requests to the API of a bookshelf.
+type Client struct {
+	// BaseURL is the URL of the bookshelf, such as
+	// "https://my-project.appspot.com".
+	BaseURL string
+
+	// HTTPClient makes the requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+// New returns a Client of the bookshelf at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// ListBooks lists a page of books. If opts is nil, it lists the first page
+// of every book.
+func (c *Client) ListBooks(ctx context.Context, opts *ListOptions) (*BookList, error) {
+	path := "/api/v1/books"
+	if opts != nil {
+		if q := opts.values().Encode(); q != "" {
+			path += "?" + q
+		}
+	}
+	list := &BookList{}
+	if err := c.do(ctx, "GET", path, nil, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// GetBook gets the book with the given ID.
+func (c *Client) GetBook(ctx context.Context, id int64) (*Book, error) {
+	return c.doBook(ctx, "GET", bookPath(id), nil)
+}
+
+// AddBook adds a book, and returns it as added.
+func (c *Client) AddBook(ctx context.Context, b *Book) (*Book, error) {
+	return c.doBook(ctx, "POST", "/api/v1/books", b)
+}
+
+// UpdateBook replaces the details of the book with b.ID with those of b, and
+// returns the book as updated. b.Version must be the version of the book the
+// details replace; if the book has been modified since, UpdateBook returns
+// an Error for which IsConflict is true.
+func (c *Client) UpdateBook(ctx context.Context, b *Book) (*Book, error) {
+	return c.doBook(ctx, "PUT", bookPath(b.ID), b)
+}
+
+// PatchBook changes the details of the book with the given ID present in p,
+// and returns the book as updated.
+func (c *Client) PatchBook(ctx context.Context, id int64, p *BookPatch) (*Book, error) {
+	return c.doBook(ctx, "PATCH", bookPath(id), p)
+}
+
+// DeleteBook moves the book with the given ID to the trash.
+func (c *Client) DeleteBook(ctx context.Context, id int64) error {
+	return c.do(ctx, "DELETE", bookPath(id), nil, nil)
+}
+
+func bookPath(id int64) string {
+	return fmt.Sprintf("/api/v1/books/%d", id)
+}
+
+func (c *Client) doBook(ctx context.Context, method, path string, in interface{}) (*Book, error) {
+	b := &Book{}
+	if err := c.do(ctx, method, path, in, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// do makes a request with in, if not nil, as its JSON body, and decodes the
+// body of the response into out, if not nil. Error responses are returned as
+// an *Error.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := ctxhttp.Do(ctx, c.HTTPClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		e := &Error{}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil || e.Code == 0 {
+			// Not an error of the API, such as one of a proxy.
+			e = &Error{Code: resp.StatusCode, Message: resp.Status}
+		}
+		return e
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("bookshelf: could not decode response: %v", err)
+	}
+	return nil
+}
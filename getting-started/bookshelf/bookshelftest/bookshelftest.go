@@ -0,0 +1,472 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package bookshelftest checks that implementations of
+// bookshelf.BookDatabase behave as the interface documents.
+//
+// A backend outside the bookshelf package proves itself with a test such as:
+//
+//	func TestConformance(t *testing.T) {
+//		bookshelftest.TestBookDatabase(t, func() (bookshelf.BookDatabase, error) {
+//			return openMyDB()
+//		})
+//	}
+package bookshelftest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// TestBookDatabase runs the conformance suite on the databases returned by
+// open. Each part of the suite opens a database of its own and closes it when
+// done, so open must return a new handle each time it is called. The handles
+// may share their books, as those of a database server do: the suite only
+// looks at the books it adds, and moves them to the trash when done.
+func TestBookDatabase(t *testing.T, open func() (bookshelf.BookDatabase, error)) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, db bookshelf.BookDatabase)
+	}{
+		{"AddBook", testAddBook},
+		{"TitleOrder", testTitleOrder},
+		{"ListBooksCreatedBy", testListBooksCreatedBy},
+		{"ListBooksCreatedByEmpty", testListBooksCreatedByEmpty},
+		{"NotFound", testNotFound},
+		{"ConcurrentAdds", testConcurrentAdds},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := open()
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer db.Close()
+			tt.f(t, db)
+		})
+	}
+	t.Run("Close", func(t *testing.T) {
+		db, err := open()
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		testClose(t, db, open)
+	})
+}
+
+// newUserID returns a creator ID unique to a part of the suite, so that the
+// books it adds can be listed apart from any others in the database.
+func newUserID(name string) string {
+	return fmt.Sprintf("bookshelftest-%s-%d", name, time.Now().UnixNano())
+}
+
+// addBooks adds the given books, setting their IDs. The returned function
+// moves them to the trash.
+func addBooks(t *testing.T, db bookshelf.BookDatabase, bs ...*bookshelf.Book) (cleanup func()) {
+	ctx := context.Background()
+	var ids []int64
+	cleanup = func() {
+		for _, id := range ids {
+			db.DeleteBook(ctx, id)
+		}
+	}
+	for _, b := range bs {
+		id, err := db.AddBook(ctx, b)
+		if err != nil {
+			cleanup()
+			t.Fatalf("AddBook(%q): %v", b.Title, err)
+		}
+		b.ID = id
+		ids = append(ids, id)
+	}
+	return cleanup
+}
+
+// titles returns the titles of a list of books, joined by commas.
+func titles(bs []*bookshelf.Book) string {
+	var s []string
+	for _, b := range bs {
+		s = append(s, b.Title)
+	}
+	return strings.Join(s, ",")
+}
+
+func testAddBook(t *testing.T, db bookshelf.BookDatabase) {
+	ctx := context.Background()
+	userID := newUserID("add")
+
+	first := &bookshelf.Book{
+		Title:         "first",
+		Author:        "Ada",
+		PublishedDate: "1843",
+		Description:   "notes",
+		CreatedBy:     "Tester",
+		CreatedByID:   userID,
+	}
+	// AddBook assigns a new ID even if the book already has one, rather than
+	// replacing the book with that ID.
+	second := &bookshelf.Book{Title: "second", CreatedByID: userID}
+	defer addBooks(t, db, first)()
+	second.ID = first.ID
+	defer addBooks(t, db, second)()
+
+	if first.ID == 0 || second.ID == 0 {
+		t.Errorf("AddBook assigned IDs %d and %d, want non-zero IDs", first.ID, second.ID)
+	}
+	if first.ID == second.ID {
+		t.Errorf("AddBook assigned ID %d to two books", first.ID)
+	}
+
+	start := time.Now().Add(-time.Minute)
+	got, err := db.GetBook(ctx, first.ID)
+	if err != nil {
+		t.Fatalf("GetBook: %v", err)
+	}
+	if got.ID != first.ID || got.Title != first.Title || got.Author != first.Author ||
+		got.PublishedDate != first.PublishedDate || got.Description != first.Description ||
+		got.CreatedBy != first.CreatedBy || got.CreatedByID != first.CreatedByID {
+		t.Errorf("GetBook(%d) = %+v, want %+v", first.ID, got, first)
+	}
+	if got.Version != 1 {
+		t.Errorf("GetBook(%d): got Version %d, want 1", first.ID, got.Version)
+	}
+	if got.CreatedAt.Before(start) || !got.DeletedAt.IsZero() {
+		t.Errorf("GetBook(%d): got CreatedAt %v and DeletedAt %v, want a recent CreatedAt and no DeletedAt",
+			first.ID, got.CreatedAt, got.DeletedAt)
+	}
+	if got, err := db.GetBook(ctx, second.ID); err != nil || got.Title != second.Title {
+		t.Errorf("GetBook(%d) = %+v, %v; want title %q", second.ID, got, err, second.Title)
+	}
+}
+
+func testTitleOrder(t *testing.T, db bookshelf.BookDatabase) {
+	ctx := context.Background()
+	userID := newUserID("order")
+
+	var bs []*bookshelf.Book
+	for _, title := range []string{"c", "a", "d", "b"} {
+		bs = append(bs, &bookshelf.Book{Title: title, CreatedByID: userID})
+	}
+	defer addBooks(t, db, bs...)()
+
+	books, err := db.ListBooksCreatedBy(ctx, userID)
+	if err != nil {
+		t.Fatalf("ListBooksCreatedBy: %v", err)
+	}
+	if got, want := titles(books), "a,b,c,d"; got != want {
+		t.Errorf("ListBooksCreatedBy: got titles %q, want %q", got, want)
+	}
+
+	// Other books may be listed in between, but in order all the same.
+	all, err := db.ListBooks(ctx)
+	if err != nil {
+		t.Fatalf("ListBooks: %v", err)
+	}
+	var ours []*bookshelf.Book
+	for i, b := range all {
+		if i > 0 && all[i-1].Title > b.Title {
+			t.Errorf("ListBooks: %q listed before %q", all[i-1].Title, b.Title)
+		}
+		if b.CreatedByID == userID {
+			ours = append(ours, b)
+		}
+	}
+	if got, want := titles(ours), "a,b,c,d"; got != want {
+		t.Errorf("ListBooks: got titles %q for the added books, want %q", got, want)
+	}
+}
+
+func testListBooksCreatedBy(t *testing.T, db bookshelf.BookDatabase) {
+	ctx := context.Background()
+	alice, bob := newUserID("alice"), newUserID("bob")
+
+	bs := []*bookshelf.Book{
+		{Title: "alice 1", CreatedByID: alice},
+		{Title: "bob 1", CreatedByID: bob},
+		{Title: "alice 2", CreatedByID: alice},
+		{Title: "alice deleted", CreatedByID: alice},
+	}
+	defer addBooks(t, db, bs...)()
+	if err := db.DeleteBook(ctx, bs[3].ID); err != nil {
+		t.Fatalf("DeleteBook: %v", err)
+	}
+
+	tests := []struct {
+		userID string
+		want   string
+	}{
+		{alice, "alice 1,alice 2"},
+		{bob, "bob 1"},
+		{newUserID("nobody"), ""},
+	}
+	for _, tt := range tests {
+		books, err := db.ListBooksCreatedBy(ctx, tt.userID)
+		if err != nil {
+			t.Errorf("ListBooksCreatedBy(%q): %v", tt.userID, err)
+			continue
+		}
+		if got := titles(books); got != tt.want {
+			t.Errorf("ListBooksCreatedBy(%q): got titles %q, want %q", tt.userID, got, tt.want)
+		}
+	}
+}
+
+func testListBooksCreatedByEmpty(t *testing.T, db bookshelf.BookDatabase) {
+	ctx := context.Background()
+	userID := newUserID("empty")
+
+	bs := []*bookshelf.Book{
+		{Title: "by someone", CreatedByID: userID},
+		{Title: "by no one"},
+	}
+	defer addBooks(t, db, bs...)()
+
+	// An empty user ID lists every book, as ListBooks does. Books with the
+	// same title may be listed in either order.
+	all, err := db.ListBooks(ctx)
+	if err != nil {
+		t.Fatalf("ListBooks: %v", err)
+	}
+	got, err := db.ListBooksCreatedBy(ctx, "")
+	if err != nil {
+		t.Fatalf("ListBooksCreatedBy(\"\"): %v", err)
+	}
+	if titles(got) != titles(all) {
+		t.Errorf("ListBooksCreatedBy(\"\"): got titles %q, want those of ListBooks, %q", titles(got), titles(all))
+	}
+	listed := make(map[int64]bool)
+	for _, b := range got {
+		listed[b.ID] = true
+	}
+	for _, b := range bs {
+		if !listed[b.ID] {
+			t.Errorf("ListBooksCreatedBy(\"\"): book %q not listed", b.Title)
+		}
+	}
+}
+
+func testNotFound(t *testing.T, db bookshelf.BookDatabase) {
+	ctx := context.Background()
+
+	b := &bookshelf.Book{Title: "gone", CreatedByID: newUserID("notfound")}
+	addBooks(t, db, b)
+	if err := db.DeleteBook(ctx, b.ID); err != nil {
+		t.Fatalf("DeleteBook: %v", err)
+	}
+
+	// A book in the trash is as good as gone.
+	if got, err := db.GetBook(ctx, b.ID); bookshelf.ErrorKind(err) != bookshelf.ErrNotFound {
+		t.Errorf("GetBook of a deleted book = %+v, %v; want an error of kind ErrNotFound", got, err)
+	}
+	if err := db.DeleteBook(ctx, b.ID); bookshelf.ErrorKind(err) != bookshelf.ErrNotFound {
+		t.Errorf("DeleteBook of a deleted book: got err %v, want kind ErrNotFound", err)
+	}
+
+	// Nor is there any book under an ID that was never assigned. IDs are
+	// assigned in increasing order by most backends, and at random by
+	// Datastore, so one far past the book's is free.
+	missing := b.ID + 1<<20
+	if got, err := db.GetBook(ctx, missing); bookshelf.ErrorKind(err) != bookshelf.ErrNotFound {
+		t.Errorf("GetBook of a missing book = %+v, %v; want an error of kind ErrNotFound", got, err)
+	}
+	if err := db.DeleteBook(ctx, missing); bookshelf.ErrorKind(err) != bookshelf.ErrNotFound {
+		t.Errorf("DeleteBook of a missing book: got err %v, want kind ErrNotFound", err)
+	}
+	if err := db.RestoreBook(ctx, missing); bookshelf.ErrorKind(err) != bookshelf.ErrNotFound {
+		t.Errorf("RestoreBook of a missing book: got err %v, want kind ErrNotFound", err)
+	}
+	if revs, err := db.ListRevisions(ctx, missing); err != nil || len(revs) != 0 {
+		t.Errorf("ListRevisions of a missing book = %d revisions, %v; want none", len(revs), err)
+	}
+}
+
+func testConcurrentAdds(t *testing.T, db bookshelf.BookDatabase) {
+	ctx := context.Background()
+	userID := newUserID("adds")
+
+	const writers, perWriter = 8, 5
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[int64]bool)
+		errs []error
+	)
+	defer func() {
+		for id := range seen {
+			db.DeleteBook(ctx, id)
+		}
+	}()
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				id, err := db.AddBook(ctx, &bookshelf.Book{
+					Title:       fmt.Sprintf("book %d-%d", i, j),
+					CreatedByID: userID,
+				})
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err)
+				} else if seen[id] {
+					errs = append(errs, fmt.Errorf("ID %d assigned twice", id))
+				} else {
+					seen[id] = true
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		t.Errorf("AddBook: %v", err)
+	}
+
+	books, err := db.ListBooksCreatedBy(ctx, userID)
+	if err != nil {
+		t.Fatalf("ListBooksCreatedBy: %v", err)
+	}
+	if got, want := len(books), writers*perWriter; got != want {
+		t.Errorf("ListBooksCreatedBy: got %d books, want %d", got, want)
+	}
+	for _, b := range books {
+		if !seen[b.ID] {
+			t.Errorf("ListBooksCreatedBy: listed book %d, which no writer added", b.ID)
+		}
+	}
+}
+
+func testConcurrentUpdates(t *testing.T, db bookshelf.BookDatabase) {
+	ctx := context.Background()
+
+	b := &bookshelf.Book{Title: "contended", CreatedByID: newUserID("updates")}
+	defer addBooks(t, db, b)()
+
+	// Every writer updates the first version of the book. Only one of them
+	// may succeed; the others must be told of the conflict.
+	const writers = 8
+	var wg sync.WaitGroup
+	errc := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errc <- db.UpdateBook(ctx, &bookshelf.Book{
+				ID:          b.ID,
+				Title:       fmt.Sprintf("writer %d", i),
+				CreatedByID: b.CreatedByID,
+				Version:     1,
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+
+	won := 0
+	for err := range errc {
+		switch err.(type) {
+		case nil:
+			won++
+		case *bookshelf.ConflictError:
+		default:
+			t.Errorf("UpdateBook: got err %v, want nil or *ConflictError", err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d of %d concurrent updates of the same version succeeded, want 1", won, writers)
+	}
+
+	got, err := db.GetBook(ctx, b.ID)
+	if err != nil {
+		t.Fatalf("GetBook: %v", err)
+	}
+	if got.Version != 2 || !strings.HasPrefix(got.Title, "writer ") {
+		t.Errorf("GetBook after concurrent updates = %+v, want the version 2 of one writer", got)
+	}
+}
+
+func testClose(t *testing.T, db bookshelf.BookDatabase, open func() (bookshelf.BookDatabase, error)) {
+	ctx := context.Background()
+	userID := newUserID("Close")
+	defer func() {
+		// The books are trashed through a handle of their own, as db is
+		// closed.
+		cleanup, err := open()
+		if err != nil {
+			return
+		}
+		defer cleanup.Close()
+		books, _ := cleanup.ListBooksCreatedBy(ctx, userID)
+		for _, b := range books {
+			cleanup.DeleteBook(ctx, b.ID)
+		}
+	}()
+
+	// Calls racing Close either succeed or fail; they do not panic.
+	var (
+		wg     sync.WaitGroup
+		done   = make(chan struct{})
+		panics = make(chan interface{}, 8)
+	)
+	for i := 0; i < cap(panics); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					panics <- r
+				}
+			}()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				db.AddBook(ctx, &bookshelf.Book{Title: "racing Close", CreatedByID: userID})
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	db.Close()
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	wg.Wait()
+	close(panics)
+	for r := range panics {
+		t.Errorf("call racing Close panicked: %v", r)
+	}
+
+	db.Close() // Closing again is harmless.
+
+	// Calls after Close fail rather than panic.
+	calls := []struct {
+		name string
+		f    func() error
+	}{
+		{"ListBooks", func() error { _, err := db.ListBooks(ctx); return err }},
+		{"GetBook", func() error { _, err := db.GetBook(ctx, 1); return err }},
+		{"AddBook", func() error { _, err := db.AddBook(ctx, &bookshelf.Book{Title: "after close"}); return err }},
+	}
+	for _, c := range calls {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s after Close panicked: %v", c.name, r)
+				}
+			}()
+			if err := c.f(); err == nil {
+				t.Errorf("%s after Close: want non-nil err", c.name)
+			}
+		}()
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Ensure lruCache conforms to the BookCache interface.
+var _ BookCache = &lruCache{}
+
+// lruCache is an in-process BookCache holding a bounded number of values.
+// When it is full, the least recently used value is evicted.
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List               // Elements hold *lruEntry, most recently used first.
+	items map[string]*list.Element // maps from key to its element in order.
+
+	now func() time.Time // Replaced in tests.
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// newLRUCache creates a BookCache that holds at most size values in memory.
+// Each process has its own copy, so it suits a single app instance.
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+		now:   time.Now,
+	}
+}
+
+// Get returns the value stored under key.
+func (c *lruCache) Get(key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	e := el.Value.(*lruEntry)
+	if !c.now().Before(e.expires) {
+		c.remove(el)
+		return nil, false, nil
+	}
+	c.order.MoveToFront(el)
+	return e.value, true, nil
+}
+
+// Set stores a value under key, evicting the least recently used value if
+// the cache is full.
+func (c *lruCache) Set(key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.now().Add(ttl)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry)
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(el)
+		return nil
+	}
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+	return nil
+}
+
+// Delete removes the value stored under key.
+func (c *lruCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	return nil
+}
+
+// remove drops an element from the cache. c.mu must be held.
+func (c *lruCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*lruEntry).key)
+}
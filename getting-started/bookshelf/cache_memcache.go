@@ -0,0 +1,72 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// Ensure memcacheCache conforms to the BookCache interface.
+var _ BookCache = &memcacheCache{}
+
+// memcacheCache is a BookCache stored in memcached, which every instance of
+// the app, and the Pub/Sub worker, can share.
+type memcacheCache struct {
+	client *memcache.Client
+}
+
+// newMemcache creates a BookCache stored on the given memcached servers,
+// each given as host:port.
+func newMemcache(servers ...string) *memcacheCache {
+	return &memcacheCache{client: memcache.New(servers...)}
+}
+
+// Get returns the value stored under key.
+func (c *memcacheCache) Get(key string) ([]byte, bool, error) {
+	item, err := c.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return item.Value, true, nil
+}
+
+// Set stores a value under key.
+func (c *memcacheCache) Set(key string, value []byte, ttl time.Duration) error {
+	return c.client.Set(&memcache.Item{
+		Key:        key,
+		Value:      value,
+		Expiration: memcacheExpiration(ttl),
+	})
+}
+
+// Delete removes the value stored under key.
+func (c *memcacheCache) Delete(key string) error {
+	if err := c.client.Delete(key); err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// maxRelativeExpiration is the longest expiration time memcached accepts as
+// a number of seconds; longer ones must be given as a Unix time.
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+// memcacheExpiration converts a TTL to a memcached expiration time. TTLs are
+// rounded up to whole seconds, as zero means the item never expires.
+func memcacheExpiration(ttl time.Duration) int32 {
+	if ttl > maxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+	secs := (ttl + time.Second - 1) / time.Second
+	if secs < 1 {
+		secs = 1
+	}
+	return int32(secs)
+}
@@ -0,0 +1,44 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+// config inspects the configuration the app and the Pub/Sub worker would
+// start with.
+func config(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: bookshelf config check [-config file]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	filename := fs.String("config", os.Getenv(bookshelf.ConfigFileEnv),
+		"configuration file (default $"+bookshelf.ConfigFileEnv+")")
+	fs.Parse(args[1:])
+
+	c, err := bookshelf.LoadConfig(*filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(b)
+
+	if err := c.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("# The configuration is valid.")
+}
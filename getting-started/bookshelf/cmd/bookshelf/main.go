@@ -0,0 +1,42 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Command bookshelf performs administrative tasks on the bookshelf app's
+// databases and configuration.
+//
+// Usage:
+//
+//	bookshelf migrate -db dsn [-version n] [-dry-run] [-status]
+//	bookshelf copy -from dsn -to dsn [-checkpoint file] [-verify-only]
+//	bookshelf config check [-config file]
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage("Missing command.")
+	}
+
+	switch os.Args[1] {
+	case "migrate":
+		migrate(os.Args[2:])
+	case "copy":
+		copyBooks(os.Args[2:])
+	case "config":
+		config(os.Args[2:])
+	default:
+		usage("Unknown command.")
+	}
+}
+
+func usage(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	fmt.Fprintln(os.Stderr, "usage: bookshelf [migrate|copy|config] [flags]")
+	fmt.Fprintln(os.Stderr, "Run 'bookshelf <command> -h' for the flags of a command.")
+	os.Exit(2)
+}
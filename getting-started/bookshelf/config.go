@@ -5,26 +5,39 @@
 package bookshelf
 
 import (
-	"errors"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"cloud.google.com/go/pubsub"
 	"cloud.google.com/go/storage"
 
-	"gopkg.in/mgo.v2"
-
 	"github.com/gorilla/sessions"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf/oidc"
 )
 
+// These are set by Configure.
 var (
-	DB          BookDatabase
-	OAuthConfig *oauth2.Config
+	DB BookDatabase
+
+	// OIDCProviders are the OpenID Connect providers users sign in with. If
+	// there are none, sign-in is disabled.
+	OIDCProviders []*oidc.Provider
 
 	StorageBucket     *storage.BucketHandle
 	StorageBucketName string
@@ -33,91 +46,490 @@ var (
 
 	PubsubClient *pubsub.Client
 
-	// Force import of mgo library.
-	_ mgo.Session
+	// Metrics holds the metrics of the calls made to DB, if
+	// Config.DebugMetrics is set, and is otherwise nil.
+	Metrics *MemoryMetrics
+
+	// TenantDomain is the domain under which each tenant has a host name of
+	// its own; see Config.TenantDomain.
+	TenantDomain string
+
+	// Tenants holds the normalized names of the tenants served under
+	// TenantDomain; see Config.Tenants.
+	Tenants []string
+
+	// TrashRetention is how long deleted books stay in the trash, where they
+	// can be restored, before the app purges them. If it is zero, they are
+	// never purged.
+	TrashRetention = 30 * 24 * time.Hour
+
+	// Admins holds the IDs of the users who may change and delete any book,
+	// and not just those they added; see Config.Admins.
+	Admins []string
 )
 
 const PubsubTopicID = "fill-book-details"
 
-func init() {
-	var err error
-
-	// To use the in-memory test database, uncomment the next line.
-	DB = newMemoryDB()
-
-	// [START cloudsql]
-	// To use MySQL, uncomment the following lines, and update the username,
-	// password and host.
-	//
-	// DB, err = newMySQLDB(MySQLConfig{
-	// 	Username: "",
-	// 	Password: "",
-	// 	Host:     "",
-	// 	Port:     3306,
-	// })
-	// [END cloudsql]
-
-	// [START mongo]
-	// To use Mongo, uncomment the next lines and update the address string and
-	// optionally, the credentials.
-	//
-	// var cred *mgo.Credential
-	// DB, err = newMongoDB("localhost", cred)
-	// [END mongo]
-
-	// [START datastore]
-	// To use Cloud Datastore, uncomment the following lines and update the
-	// project ID.
-	// More options can be set, see the google package docs for details:
-	// http://godoc.org/golang.org/x/oauth2/google
-	//
-	DB, err = configureDatastoreDB("<your-project-id>")
-	// [END datastore]
+// PubsubTenantAttribute is the attribute of the Pub/Sub messages asking the
+// worker to fill in a book's details that holds the book's tenant. Messages
+// for books of DefaultTenant may lack it.
+const PubsubTenantAttribute = "tenant"
+
+// ConfigFileEnv is the environment variable holding the name of the
+// configuration file read by Init.
+const ConfigFileEnv = "BOOKSHELF_CONFIG"
+
+// Config describes the pieces the app and the Pub/Sub worker are built from.
+// It is read from an optional YAML or JSON file, using the field names in the
+// yaml tags below, and from environment variables, which take precedence:
+//
+//	BOOKSHELF_DATABASE             Database
+//	BOOKSHELF_CACHE_SIZE           CacheSize
+//	BOOKSHELF_MEMCACHE             Memcache, as a comma-separated list
+//	BOOKSHELF_STORAGE_BUCKET       StorageBucket
+//	BOOKSHELF_OAUTH_CLIENT_ID      OAuthClientID
+//	BOOKSHELF_OAUTH_CLIENT_SECRET  OAuthClientSecret
+//	OAUTH2_CALLBACK                OAuthRedirectURL
+//	BOOKSHELF_SESSION_SECRET       SessionSecret
+//	BOOKSHELF_SESSION_MAX_AGE      SessionMaxAge, e.g. "720h"
+//	BOOKSHELF_PUBSUB_PROJECT_ID    PubsubProjectID
+//	BOOKSHELF_TENANT_DOMAIN        TenantDomain
+//	BOOKSHELF_TENANTS              Tenants, as a comma-separated list
+//	BOOKSHELF_METRICS_PROJECT_ID   MetricsProjectID
+//	BOOKSHELF_DEBUG_METRICS        DebugMetrics, e.g. "true"
+//	BOOKSHELF_TRASH_RETENTION      TrashRetention, e.g. "720h"
+//	BOOKSHELF_ADMINS               Admins, as a comma-separated list
+type Config struct {
+	// Database is the data source name of the database; see OpenDB for the
+	// backends. The default is "memory:".
+	Database string `json:"database" yaml:"database"`
+
+	// To cache the books read by ID, set CacheSize to the number of books to
+	// keep in memory, or set Memcache to the addresses of memcached servers
+	// to share the cache between instances of the app. Books are kept for a
+	// minute, and missing books for ten seconds.
+	CacheSize int      `json:"cacheSize,omitempty" yaml:"cacheSize,omitempty"`
+	Memcache  []string `json:"memcache,omitempty" yaml:"memcache,omitempty"`
+
+	// StorageBucket is the Cloud Storage bucket cover images are uploaded
+	// to. If it is empty, uploads are disabled.
+	StorageBucket string `json:"storageBucket,omitempty" yaml:"storageBucket,omitempty"`
+
+	// The OAuth client used to sign users in with Google. If OAuthClientID
+	// is empty, Google sign-in is disabled.
+	OAuthClientID     string `json:"oauthClientID,omitempty" yaml:"oauthClientID,omitempty"`
+	OAuthClientSecret string `json:"oauthClientSecret,omitempty" yaml:"oauthClientSecret,omitempty"`
+
+	// OIDCProviders lists other OpenID Connect providers users may sign in
+	// with. If there are none, and no Google client either, sign-in is
+	// disabled.
+	OIDCProviders []OIDCProvider `json:"oidcProviders,omitempty" yaml:"oidcProviders,omitempty"`
+
+	// OAuthRedirectURL is the URL every provider sends users back to once
+	// they have signed in, which must be registered with each OAuth client.
+	// It defaults to the local development server.
+	OAuthRedirectURL string `json:"oauthRedirectURL,omitempty" yaml:"oauthRedirectURL,omitempty"`
+
+	// SessionSecret is the key that signs session cookies. It is required
+	// when sign-in is enabled, and must be at least 32 bytes long. If it is
+	// empty, a random key is used, so sessions do not survive restarts.
+	SessionSecret string `json:"sessionSecret,omitempty" yaml:"sessionSecret,omitempty"`
+
+	// SessionMaxAge is how long a session, and so a sign-in, lasts. It
+	// defaults to 30 days. If it is zero, sessions last until the browser
+	// is closed.
+	SessionMaxAge Duration `json:"sessionMaxAge" yaml:"sessionMaxAge"`
+
+	// PubsubProjectID is the project whose Pub/Sub topic the app asks the
+	// worker to fill in book details through. If it is empty, books are not
+	// filled in.
+	PubsubProjectID string `json:"pubsubProjectID,omitempty" yaml:"pubsubProjectID,omitempty"`
+
+	// TenantDomain, if set, gives each tenant a host name under it: requests
+	// to acme.TenantDomain are served the books of the tenant "acme". Requests
+	// to other host names are served the books of the signed-in user's Google
+	// Apps domain, or of DefaultTenant if there is none.
+	TenantDomain string `json:"tenantDomain,omitempty" yaml:"tenantDomain,omitempty"`
+
+	// Tenants lists the tenants served under TenantDomain, and is required
+	// with it: requests to the host names of other tenants are refused, so
+	// that a mistyped subdomain does not start a new, empty bookshelf. The
+	// trash of these tenants is purged even if no one visits them.
+	Tenants []string `json:"tenants,omitempty" yaml:"tenants,omitempty"`
+
+	// The calls made to the database are counted and timed by method if
+	// either of these is set. MetricsProjectID is the project whose Cloud
+	// Monitoring custom metrics they are written to, every minute.
+	// DebugMetrics keeps them in memory, where the app serves them at
+	// /debug/metrics.
+	MetricsProjectID string `json:"metricsProjectID,omitempty" yaml:"metricsProjectID,omitempty"`
+	DebugMetrics     bool   `json:"debugMetrics,omitempty" yaml:"debugMetrics,omitempty"`
+
+	TrashRetention Duration `json:"trashRetention" yaml:"trashRetention"`
+
+	// Admins lists the IDs of the signed-in users who may change and delete
+	// every book. Other users may only change and delete the books they
+	// added. Without sign-in, every visitor may change every book. The ID of
+	// a user signed in with Google is their Google account ID; that of a
+	// user signed in with another provider is the provider's name, a colon
+	// and their ID at the provider, such as "example:1234".
+	Admins []string `json:"admins,omitempty" yaml:"admins,omitempty"`
+}
+
+// OIDCProvider is an OpenID Connect provider, and the OAuth client the app
+// is registered with there.
+type OIDCProvider struct {
+	// Name names the provider on the login page and in the IDs of its users.
+	// It must be unique.
+	Name string `json:"name" yaml:"name"`
+
+	// Issuer is the provider's issuer URL, such as
+	// "https://accounts.google.com", from which its endpoints are discovered.
+	Issuer string `json:"issuer" yaml:"issuer"`
+
+	ClientID     string `json:"clientID" yaml:"clientID"`
+	ClientSecret string `json:"clientSecret" yaml:"clientSecret"`
+}
+
+// The provider configured by Config.OAuthClientID.
+const (
+	GoogleProviderName = "google"
+	GoogleIssuer       = oidc.GoogleIssuer
+)
+
+// providers returns every provider configured: Google's, if OAuthClientID
+// is set, and OIDCProviders.
+func (c *Config) providers() []OIDCProvider {
+	var ps []OIDCProvider
+	if c.OAuthClientID != "" {
+		ps = append(ps, OIDCProvider{
+			Name:         GoogleProviderName,
+			Issuer:       GoogleIssuer,
+			ClientID:     c.OAuthClientID,
+			ClientSecret: c.OAuthClientSecret,
+		})
+	}
+	return append(ps, c.OIDCProviders...)
+}
+
+// Duration is a time.Duration written as a string, such as "720h", in
+// configuration files.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+// configEnv lists the environment variables that override a Config.
+var configEnv = []struct {
+	name string
+	set  func(c *Config, v string) error
+}{
+	{"BOOKSHELF_DATABASE", func(c *Config, v string) error { c.Database = v; return nil }},
+	{"BOOKSHELF_CACHE_SIZE", func(c *Config, v string) (err error) { c.CacheSize, err = strconv.Atoi(v); return err }},
+	{"BOOKSHELF_MEMCACHE", func(c *Config, v string) error { c.Memcache = strings.Split(v, ","); return nil }},
+	{"BOOKSHELF_STORAGE_BUCKET", func(c *Config, v string) error { c.StorageBucket = v; return nil }},
+	{"BOOKSHELF_OAUTH_CLIENT_ID", func(c *Config, v string) error { c.OAuthClientID = v; return nil }},
+	{"BOOKSHELF_OAUTH_CLIENT_SECRET", func(c *Config, v string) error { c.OAuthClientSecret = v; return nil }},
+	{"OAUTH2_CALLBACK", func(c *Config, v string) error { c.OAuthRedirectURL = v; return nil }},
+	{"BOOKSHELF_SESSION_SECRET", func(c *Config, v string) error { c.SessionSecret = v; return nil }},
+	{"BOOKSHELF_SESSION_MAX_AGE", func(c *Config, v string) error { return c.SessionMaxAge.UnmarshalText([]byte(v)) }},
+	{"BOOKSHELF_PUBSUB_PROJECT_ID", func(c *Config, v string) error { c.PubsubProjectID = v; return nil }},
+	{"BOOKSHELF_TENANT_DOMAIN", func(c *Config, v string) error { c.TenantDomain = v; return nil }},
+	{"BOOKSHELF_TENANTS", func(c *Config, v string) error { c.Tenants = strings.Split(v, ","); return nil }},
+	{"BOOKSHELF_METRICS_PROJECT_ID", func(c *Config, v string) error { c.MetricsProjectID = v; return nil }},
+	{"BOOKSHELF_DEBUG_METRICS", func(c *Config, v string) (err error) { c.DebugMetrics, err = strconv.ParseBool(v); return err }},
+	{"BOOKSHELF_TRASH_RETENTION", func(c *Config, v string) error { return c.TrashRetention.UnmarshalText([]byte(v)) }},
+	{"BOOKSHELF_ADMINS", func(c *Config, v string) error { c.Admins = strings.Split(v, ","); return nil }},
+}
+
+// LoadConfig reads the configuration from filename, if it is not empty, and
+// from the environment. Files whose name ends in ".json" are read as JSON,
+// others as YAML. The configuration is not validated.
+func LoadConfig(filename string) (*Config, error) {
+	c := &Config{
+		Database:       "memory:",
+		SessionMaxAge:  Duration(30 * 24 * time.Hour),
+		TrashRetention: Duration(TrashRetention),
+	}
+	if filename != "" {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("bookshelf: could not read configuration: %v", err)
+		}
+		if filepath.Ext(filename) == ".json" {
+			err = json.Unmarshal(b, c)
+		} else {
+			err = yaml.Unmarshal(b, c)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bookshelf: could not parse configuration %s: %v", filename, err)
+		}
+	}
+	for _, e := range configEnv {
+		v := os.Getenv(e.name)
+		if v == "" {
+			continue
+		}
+		if err := e.set(c, v); err != nil {
+			return nil, fmt.Errorf("bookshelf: bad %s %q: %v", e.name, v, err)
+		}
+	}
+	return c, nil
+}
+
+// Validate checks the configuration without connecting to any service. The
+// error lists every problem found.
+func (c *Config) Validate() error {
+	var errs []string
+	addf := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if u, err := url.Parse(c.Database); err != nil || !knownDatabase[u.Scheme] {
+		addf("database: %q is not a data source name such as memory:, file:path or datastore://project-id", c.Database)
+	}
+	if c.CacheSize < 0 {
+		addf("cacheSize: %d is negative", c.CacheSize)
+	}
+	if c.CacheSize > 0 && len(c.Memcache) > 0 {
+		addf("cacheSize and memcache: set at most one of them")
+	}
+	for _, s := range c.Memcache {
+		if s == "" {
+			addf("memcache: empty server address")
+		}
+	}
+
+	if (c.OAuthClientID == "") != (c.OAuthClientSecret == "") {
+		addf("oauthClientID and oauthClientSecret: set both of them or neither")
+	}
+	names := make(map[string]bool)
+	for _, p := range c.OIDCProviders {
+		switch {
+		case p.Name == "" || strings.Contains(p.Name, ":"):
+			addf("oidcProviders: %q is not a provider name", p.Name)
+		case names[p.Name] || p.Name == GoogleProviderName && c.OAuthClientID != "":
+			addf("oidcProviders: more than one provider is named %q", p.Name)
+		}
+		names[p.Name] = true
+		if u, err := url.Parse(p.Issuer); err != nil || !u.IsAbs() {
+			addf("oidcProviders: the issuer of %q, %q, is not an absolute URL", p.Name, p.Issuer)
+		}
+		if p.ClientID == "" || p.ClientSecret == "" {
+			addf("oidcProviders: %q needs a clientID and a clientSecret", p.Name)
+		}
+	}
+	if c.OAuthRedirectURL != "" {
+		if u, err := url.Parse(c.OAuthRedirectURL); err != nil || !u.IsAbs() {
+			addf("oauthRedirectURL: %q is not an absolute URL", c.OAuthRedirectURL)
+		}
+	}
+	signIn := len(c.providers()) > 0
+	if signIn && c.SessionSecret == "" {
+		addf("sessionSecret: required when sign-in is enabled")
+	}
+	if c.SessionSecret != "" && len(c.SessionSecret) < 32 {
+		addf("sessionSecret: must be at least 32 bytes long")
+	}
+	if c.SessionMaxAge < 0 {
+		addf("sessionMaxAge: %v is negative", time.Duration(c.SessionMaxAge))
+	}
+
+	if c.PubsubProjectID != "" && strings.HasPrefix(c.Database, "memory:") {
+		addf("pubsubProjectID: the Pub/Sub worker doesn't work with the in-memory " +
+			"database, as it does not share its memory with the app; configure " +
+			"another database (e.g. a local file, MySQL, Cloud Datastore, etc)")
+	}
+	if c.TenantDomain != "" {
+		if _, err := NormalizeTenant(c.TenantDomain); err != nil {
+			addf("tenantDomain: %q is not a domain name", c.TenantDomain)
+		}
+		if len(c.Tenants) == 0 {
+			addf("tenants: required when tenantDomain is set")
+		}
+	}
+	for _, t := range c.Tenants {
+		if t == "" {
+			addf("tenants: empty tenant name")
+		} else if _, err := NormalizeTenant(t); err != nil {
+			addf("tenants: %v", err)
+		}
+	}
+	if c.TrashRetention < 0 {
+		addf("trashRetention: %v is negative", time.Duration(c.TrashRetention))
+	}
+	if len(c.Admins) > 0 && !signIn {
+		addf("admins: sign-in must be enabled to tell admins apart")
+	}
+	for _, id := range c.Admins {
+		if id == "" {
+			addf("admins: empty user ID")
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("bookshelf: invalid configuration:\n\t%s", strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// knownDatabase holds the data source name schemes accepted by OpenDB.
+var knownDatabase = map[string]bool{
+	"memory": true, "file": true, "mysql": true, "postgres": true,
+	"sqlite": true, "mongodb": true, "datastore": true,
+}
+
+const redacted = "REDACTED"
 
+// Redacted returns a copy of c with its secrets, including any password in
+// the data source name, replaced so that it can be logged.
+func (c *Config) Redacted() *Config {
+	r := *c
+	if u, err := url.Parse(r.Database); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			r.Database = u.String()
+		}
+	}
+	if r.OAuthClientSecret != "" {
+		r.OAuthClientSecret = redacted
+	}
+	if r.OIDCProviders != nil {
+		r.OIDCProviders = append([]OIDCProvider(nil), c.OIDCProviders...)
+		for i := range r.OIDCProviders {
+			if r.OIDCProviders[i].ClientSecret != "" {
+				r.OIDCProviders[i].ClientSecret = redacted
+			}
+		}
+	}
+	if r.SessionSecret != "" {
+		r.SessionSecret = redacted
+	}
+	return &r
+}
+
+// Init loads the configuration from the file named by the BOOKSHELF_CONFIG
+// environment variable and the environment, validates it and configures the
+// package with it.
+func Init() error {
+	c, err := LoadConfig(os.Getenv(ConfigFileEnv))
+	if err != nil {
+		return err
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	return Configure(c)
+}
+
+// Configure sets DB, StorageBucket, OIDCProviders, SessionStore,
+// PubsubClient, Metrics, TenantDomain, Tenants, TrashRetention and Admins
+// from a validated configuration. The endpoints of the OpenID Connect
+// providers are discovered from their issuers.
+func Configure(c *Config) error {
+	db, err := OpenDB(c.Database)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	// Measure the database itself, not the cache in front of it.
+	var (
+		sinks   []MetricsSink
+		metrics *MemoryMetrics
+	)
+	if c.DebugMetrics {
+		metrics = NewMemoryMetrics()
+		sinks = append(sinks, metrics)
+	}
+	if c.MetricsProjectID != "" {
+		s, err := newMonitoringSink(c.MetricsProjectID, time.Minute)
+		if err != nil {
+			return fmt.Errorf("bookshelf: could not configure Cloud Monitoring: %v", err)
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) > 0 {
+		db = NewMetricsDB(db, sinks...)
 	}
 
-	// [START storage]
-	// To configure Cloud Storage, uncomment the following lines and update the
-	// bucket name.
-	//
-	// StorageBucketName = "<your-storage-bucket>"
-	// StorageBucket, err = configureStorage(StorageBucketName)
-	// [END storage]
+	switch {
+	case c.CacheSize > 0:
+		db = newCachedDB(db, newLRUCache(c.CacheSize), time.Minute, 10*time.Second)
+	case len(c.Memcache) > 0:
+		db = newCachedDB(db, newMemcache(c.Memcache...), time.Minute, 10*time.Second)
+	}
 
+	var bucket *storage.BucketHandle
+	if c.StorageBucket != "" {
+		if bucket, err = configureStorage(c.StorageBucket); err != nil {
+			return fmt.Errorf("bookshelf: could not configure Cloud Storage: %v", err)
+		}
+	}
+
+	providers, err := configureOIDCProviders(c.providers(), c.OAuthRedirectURL)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	// [START auth]
-	// To enable user sign-in, uncomment the following lines and update the
-	// Client ID and Client Secret.
-	// You will also need to update OAUTH2_CALLBACK in app.yaml when pushing to
-	// production.
-	//
-	// OAuthConfig = configureOAuthClient("clientid", "clientsecret")
-	// [END auth]
-
-	// [START sessions]
-	// Configure storage method for session-wide information.
-	// Update "something-very-secret" with a hard to guess string or byte sequence.
-	cookieStore := sessions.NewCookieStore([]byte("something-very-secret"))
+		return err
+	}
+
+	secret := []byte(c.SessionSecret)
+	if len(secret) == 0 {
+		log.Print("bookshelf: no session secret configured; using a random one")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+	}
+	cookieStore := sessions.NewCookieStore(secret)
+	// The path is set so that every page shares one session: otherwise a
+	// page under /books would get a session of its own, with its own CSRF
+	// token, which sign-in and sign-out would not reach.
 	cookieStore.Options = &sessions.Options{
+		Path:     "/",
 		HttpOnly: true,
 	}
-	SessionStore = cookieStore
-	// [END sessions]
+	// Cookies older than this are also rejected, whatever the browser keeps.
+	cookieStore.MaxAge(int(time.Duration(c.SessionMaxAge) / time.Second))
 
-	// [START pubsub]
-	// To configure Pub/Sub, uncomment the following lines and update the project ID.
-	//
-	// PubsubClient, err = configurePubsub("<your-project-id>")
-	// [END pubsub]
+	var pubsubClient *pubsub.Client
+	if c.PubsubProjectID != "" {
+		if pubsubClient, err = configurePubsub(c.PubsubProjectID); err != nil {
+			return fmt.Errorf("bookshelf: could not configure Pub/Sub: %v", err)
+		}
+	}
 
-	if err != nil {
-		log.Fatal(err)
+	DB = db
+	StorageBucket, StorageBucketName = bucket, c.StorageBucket
+	OIDCProviders = providers
+	SessionStore = cookieStore
+	PubsubClient = pubsubClient
+	Metrics = metrics
+	TenantDomain = strings.ToLower(c.TenantDomain)
+	Tenants = nil
+	for _, t := range c.Tenants {
+		tenant, _ := NormalizeTenant(t)
+		Tenants = append(Tenants, tenant)
 	}
+	TrashRetention = time.Duration(c.TrashRetention)
+	Admins = c.Admins
+	return nil
 }
 
 func configureDatastoreDB(projectID string) (BookDatabase, error) {
@@ -139,12 +551,6 @@ func configureStorage(bucketID string) (*storage.BucketHandle, error) {
 }
 
 func configurePubsub(projectID string) (*pubsub.Client, error) {
-	if _, ok := DB.(*memoryDB); ok {
-		return nil, errors.New("Pub/Sub worker doesn't work with the in-memory DB " +
-			"(worker does not share its memory as the main app). Configure another " +
-			"database in bookshelf/config.go first (e.g. MySQL, Cloud Datastore, etc)")
-	}
-
 	ctx := context.Background()
 	client, err := pubsub.NewClient(ctx, projectID)
 	if err != nil {
@@ -162,16 +568,22 @@ func configurePubsub(projectID string) (*pubsub.Client, error) {
 	return client, nil
 }
 
-func configureOAuthClient(clientID, clientSecret string) *oauth2.Config {
-	redirectURL := os.Getenv("OAUTH2_CALLBACK")
+func configureOIDCProviders(ps []OIDCProvider, redirectURL string) ([]*oidc.Provider, error) {
 	if redirectURL == "" {
 		redirectURL = "http://localhost:8080/oauth2callback"
 	}
-	return &oauth2.Config{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		RedirectURL:  redirectURL,
-		Scopes:       []string{"email", "profile"},
-		Endpoint:     google.Endpoint,
+	ctx := context.Background()
+	var providers []*oidc.Provider
+	for _, p := range ps {
+		provider, err := oidc.Discover(ctx, p.Name, p.Issuer, oauth2.Config{
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			RedirectURL:  redirectURL,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("bookshelf: could not configure sign-in with %s: %v", p.Name, err)
+		}
+		providers = append(providers, provider)
 	}
+	return providers, nil
 }
@@ -0,0 +1,85 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf/bookshelftest"
+	"github.com/GoogleCloudPlatform/golang-samples/internal/testutil"
+)
+
+// testConformance runs the bookshelftest suite on the database described by
+// a data source name; see bookshelf.OpenDB.
+func testConformance(t *testing.T, dsn string) {
+	bookshelftest.TestBookDatabase(t, func() (bookshelf.BookDatabase, error) {
+		return bookshelf.OpenDB(dsn)
+	})
+}
+
+// tempPath returns the path of a file in a new temporary directory, and a
+// function that removes the directory.
+func tempPath(t *testing.T, name string) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "bookshelf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, name), func() { os.RemoveAll(dir) }
+}
+
+func TestMemoryDBConformance(t *testing.T) {
+	testConformance(t, "memory:")
+}
+
+func TestFileDBConformance(t *testing.T) {
+	path, cleanup := tempPath(t, "books.json")
+	defer cleanup()
+	testConformance(t, "file:"+path)
+}
+
+func TestSQLiteDBConformance(t *testing.T) {
+	path, cleanup := tempPath(t, "books.db")
+	defer cleanup()
+	testConformance(t, "sqlite:"+path)
+}
+
+func TestMySQLDBConformance(t *testing.T) {
+	host := os.Getenv("GOLANG_SAMPLES_MYSQL_HOST")
+	if host == "" {
+		t.Skip("GOLANG_SAMPLES_MYSQL_HOST not set.")
+	}
+	if port := os.Getenv("GOLANG_SAMPLES_MYSQL_PORT"); port != "" {
+		host += ":" + port
+	}
+	testConformance(t, "mysql://root@"+host)
+}
+
+func TestPostgresDBConformance(t *testing.T) {
+	host := os.Getenv("GOLANG_SAMPLES_POSTGRES_HOST")
+	if host == "" {
+		t.Skip("GOLANG_SAMPLES_POSTGRES_HOST not set.")
+	}
+	if port := os.Getenv("GOLANG_SAMPLES_POSTGRES_PORT"); port != "" {
+		host += ":" + port
+	}
+	testConformance(t, "postgres://postgres@"+host+"?sslmode=disable")
+}
+
+func TestMongoDBConformance(t *testing.T) {
+	host := os.Getenv("GOLANG_SAMPLES_MONGO_HOST")
+	if host == "" {
+		t.Skip("GOLANG_SAMPLES_MONGO_HOST not set.")
+	}
+	testConformance(t, "mongodb://"+host)
+}
+
+func TestDatastoreDBConformance(t *testing.T) {
+	tc := testutil.SystemTest(t)
+	testConformance(t, "datastore://"+tc.ProjectID)
+}
@@ -0,0 +1,262 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// copyPageSize is the number of books CopyBooks reads at a time.
+const copyPageSize = 100
+
+// CopyCheckpoint records the progress of CopyBooks, so that an interrupted
+// copy can be resumed. The zero value starts a copy from the beginning.
+type CopyCheckpoint struct {
+	// Tenant is the tenant whose books are copied.
+	Tenant string `json:",omitempty"`
+
+	// Cursor is the position in the source listing after the last book
+	// copied.
+	Cursor string
+
+	// Copied is the number of books copied so far.
+	Copied int
+
+	// IDs maps the IDs of source books that could not keep their ID in the
+	// destination to the ID they were given there.
+	IDs map[int64]int64 `json:",omitempty"`
+
+	// Pending is the ID of the source book being added to the destination
+	// under a new ID, or zero. The destination may hold the book even though
+	// its new ID was never recorded, so a resumed copy looks for it there
+	// before adding it again.
+	Pending int64 `json:",omitempty"`
+}
+
+// CopyBooks copies every book of the tenant carried by ctx (see WithTenant)
+// from src to dst, starting after the position recorded in cp. Each tenant is
+// copied separately, with a checkpoint of its own. After each book is copied,
+// cp is updated and passed to save, which should persist it so that a failed
+// copy can be resumed.
+//
+// If dst implements BookImporter, books keep their IDs and versions.
+// Otherwise, or if dst rejects a book's ID, the book is added under a new ID
+// which is recorded in cp.IDs. cp is saved before such a book is added, so
+// that a resumed copy can find the book rather than add it twice.
+//
+// Books added to or changed in src while the copy runs may not be copied.
+// Books in the trash are not copied.
+func CopyBooks(ctx context.Context, dst, src BookDatabase, cp *CopyCheckpoint,
+	save func(*CopyCheckpoint) error) error {
+	tenant := TenantFromContext(ctx)
+	if cp.Copied > 0 && cp.Tenant != tenant {
+		return fmt.Errorf("bookshelf: checkpoint is of a copy of tenant %q, not %q", cp.Tenant, tenant)
+	}
+	cp.Tenant = tenant
+
+	c := &bookCopier{dst: dst, cp: cp, save: save}
+	c.importer, _ = dst.(BookImporter)
+	for {
+		page, err := src.ListBooksPage(ctx, ListOptions{}, cp.Cursor, copyPageSize)
+		if err != nil {
+			return fmt.Errorf("bookshelf: could not read books to copy: %v", err)
+		}
+		for _, b := range page.Books {
+			next := newCursor(&ListOptions{}, b, false).String()
+			if err := c.store(ctx, b); err != nil {
+				return err
+			}
+			cp.Cursor = next
+			cp.Copied++
+			if err := save(cp); err != nil {
+				return fmt.Errorf("bookshelf: could not save copy checkpoint: %v", err)
+			}
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+	}
+}
+
+// bookCopier stores the books copied by CopyBooks in their destination.
+type bookCopier struct {
+	dst      BookDatabase
+	importer BookImporter // dst, if it is a BookImporter.
+	cp       *CopyCheckpoint
+	save     func(*CopyCheckpoint) error
+}
+
+// store stores b in the destination, importing it under its own ID if
+// possible.
+func (c *bookCopier) store(ctx context.Context, b *Book) error {
+	cp := c.cp
+	if c.importer != nil {
+		err := c.importer.ImportBook(ctx, b)
+		if err == nil {
+			return nil
+		}
+		if ErrorKind(err) != ErrInvalidArgument {
+			return fmt.Errorf("bookshelf: could not copy book with ID %d: %v", b.ID, err)
+		}
+	}
+
+	if cp.Pending == b.ID {
+		id, err := c.find(ctx, b)
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			cp.setID(b.ID, id)
+			return nil
+		}
+	}
+	cp.Pending = b.ID
+	if err := c.save(cp); err != nil {
+		return fmt.Errorf("bookshelf: could not save copy checkpoint: %v", err)
+	}
+	id, err := c.dst.AddBook(ctx, copyBook(b))
+	if err != nil {
+		return fmt.Errorf("bookshelf: could not copy book with ID %d: %v", b.ID, err)
+	}
+	cp.setID(b.ID, id)
+	return nil
+}
+
+// setID records that the source book with ID src was added to the
+// destination under ID dst.
+func (cp *CopyCheckpoint) setID(src, dst int64) {
+	if cp.IDs == nil {
+		cp.IDs = make(map[int64]int64)
+	}
+	cp.IDs[src] = dst
+	cp.Pending = 0
+}
+
+// find returns the ID of a copy of b in the destination that was added by an
+// interrupted copy, or zero if there is none. Books are found by ISBN if they
+// have one, and otherwise by their contents, among the books of the same
+// author not already known to be copies of other books.
+func (c *bookCopier) find(ctx context.Context, b *Book) (int64, error) {
+	if b.ISBN != "" {
+		found, err := c.dst.GetBookByISBN(ctx, b.ISBN)
+		if ErrorKind(err) == ErrNotFound {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("bookshelf: could not look for copy of book with ID %d: %v", b.ID, err)
+		}
+		return found.ID, nil
+	}
+
+	copied := make(map[int64]bool)
+	for _, id := range c.cp.IDs {
+		copied[id] = true
+	}
+	want := bookDigest(0, b)
+	opts := ListOptions{Author: b.Author}
+	cursor := ""
+	for {
+		page, err := c.dst.ListBooksPage(ctx, opts, cursor, copyPageSize)
+		if err != nil {
+			return 0, fmt.Errorf("bookshelf: could not look for copy of book with ID %d: %v", b.ID, err)
+		}
+		for _, other := range page.Books {
+			if !copied[other.ID] && bookDigest(0, other) == want {
+				return other.ID, nil
+			}
+		}
+		if page.NextCursor == "" {
+			return 0, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// CopyReport summarizes the contents of the source and destination of a copy.
+// See VerifyCopy.
+type CopyReport struct {
+	SourceCount, DestCount       int
+	SourceChecksum, DestChecksum string
+}
+
+// Match reports whether the source and destination hold the same books.
+func (r *CopyReport) Match() bool {
+	return r.SourceCount == r.DestCount && r.SourceChecksum == r.DestChecksum
+}
+
+// VerifyCopy compares the books of the tenant carried by ctx in src and dst
+// after a copy, by counting them and checksumming their contents. The IDs of
+// source books are mapped through cp.IDs before being compared. Versions are
+// not compared, since they are reset for books that could not keep their ID.
+//
+// The destination matches only if it held no other books before the copy.
+func VerifyCopy(ctx context.Context, dst, src BookDatabase,
+	cp *CopyCheckpoint) (*CopyReport, error) {
+	r := &CopyReport{}
+	var err error
+	r.SourceCount, r.SourceChecksum, err = checksumBooks(ctx, src, cp.IDs)
+	if err != nil {
+		return nil, err
+	}
+	r.DestCount, r.DestChecksum, err = checksumBooks(ctx, dst, nil)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// checksumBooks counts the books in db and computes a checksum of their
+// contents that does not depend on the order they are listed in.
+func checksumBooks(ctx context.Context, db BookDatabase,
+	ids map[int64]int64) (n int, checksum string, err error) {
+	var digests []string
+	cursor := ""
+	for {
+		page, err := db.ListBooksPage(ctx, ListOptions{}, cursor, copyPageSize)
+		if err != nil {
+			return 0, "", fmt.Errorf("bookshelf: could not read books to verify: %v", err)
+		}
+		for _, b := range page.Books {
+			id := b.ID
+			if mapped, ok := ids[id]; ok {
+				id = mapped
+			}
+			digests = append(digests, bookDigest(id, b))
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	sort.Strings(digests)
+	h := sha256.New()
+	for _, d := range digests {
+		io.WriteString(h, d)
+	}
+	return len(digests), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// bookDigest returns a hash of a book's ID and contents.
+func bookDigest(id int64, b *Book) string {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, id)
+	for _, f := range []string{b.Title, b.Author, b.PublishedDate, b.ImageURL,
+		b.Description, b.CreatedBy, b.CreatedByID, b.ISBN, strings.Join(b.Tags, ",")} {
+		// Length-prefix each field so that moving text between fields changes
+		// the digest.
+		binary.Write(h, binary.BigEndian, int64(len(f)))
+		io.WriteString(h, f)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,171 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// plainDB hides the BookImporter implementation of a BookDatabase.
+type plainDB struct {
+	BookDatabase
+}
+
+func addTestBooks(t *testing.T, db BookDatabase, n int) {
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		b := &Book{Title: fmt.Sprintf("book %03d", i), Author: "author"}
+		if _, err := db.AddBook(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCopyBooks(t *testing.T) {
+	ctx := context.Background()
+	src := newMemoryDB()
+	addTestBooks(t, src, copyPageSize+5)
+
+	for _, tt := range []struct {
+		name string
+		dst  BookDatabase
+	}{
+		{"importer", newMemoryDB()},
+		{"no importer", plainDB{newMemoryDB()}},
+	} {
+		// Books added to a fresh memoryDB get the same IDs as in src, so
+		// shift them to check that remapped IDs are verified.
+		if _, err := tt.dst.AddBook(ctx, &Book{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tt.dst.DeleteBook(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		cp := &CopyCheckpoint{}
+		if err := CopyBooks(ctx, tt.dst, src, cp, func(*CopyCheckpoint) error { return nil }); err != nil {
+			t.Fatalf("%s: CopyBooks: %v", tt.name, err)
+		}
+		if cp.Copied != copyPageSize+5 {
+			t.Errorf("%s: copied %d books, want %d", tt.name, cp.Copied, copyPageSize+5)
+		}
+		if _, isImporter := tt.dst.(BookImporter); !isImporter && len(cp.IDs) != cp.Copied {
+			t.Errorf("%s: %d books given new IDs, want %d", tt.name, len(cp.IDs), cp.Copied)
+		}
+
+		r, err := VerifyCopy(ctx, tt.dst, src, cp)
+		if err != nil {
+			t.Fatalf("%s: VerifyCopy: %v", tt.name, err)
+		}
+		if !r.Match() {
+			t.Errorf("%s: VerifyCopy: got %+v, want match", tt.name, r)
+		}
+
+		// Changing a copied book is detected.
+		id := int64(2)
+		if mapped, ok := cp.IDs[id]; ok {
+			id = mapped
+		}
+		b, err := tt.dst.GetBook(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Title = "changed"
+		if err := tt.dst.UpdateBook(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		if r, err := VerifyCopy(ctx, tt.dst, src, cp); err != nil || r.Match() {
+			t.Errorf("%s: VerifyCopy after change: got %+v, %v; want mismatch", tt.name, r, err)
+		}
+	}
+}
+
+func TestCopyBooksResume(t *testing.T) {
+	ctx := context.Background()
+	src := newMemoryDB()
+	addTestBooks(t, src, 10)
+
+	for _, tt := range []struct {
+		name string
+		dst  BookDatabase
+	}{
+		{"importer", newMemoryDB()},
+		// The copy stops after the fifth book is added, before its new ID
+		// is recorded, and must not add it again.
+		{"no importer", plainDB{newMemoryDB()}},
+	} {
+		// Checkpoints are saved as JSON, as the copy command does.
+		errStop := errors.New("stop")
+		var saved CopyCheckpoint
+		save := func(cp *CopyCheckpoint) error {
+			if cp.Copied == 4 {
+				return errStop
+			}
+			b, err := json.Marshal(cp)
+			if err != nil {
+				return err
+			}
+			saved = CopyCheckpoint{}
+			return json.Unmarshal(b, &saved)
+		}
+		if err := CopyBooks(ctx, tt.dst, src, &CopyCheckpoint{}, save); err == nil {
+			t.Fatalf("%s: CopyBooks: want non-nil err", tt.name)
+		}
+		if saved.Copied != 3 {
+			t.Fatalf("%s: saved checkpoint after %d books, want 3", tt.name, saved.Copied)
+		}
+
+		cp := saved
+		if err := CopyBooks(ctx, tt.dst, src, &cp, func(*CopyCheckpoint) error { return nil }); err != nil {
+			t.Fatalf("%s: CopyBooks: %v", tt.name, err)
+		}
+		if cp.Copied != 10 || cp.Pending != 0 {
+			t.Errorf("%s: copied %d books with %d pending, want 10 with none", tt.name, cp.Copied, cp.Pending)
+		}
+		r, err := VerifyCopy(ctx, tt.dst, src, &cp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.Match() {
+			t.Errorf("%s: VerifyCopy: got %+v, want match", tt.name, r)
+		}
+	}
+}
+
+func TestCopyBooksTenant(t *testing.T) {
+	ctx := context.Background()
+	acme := WithTenant(ctx, "acme")
+	src, dst := newTenantMemoryDB(), newTenantMemoryDB()
+	for _, c := range []context.Context{ctx, acme, acme} {
+		if _, err := src.AddBook(c, &Book{Title: TenantFromContext(c) + " book"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cp := &CopyCheckpoint{}
+	if err := CopyBooks(acme, dst, src, cp, func(*CopyCheckpoint) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if cp.Copied != 2 || cp.Tenant != "acme" {
+		t.Errorf("copied %d books of tenant %q, want 2 of acme", cp.Copied, cp.Tenant)
+	}
+	if r, err := VerifyCopy(acme, dst, src, cp); err != nil || !r.Match() {
+		t.Errorf("VerifyCopy of acme: got %+v, %v; want match", r, err)
+	}
+
+	// The other tenants are left alone, and verifying them shows it.
+	if r, err := VerifyCopy(ctx, dst, src, &CopyCheckpoint{}); err != nil || r.Match() || r.DestCount != 0 {
+		t.Errorf("VerifyCopy of the default tenant: got %+v, %v; want mismatch", r, err)
+	}
+	// A checkpoint cannot resume the copy of another tenant.
+	if err := CopyBooks(ctx, dst, src, cp, func(*CopyCheckpoint) error { return nil }); err == nil {
+		t.Error("CopyBooks of the default tenant with acme's checkpoint: want non-nil err")
+	}
+}
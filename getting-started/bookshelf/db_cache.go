@@ -0,0 +1,255 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Ensure cachedDB conforms to the BookDatabase and BookImporter interfaces.
+var (
+	_ BookDatabase = &cachedDB{}
+	_ BookImporter = &cachedDB{}
+)
+
+// BookCache stores values for a cachedDB. Implementations must be safe for
+// concurrent use, and may drop values before they expire.
+type BookCache interface {
+	// Get returns the value stored under key. ok is false if there is no
+	// such value, or it has expired.
+	Get(key string) (value []byte, ok bool, err error)
+
+	// Set stores a value under key for the given duration.
+	Set(key string, value []byte, ttl time.Duration) error
+
+	// Delete removes the value stored under key, if any.
+	Delete(key string) error
+}
+
+// CacheStats counts how often GetBook calls were answered from a cache.
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+	Errors int64 // Failed cache calls. These also count as misses.
+}
+
+// cachedDB is a BookDatabase that keeps the books retrieved with GetBook in a
+// cache, so that reading a book again does not go to the underlying
+// database. Books that do not exist are cached too, for a shorter time.
+//
+// Updates, deletes, restores and imports through the cachedDB invalidate the
+// cached book. Changes made to the underlying database by other means, such as by
+// the Pub/Sub worker with a cache of its own, are seen once the cached value
+// expires.
+//
+// The other methods go straight to the underlying database.
+type cachedDB struct {
+	BookDatabase
+
+	cache       BookCache
+	ttl         time.Duration
+	negativeTTL time.Duration // If zero, missing books are not cached.
+
+	hits, misses, errors int64 // Accessed atomically.
+}
+
+// cacheEntry is the cached form of a GetBook result. A nil Book records that
+// the book does not exist.
+type cacheEntry struct {
+	Book *Book
+}
+
+// newCachedDB returns a BookDatabase that caches the books read from db in
+// cache for ttl, and the absence of books for negativeTTL.
+func newCachedDB(db BookDatabase, cache BookCache, ttl, negativeTTL time.Duration) *cachedDB {
+	return &cachedDB{
+		BookDatabase: db,
+		cache:        cache,
+		ttl:          ttl,
+		negativeTTL:  negativeTTL,
+	}
+}
+
+// Stats returns the cache hits and misses of db so far.
+func (db *cachedDB) Stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&db.hits),
+		Misses: atomic.LoadInt64(&db.misses),
+		Errors: atomic.LoadInt64(&db.errors),
+	}
+}
+
+// CacheStatsOf returns the cache hits and misses so far of db, and whether
+// it caches books at all. The DB configured with Config.CacheSize or
+// Config.Memcache does.
+func CacheStatsOf(db BookDatabase) (stats CacheStats, ok bool) {
+	c, ok := db.(*cachedDB)
+	if !ok {
+		return CacheStats{}, false
+	}
+	return c.Stats(), true
+}
+
+// bookCacheKey returns the cache key of the book with the given ID, in the
+// tenant carried by ctx. Tenants may number their books independently, so
+// the key of a book outside DefaultTenant names its tenant.
+func bookCacheKey(ctx context.Context, id int64) string {
+	prefix := "bookshelf:"
+	if tenant := TenantFromContext(ctx); tenant != DefaultTenant {
+		prefix += tenant + ":"
+	}
+	return prefix + "book:" + strconv.FormatInt(id, 10)
+}
+
+// GetBook retrieves a book by its ID, from the cache if it is there.
+func (db *cachedDB) GetBook(ctx context.Context, id int64) (*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	key := bookCacheKey(ctx, id)
+	if b, ok := db.lookup(key); ok {
+		atomic.AddInt64(&db.hits, 1)
+		if b == nil {
+			return nil, errorf(ErrNotFound, "cache: book not found with ID %d", id)
+		}
+		return b, nil
+	}
+	atomic.AddInt64(&db.misses, 1)
+
+	b, err := db.BookDatabase.GetBook(ctx, id)
+	switch {
+	case err == nil:
+		db.store(key, cacheEntry{Book: b}, db.ttl)
+	case ErrorKind(err) == ErrNotFound && db.negativeTTL > 0:
+		db.store(key, cacheEntry{}, db.negativeTTL)
+	}
+	return b, err
+}
+
+// lookup returns the cached book stored under key, which is nil if the book
+// is known not to exist. ok is false if nothing usable is cached.
+func (db *cachedDB) lookup(key string) (b *Book, ok bool) {
+	value, ok, err := db.cache.Get(key)
+	if err != nil {
+		atomic.AddInt64(&db.errors, 1)
+		log.Printf("cache: could not get %s: %v", key, err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(value, &e); err != nil {
+		atomic.AddInt64(&db.errors, 1)
+		log.Printf("cache: could not decode %s: %v", key, err)
+		return nil, false
+	}
+	return e.Book, true
+}
+
+// store caches e under key. A cache failure only costs a later miss, so it
+// is logged rather than returned.
+func (db *cachedDB) store(key string, e cacheEntry, ttl time.Duration) {
+	value, err := json.Marshal(e)
+	if err == nil {
+		err = db.cache.Set(key, value, ttl)
+	}
+	if err != nil {
+		atomic.AddInt64(&db.errors, 1)
+		log.Printf("cache: could not set %s: %v", key, err)
+	}
+}
+
+// invalidate removes the cached book with the given ID, in the tenant
+// carried by ctx.
+func (db *cachedDB) invalidate(ctx context.Context, id int64) {
+	key := bookCacheKey(ctx, id)
+	if err := db.cache.Delete(key); err != nil {
+		atomic.AddInt64(&db.errors, 1)
+		log.Printf("cache: could not delete %s, it may be stale until it expires: %v", key, err)
+	}
+}
+
+// AddBook saves a given book, assigning it a new ID.
+func (db *cachedDB) AddBook(ctx context.Context, b *Book) (int64, error) {
+	id, err := db.BookDatabase.AddBook(ctx, b)
+	if err == nil {
+		// The ID may have been looked up, and cached as missing, before the
+		// book existed.
+		db.invalidate(ctx, id)
+	}
+	return id, err
+}
+
+// UpdateBook updates the entry for a given book.
+func (db *cachedDB) UpdateBook(ctx context.Context, b *Book) error {
+	err := db.BookDatabase.UpdateBook(ctx, b)
+	// A conflict shows the cached book may be out of date, so drop it even
+	// if the update failed.
+	db.invalidate(ctx, b.ID)
+	return err
+}
+
+// DeleteBook removes a given book by its ID.
+func (db *cachedDB) DeleteBook(ctx context.Context, id int64) error {
+	err := db.BookDatabase.DeleteBook(ctx, id)
+	db.invalidate(ctx, id)
+	return err
+}
+
+// RestoreBook takes a given book out of the trash by its ID.
+func (db *cachedDB) RestoreBook(ctx context.Context, id int64) error {
+	err := db.BookDatabase.RestoreBook(ctx, id)
+	// The book may be cached as missing while it was in the trash.
+	db.invalidate(ctx, id)
+	return err
+}
+
+// AddBooks saves the given books, assigning them new IDs.
+func (db *cachedDB) AddBooks(ctx context.Context, bs []*Book) ([]int64, error) {
+	ids, err := db.BookDatabase.AddBooks(ctx, bs)
+	for _, id := range ids {
+		if id != 0 {
+			db.invalidate(ctx, id)
+		}
+	}
+	return ids, err
+}
+
+// UpdateBooks updates the entries for the given books.
+func (db *cachedDB) UpdateBooks(ctx context.Context, bs []*Book) error {
+	err := db.BookDatabase.UpdateBooks(ctx, bs)
+	for _, b := range bs {
+		db.invalidate(ctx, b.ID)
+	}
+	return err
+}
+
+// DeleteBooks moves the books with the given IDs to the trash.
+func (db *cachedDB) DeleteBooks(ctx context.Context, ids []int64) error {
+	err := db.BookDatabase.DeleteBooks(ctx, ids)
+	for _, id := range ids {
+		db.invalidate(ctx, id)
+	}
+	return err
+}
+
+// ImportBook saves a book under its existing ID and Version, if the
+// underlying database supports it.
+func (db *cachedDB) ImportBook(ctx context.Context, b *Book) error {
+	importer, ok := db.BookDatabase.(BookImporter)
+	if !ok {
+		return errorf(ErrInvalidArgument, "cache: the underlying database cannot import books")
+	}
+	err := importer.ImportBook(ctx, b)
+	db.invalidate(ctx, b.ID)
+	return err
+}
@@ -0,0 +1,167 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestCachedDB(t *testing.T) {
+	testDB(t, newCachedDB(newTenantMemoryDB(), newLRUCache(100), time.Minute, time.Minute))
+}
+
+func TestCachedDBMemcache(t *testing.T) {
+	addr := os.Getenv("GOLANG_SAMPLES_MEMCACHE_ADDR")
+	if addr == "" {
+		t.Skip("GOLANG_SAMPLES_MEMCACHE_ADDR not set")
+	}
+	testDB(t, newCachedDB(newTenantMemoryDB(), newMemcache(addr), time.Minute, time.Minute))
+}
+
+func TestCachedDBStats(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemoryDB()
+	db := newCachedDB(mem, newLRUCache(100), time.Minute, time.Minute)
+
+	id, err := db.AddBook(ctx, &Book{Title: "cached"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.GetBook(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := db.Stats(), (CacheStats{Hits: 2, Misses: 1}); got != want {
+		t.Errorf("Stats after three reads: got %+v, want %+v", got, want)
+	}
+	if got, ok := CacheStatsOf(db); !ok || got != db.Stats() {
+		t.Errorf("CacheStatsOf: got %+v, %v; want %+v", got, ok, db.Stats())
+	}
+	if _, ok := CacheStatsOf(mem); ok {
+		t.Error("CacheStatsOf of uncached DB: got ok, want not ok")
+	}
+
+	// A change made behind the cache's back is not seen...
+	b, _ := mem.GetBook(ctx, id)
+	b.Title = "changed"
+	if err := mem.UpdateBook(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.GetBook(ctx, id); got.Title != "cached" {
+		t.Errorf("GetBook after uncached update: got title %q, want %q", got.Title, "cached")
+	}
+
+	// ...but one made through it is.
+	b.Title = "updated"
+	if err := db.UpdateBook(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.GetBook(ctx, id); got.Title != "updated" {
+		t.Errorf("GetBook after update: got title %q, want %q", got.Title, "updated")
+	}
+
+	if err := db.DeleteBook(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetBook(ctx, id); ErrorKind(err) != ErrNotFound {
+		t.Errorf("GetBook after delete: got err %v, want kind ErrNotFound", err)
+	}
+}
+
+func TestCachedDBNegative(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemoryDB()
+	cache := newLRUCache(100)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	db := newCachedDB(mem, cache, time.Minute, 10*time.Second)
+
+	const id = 1
+	for i := 0; i < 2; i++ {
+		if _, err := db.GetBook(ctx, id); ErrorKind(err) != ErrNotFound {
+			t.Fatalf("GetBook of missing book: got err %v, want kind ErrNotFound", err)
+		}
+	}
+	if got, want := db.Stats(), (CacheStats{Hits: 1, Misses: 1}); got != want {
+		t.Errorf("Stats after two reads of a missing book: got %+v, want %+v", got, want)
+	}
+
+	// Adding the book through the cache drops the negative entry.
+	if _, err := db.AddBook(ctx, &Book{Title: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetBook(ctx, id); err != nil {
+		t.Errorf("GetBook after add: %v", err)
+	}
+
+	// A book added behind the cache's back is found once the negative entry
+	// expires.
+	if _, err := db.GetBook(ctx, id+1); ErrorKind(err) != ErrNotFound {
+		t.Fatalf("GetBook of missing book: got err %v, want kind ErrNotFound", err)
+	}
+	if _, err := mem.AddBook(ctx, &Book{Title: "uncached"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetBook(ctx, id+1); ErrorKind(err) != ErrNotFound {
+		t.Errorf("GetBook before negative entry expires: got err %v, want kind ErrNotFound", err)
+	}
+	now = now.Add(11 * time.Second)
+	if _, err := db.GetBook(ctx, id+1); err != nil {
+		t.Errorf("GetBook after negative entry expires: %v", err)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.Set("a", []byte("1"), time.Minute)
+	c.Set("b", []byte("2"), time.Second)
+	c.Get("a") // a is now more recently used than b.
+	c.Set("c", []byte("3"), time.Minute)
+
+	if _, ok, _ := c.Get("b"); ok {
+		t.Error("Get of least recently used key: got ok, want evicted")
+	}
+	if v, ok, _ := c.Get("a"); !ok || string(v) != "1" {
+		t.Errorf("Get(a) = %q, %v; want %q, true", v, ok, "1")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok, _ := c.Get("c"); ok {
+		t.Error("Get of expired key: got ok, want expired")
+	}
+
+	c.Set("a", []byte("4"), time.Minute)
+	c.Delete("a")
+	if _, ok, _ := c.Get("a"); ok {
+		t.Error("Get of deleted key: got ok, want deleted")
+	}
+}
+
+func TestMemcacheExpiration(t *testing.T) {
+	for _, tt := range []struct {
+		ttl  time.Duration
+		want int32
+	}{
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Hour, 3600},
+	} {
+		if got := memcacheExpiration(tt.ttl); got != tt.want {
+			t.Errorf("memcacheExpiration(%v) = %d, want %d", tt.ttl, got, tt.want)
+		}
+	}
+	if got := memcacheExpiration(60 * 24 * time.Hour); int64(got) < time.Now().Unix() {
+		t.Errorf("memcacheExpiration(60 days) = %d, want a Unix time", got)
+	}
+}
@@ -5,7 +5,10 @@
 package bookshelf
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"cloud.google.com/go/datastore"
 
@@ -14,16 +17,24 @@ import (
 
 // datastoreDB persists books to Cloud Datastore.
 // https://cloud.google.com/datastore/docs/concepts/overview
+//
+// The books of each tenant are kept in the Datastore namespace named after
+// it; those of DefaultTenant in the default namespace.
+// https://cloud.google.com/datastore/docs/concepts/multitenancy
 type datastoreDB struct {
 	client *datastore.Client
 }
 
-// Ensure datastoreDB conforms to the BookDatabase interface.
-var _ BookDatabase = &datastoreDB{}
+// Ensure datastoreDB conforms to the BookDatabase and BookImporter interfaces.
+var (
+	_ BookDatabase = &datastoreDB{}
+	_ BookImporter = &datastoreDB{}
+)
 
 // newDatastoreDB creates a new BookDatabase backed by Cloud Datastore.
 // See the datastore and google packages for details on creating a suitable Client:
 // https://godoc.org/cloud.google.com/go/datastore
+// The database owns the client from then on, and closes it in Close.
 func newDatastoreDB(client *datastore.Client) (BookDatabase, error) {
 	ctx := context.Background()
 	// Verify that we can communicate and authenticate with the datastore service.
@@ -39,101 +50,1058 @@ func newDatastoreDB(client *datastore.Client) (BookDatabase, error) {
 	}, nil
 }
 
-// Close closes the database.
+// Close closes the database's client, after which calls fail.
 func (db *datastoreDB) Close() {
-	// No op.
+	db.client.Close()
 }
 
-func (db *datastoreDB) datastoreKey(id int64) *datastore.Key {
-	ctx := context.Background()
+// searchTermsProperty is the name of the list property that holds a book's
+// search terms.
+const searchTermsProperty = "SearchTerms"
+
+// activeTagsProperty is the name of the list property that holds the tags of
+// a book outside the trash. Unlike the Tags property, it is absent from books
+// in the trash, so that ListBooksByTag and ListTags need not filter them out.
+const activeTagsProperty = "ActiveTags"
+
+// bookEntity is the Datastore representation of a Book. Alongside the book's
+// own fields, it stores the book's search terms, which back SearchBooks, and
+// its active tags.
+type bookEntity struct {
+	Book
+}
+
+// Load loads the book's fields, ignoring its search terms and active tags.
+func (e *bookEntity) Load(ps []datastore.Property) error {
+	var bookProps []datastore.Property
+	for _, p := range ps {
+		if p.Name != searchTermsProperty && p.Name != activeTagsProperty {
+			bookProps = append(bookProps, p)
+		}
+	}
+	return datastore.LoadStruct(&e.Book, bookProps)
+}
+
+// Save saves the book's fields, its search terms and its active tags. Books
+// in the trash have neither, so that SearchBooks and ListBooksByTag do not
+// find them.
+func (e *bookEntity) Save() ([]datastore.Property, error) {
+	ps, err := datastore.SaveStruct(&e.Book)
+	if err != nil {
+		return nil, err
+	}
+	if !e.DeletedAt.IsZero() {
+		return ps, nil
+	}
+	var terms []interface{}
+	for t := range bookTerms(&e.Book) {
+		terms = append(terms, t)
+	}
+	ps = append(ps, datastore.Property{Name: searchTermsProperty, Value: terms})
+	if len(e.Tags) > 0 {
+		tags := make([]interface{}, len(e.Tags))
+		for i, t := range e.Tags {
+			tags[i] = t
+		}
+		ps = append(ps, datastore.Property{Name: activeTagsProperty, Value: tags})
+	}
+	return ps, nil
+}
+
+// tenantNamespace returns a copy of ctx whose keys and queries are in the
+// namespace of the tenant ctx carries. Every method calls it first.
+func tenantNamespace(ctx context.Context) context.Context {
+	return datastore.WithNamespace(ctx, TenantFromContext(ctx))
+}
+
+func (db *datastoreDB) datastoreKey(ctx context.Context, id int64) *datastore.Key {
 	return datastore.NewKey(ctx, "Book", "", id, nil)
 }
 
 // GetBook retrieves a book by its ID.
-func (db *datastoreDB) GetBook(id int64) (*Book, error) {
-	ctx := context.Background()
-	k := db.datastoreKey(id)
-	book := &Book{}
-	if err := db.client.Get(ctx, k, book); err != nil {
+func (db *datastoreDB) GetBook(ctx context.Context, id int64) (*Book, error) {
+	ctx = tenantNamespace(ctx)
+	k := db.datastoreKey(ctx, id)
+	e := &bookEntity{}
+	err := db.client.Get(ctx, k, e)
+	if err == datastore.ErrNoSuchEntity || (err == nil && !e.DeletedAt.IsZero()) {
+		return nil, errorf(ErrNotFound, "datastoredb: book not found with ID %d", id)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("datastoredb: could not get Book: %v", err)
 	}
-	book.ID = id
-	return book, nil
+	e.ID = id
+	return &e.Book, nil
 }
 
+// GetBookByISBN retrieves a book by its ISBN. It looks up the ISBN's claim,
+// which unlike a query on the ISBN property is strongly consistent.
+func (db *datastoreDB) GetBookByISBN(ctx context.Context, isbn string) (*Book, error) {
+	ctx = tenantNamespace(ctx)
+	isbn, err := NormalizeISBN(isbn)
+	if err != nil {
+		return nil, err
+	}
+	claim := &isbnClaim{}
+	err = db.client.Get(ctx, isbnKey(ctx, isbn), claim)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, errorf(ErrNotFound, "datastoredb: book not found with ISBN %s", isbn)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not get ISBN: %v", err)
+	}
+	b, err := db.GetBook(ctx, claim.BookID)
+	if ErrorKind(err) == ErrNotFound {
+		return nil, errorf(ErrNotFound, "datastoredb: book not found with ISBN %s", isbn)
+	}
+	return b, err
+}
+
+// isbnClaim is an entity recording which book has an ISBN. Its key's name is
+// the ISBN, so Datastore keeps ISBNs unique: the methods writing a book take
+// the claim on its ISBN in the same transaction, failing if another book
+// holds it, and release the claim on the ISBN the book had before.
+type isbnClaim struct {
+	BookID int64
+}
+
+// isbnKey returns the key of the claim on an ISBN.
+func isbnKey(ctx context.Context, isbn string) *datastore.Key {
+	return datastore.NewKey(ctx, "ISBN", isbn, 0, nil)
+}
+
+// claimISBNs takes, in tx, the claims on the ISBNs of the given books, whose
+// IDs must be assigned, and releases the claims on the ISBNs they replace.
+// old holds the books as stored, with nil entries for books that are not.
+// Books whose ISBN is claimed by another book are reported in errs, in which
+// case nothing is written; books that already have an error are skipped.
+func (db *datastoreDB) claimISBNs(ctx context.Context, tx *datastore.Transaction, bs, old []*Book, errs BatchError) error {
+	var (
+		keys  []*datastore.Key
+		books []int
+	)
+	for i, b := range bs {
+		if errs[i] == nil && b.ISBN != "" && (old[i] == nil || old[i].ISBN != b.ISBN) {
+			keys = append(keys, isbnKey(ctx, b.ISBN))
+			books = append(books, i)
+		}
+	}
+	claims := make([]*isbnClaim, len(keys))
+	for j := range claims {
+		claims[j] = &isbnClaim{}
+	}
+	getErrs := make([]error, len(keys))
+	if len(keys) > 0 {
+		err := tx.GetMulti(keys, claims)
+		if merr, ok := err.(datastore.MultiError); ok {
+			copy(getErrs, merr)
+		} else if err != nil {
+			return err
+		}
+	}
+	for j, i := range books {
+		switch {
+		case getErrs[j] == datastore.ErrNoSuchEntity:
+		case getErrs[j] != nil:
+			return getErrs[j]
+		case claims[j].BookID != bs[i].ID:
+			errs[i] = errorf(ErrAlreadyExists, "datastoredb: ISBN %s is taken by the book with ID %d",
+				bs[i].ISBN, claims[j].BookID)
+		}
+		claims[j].BookID = bs[i].ID
+	}
+	if errs.failed() {
+		return nil
+	}
+
+	var released []*datastore.Key
+	for i, b := range bs {
+		if old[i] != nil && old[i].ISBN != "" && old[i].ISBN != b.ISBN {
+			released = append(released, isbnKey(ctx, old[i].ISBN))
+		}
+	}
+	if len(released) > 0 {
+		if err := tx.DeleteMulti(released); err != nil {
+			return err
+		}
+	}
+	if len(keys) > 0 {
+		if _, err := tx.PutMulti(keys, claims); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimISBN is claimISBNs for a single book, whose stored version is old.
+func (db *datastoreDB) claimISBN(ctx context.Context, tx *datastore.Transaction, b, old *Book) error {
+	errs := make(BatchError, 1)
+	if err := db.claimISBNs(ctx, tx, []*Book{b}, []*Book{old}, errs); err != nil {
+		return err
+	}
+	return errs[0]
+}
+
+// maxAllocations is the number of IDs AddBook allocates for a book before
+// giving up on finding one that no imported book has taken.
+const maxAllocations = 5
+
 // AddBook saves a given book, assigning it a new ID.
-func (db *datastoreDB) AddBook(b *Book) (id int64, err error) {
-	ctx := context.Background()
-	k := datastore.NewIncompleteKey(ctx, "Book", nil)
-	k, err = db.client.Put(ctx, k, b)
+//
+// The ID is allocated first, so that the book, the claim on its ISBN and its
+// first revision are written in a single transaction. Datastore does not
+// know about the IDs of imported books, so an allocated ID that one of them
+// has taken is replaced by another.
+func (db *datastoreDB) AddBook(ctx context.Context, b *Book) (id int64, err error) {
+	ctx = tenantNamespace(ctx)
+	if err := normalizeBook("datastoredb", b); err != nil {
+		return 0, err
+	}
+
+	added := *b
+	added.Version = 1
+	added.CreatedAt = creationTime()
+	added.DeletedAt = time.Time{}
+	for i := 0; ; i++ {
+		keys, err := db.client.AllocateIDs(ctx, []*datastore.Key{datastore.NewIncompleteKey(ctx, "Book", nil)})
+		if err != nil {
+			return 0, fmt.Errorf("datastoredb: could not allocate an ID: %v", err)
+		}
+		k := keys[0]
+		added.ID = k.ID()
+		_, err = db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			taken, err := takenKeys(tx, keys)
+			if err != nil {
+				return err
+			}
+			if taken[0] {
+				return errIDTaken
+			}
+			if err := db.claimISBN(ctx, tx, &added, nil); err != nil {
+				return err
+			}
+			if _, err := tx.Put(k, &bookEntity{added}); err != nil {
+				return err
+			}
+			return db.addRevision(ctx, tx, k, RevisionAdd, &added)
+		})
+		if err == errIDTaken && i+1 < maxAllocations {
+			continue
+		}
+		if ErrorKind(err) == ErrAlreadyExists {
+			return 0, err
+		}
+		if err != nil {
+			return 0, fmt.Errorf("datastoredb: could not put Book: %v", err)
+		}
+		b.Version = 1
+		b.CreatedAt = added.CreatedAt
+		b.DeletedAt = time.Time{}
+		return k.ID(), nil
+	}
+}
+
+// errIDTaken reports that an ID allocated by Datastore is already used by
+// an imported book.
+var errIDTaken = errors.New("allocated ID is taken by an imported book")
+
+// takenKeys reports, for each of the given book keys, whether a book is
+// stored under it, in or out of the trash.
+func takenKeys(tx *datastore.Transaction, keys []*datastore.Key) ([]bool, error) {
+	taken := make([]bool, len(keys))
+	stored := make([]*bookEntity, len(keys))
+	for i := range stored {
+		stored[i] = &bookEntity{}
+	}
+	err := tx.GetMulti(keys, stored)
+	merr, isMulti := err.(datastore.MultiError)
+	if err != nil && !isMulti {
+		return nil, err
+	}
+	for i := range keys {
+		switch {
+		case merr == nil || merr[i] == nil:
+			taken[i] = true
+		case merr[i] != datastore.ErrNoSuchEntity:
+			return nil, merr[i]
+		}
+	}
+	return taken, nil
+}
+
+// addRevision records a revision of the book with key k in tx. Revisions are
+// children of their book, so that listing them is strongly consistent.
+func (db *datastoreDB) addRevision(ctx context.Context, tx *datastore.Transaction, k *datastore.Key, action string, b *Book) error {
+	rb := *b
+	rb.ID = k.ID()
+	_, err := tx.Put(datastore.NewIncompleteKey(ctx, "Revision", k), newRevision(ctx, action, &rb))
+	return err
+}
+
+// ListRevisions returns the revisions of a given book by its ID, oldest
+// first.
+func (db *datastoreDB) ListRevisions(ctx context.Context, id int64) ([]*Revision, error) {
+	ctx = tenantNamespace(ctx)
+	q := datastore.NewQuery("Revision").
+		Ancestor(db.datastoreKey(ctx, id))
+	var revs []*Revision
+	if _, err := db.client.GetAll(ctx, q, &revs); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list revisions: %v", err)
+	}
+	// Sorting here rather than in the query saves a composite index.
+	sort.Stable(revisionsByTime(revs))
+	return revs, nil
+}
+
+// revisionsByTime implements sort.Interface, ordering revisions from the
+// oldest to the newest.
+type revisionsByTime []*Revision
+
+func (s revisionsByTime) Len() int           { return len(s) }
+func (s revisionsByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s revisionsByTime) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+
+// ImportBook saves a book under its existing ID.
+//
+// Datastore does not know about imported IDs when it allocates new ones, so
+// AddBook and AddBooks check that the IDs they are given are free.
+func (db *datastoreDB) ImportBook(ctx context.Context, b *Book) error {
+	ctx = tenantNamespace(ctx)
+	if b.ID <= 0 {
+		return errorf(ErrInvalidArgument, "datastoredb: cannot import book with ID %d", b.ID)
+	}
+	if err := normalizeBook("datastoredb", b); err != nil {
+		return err
+	}
+	if b.CreatedAt.IsZero() {
+		b.CreatedAt = creationTime()
+	}
+	k := db.datastoreKey(ctx, b.ID)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var old *Book
+		stored := &bookEntity{}
+		switch err := tx.Get(k, stored); err {
+		case nil:
+			old = &stored.Book
+		case datastore.ErrNoSuchEntity:
+		default:
+			return err
+		}
+		if err := db.claimISBN(ctx, tx, b, old); err != nil {
+			return err
+		}
+		_, err := tx.Put(k, &bookEntity{*b})
+		return err
+	})
+	if ErrorKind(err) == ErrAlreadyExists {
+		return err
+	}
 	if err != nil {
-		return 0, fmt.Errorf("datastoredb: could not put Book: %v", err)
+		return fmt.Errorf("datastoredb: could not import Book: %v", err)
 	}
-	return k.ID(), nil
+	return nil
 }
 
-// DeleteBook removes a given book by its ID.
-func (db *datastoreDB) DeleteBook(id int64) error {
-	ctx := context.Background()
-	k := db.datastoreKey(id)
-	if err := db.client.Delete(ctx, k); err != nil {
+// DeleteBook moves a given book to the trash by its ID.
+func (db *datastoreDB) DeleteBook(ctx context.Context, id int64) error {
+	ctx = tenantNamespace(ctx)
+	err := db.setDeletedAt(ctx, id, time.Now().UTC(), RevisionDelete)
+	if err == datastore.ErrNoSuchEntity {
+		return errorf(ErrNotFound, "datastoredb: could not delete book with ID %d, does not exist", id)
+	}
+	if err != nil {
 		return fmt.Errorf("datastoredb: could not delete Book: %v", err)
 	}
 	return nil
 }
 
+// RestoreBook takes a given book out of the trash by its ID.
+func (db *datastoreDB) RestoreBook(ctx context.Context, id int64) error {
+	ctx = tenantNamespace(ctx)
+	err := db.setDeletedAt(ctx, id, time.Time{}, RevisionRestore)
+	if err == datastore.ErrNoSuchEntity {
+		return errorf(ErrNotFound, "datastoredb: could not restore book with ID %d, not in the trash", id)
+	}
+	if err != nil {
+		return fmt.Errorf("datastoredb: could not restore Book: %v", err)
+	}
+	return nil
+}
+
+// setDeletedAt moves a book into the trash at time t, or out of it if t is
+// zero, and records a revision with the given action. It returns
+// datastore.ErrNoSuchEntity if the book does not exist or is already where it
+// is being moved.
+func (db *datastoreDB) setDeletedAt(ctx context.Context, id int64, t time.Time, action string) error {
+	k := db.datastoreKey(ctx, id)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		e := &bookEntity{}
+		if err := tx.Get(k, e); err != nil {
+			return err
+		}
+		if e.DeletedAt.IsZero() == t.IsZero() {
+			return datastore.ErrNoSuchEntity
+		}
+		e.DeletedAt = t
+		if _, err := tx.Put(k, e); err != nil {
+			return err
+		}
+		return db.addRevision(ctx, tx, k, action, &e.Book)
+	})
+	return err
+}
+
+// ListDeletedBooks returns the books in the trash, most recently deleted
+// first, optionally filtered by the user who created the book entry.
+func (db *datastoreDB) ListDeletedBooks(ctx context.Context, userID string) ([]*Book, error) {
+	ctx = tenantNamespace(ctx)
+	q := datastore.NewQuery("Book").
+		Filter("DeletedAt >", time.Time{})
+	if userID != "" {
+		q = q.Filter("CreatedByID =", userID)
+	}
+	// See index.yaml for the index the filtered query needs.
+	q = q.Order("-DeletedAt")
+
+	return db.getAll(ctx, q)
+}
+
+// PurgeBooks permanently removes the books moved to the trash before a given
+// time, their revisions and the claims on their ISBNs.
+func (db *datastoreDB) PurgeBooks(ctx context.Context, before time.Time) (int, error) {
+	ctx = tenantNamespace(ctx)
+	q := datastore.NewQuery("Book").
+		Filter("DeletedAt >", time.Time{}).
+		Filter("DeletedAt <", before)
+	var purged []*bookEntity
+	bookKeys, err := db.client.GetAll(ctx, q, &purged)
+	if err != nil {
+		return 0, fmt.Errorf("datastoredb: could not purge books: %v", err)
+	}
+	var claimKeys []*datastore.Key
+	for _, e := range purged {
+		if e.ISBN != "" {
+			claimKeys = append(claimKeys, isbnKey(ctx, e.ISBN))
+		}
+	}
+	for _, k := range bookKeys {
+		// Delete the revisions first, so that a failed purge leaves no
+		// revisions without their book.
+		q := datastore.NewQuery("Revision").Ancestor(k).KeysOnly()
+		keys, err := db.client.GetAll(ctx, q, nil)
+		if err != nil {
+			return 0, fmt.Errorf("datastoredb: could not purge books: %v", err)
+		}
+		if err := db.deleteKeys(ctx, keys); err != nil {
+			return 0, fmt.Errorf("datastoredb: could not purge books: %v", err)
+		}
+	}
+	// Release the ISBNs last, so that they stay taken until their books are
+	// gone.
+	if err := db.deleteKeys(ctx, append(bookKeys, claimKeys...)); err != nil {
+		return 0, fmt.Errorf("datastoredb: could not purge books: %v", err)
+	}
+	return len(bookKeys), nil
+}
+
+// deleteKeys deletes the entities with the given keys, in batches small
+// enough for DeleteMulti.
+func (db *datastoreDB) deleteKeys(ctx context.Context, keys []*datastore.Key) error {
+	const batchSize = 500
+	for i := 0; i < len(keys); i += batchSize {
+		end := i + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := db.client.DeleteMulti(ctx, keys[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // UpdateBook updates the entry for a given book.
-func (db *datastoreDB) UpdateBook(b *Book) error {
-	ctx := context.Background()
-	k := db.datastoreKey(b.ID)
-	if _, err := db.client.Put(ctx, k, b); err != nil {
+func (db *datastoreDB) UpdateBook(ctx context.Context, b *Book) error {
+	ctx = tenantNamespace(ctx)
+	if err := normalizeBook("datastoredb", b); err != nil {
+		return err
+	}
+	k := db.datastoreKey(ctx, b.ID)
+	_, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		stored := &bookEntity{}
+		if err := tx.Get(k, stored); err != nil {
+			return err
+		}
+		if !stored.DeletedAt.IsZero() {
+			return datastore.ErrNoSuchEntity
+		}
+		if stored.Version != b.Version {
+			return &ConflictError{ID: b.ID, Version: b.Version}
+		}
+		if err := db.claimISBN(ctx, tx, b, &stored.Book); err != nil {
+			return err
+		}
+		updated := bookEntity{*b}
+		updated.Version++
+		updated.CreatedAt = stored.CreatedAt
+		updated.DeletedAt = time.Time{}
+		if _, err := tx.Put(k, &updated); err != nil {
+			return err
+		}
+		return db.addRevision(ctx, tx, k, RevisionUpdate, &updated.Book)
+	})
+	if k := ErrorKind(err); k == ErrConflict || k == ErrAlreadyExists {
+		return err
+	}
+	if err == datastore.ErrNoSuchEntity {
+		return errorf(ErrNotFound, "datastoredb: could not update book with ID %d, does not exist", b.ID)
+	}
+	if err != nil {
 		return fmt.Errorf("datastoredb: could not update Book: %v", err)
 	}
+	b.Version++
 	return nil
 }
 
-// ListBooks returns a list of books, ordered by title.
-func (db *datastoreDB) ListBooks() ([]*Book, error) {
-	ctx := context.Background()
-	books := make([]*Book, 0)
-	q := datastore.NewQuery("Book").
-		Order("Title")
+// datastoreBatchSize is the largest number of books the batch methods write
+// in one transaction. A transaction can span at most 25 entity groups, and
+// each book is the root of its own, as are the claims on the ISBN it takes
+// and the ISBN it gives up.
+const datastoreBatchSize = 8
 
-	keys, err := db.client.GetAll(ctx, q, &books)
+// writeChunks writes a batch of books in chunks of at most
+// datastoreBatchSize books, each in its own transaction, and records the
+// fate of each book in errs. A chunk holding a book that already has an
+// error is not written.
+//
+// write writes the books from start to end in tx. It reports the books that
+// cannot be written in chunkErrs, which rolls the transaction back. Once the
+// transaction commits, committed is called, if it is not nil.
+func (db *datastoreDB) writeChunks(ctx context.Context, errs BatchError,
+	write func(tx *datastore.Transaction, start, end int, chunkErrs BatchError) error,
+	committed func(start, end int, c *datastore.Commit)) {
+	for start := 0; start < len(errs); start += datastoreBatchSize {
+		end := start + datastoreBatchSize
+		if end > len(errs) {
+			end = len(errs)
+		}
+		chunk := errs[start:end]
+		if chunk.failed() {
+			chunk.abort()
+			continue
+		}
 
+		var chunkErrs BatchError
+		c, err := db.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			// The function may be retried, so start afresh each time.
+			chunkErrs = make(BatchError, end-start)
+			if err := write(tx, start, end, chunkErrs); err != nil {
+				return err
+			}
+			return chunkErrs.orNil()
+		})
+		switch {
+		case err == nil:
+			if committed != nil {
+				committed(start, end, c)
+			}
+		case chunkErrs.failed():
+			copy(chunk, chunkErrs)
+			chunk.abort()
+		default:
+			for i := range chunk {
+				chunk[i] = fmt.Errorf("datastoredb: could not write books: %v", err)
+			}
+		}
+	}
+}
+
+// getBooks reads the books with the given keys in tx. It returns
+// datastore.ErrNoSuchEntity for the books that do not exist or are in the
+// trash.
+func getBooks(tx *datastore.Transaction, keys []*datastore.Key) ([]*bookEntity, BatchError, error) {
+	stored := make([]*bookEntity, len(keys))
+	for i := range stored {
+		stored[i] = &bookEntity{}
+	}
+	errs := make(BatchError, len(keys))
+	err := tx.GetMulti(keys, stored)
+	if merr, ok := err.(datastore.MultiError); ok {
+		copy(errs, merr)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	for i, e := range stored {
+		if errs[i] == nil && !e.DeletedAt.IsZero() {
+			errs[i] = datastore.ErrNoSuchEntity
+		}
+	}
+	return stored, errs, nil
+}
+
+// AddBooks saves the given books, assigning them new IDs.
+//
+// The IDs are allocated first. The books are then saved with PutMulti,
+// datastoreBatchSize at a time, each chunk in a transaction together with
+// its revisions and ISBN claims: a chunk is saved whole or not at all, but
+// does not stop the other chunks being saved. A book whose allocated ID has
+// been taken by an imported book fails with ErrAlreadyExists.
+func (db *datastoreDB) AddBooks(ctx context.Context, bs []*Book) ([]int64, error) {
+	ctx = tenantNamespace(ctx)
+	errs := make(BatchError, len(bs))
+	keys := make([]*datastore.Key, len(bs))
+	for i, b := range bs {
+		errs[i] = normalizeBook("datastoredb", b)
+		keys[i] = datastore.NewIncompleteKey(ctx, "Book", nil)
+	}
+	if len(bs) == 0 {
+		return nil, nil
+	}
+	keys, err := db.client.AllocateIDs(ctx, keys)
 	if err != nil {
-		return nil, fmt.Errorf("datastoredb: could not list books: %v", err)
+		return nil, fmt.Errorf("datastoredb: could not allocate IDs: %v", err)
+	}
+	added := make([]*Book, len(bs))
+	ids := make([]int64, len(bs))
+	now := creationTime()
+	for i, b := range bs {
+		added[i] = &Book{}
+		*added[i] = *b
+		added[i].ID = keys[i].ID()
+		added[i].Version = 1
+		added[i].CreatedAt = now
+		added[i].DeletedAt = time.Time{}
+		ids[i] = keys[i].ID()
 	}
+	checkBatchISBNs("datastoredb", added, ids, nil, errs)
 
-	for i, k := range keys {
-		books[i].ID = k.ID()
+	db.writeChunks(ctx, errs, func(tx *datastore.Transaction, start, end int, chunkErrs BatchError) error {
+		chunk := added[start:end]
+		taken, err := takenKeys(tx, keys[start:end])
+		if err != nil {
+			return err
+		}
+		for i, b := range chunk {
+			if taken[i] {
+				chunkErrs[i] = errorf(ErrAlreadyExists, "datastoredb: ID %d is taken by an imported book", b.ID)
+			}
+		}
+		if chunkErrs.failed() {
+			return nil
+		}
+		if err := db.claimISBNs(ctx, tx, chunk, make([]*Book, len(chunk)), chunkErrs); err != nil || chunkErrs.failed() {
+			return err
+		}
+		entities := make([]*bookEntity, len(chunk))
+		revKeys := make([]*datastore.Key, len(chunk))
+		revs := make([]*Revision, len(chunk))
+		for i, b := range chunk {
+			entities[i] = &bookEntity{*b}
+			revKeys[i] = datastore.NewIncompleteKey(ctx, "Revision", keys[start+i])
+			revs[i] = newRevision(ctx, RevisionAdd, b)
+		}
+		if _, err := tx.PutMulti(keys[start:end], entities); err != nil {
+			return err
+		}
+		_, err = tx.PutMulti(revKeys, revs)
+		return err
+	}, func(start, end int, _ *datastore.Commit) {
+		for _, b := range bs[start:end] {
+			b.Version = 1
+			b.CreatedAt = now
+			b.DeletedAt = time.Time{}
+		}
+	})
+
+	for i := range ids {
+		if errs[i] != nil {
+			ids[i] = 0
+		}
+	}
+	return ids, errs.orNil()
+}
+
+// UpdateBooks updates the entries for the given books.
+//
+// The books are updated datastoreBatchSize at a time, each chunk in a
+// transaction: a chunk is updated whole or not at all, so a book that cannot
+// be updated stops the others of its chunk, which fail with
+// ErrBatchAborted, but not the other chunks.
+func (db *datastoreDB) UpdateBooks(ctx context.Context, bs []*Book) error {
+	ctx = tenantNamespace(ctx)
+	errs := make(BatchError, len(bs))
+	for i, b := range bs {
+		errs[i] = normalizeBook("datastoredb", b)
 	}
+	checkBatchIDs("datastoredb", bookIDs(bs), errs)
+	checkBatchISBNs("datastoredb", bs, bookIDs(bs), nil, errs)
 
-	return books, nil
+	db.writeChunks(ctx, errs, func(tx *datastore.Transaction, start, end int, chunkErrs BatchError) error {
+		chunk := bs[start:end]
+		keys := make([]*datastore.Key, len(chunk))
+		for i, b := range chunk {
+			keys[i] = db.datastoreKey(ctx, b.ID)
+		}
+		stored, getErrs, err := getBooks(tx, keys)
+		if err != nil {
+			return err
+		}
+
+		updated := make([]*bookEntity, len(chunk))
+		revKeys := make([]*datastore.Key, len(chunk))
+		revs := make([]*Revision, len(chunk))
+		for i, b := range chunk {
+			switch {
+			case getErrs[i] == datastore.ErrNoSuchEntity:
+				chunkErrs[i] = errorf(ErrNotFound, "datastoredb: could not update book with ID %d, does not exist", b.ID)
+			case getErrs[i] != nil:
+				chunkErrs[i] = fmt.Errorf("datastoredb: could not get Book: %v", getErrs[i])
+			case stored[i].Version != b.Version:
+				chunkErrs[i] = &ConflictError{ID: b.ID, Version: b.Version}
+			default:
+				updated[i] = &bookEntity{*b}
+				updated[i].Version++
+				updated[i].CreatedAt = stored[i].CreatedAt
+				updated[i].DeletedAt = time.Time{}
+				revKeys[i] = datastore.NewIncompleteKey(ctx, "Revision", keys[i])
+				revs[i] = newRevision(ctx, RevisionUpdate, &updated[i].Book)
+			}
+		}
+		if chunkErrs.failed() {
+			return nil
+		}
+		old := make([]*Book, len(chunk))
+		for i := range stored {
+			old[i] = &stored[i].Book
+		}
+		if err := db.claimISBNs(ctx, tx, chunk, old, chunkErrs); err != nil || chunkErrs.failed() {
+			return err
+		}
+
+		if _, err := tx.PutMulti(keys, updated); err != nil {
+			return err
+		}
+		_, err = tx.PutMulti(revKeys, revs)
+		return err
+	}, func(start, end int, _ *datastore.Commit) {
+		for _, b := range bs[start:end] {
+			b.Version++
+		}
+	})
+
+	return errs.orNil()
+}
+
+// DeleteBooks moves the books with the given IDs to the trash.
+//
+// The books are moved datastoreBatchSize at a time, each chunk in a
+// transaction, as for UpdateBooks.
+func (db *datastoreDB) DeleteBooks(ctx context.Context, ids []int64) error {
+	ctx = tenantNamespace(ctx)
+	errs := make(BatchError, len(ids))
+	checkBatchIDs("datastoredb", ids, errs)
+	now := time.Now().UTC()
+
+	db.writeChunks(ctx, errs, func(tx *datastore.Transaction, start, end int, chunkErrs BatchError) error {
+		chunk := ids[start:end]
+		keys := make([]*datastore.Key, len(chunk))
+		for i, id := range chunk {
+			keys[i] = db.datastoreKey(ctx, id)
+		}
+		stored, getErrs, err := getBooks(tx, keys)
+		if err != nil {
+			return err
+		}
+
+		revKeys := make([]*datastore.Key, len(chunk))
+		revs := make([]*Revision, len(chunk))
+		for i, id := range chunk {
+			switch {
+			case getErrs[i] == datastore.ErrNoSuchEntity:
+				chunkErrs[i] = errorf(ErrNotFound, "datastoredb: could not delete book with ID %d, does not exist", id)
+				continue
+			case getErrs[i] != nil:
+				chunkErrs[i] = fmt.Errorf("datastoredb: could not get Book: %v", getErrs[i])
+				continue
+			}
+			stored[i].ID = id
+			stored[i].DeletedAt = now
+			revKeys[i] = datastore.NewIncompleteKey(ctx, "Revision", keys[i])
+			revs[i] = newRevision(ctx, RevisionDelete, &stored[i].Book)
+		}
+		if chunkErrs.failed() {
+			return nil
+		}
+
+		if _, err := tx.PutMulti(keys, stored); err != nil {
+			return err
+		}
+		_, err = tx.PutMulti(revKeys, revs)
+		return err
+	}, nil)
+
+	return errs.orNil()
+}
+
+// ListBooks returns a list of books, ordered by title.
+func (db *datastoreDB) ListBooks(ctx context.Context) ([]*Book, error) {
+	ctx = tenantNamespace(ctx)
+	q := datastore.NewQuery("Book").
+		Order("Title")
+
+	books, err := db.getAll(ctx, q)
+	return withoutDeleted(books), err
 }
 
 // ListBooksCreatedBy returns a list of books, ordered by title, filtered by
 // the user who created the book entry.
-func (db *datastoreDB) ListBooksCreatedBy(userID string) ([]*Book, error) {
-	ctx := context.Background()
+func (db *datastoreDB) ListBooksCreatedBy(ctx context.Context, userID string) ([]*Book, error) {
+	ctx = tenantNamespace(ctx)
 	if userID == "" {
-		return db.ListBooks()
+		return db.ListBooks(ctx)
 	}
 
-	books := make([]*Book, 0)
 	q := datastore.NewQuery("Book").
 		Filter("CreatedByID =", userID).
 		Order("Title")
 
-	keys, err := db.client.GetAll(ctx, q, &books)
+	books, err := db.getAll(ctx, q)
+	return withoutDeleted(books), err
+}
+
+// ListBooksByTag returns the books with a given tag, ordered by title.
+func (db *datastoreDB) ListBooksByTag(ctx context.Context, tag string) ([]*Book, error) {
+	ctx = tenantNamespace(ctx)
+	tag, err := NormalizeTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	// See index.yaml for the index this query needs.
+	q := datastore.NewQuery("Book").
+		Filter(activeTagsProperty+" =", tag).
+		Order("Title")
+
+	return db.getAll(ctx, q)
+}
+
+// ListTags returns the tags of the books outside the trash, with their
+// counts. A projection on the active tags yields a result for each tag of
+// each book, read from the property's built-in index.
+func (db *datastoreDB) ListTags(ctx context.Context) ([]TagCount, error) {
+	ctx = tenantNamespace(ctx)
+	q := datastore.NewQuery("Book").Project(activeTagsProperty)
+	var results []datastore.PropertyList
+	if _, err := db.client.GetAll(ctx, q, &results); err != nil {
+		return nil, fmt.Errorf("datastoredb: could not list tags: %v", err)
+	}
+	counts := make(map[string]int)
+	for _, ps := range results {
+		for _, p := range ps {
+			if t, ok := p.Value.(string); ok {
+				counts[t]++
+			}
+		}
+	}
+	return tagCounts(counts), nil
+}
+
+// withoutDeleted removes the books in the trash from a list of books, in
+// place.
+//
+// Books stored before the trash was introduced have no DeletedAt property,
+// and a Datastore query filtering on DeletedAt would skip them, so queries
+// for books outside the trash filter their results instead.
+func withoutDeleted(books []*Book) []*Book {
+	kept := books[:0]
+	for _, b := range books {
+		if b.DeletedAt.IsZero() {
+			kept = append(kept, b)
+		}
+	}
+	return kept
+}
+
+// getAll returns all the books matching a query.
+func (db *datastoreDB) getAll(ctx context.Context, q *datastore.Query) ([]*Book, error) {
+	var entities []bookEntity
+	keys, err := db.client.GetAll(ctx, q, &entities)
 
 	if err != nil {
 		return nil, fmt.Errorf("datastoredb: could not list books: %v", err)
 	}
 
+	books := make([]*Book, len(entities))
 	for i, k := range keys {
+		books[i] = &entities[i].Book
 		books[i].ID = k.ID()
 	}
 
 	return books, nil
 }
+
+// datastoreSortProperties maps each SortField to the property it sorts by.
+var datastoreSortProperties = map[SortField]string{
+	SortByTitle:         "Title",
+	SortByAuthor:        "Author",
+	SortByPublishedDate: "PublishedDate",
+	SortByCreatedAt:     "CreatedAt",
+}
+
+// ListBooksPage returns a page of books, selected and ordered by opts,
+// starting at the given cursor.
+//
+// The creator and author filters are part of the query, and so is the year
+// filter when books are sorted by PublishedDate: Datastore only allows a range
+// filter on the property a query is first sorted by. Otherwise, the year
+// filter is applied to the books the query returns. See index.yaml for the
+// indexes these queries need. Books stored before CreatedAt was introduced
+// lack the property, and are not listed in order of creation.
+func (db *datastoreDB) ListBooksPage(ctx context.Context, opts ListOptions, cursor string, pageSize int) (*BookPage, error) {
+	ctx = tenantNamespace(ctx)
+	if err := opts.validate("datastoredb"); err != nil {
+		return nil, err
+	}
+	c, err := decodeCursor(cursor, &opts)
+	if err != nil {
+		return nil, err
+	}
+	pageSize = normalizePageSize(pageSize)
+
+	q := datastore.NewQuery("Book")
+	if opts.CreatedByID != "" {
+		q = q.Filter("CreatedByID =", opts.CreatedByID)
+	}
+	if opts.Author != "" {
+		q = q.Filter("Author =", opts.Author)
+	}
+	prop := datastoreSortProperties[opts.sortBy()]
+	if from, to, ok := opts.publishedRange(); ok && prop == "PublishedDate" {
+		q = q.Filter("PublishedDate >=", from).Filter("PublishedDate <", to)
+	}
+	// Datastore has no OR filter, so the query starts at the cursor's sort
+	// value and books sharing that value are skipped below if they precede
+	// the cursor.
+	op, order, keyOrder := " >=", prop, "__key__"
+	if !opts.readsAscending(c) {
+		op, order, keyOrder = " <=", "-"+prop, "-__key__"
+	}
+	if prop == "Author" && opts.Author != "" {
+		// Every book has the same author, so only the key orders them.
+		q = q.Order(keyOrder)
+	} else {
+		if c != nil {
+			q = q.Filter(prop+op, c.value())
+		}
+		q = q.Order(order).Order(keyOrder)
+	}
+
+	var books []*Book
+	it := db.client.Run(ctx, q)
+	// Read one extra book to find out whether there is another page.
+	for len(books) <= pageSize {
+		e := &bookEntity{}
+		k, err := it.Next(e)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: could not list books: %v", err)
+		}
+		b := &e.Book
+		b.ID = k.ID()
+		if !b.DeletedAt.IsZero() || !opts.matches(b) || (c != nil && !c.admits(b)) {
+			continue
+		}
+		books = append(books, b)
+	}
+
+	return newBookPage(books, &opts, c, pageSize), nil
+}
+
+// SearchBooks returns the books whose title, author or description match the
+// query, most relevant first.
+func (db *datastoreDB) SearchBooks(ctx context.Context, query string) ([]*Book, error) {
+	ctx = tenantNamespace(ctx)
+
+	// Datastore has no full-text search, so each book stores its search terms
+	// in a list property. Look up the books matching each of the query's
+	// terms, then rank them.
+	terms := queryTerms(query)
+	docFreq := make(map[string]int)
+	var keys []*datastore.Key
+	seen := make(map[int64]bool)
+	for _, t := range terms {
+		q := datastore.NewQuery("Book").
+			Filter(searchTermsProperty+" =", t).
+			KeysOnly()
+		ks, err := db.client.GetAll(ctx, q, nil)
+		if err != nil {
+			return nil, fmt.Errorf("datastoredb: could not search books: %v", err)
+		}
+		docFreq[t] = len(ks)
+		for _, k := range ks {
+			if !seen[k.ID()] {
+				seen[k.ID()] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	total, err := db.countBooks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("datastoredb: could not search books: %v", err)
+	}
+
+	// The index lags behind writes, so some of the books found may since
+	// have been moved to the trash or purged.
+	entities := make([]bookEntity, len(keys))
+	err = db.client.GetMulti(ctx, keys, entities)
+	merr, isMulti := err.(datastore.MultiError)
+	if err != nil && !isMulti {
+		return nil, fmt.Errorf("datastoredb: could not search books: %v", err)
+	}
+
+	var hits []searchHit
+	for i, k := range keys {
+		if merr != nil && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, fmt.Errorf("datastoredb: could not search books: %v", merr[i])
+		}
+		b := &entities[i].Book
+		if !b.DeletedAt.IsZero() {
+			continue
+		}
+		b.ID = k.ID()
+		bt := bookTerms(b)
+		var score float64
+		for _, t := range terms {
+			if n := bt[t]; n > 0 {
+				score += float64(n) * inverseDocFreq(docFreq[t], total)
+			}
+		}
+		hits = append(hits, searchHit{book: b, score: score})
+	}
+	return rankHits(hits), nil
+}
+
+// countBooks returns the number of books of the tenant outside the trash.
+// Books stored before the trash was introduced have no DeletedAt property,
+// so the books in the trash are counted and taken away from all the books.
+func (db *datastoreDB) countBooks(ctx context.Context) (int, error) {
+	all, err := db.client.Count(ctx, datastore.NewQuery("Book").KeysOnly())
+	if err != nil {
+		return 0, err
+	}
+	trashed, err := db.client.Count(ctx, datastore.NewQuery("Book").
+		Filter("DeletedAt >", time.Time{}).
+		KeysOnly())
+	if err != nil {
+		return 0, err
+	}
+	return all - trashed, nil
+}
@@ -0,0 +1,396 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Ensure fileDB conforms to the BookDatabase and BookImporter interfaces.
+var (
+	_ BookDatabase = &fileDB{}
+	_ BookImporter = &fileDB{}
+)
+
+// fileDB persists books to a JSON file on the local disk. It is meant for
+// local development, where it lets the app and the Pub/Sub worker share a
+// database without running a database server.
+//
+// Several processes can open the same file. Every call locks the file, reads
+// it into a memoryDB, and, if the call modifies the books, writes it back
+// before releasing the lock. Writes replace the file atomically and are
+// flushed to disk before the call returns.
+//
+// The books of DefaultTenant are stored at path, and those of other tenants
+// in files beside it, named by tenantPath.
+type fileDB struct {
+	path string
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// fileContents is the format of a fileDB file.
+type fileContents struct {
+	NextID    int64
+	Books     []*Book     // Ordered by ID.
+	Revisions []*Revision // Ordered by book ID, then oldest first.
+}
+
+// newFileDB creates a BookDatabase stored in the file at the given path. The
+// file is created if it does not exist.
+func newFileDB(path string) (*fileDB, error) {
+	db := &fileDB{path: path}
+	err := db.update(context.Background(), func(*memoryDB) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Close closes the database. A fileDB holds no resources between calls, but
+// later calls fail with errClosed all the same.
+func (db *fileDB) Close() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.closed = true
+}
+
+// check returns the error a call made with ctx fails with before it touches
+// the file: ctx's error, or errClosed.
+func (db *fileDB) check(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return errClosed
+	}
+	return nil
+}
+
+// tenantPath returns the path of the file storing the books of the tenant
+// carried by ctx: for tenant "acme", books.json becomes books.acme.json.
+func (db *fileDB) tenantPath(ctx context.Context) string {
+	tenant := TenantFromContext(ctx)
+	if tenant == DefaultTenant {
+		return db.path
+	}
+	ext := filepath.Ext(db.path)
+	return strings.TrimSuffix(db.path, ext) + "." + tenant + ext
+}
+
+// view calls f with the current contents of the tenant's file, under a
+// shared lock.
+func (db *fileDB) view(ctx context.Context, f func(m *memoryDB) error) error {
+	if err := db.check(ctx); err != nil {
+		return err
+	}
+	path := db.tenantPath(ctx)
+	unlock, err := lockFile(path+".lock", false)
+	if err != nil {
+		return fmt.Errorf("filedb: could not lock %s: %v", path, err)
+	}
+	defer unlock()
+
+	m, err := loadFile(path)
+	if err != nil {
+		return err
+	}
+	return f(m)
+}
+
+// update calls f with the current contents of the tenant's file, under an
+// exclusive lock, and saves the contents if f succeeds.
+func (db *fileDB) update(ctx context.Context, f func(m *memoryDB) error) error {
+	if err := db.check(ctx); err != nil {
+		return err
+	}
+	path := db.tenantPath(ctx)
+	unlock, err := lockFile(path+".lock", true)
+	if err != nil {
+		return fmt.Errorf("filedb: could not lock %s: %v", path, err)
+	}
+	defer unlock()
+
+	m, err := loadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := f(m); err != nil {
+		return err
+	}
+	return saveFile(path, m)
+}
+
+// loadFile reads the file at path into a new memoryDB. A missing file holds
+// no books. The caller must hold the file's lock.
+func loadFile(path string) (*memoryDB, error) {
+	m := newMemoryDB()
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filedb: could not read %s: %v", path, err)
+	}
+
+	var c fileContents
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("filedb: could not parse %s: %v", path, err)
+	}
+	for _, book := range c.Books {
+		m.putBook(book)
+	}
+	for _, r := range c.Revisions {
+		m.addRevision(r)
+	}
+	if c.NextID > m.nextID {
+		m.nextID = c.NextID
+	}
+	return m, nil
+}
+
+// booksByID implements sort.Interface, ordering books by ID.
+type booksByID []*Book
+
+func (s booksByID) Len() int           { return len(s) }
+func (s booksByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s booksByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// saveFile writes the contents of m to the file at path. It writes a
+// temporary file and renames it over the old one, so that a crash cannot
+// leave the file partly written. The caller must hold the file's lock.
+func saveFile(path string, m *memoryDB) error {
+	c := fileContents{NextID: m.nextID}
+	for _, b := range m.books {
+		c.Books = append(c.Books, b)
+	}
+	sort.Sort(booksByID(c.Books))
+	for _, book := range c.Books {
+		c.Revisions = append(c.Revisions, m.revisions[book.ID]...)
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("filedb: could not encode books: %v", err)
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("filedb: could not save books: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed.
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		return fmt.Errorf("filedb: could not save books: %v", err)
+	}
+	return nil
+}
+
+// syncDir flushes a directory to disk, making a rename within it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// GetBook retrieves a book by its ID.
+func (db *fileDB) GetBook(ctx context.Context, id int64) (book *Book, err error) {
+	err = db.view(ctx, func(m *memoryDB) error {
+		book, err = m.GetBook(ctx, id)
+		return err
+	})
+	return book, err
+}
+
+// GetBookByISBN retrieves a book by its ISBN.
+func (db *fileDB) GetBookByISBN(ctx context.Context, isbn string) (book *Book, err error) {
+	err = db.view(ctx, func(m *memoryDB) error {
+		book, err = m.GetBookByISBN(ctx, isbn)
+		return err
+	})
+	return book, err
+}
+
+// AddBook saves a given book, assigning it a new ID.
+func (db *fileDB) AddBook(ctx context.Context, b *Book) (id int64, err error) {
+	err = db.update(ctx, func(m *memoryDB) error {
+		id, err = m.AddBook(ctx, b)
+		return err
+	})
+	return id, err
+}
+
+// ImportBook saves a book under its existing ID.
+func (db *fileDB) ImportBook(ctx context.Context, b *Book) error {
+	return db.update(ctx, func(m *memoryDB) error {
+		return m.ImportBook(ctx, b)
+	})
+}
+
+// DeleteBook moves a given book to the trash by its ID.
+func (db *fileDB) DeleteBook(ctx context.Context, id int64) error {
+	return db.update(ctx, func(m *memoryDB) error {
+		return m.DeleteBook(ctx, id)
+	})
+}
+
+// ListDeletedBooks returns the books in the trash, most recently deleted
+// first, optionally filtered by the user who created the book entry.
+func (db *fileDB) ListDeletedBooks(ctx context.Context, userID string) (books []*Book, err error) {
+	err = db.view(ctx, func(m *memoryDB) error {
+		books, err = m.ListDeletedBooks(ctx, userID)
+		return err
+	})
+	return books, err
+}
+
+// RestoreBook takes a given book out of the trash by its ID.
+func (db *fileDB) RestoreBook(ctx context.Context, id int64) error {
+	return db.update(ctx, func(m *memoryDB) error {
+		return m.RestoreBook(ctx, id)
+	})
+}
+
+// PurgeBooks permanently removes the books moved to the trash before a given
+// time.
+func (db *fileDB) PurgeBooks(ctx context.Context, before time.Time) (n int, err error) {
+	err = db.update(ctx, func(m *memoryDB) error {
+		n, err = m.PurgeBooks(ctx, before)
+		return err
+	})
+	return n, err
+}
+
+// ListRevisions returns the revisions of a given book by its ID, oldest
+// first.
+func (db *fileDB) ListRevisions(ctx context.Context, id int64) (revs []*Revision, err error) {
+	err = db.view(ctx, func(m *memoryDB) error {
+		revs, err = m.ListRevisions(ctx, id)
+		return err
+	})
+	return revs, err
+}
+
+// UpdateBook updates the entry for a given book.
+func (db *fileDB) UpdateBook(ctx context.Context, b *Book) error {
+	return db.update(ctx, func(m *memoryDB) error {
+		return m.UpdateBook(ctx, b)
+	})
+}
+
+// AddBooks saves the given books, assigning them new IDs.
+func (db *fileDB) AddBooks(ctx context.Context, bs []*Book) (ids []int64, err error) {
+	err = db.update(ctx, func(m *memoryDB) error {
+		ids, err = m.AddBooks(ctx, bs)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// UpdateBooks updates the entries for the given books. The batch is written
+// all or nothing, in a single rewrite of the file.
+func (db *fileDB) UpdateBooks(ctx context.Context, bs []*Book) error {
+	return db.update(ctx, func(m *memoryDB) error {
+		return m.UpdateBooks(ctx, bs)
+	})
+}
+
+// DeleteBooks moves the books with the given IDs to the trash. The batch is
+// written all or nothing, in a single rewrite of the file.
+func (db *fileDB) DeleteBooks(ctx context.Context, ids []int64) error {
+	return db.update(ctx, func(m *memoryDB) error {
+		return m.DeleteBooks(ctx, ids)
+	})
+}
+
+// ListBooks returns a list of books, ordered by title.
+func (db *fileDB) ListBooks(ctx context.Context) (books []*Book, err error) {
+	err = db.view(ctx, func(m *memoryDB) error {
+		books, err = m.ListBooks(ctx)
+		return err
+	})
+	return books, err
+}
+
+// ListBooksCreatedBy returns a list of books, ordered by title, filtered by
+// the user who created the book entry.
+func (db *fileDB) ListBooksCreatedBy(ctx context.Context, userID string) (books []*Book, err error) {
+	err = db.view(ctx, func(m *memoryDB) error {
+		books, err = m.ListBooksCreatedBy(ctx, userID)
+		return err
+	})
+	return books, err
+}
+
+// ListBooksByTag returns the books with a given tag, ordered by title.
+func (db *fileDB) ListBooksByTag(ctx context.Context, tag string) (books []*Book, err error) {
+	err = db.view(ctx, func(m *memoryDB) error {
+		books, err = m.ListBooksByTag(ctx, tag)
+		return err
+	})
+	return books, err
+}
+
+// ListTags returns the tags of the books outside the trash, with their
+// counts.
+func (db *fileDB) ListTags(ctx context.Context) (tags []TagCount, err error) {
+	err = db.view(ctx, func(m *memoryDB) error {
+		tags, err = m.ListTags(ctx)
+		return err
+	})
+	return tags, err
+}
+
+// ListBooksPage returns a page of books, selected and ordered by opts,
+// starting at the given cursor.
+func (db *fileDB) ListBooksPage(ctx context.Context, opts ListOptions, cursor string, pageSize int) (page *BookPage, err error) {
+	err = db.view(ctx, func(m *memoryDB) error {
+		page, err = m.ListBooksPage(ctx, opts, cursor, pageSize)
+		return err
+	})
+	return page, err
+}
+
+// SearchBooks returns the books whose title, author or description match the
+// query, most relevant first.
+func (db *fileDB) SearchBooks(ctx context.Context, query string) (books []*Book, err error) {
+	err = db.view(ctx, func(m *memoryDB) error {
+		books, err = m.SearchBooks(ctx, query)
+		return err
+	})
+	return books, err
+}
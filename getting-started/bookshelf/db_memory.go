@@ -5,107 +5,579 @@
 package bookshelf
 
 import (
-	"errors"
-	"fmt"
 	"sort"
 	"sync"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
-// Ensure memoryDB conforms to the BookDatabase interface.
-var _ BookDatabase = &memoryDB{}
+// Ensure memoryDB conforms to the BookDatabase and BookImporter interfaces.
+var (
+	_ BookDatabase = &memoryDB{}
+	_ BookImporter = &memoryDB{}
+)
 
 // memoryDB is a simple in-memory persistence layer for books.
 type memoryDB struct {
 	mu     sync.Mutex
+	closed bool            // Calls made once the database is closed fail with errClosed.
 	nextID int64           // next ID to assign to a book.
-	books  map[int64]*Book // maps from Book ID to Book.
+	books  map[int64]*Book // maps from Book ID to Book, including books in the trash.
+
+	// index is an inverted index for SearchBooks. It maps from a search term
+	// to the weighted frequency of the term in each book containing it.
+	// Books in the trash are not indexed.
+	index map[string]map[int64]int
+	terms map[int64]map[string]int // maps from Book ID to the book's indexed terms.
+
+	revisions map[int64][]*Revision     // maps from Book ID to its revisions, oldest first.
+	isbns     map[string]int64          // maps from ISBN to the ID of the book with it, including books in the trash.
+	tagged    map[string]map[int64]bool // maps from tag to the IDs of the books outside the trash with it.
 }
 
 func newMemoryDB() *memoryDB {
 	return &memoryDB{
 		books:  make(map[int64]*Book),
 		nextID: 1,
+		index:  make(map[string]map[int64]int),
+		terms:  make(map[int64]map[string]int),
+
+		revisions: make(map[int64][]*Revision),
+		isbns:     make(map[string]int64),
+		tagged:    make(map[string]map[int64]bool),
 	}
 }
 
-// Close closes the database.
+// Close closes the database. Later calls, and those waiting for the lock,
+// fail with errClosed.
 func (db *memoryDB) Close() {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	db.closed = true
 	db.books = nil
+	db.index = nil
+	db.terms = nil
+	db.revisions = nil
+	db.isbns = nil
+	db.tagged = nil
 }
 
 // GetBook retrieves a book by its ID.
-func (db *memoryDB) GetBook(id int64) (*Book, error) {
+func (db *memoryDB) GetBook(ctx context.Context, id int64) (*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.closed {
+		return nil, errClosed
+	}
+
 	book, ok := db.books[id]
-	if !ok {
-		return nil, fmt.Errorf("memorydb: book not found with ID %d", id)
+	if !ok || !book.DeletedAt.IsZero() {
+		return nil, errorf(ErrNotFound, "memorydb: book not found with ID %d", id)
+	}
+	return copyBook(book), nil
+}
+
+// GetBookByISBN retrieves a book by its ISBN.
+func (db *memoryDB) GetBookByISBN(ctx context.Context, isbn string) (*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	isbn, err := NormalizeISBN(isbn)
+	if err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, errClosed
 	}
-	return book, nil
+
+	id, ok := db.isbns[isbn]
+	if !ok || !db.books[id].DeletedAt.IsZero() {
+		return nil, errorf(ErrNotFound, "memorydb: book not found with ISBN %s", isbn)
+	}
+	return copyBook(db.books[id]), nil
 }
 
 // AddBook saves a given book, assigning it a new ID.
-func (db *memoryDB) AddBook(b *Book) (id int64, err error) {
+func (db *memoryDB) AddBook(ctx context.Context, b *Book) (id int64, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := normalizeBook("memorydb", b); err != nil {
+		return 0, err
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.closed {
+		return 0, errClosed
+	}
+
+	if err := checkISBN("memorydb", b.ISBN, 0, db.isbns); err != nil {
+		return 0, err
+	}
 	b.ID = db.nextID
-	db.books[b.ID] = b
+	b.Version = 1
+	b.CreatedAt = creationTime()
+	b.DeletedAt = time.Time{}
+	db.putBook(b)
+	db.addRevision(newRevision(ctx, RevisionAdd, b))
 
 	db.nextID++
 
 	return b.ID, nil
 }
 
-// DeleteBook removes a given book by its ID.
-func (db *memoryDB) DeleteBook(id int64) error {
+// ImportBook saves a book under its existing ID.
+func (db *memoryDB) ImportBook(ctx context.Context, b *Book) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if b.ID <= 0 {
+		return errorf(ErrInvalidArgument, "memorydb: cannot import book with ID %d", b.ID)
+	}
+	if err := normalizeBook("memorydb", b); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return errClosed
+	}
+
+	if err := checkISBN("memorydb", b.ISBN, b.ID, db.isbns); err != nil {
+		return err
+	}
+	if b.CreatedAt.IsZero() {
+		b.CreatedAt = creationTime()
+	}
+	db.putBook(b)
+	if b.ID >= db.nextID {
+		db.nextID = b.ID + 1
+	}
+	return nil
+}
+
+// DeleteBook moves a given book to the trash by its ID.
+func (db *memoryDB) DeleteBook(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if id == 0 {
-		return errors.New("memorydb: book with unassigned ID passed into deleteBook")
+		return errorf(ErrInvalidArgument, "memorydb: book with unassigned ID passed into deleteBook")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return errClosed
+	}
+
+	b, ok := db.books[id]
+	if !ok || !b.DeletedAt.IsZero() {
+		return errorf(ErrNotFound, "memorydb: could not delete book with ID %d, does not exist", id)
+	}
+	b = copyBook(b)
+	b.DeletedAt = time.Now().UTC()
+	db.putBook(b)
+	db.addRevision(newRevision(ctx, RevisionDelete, b))
+	return nil
+}
+
+// ListDeletedBooks returns the books in the trash, most recently deleted
+// first, optionally filtered by the user who created the book entry.
+func (db *memoryDB) ListDeletedBooks(ctx context.Context, userID string) ([]*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, errClosed
+	}
+
+	var books []*Book
+	for _, b := range db.books {
+		if b.DeletedAt.IsZero() || (userID != "" && b.CreatedByID != userID) {
+			continue
+		}
+		books = append(books, copyBook(b))
 	}
 
+	sort.Sort(booksByDeletedAt(books))
+	return books, nil
+}
+
+// RestoreBook takes a given book out of the trash by its ID.
+func (db *memoryDB) RestoreBook(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	if _, ok := db.books[id]; !ok {
-		return fmt.Errorf("memorydb: could not delete book with ID %d, does not exist", id)
+	if db.closed {
+		return errClosed
+	}
+
+	b, ok := db.books[id]
+	if !ok || b.DeletedAt.IsZero() {
+		return errorf(ErrNotFound, "memorydb: could not restore book with ID %d, not in the trash", id)
 	}
-	delete(db.books, id)
+	b = copyBook(b)
+	b.DeletedAt = time.Time{}
+	db.putBook(b)
+	db.addRevision(newRevision(ctx, RevisionRestore, b))
 	return nil
 }
 
+// PurgeBooks permanently removes the books moved to the trash before a given
+// time.
+func (db *memoryDB) PurgeBooks(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return 0, errClosed
+	}
+
+	n := 0
+	for id, b := range db.books {
+		if !b.DeletedAt.IsZero() && b.DeletedAt.Before(before) {
+			delete(db.books, id)
+			delete(db.revisions, id)
+			delete(db.isbns, b.ISBN)
+			n++
+		}
+	}
+	return n, nil
+}
+
 // UpdateBook updates the entry for a given book.
-func (db *memoryDB) UpdateBook(b *Book) error {
+func (db *memoryDB) UpdateBook(ctx context.Context, b *Book) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if b.ID == 0 {
-		return errors.New("memorydb: book with unassigned ID passed into updateBook")
+		return errorf(ErrInvalidArgument, "memorydb: book with unassigned ID passed into updateBook")
+	}
+	if err := normalizeBook("memorydb", b); err != nil {
+		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	db.books[b.ID] = b
+	if db.closed {
+		return errClosed
+	}
+
+	stored, ok := db.books[b.ID]
+	if !ok || !stored.DeletedAt.IsZero() {
+		return errorf(ErrNotFound, "memorydb: could not update book with ID %d, does not exist", b.ID)
+	}
+	if stored.Version != b.Version {
+		return &ConflictError{ID: b.ID, Version: b.Version}
+	}
+	if err := checkISBN("memorydb", b.ISBN, b.ID, db.isbns); err != nil {
+		return err
+	}
+	b.Version++
+	b.CreatedAt = stored.CreatedAt
+	b.DeletedAt = time.Time{}
+
+	db.putBook(b)
+	db.addRevision(newRevision(ctx, RevisionUpdate, b))
 	return nil
 }
 
+// AddBooks saves the given books, assigning them new IDs.
+//
+// The batch is written all or nothing, as for UpdateBooks.
+func (db *memoryDB) AddBooks(ctx context.Context, bs []*Book) ([]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	errs := make(BatchError, len(bs))
+	for i, b := range bs {
+		errs[i] = normalizeBook("memorydb", b)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, errClosed
+	}
+
+	checkBatchISBNs("memorydb", bs, make([]int64, len(bs)), db.isbns, errs)
+	if err := errs.abort(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(bs))
+	now := creationTime()
+	for i, b := range bs {
+		b.ID = db.nextID
+		b.Version = 1
+		b.CreatedAt = now
+		b.DeletedAt = time.Time{}
+		db.putBook(b)
+		db.addRevision(newRevision(ctx, RevisionAdd, b))
+		db.nextID++
+		ids[i] = b.ID
+	}
+	return ids, nil
+}
+
+// UpdateBooks updates the entries for the given books.
+//
+// The batch is written all or nothing: every book is checked under a single
+// lock before any is updated.
+func (db *memoryDB) UpdateBooks(ctx context.Context, bs []*Book) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	errs := make(BatchError, len(bs))
+	for i, b := range bs {
+		errs[i] = normalizeBook("memorydb", b)
+	}
+	checkBatchIDs("memorydb", bookIDs(bs), errs)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return errClosed
+	}
+
+	for i, b := range bs {
+		if errs[i] != nil {
+			continue
+		}
+		stored, ok := db.books[b.ID]
+		if !ok || !stored.DeletedAt.IsZero() {
+			errs[i] = errorf(ErrNotFound, "memorydb: could not update book with ID %d, does not exist", b.ID)
+		} else if stored.Version != b.Version {
+			errs[i] = &ConflictError{ID: b.ID, Version: b.Version}
+		}
+	}
+	checkBatchISBNs("memorydb", bs, bookIDs(bs), db.isbns, errs)
+	if err := errs.abort(); err != nil {
+		return err
+	}
+
+	for _, b := range bs {
+		b.Version++
+		b.CreatedAt = db.books[b.ID].CreatedAt
+		b.DeletedAt = time.Time{}
+		db.putBook(b)
+		db.addRevision(newRevision(ctx, RevisionUpdate, b))
+	}
+	return nil
+}
+
+// DeleteBooks moves the books with the given IDs to the trash.
+//
+// The batch is written all or nothing, as for UpdateBooks.
+func (db *memoryDB) DeleteBooks(ctx context.Context, ids []int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	errs := make(BatchError, len(ids))
+	checkBatchIDs("memorydb", ids, errs)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return errClosed
+	}
+
+	for i, id := range ids {
+		if errs[i] != nil {
+			continue
+		}
+		if b, ok := db.books[id]; !ok || !b.DeletedAt.IsZero() {
+			errs[i] = errorf(ErrNotFound, "memorydb: could not delete book with ID %d, does not exist", id)
+		}
+	}
+	if err := errs.abort(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, id := range ids {
+		b := copyBook(db.books[id])
+		b.DeletedAt = now
+		db.putBook(b)
+		db.addRevision(newRevision(ctx, RevisionDelete, b))
+	}
+	return nil
+}
+
+// ListRevisions returns the revisions of a given book by its ID, oldest
+// first.
+func (db *memoryDB) ListRevisions(ctx context.Context, id int64) ([]*Revision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, errClosed
+	}
+
+	var revs []*Revision
+	for _, r := range db.revisions[id] {
+		c := *r
+		revs = append(revs, &c)
+	}
+	return revs, nil
+}
+
+// addRevision records a revision of a book.
+// The caller must hold db.mu.
+func (db *memoryDB) addRevision(r *Revision) {
+	db.revisions[r.BookID] = append(db.revisions[r.BookID], r)
+}
+
+// copyBook returns a copy of a book, so that callers cannot modify the stored
+// books other than through UpdateBook.
+func copyBook(b *Book) *Book {
+	c := *b
+	if b.Tags != nil {
+		c.Tags = append([]string(nil), b.Tags...)
+	}
+	return &c
+}
+
+// putBook stores a copy of a book, replacing any book with the same ID, and
+// indexes it unless it is in the trash.
+// The caller must hold db.mu.
+func (db *memoryDB) putBook(b *Book) {
+	db.unindexBook(b.ID)
+	if old, ok := db.books[b.ID]; ok && db.isbns[old.ISBN] == b.ID {
+		delete(db.isbns, old.ISBN)
+	}
+	if b.ISBN != "" {
+		db.isbns[b.ISBN] = b.ID
+	}
+	db.books[b.ID] = copyBook(b)
+	if b.DeletedAt.IsZero() {
+		db.indexBook(b)
+	}
+}
+
+// indexBook adds a book's terms to the search index, and the book to the
+// index of its tags.
+// The caller must hold db.mu.
+func (db *memoryDB) indexBook(b *Book) {
+	terms := bookTerms(b)
+	for t, n := range terms {
+		postings, ok := db.index[t]
+		if !ok {
+			postings = make(map[int64]int)
+			db.index[t] = postings
+		}
+		postings[b.ID] = n
+	}
+	db.terms[b.ID] = terms
+
+	for _, t := range b.Tags {
+		ids, ok := db.tagged[t]
+		if !ok {
+			ids = make(map[int64]bool)
+			db.tagged[t] = ids
+		}
+		ids[b.ID] = true
+	}
+}
+
+// unindexBook removes the stored book with the given ID from the search
+// and tag indexes.
+// The caller must hold db.mu.
+func (db *memoryDB) unindexBook(id int64) {
+	for t := range db.terms[id] {
+		delete(db.index[t], id)
+		if len(db.index[t]) == 0 {
+			delete(db.index, t)
+		}
+	}
+	delete(db.terms, id)
+
+	if b, ok := db.books[id]; ok {
+		for _, t := range b.Tags {
+			delete(db.tagged[t], id)
+			if len(db.tagged[t]) == 0 {
+				delete(db.tagged, t)
+			}
+		}
+	}
+}
+
 // booksByTitle implements sort.Interface, ordering books by Title.
 // https://golang.org/pkg/sort/#example__sortWrapper
 type booksByTitle []*Book
 
-func (s booksByTitle) Less(i, j int) bool { return s[i].Title < s[j].Title }
-func (s booksByTitle) Len() int           { return len(s) }
-func (s booksByTitle) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s booksByTitle) Len() int      { return len(s) }
+func (s booksByTitle) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// Less orders books by Title, breaking ties by ID so that the order is stable
+// across calls, as required for paging.
+func (s booksByTitle) Less(i, j int) bool {
+	if s[i].Title != s[j].Title {
+		return s[i].Title < s[j].Title
+	}
+	return s[i].ID < s[j].ID
+}
+
+// booksByDeletedAt implements sort.Interface, ordering books from the most
+// to the least recently deleted.
+type booksByDeletedAt []*Book
+
+func (s booksByDeletedAt) Len() int      { return len(s) }
+func (s booksByDeletedAt) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s booksByDeletedAt) Less(i, j int) bool {
+	if !s[i].DeletedAt.Equal(s[j].DeletedAt) {
+		return s[i].DeletedAt.After(s[j].DeletedAt)
+	}
+	return s[i].ID < s[j].ID
+}
 
 // ListBooks returns a list of books, ordered by title.
-func (db *memoryDB) ListBooks() ([]*Book, error) {
+func (db *memoryDB) ListBooks(ctx context.Context) ([]*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.closed {
+		return nil, errClosed
+	}
+
 	var books []*Book
 	for _, b := range db.books {
-		books = append(books, b)
+		if b.DeletedAt.IsZero() {
+			books = append(books, copyBook(b))
+		}
 	}
 
 	sort.Sort(booksByTitle(books))
@@ -114,21 +586,341 @@ func (db *memoryDB) ListBooks() ([]*Book, error) {
 
 // ListBooksCreatedBy returns a list of books, ordered by title, filtered by
 // the user who created the book entry.
-func (db *memoryDB) ListBooksCreatedBy(userID string) ([]*Book, error) {
+func (db *memoryDB) ListBooksCreatedBy(ctx context.Context, userID string) ([]*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if userID == "" {
-		return db.ListBooks()
+		return db.ListBooks(ctx)
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.closed {
+		return nil, errClosed
+	}
+
 	var books []*Book
 	for _, b := range db.books {
-		if b.CreatedByID == userID {
-			books = append(books, b)
+		if b.CreatedByID == userID && b.DeletedAt.IsZero() {
+			books = append(books, copyBook(b))
 		}
 	}
 
 	sort.Sort(booksByTitle(books))
 	return books, nil
 }
+
+// ListBooksByTag returns the books with a given tag, ordered by title.
+func (db *memoryDB) ListBooksByTag(ctx context.Context, tag string) ([]*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	tag, err := NormalizeTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, errClosed
+	}
+
+	var books []*Book
+	for id := range db.tagged[tag] {
+		books = append(books, copyBook(db.books[id]))
+	}
+
+	sort.Sort(booksByTitle(books))
+	return books, nil
+}
+
+// ListTags returns the tags of the books outside the trash, with their
+// counts.
+func (db *memoryDB) ListTags(ctx context.Context) ([]TagCount, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, errClosed
+	}
+
+	counts := make(map[string]int)
+	for t, ids := range db.tagged {
+		counts[t] = len(ids)
+	}
+	return tagCounts(counts), nil
+}
+
+// ListBooksPage returns a page of books, selected and ordered by opts,
+// starting at the given cursor.
+func (db *memoryDB) ListBooksPage(ctx context.Context, opts ListOptions, cursor string, pageSize int) (*BookPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := opts.validate("memorydb"); err != nil {
+		return nil, err
+	}
+	c, err := decodeCursor(cursor, &opts)
+	if err != nil {
+		return nil, err
+	}
+	pageSize = normalizePageSize(pageSize)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, errClosed
+	}
+
+	var books []*Book
+	for _, b := range db.books {
+		if !b.DeletedAt.IsZero() || !opts.matches(b) {
+			continue
+		}
+		if c != nil && !c.admits(b) {
+			continue
+		}
+		books = append(books, copyBook(b))
+	}
+
+	sort.Sort(booksBy{books: books, sort: opts.sortBy(), asc: opts.readsAscending(c)})
+	if len(books) > pageSize+1 {
+		books = books[:pageSize+1]
+	}
+	return newBookPage(books, &opts, c, pageSize), nil
+}
+
+// SearchBooks returns the books whose title, author or description match the
+// query, most relevant first.
+func (db *memoryDB) SearchBooks(ctx context.Context, query string) ([]*Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, errClosed
+	}
+
+	scores := make(map[int64]float64)
+	for _, t := range queryTerms(query) {
+		postings := db.index[t]
+		for id, n := range postings {
+			scores[id] += float64(n) * inverseDocFreq(len(postings), len(db.terms))
+		}
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, searchHit{book: copyBook(db.books[id]), score: score})
+	}
+	return rankHits(hits), nil
+}
+
+// Ensure tenantMemoryDB conforms to the BookDatabase and BookImporter
+// interfaces.
+var (
+	_ BookDatabase = &tenantMemoryDB{}
+	_ BookImporter = &tenantMemoryDB{}
+)
+
+// tenantMemoryDB keeps the books of each tenant in a memoryDB of its own,
+// created when the tenant is first seen.
+type tenantMemoryDB struct {
+	mu  sync.Mutex
+	dbs map[string]*memoryDB // maps from tenant to its books.
+}
+
+func newTenantMemoryDB() *tenantMemoryDB {
+	return &tenantMemoryDB{dbs: make(map[string]*memoryDB)}
+}
+
+// tenant returns the memoryDB of the tenant carried by ctx, or errClosed
+// if the database is closed.
+func (db *tenantMemoryDB) tenant(ctx context.Context) (*memoryDB, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.dbs == nil {
+		return nil, errClosed
+	}
+	t := TenantFromContext(ctx)
+	m, ok := db.dbs[t]
+	if !ok {
+		m = newMemoryDB()
+		db.dbs[t] = m
+	}
+	return m, nil
+}
+
+// Close closes the database of every tenant. Later calls fail with
+// errClosed.
+func (db *tenantMemoryDB) Close() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, m := range db.dbs {
+		m.Close()
+	}
+	db.dbs = nil
+}
+
+func (db *tenantMemoryDB) ListBooks(ctx context.Context) ([]*Book, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.ListBooks(ctx)
+}
+
+func (db *tenantMemoryDB) ListBooksCreatedBy(ctx context.Context, userID string) ([]*Book, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.ListBooksCreatedBy(ctx, userID)
+}
+
+func (db *tenantMemoryDB) ListBooksPage(ctx context.Context, opts ListOptions, cursor string, pageSize int) (*BookPage, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.ListBooksPage(ctx, opts, cursor, pageSize)
+}
+
+func (db *tenantMemoryDB) ListBooksByTag(ctx context.Context, tag string) ([]*Book, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.ListBooksByTag(ctx, tag)
+}
+
+func (db *tenantMemoryDB) ListTags(ctx context.Context) ([]TagCount, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.ListTags(ctx)
+}
+
+func (db *tenantMemoryDB) SearchBooks(ctx context.Context, query string) ([]*Book, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.SearchBooks(ctx, query)
+}
+
+func (db *tenantMemoryDB) GetBook(ctx context.Context, id int64) (*Book, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.GetBook(ctx, id)
+}
+
+func (db *tenantMemoryDB) GetBookByISBN(ctx context.Context, isbn string) (*Book, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.GetBookByISBN(ctx, isbn)
+}
+
+func (db *tenantMemoryDB) AddBook(ctx context.Context, b *Book) (int64, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return m.AddBook(ctx, b)
+}
+
+func (db *tenantMemoryDB) ImportBook(ctx context.Context, b *Book) error {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	return m.ImportBook(ctx, b)
+}
+
+func (db *tenantMemoryDB) DeleteBook(ctx context.Context, id int64) error {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	return m.DeleteBook(ctx, id)
+}
+
+func (db *tenantMemoryDB) ListDeletedBooks(ctx context.Context, userID string) ([]*Book, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.ListDeletedBooks(ctx, userID)
+}
+
+func (db *tenantMemoryDB) RestoreBook(ctx context.Context, id int64) error {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	return m.RestoreBook(ctx, id)
+}
+
+func (db *tenantMemoryDB) PurgeBooks(ctx context.Context, before time.Time) (int, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return m.PurgeBooks(ctx, before)
+}
+
+func (db *tenantMemoryDB) ListRevisions(ctx context.Context, id int64) ([]*Revision, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.ListRevisions(ctx, id)
+}
+
+func (db *tenantMemoryDB) UpdateBook(ctx context.Context, b *Book) error {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	return m.UpdateBook(ctx, b)
+}
+
+func (db *tenantMemoryDB) AddBooks(ctx context.Context, bs []*Book) ([]int64, error) {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return m.AddBooks(ctx, bs)
+}
+
+func (db *tenantMemoryDB) UpdateBooks(ctx context.Context, bs []*Book) error {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	return m.UpdateBooks(ctx, bs)
+}
+
+func (db *tenantMemoryDB) DeleteBooks(ctx context.Context, ids []int64) error {
+	m, err := db.tenant(ctx)
+	if err != nil {
+		return err
+	}
+	return m.DeleteBooks(ctx, ids)
+}
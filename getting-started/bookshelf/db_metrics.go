@@ -0,0 +1,291 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Ensure metricsDB conforms to the BookDatabase and BookImporter interfaces.
+var (
+	_ BookDatabase = &metricsDB{}
+	_ BookImporter = &metricsDB{}
+)
+
+// MetricsSink receives the measurements of a BookDatabase wrapped by
+// NewMetricsDB. Implementations must be safe for concurrent use, and should
+// not block, as they are called on the path of every database call.
+type MetricsSink interface {
+	// RecordCall records a call of the named BookDatabase method, which took
+	// latency and, if failed is true, failed.
+	RecordCall(method string, latency time.Duration, failed bool)
+}
+
+// metricsDB is a BookDatabase that measures the calls made to the underlying
+// database, and reports them to its sinks.
+//
+// A call fails, as far as the metrics are concerned, if it returns an error
+// that has no ErrorKind, such as a lost connection or an expired deadline.
+// Errors such as ErrNotFound are the database answering as documented, so
+// the calls returning them count as successful.
+type metricsDB struct {
+	BookDatabase
+
+	sinks []MetricsSink
+}
+
+// NewMetricsDB returns a BookDatabase that counts the calls to each method of
+// db, the calls that fail and their latency, and reports them to the given
+// sinks. Close is not measured.
+func NewMetricsDB(db BookDatabase, sinks ...MetricsSink) BookDatabase {
+	return &metricsDB{BookDatabase: db, sinks: sinks}
+}
+
+// record reports a call of method that started at start and returned *errp.
+// It is deferred by each method, so that it sees the error returned.
+func (db *metricsDB) record(method string, start time.Time, errp *error) {
+	latency := time.Since(start)
+	failed := *errp != nil && ErrorKind(*errp) == nil
+	for _, s := range db.sinks {
+		s.RecordCall(method, latency, failed)
+	}
+}
+
+func (db *metricsDB) ListBooks(ctx context.Context) (_ []*Book, err error) {
+	defer db.record("ListBooks", time.Now(), &err)
+	return db.BookDatabase.ListBooks(ctx)
+}
+
+func (db *metricsDB) ListBooksCreatedBy(ctx context.Context, userID string) (_ []*Book, err error) {
+	defer db.record("ListBooksCreatedBy", time.Now(), &err)
+	return db.BookDatabase.ListBooksCreatedBy(ctx, userID)
+}
+
+func (db *metricsDB) ListBooksPage(ctx context.Context, opts ListOptions, cursor string, pageSize int) (_ *BookPage, err error) {
+	defer db.record("ListBooksPage", time.Now(), &err)
+	return db.BookDatabase.ListBooksPage(ctx, opts, cursor, pageSize)
+}
+
+func (db *metricsDB) ListBooksByTag(ctx context.Context, tag string) (_ []*Book, err error) {
+	defer db.record("ListBooksByTag", time.Now(), &err)
+	return db.BookDatabase.ListBooksByTag(ctx, tag)
+}
+
+func (db *metricsDB) ListTags(ctx context.Context) (_ []TagCount, err error) {
+	defer db.record("ListTags", time.Now(), &err)
+	return db.BookDatabase.ListTags(ctx)
+}
+
+func (db *metricsDB) SearchBooks(ctx context.Context, query string) (_ []*Book, err error) {
+	defer db.record("SearchBooks", time.Now(), &err)
+	return db.BookDatabase.SearchBooks(ctx, query)
+}
+
+func (db *metricsDB) GetBook(ctx context.Context, id int64) (_ *Book, err error) {
+	defer db.record("GetBook", time.Now(), &err)
+	return db.BookDatabase.GetBook(ctx, id)
+}
+
+func (db *metricsDB) GetBookByISBN(ctx context.Context, isbn string) (_ *Book, err error) {
+	defer db.record("GetBookByISBN", time.Now(), &err)
+	return db.BookDatabase.GetBookByISBN(ctx, isbn)
+}
+
+func (db *metricsDB) AddBook(ctx context.Context, b *Book) (_ int64, err error) {
+	defer db.record("AddBook", time.Now(), &err)
+	return db.BookDatabase.AddBook(ctx, b)
+}
+
+func (db *metricsDB) DeleteBook(ctx context.Context, id int64) (err error) {
+	defer db.record("DeleteBook", time.Now(), &err)
+	return db.BookDatabase.DeleteBook(ctx, id)
+}
+
+func (db *metricsDB) ListDeletedBooks(ctx context.Context, userID string) (_ []*Book, err error) {
+	defer db.record("ListDeletedBooks", time.Now(), &err)
+	return db.BookDatabase.ListDeletedBooks(ctx, userID)
+}
+
+func (db *metricsDB) RestoreBook(ctx context.Context, id int64) (err error) {
+	defer db.record("RestoreBook", time.Now(), &err)
+	return db.BookDatabase.RestoreBook(ctx, id)
+}
+
+func (db *metricsDB) PurgeBooks(ctx context.Context, before time.Time) (_ int, err error) {
+	defer db.record("PurgeBooks", time.Now(), &err)
+	return db.BookDatabase.PurgeBooks(ctx, before)
+}
+
+func (db *metricsDB) ListRevisions(ctx context.Context, id int64) (_ []*Revision, err error) {
+	defer db.record("ListRevisions", time.Now(), &err)
+	return db.BookDatabase.ListRevisions(ctx, id)
+}
+
+func (db *metricsDB) UpdateBook(ctx context.Context, b *Book) (err error) {
+	defer db.record("UpdateBook", time.Now(), &err)
+	return db.BookDatabase.UpdateBook(ctx, b)
+}
+
+func (db *metricsDB) AddBooks(ctx context.Context, bs []*Book) (_ []int64, err error) {
+	defer db.record("AddBooks", time.Now(), &err)
+	return db.BookDatabase.AddBooks(ctx, bs)
+}
+
+func (db *metricsDB) UpdateBooks(ctx context.Context, bs []*Book) (err error) {
+	defer db.record("UpdateBooks", time.Now(), &err)
+	return db.BookDatabase.UpdateBooks(ctx, bs)
+}
+
+func (db *metricsDB) DeleteBooks(ctx context.Context, ids []int64) (err error) {
+	defer db.record("DeleteBooks", time.Now(), &err)
+	return db.BookDatabase.DeleteBooks(ctx, ids)
+}
+
+// ImportBook saves a book under its existing ID and Version, if the
+// underlying database supports it.
+func (db *metricsDB) ImportBook(ctx context.Context, b *Book) (err error) {
+	importer, ok := db.BookDatabase.(BookImporter)
+	if !ok {
+		return errorf(ErrInvalidArgument, "metrics: the underlying database cannot import books")
+	}
+	defer db.record("ImportBook", time.Now(), &err)
+	return importer.ImportBook(ctx, b)
+}
+
+// latencyBounds are the upper bounds of the buckets of a latency
+// Distribution, but for the last bucket, which has none.
+var latencyBounds = []time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Distribution is a histogram of latencies.
+type Distribution struct {
+	Count int64
+	Sum   time.Duration
+	Max   time.Duration
+
+	// Buckets holds the number of latencies in each bucket. Bucket i holds
+	// those up to the i-th of the bounds returned by LatencyBounds, and above
+	// the previous bound; the last bucket holds those above every bound.
+	Buckets []int64
+}
+
+// LatencyBounds returns the upper bounds of the buckets of a Distribution.
+func LatencyBounds() []time.Duration {
+	return append([]time.Duration(nil), latencyBounds...)
+}
+
+func (d *Distribution) add(latency time.Duration) {
+	if d.Buckets == nil {
+		d.Buckets = make([]int64, len(latencyBounds)+1)
+	}
+	i := sort.Search(len(latencyBounds), func(i int) bool { return latency <= latencyBounds[i] })
+	d.Buckets[i]++
+	d.Count++
+	d.Sum += latency
+	if latency > d.Max {
+		d.Max = latency
+	}
+}
+
+// Mean returns the mean latency, or 0 if there is none.
+func (d *Distribution) Mean() time.Duration {
+	if d.Count == 0 {
+		return 0
+	}
+	return d.Sum / time.Duration(d.Count)
+}
+
+// Quantile returns an upper bound of the q-quantile of the latencies, such as
+// the 99th percentile for q = 0.99: the bound of the bucket holding it, or the
+// maximum latency if that is lower. It returns 0 if there are no latencies.
+func (d *Distribution) Quantile(q float64) time.Duration {
+	rank := int64(q*float64(d.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range d.Buckets {
+		seen += n
+		if seen < rank {
+			continue
+		}
+		if i < len(latencyBounds) && latencyBounds[i] < d.Max {
+			return latencyBounds[i]
+		}
+		break
+	}
+	return d.Max
+}
+
+// MethodMetrics holds the metrics of the calls of one BookDatabase method.
+type MethodMetrics struct {
+	Method  string
+	Calls   int64
+	Errors  int64 // Failed calls.
+	Latency Distribution
+}
+
+// metricsTable accumulates the calls reported to a MetricsSink, by method.
+// The zero value is an empty table, ready to use.
+type metricsTable struct {
+	mu      sync.Mutex
+	methods map[string]*MethodMetrics
+}
+
+func (t *metricsTable) RecordCall(method string, latency time.Duration, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.methods == nil {
+		t.methods = make(map[string]*MethodMetrics)
+	}
+	m, ok := t.methods[method]
+	if !ok {
+		m = &MethodMetrics{Method: method}
+		t.methods[method] = m
+	}
+	m.Calls++
+	if failed {
+		m.Errors++
+	}
+	m.Latency.add(latency)
+}
+
+// snapshot returns a copy of the metrics of each method called so far,
+// ordered by method.
+func (t *metricsTable) snapshot() []MethodMetrics {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var names []string
+	for name := range t.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ms := make([]MethodMetrics, len(names))
+	for i, name := range names {
+		ms[i] = *t.methods[name]
+		ms[i].Latency.Buckets = append([]int64(nil), ms[i].Latency.Buckets...)
+	}
+	return ms
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestMetricsDB(t *testing.T) {
+	testDB(t, NewMetricsDB(newTenantMemoryDB(), NewMemoryMetrics()))
+}
+
+func TestMetricsDBRecordsCalls(t *testing.T) {
+	ctx := context.Background()
+	metrics := NewMemoryMetrics()
+	db := NewMetricsDB(newTenantMemoryDB(), metrics)
+
+	id, err := db.AddBook(ctx, &Book{Title: "measured"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetBook(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	// A missing book is an answer, not a failure...
+	if _, err := db.GetBook(ctx, id+1); ErrorKind(err) != ErrNotFound {
+		t.Fatalf("GetBook of missing book: got err %v, want kind ErrNotFound", err)
+	}
+	// ...but a call that could not be made is.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := db.ListBooks(cancelled); err == nil {
+		t.Fatal("ListBooks with cancelled context: want non-nil err")
+	}
+
+	want := map[string][2]int64{ // Calls and errors, by method.
+		"AddBook":   {1, 0},
+		"GetBook":   {2, 0},
+		"ListBooks": {1, 1},
+	}
+	got := metrics.Snapshot()
+	if len(got) != len(want) {
+		t.Fatalf("Snapshot: got %d methods, want %d: %+v", len(got), len(want), got)
+	}
+	for i, m := range got {
+		if i > 0 && got[i-1].Method >= m.Method {
+			t.Errorf("Snapshot: %s listed before %s", got[i-1].Method, m.Method)
+		}
+		if w := want[m.Method]; m.Calls != w[0] || m.Errors != w[1] {
+			t.Errorf("%s: got %d calls and %d errors, want %d and %d", m.Method, m.Calls, m.Errors, w[0], w[1])
+		}
+		if m.Latency.Count != m.Calls {
+			t.Errorf("%s: got %d latencies for %d calls", m.Method, m.Latency.Count, m.Calls)
+		}
+	}
+}
+
+func TestDistribution(t *testing.T) {
+	var d Distribution
+	if d.Mean() != 0 || d.Quantile(0.5) != 0 {
+		t.Errorf("empty Distribution: got mean %v and median %v, want 0", d.Mean(), d.Quantile(0.5))
+	}
+
+	for _, l := range []time.Duration{
+		500 * time.Microsecond,
+		1 * time.Millisecond, // A bound belongs to the bucket below it.
+		3 * time.Millisecond,
+		4 * time.Millisecond,
+		time.Minute,
+	} {
+		d.add(l)
+	}
+	if got, want := d.Buckets[:3], []int64{2, 0, 2}; !equalInt64s(got, want) {
+		t.Errorf("Buckets: got %v, want %v to start with", d.Buckets, want)
+	}
+	if got := d.Buckets[len(d.Buckets)-1]; got != 1 {
+		t.Errorf("Buckets: got %d latencies above every bound, want 1", got)
+	}
+	if got, want := d.Mean(), (time.Minute+8500*time.Microsecond)/5; got != want {
+		t.Errorf("Mean: got %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, time.Millisecond},
+		{0.4, time.Millisecond},
+		{0.5, 5 * time.Millisecond},
+		{0.99, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := d.Quantile(tt.q); got != tt.want {
+			t.Errorf("Quantile(%v): got %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestMonitoringTimeSeries(t *testing.T) {
+	start := time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := &monitoringSink{
+		projectID: "my-project",
+		instance:  "host-1/app",
+		resource:  globalResource("my-project"),
+		start:     start,
+	}
+
+	var table metricsTable
+	table.RecordCall("GetBook", 3*time.Millisecond, false)
+	table.RecordCall("GetBook", 5*time.Millisecond, true)
+	ts := s.timeSeries(start.Add(time.Minute), table.snapshot())
+
+	if len(ts) != 3 {
+		t.Fatalf("got %d time series, want 3", len(ts))
+	}
+	for _, series := range ts {
+		if got := series.Metric.Labels["method"]; got != "GetBook" {
+			t.Errorf("%s: got method %q, want GetBook", series.Metric.Type, got)
+		}
+		// Each instance writes series of its own.
+		if got := series.Metric.Labels["instance"]; got != "host-1/app" {
+			t.Errorf("%s: got instance %q, want host-1/app", series.Metric.Type, got)
+		}
+		if got := series.Resource.Labels["project_id"]; got != "my-project" {
+			t.Errorf("%s: got project %q, want my-project", series.Metric.Type, got)
+		}
+		if got, want := series.Points[0].Interval.StartTime, "2016-05-01T12:00:00Z"; got != want {
+			t.Errorf("%s: got start time %q, want %q", series.Metric.Type, got, want)
+		}
+	}
+	if got := *ts[0].Points[0].Value.Int64Value; ts[0].Metric.Type != callsMetricType || got != 2 {
+		t.Errorf("%s = %d, want %s = 2", ts[0].Metric.Type, got, callsMetricType)
+	}
+	if got := *ts[1].Points[0].Value.Int64Value; ts[1].Metric.Type != errorsMetricType || got != 1 {
+		t.Errorf("%s = %d, want %s = 1", ts[1].Metric.Type, got, errorsMetricType)
+	}
+	dist := ts[2].Points[0].Value.DistributionValue
+	if dist.Count != 2 || dist.Mean != 4 || len(dist.BucketCounts) != len(dist.BucketOptions.ExplicitBuckets.Bounds)+1 {
+		t.Errorf("%s = %+v, want 2 latencies with a mean of 4ms", latencyMetricType, dist)
+	}
+}
+
+func equalInt64s(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -8,18 +8,32 @@ import (
 	"crypto/rand"
 	"fmt"
 	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+// mongoDB persists books to a Mongo server. Each tenant has a database of
+// its own, named by mongoDatabaseName, holding a books collection and a
+// revisions collection; see addRevision.
 type mongoDB struct {
 	conn *mgo.Session
-	c    *mgo.Collection
+
+	mu      sync.Mutex
+	indexed map[string]bool // Databases whose indexes have been ensured.
+	closed  bool
 }
 
-// Ensure mongoDB conforms to the BookDatabase interface.
-var _ BookDatabase = &mongoDB{}
+// Ensure mongoDB conforms to the BookDatabase and BookImporter interfaces.
+var (
+	_ BookDatabase = &mongoDB{}
+	_ BookImporter = &mongoDB{}
+)
 
 // newMongoDB creates a new BookDatabase backed by a given Mongo server,
 // authenticated with given credentials.
@@ -35,26 +49,219 @@ func newMongoDB(addr string, cred *mgo.Credential) (BookDatabase, error) {
 		}
 	}
 
-	return &mongoDB{
-		conn: conn,
-		c:    conn.DB("bookshelf").C("books"),
-	}, nil
+	db := &mongoDB{
+		conn:    conn,
+		indexed: make(map[string]bool),
+	}
+	if err := db.ensureIndexes(conn.DB(mongoDatabaseName(DefaultTenant))); err != nil {
+		return nil, err
+	}
+	return db, nil
 }
 
-// Close closes the database.
+// mongoDatabaseName returns the name of the database holding the books of a
+// tenant: bookshelf for DefaultTenant, and otherwise the tenant's name
+// prefixed by bookshelf_, with its dots, which Mongo does not allow in
+// database names, replaced by underscores.
+func mongoDatabaseName(tenant string) string {
+	if tenant == DefaultTenant {
+		return "bookshelf"
+	}
+	return "bookshelf_" + strings.Replace(tenant, ".", "_", -1)
+}
+
+// ensureIndexes creates the indexes of a tenant's database, unless they were
+// created since db was opened.
+func (db *mongoDB) ensureIndexes(d *mgo.Database) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.indexed[d.Name] {
+		return nil
+	}
+
+	c := d.C("books")
+
+	// The text index backs SearchBooks.
+	if err := c.EnsureIndex(mgo.Index{
+		Name: "books_search",
+		Key:  []string{"$text:title", "$text:author", "$text:description"},
+		Weights: map[string]int{
+			"title":       titleWeight,
+			"author":      authorWeight,
+			"description": descriptionWeight,
+		},
+	}); err != nil {
+		return fmt.Errorf("mongo: could not create search index: %v", err)
+	}
+
+	// Books without an ISBN have no isbn field, so a sparse index lets any
+	// number of them share the collection.
+	if err := c.EnsureIndex(mgo.Index{
+		Name:   "books_isbn",
+		Key:    []string{"isbn"},
+		Unique: true,
+		Sparse: true,
+	}); err != nil {
+		return fmt.Errorf("mongo: could not create ISBN index: %v", err)
+	}
+
+	if err := c.EnsureIndexKey("tags", "title"); err != nil {
+		return fmt.Errorf("mongo: could not create tags index: %v", err)
+	}
+
+	// These indexes back the orders of ListBooksPage.
+	for _, field := range mongoSortFields {
+		if err := c.EnsureIndexKey(field, "id"); err != nil {
+			return fmt.Errorf("mongo: could not create %s index: %v", field, err)
+		}
+	}
+
+	if err := d.C("revisions").EnsureIndexKey("bookid", "time"); err != nil {
+		return fmt.Errorf("mongo: could not create revisions index: %v", err)
+	}
+
+	db.indexed[d.Name] = true
+	return nil
+}
+
+// Close closes the database. Later calls fail with errClosed, rather than
+// the panic of mgo's closed sessions.
 func (db *mongoDB) Close() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.closed = true
 	db.conn.Close()
 }
 
+// session returns a copy of the database session, or errClosed.
+func (db *mongoDB) session() (*mgo.Session, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, errClosed
+	}
+	return db.conn.Copy(), nil
+}
+
+// run calls f with the books collection of the tenant carried by ctx, on a
+// copy of the database session. The revisions collection on the same
+// session is reached with db.revisionsOf(c).
+//
+// mgo does not support contexts, so f runs in its own goroutine and run
+// returns early if ctx is done first. The session's socket timeout is bounded
+// by ctx's deadline, so that abandoned operations do not linger.
+func (db *mongoDB) run(ctx context.Context, f func(c *mgo.Collection) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s, err := db.session()
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetSocketTimeout(deadline.Sub(time.Now()))
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		defer s.Close()
+		d := s.DB(mongoDatabaseName(TenantFromContext(ctx)))
+		if err := db.ensureIndexes(d); err != nil {
+			errc <- err
+			return
+		}
+		errc <- f(d.C("books"))
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// revisionsOf returns the revisions collection in the database and on the
+// session of c.
+func (db *mongoDB) revisionsOf(c *mgo.Collection) *mgo.Collection {
+	return c.Database.C("revisions")
+}
+
+// addRevision records a revision in the revisions collection of c's session.
+//
+// mgo cannot write two documents atomically, so a change to a book and its
+// revision are written one after the other. If writing the revision fails,
+// the change stands and the error is returned.
+func (db *mongoDB) addRevision(ctx context.Context, c *mgo.Collection, action string, b *Book) error {
+	if err := db.revisionsOf(c).Insert(newRevision(ctx, action, b)); err != nil {
+		return fmt.Errorf("mongodb: could not record revision: %v", err)
+	}
+	return nil
+}
+
+// setDeletedAt moves a book matching selector into the trash at time t, or
+// out of it if t is zero, and records a revision of the change.
+func (db *mongoDB) setDeletedAt(ctx context.Context, c *mgo.Collection, selector bson.M, t time.Time, action string) error {
+	b := &Book{}
+	_, err := c.Find(selector).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"deletedat": t}},
+		ReturnNew: true,
+	}, b)
+	if err != nil {
+		return err
+	}
+	return db.addRevision(ctx, c, action, b)
+}
+
+// notDeleted matches the deletedat field of books outside the trash. Books
+// stored before the trash was introduced have no such field.
+var notDeleted = bson.M{"$in": []interface{}{nil, time.Time{}}}
+
 // GetBook retrieves a book by its ID.
-func (db *mongoDB) GetBook(id int64) (*Book, error) {
+func (db *mongoDB) GetBook(ctx context.Context, id int64) (*Book, error) {
+	b := &Book{}
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		return c.Find(bson.M{"id": id, "deletedat": notDeleted}).One(b)
+	})
+	if err == mgo.ErrNotFound {
+		return nil, errorf(ErrNotFound, "mongodb: book not found with ID %d", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// GetBookByISBN retrieves a book by its ISBN.
+func (db *mongoDB) GetBookByISBN(ctx context.Context, isbn string) (*Book, error) {
+	isbn, err := NormalizeISBN(isbn)
+	if err != nil {
+		return nil, err
+	}
 	b := &Book{}
-	if err := db.c.Find(bson.D{{Name: "id", Value: id}}).One(b); err != nil {
+	err = db.run(ctx, func(c *mgo.Collection) error {
+		return c.Find(bson.M{"isbn": isbn, "deletedat": notDeleted}).One(b)
+	})
+	if err == mgo.ErrNotFound {
+		return nil, errorf(ErrNotFound, "mongodb: book not found with ISBN %s", isbn)
+	}
+	if err != nil {
 		return nil, err
 	}
 	return b, nil
 }
 
+// isbnTaken returns an ErrAlreadyExists error for b if err is a duplicate
+// key error, which the unique ISBN index is the only source of, and err
+// otherwise.
+func isbnTaken(err error, b *Book) error {
+	if mgo.IsDup(err) {
+		return errorf(ErrAlreadyExists, "mongodb: ISBN %s is taken by another book", b.ISBN)
+	}
+	return err
+}
+
 var maxRand = big.NewInt(1<<63 - 1)
 
 // randomID returns a positive number that fits within an int64.
@@ -69,33 +276,496 @@ func randomID() (int64, error) {
 }
 
 // AddBook saves a given book, assigning it a new ID.
-func (db *mongoDB) AddBook(b *Book) (id int64, err error) {
+func (db *mongoDB) AddBook(ctx context.Context, b *Book) (id int64, err error) {
+	if err := normalizeBook("mongodb", b); err != nil {
+		return 0, err
+	}
 	id, err = randomID()
 	if err != nil {
 		return 0, fmt.Errorf("mongodb: could not assign an new ID: %v", err)
 	}
 
 	b.ID = id
-	if err := db.c.Insert(b); err != nil {
+	b.Version = 1
+	b.CreatedAt = creationTime()
+	b.DeletedAt = time.Time{}
+	err = db.run(ctx, func(c *mgo.Collection) error {
+		if err := c.Insert(b); err != nil {
+			return isbnTaken(err, b)
+		}
+		return db.addRevision(ctx, c, RevisionAdd, b)
+	})
+	if ErrorKind(err) == ErrAlreadyExists {
+		return 0, err
+	}
+	if err != nil {
 		return 0, fmt.Errorf("mongodb: could not add book: %v", err)
 	}
 	return id, nil
 }
 
-// DeleteBook removes a given book by its ID.
-func (db *mongoDB) DeleteBook(id int64) error {
-	return db.c.Remove(bson.D{{Name: "id", Value: id}})
+// ImportBook saves a book under its existing ID.
+func (db *mongoDB) ImportBook(ctx context.Context, b *Book) error {
+	if b.ID <= 0 {
+		return errorf(ErrInvalidArgument, "mongodb: cannot import book with ID %d", b.ID)
+	}
+	if err := normalizeBook("mongodb", b); err != nil {
+		return err
+	}
+	if b.CreatedAt.IsZero() {
+		b.CreatedAt = creationTime()
+	}
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		_, err := c.Upsert(bson.D{{Name: "id", Value: b.ID}}, b)
+		return isbnTaken(err, b)
+	})
+	if ErrorKind(err) == ErrAlreadyExists {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("mongodb: could not import book: %v", err)
+	}
+	return nil
+}
+
+// DeleteBook moves a given book to the trash by its ID.
+func (db *mongoDB) DeleteBook(ctx context.Context, id int64) error {
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		return db.setDeletedAt(ctx, c, bson.M{"id": id, "deletedat": notDeleted},
+			time.Now().UTC(), RevisionDelete)
+	})
+	if err == mgo.ErrNotFound {
+		return errorf(ErrNotFound, "mongodb: could not delete book with ID %d, does not exist", id)
+	}
+	return err
+}
+
+// ListDeletedBooks returns the books in the trash, most recently deleted
+// first, optionally filtered by the user who created the book entry.
+func (db *mongoDB) ListDeletedBooks(ctx context.Context, userID string) ([]*Book, error) {
+	query := bson.M{"deletedat": bson.M{"$gt": time.Time{}}}
+	if userID != "" {
+		query["createdbyid"] = userID
+	}
+	var result []*Book
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		return c.Find(query).Sort("-deletedat", "id").All(&result)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mongodb: could not list deleted books: %v", err)
+	}
+	return result, nil
+}
+
+// RestoreBook takes a given book out of the trash by its ID.
+func (db *mongoDB) RestoreBook(ctx context.Context, id int64) error {
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		return db.setDeletedAt(ctx, c, bson.M{"id": id, "deletedat": bson.M{"$gt": time.Time{}}},
+			time.Time{}, RevisionRestore)
+	})
+	if err == mgo.ErrNotFound {
+		return errorf(ErrNotFound, "mongodb: could not restore book with ID %d, not in the trash", id)
+	}
+	return err
+}
+
+// PurgeBooks permanently removes the books moved to the trash before a given
+// time, and their revisions.
+func (db *mongoDB) PurgeBooks(ctx context.Context, before time.Time) (int, error) {
+	var n int
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		var purged []struct{ ID int64 }
+		err := c.Find(bson.M{"deletedat": bson.M{"$gt": time.Time{}, "$lt": before}}).
+			Select(bson.M{"id": 1}).All(&purged)
+		if err != nil || len(purged) == 0 {
+			return err
+		}
+		ids := make([]int64, len(purged))
+		for i, p := range purged {
+			ids[i] = p.ID
+		}
+		if _, err := db.revisionsOf(c).RemoveAll(bson.M{"bookid": bson.M{"$in": ids}}); err != nil {
+			return err
+		}
+		info, err := c.RemoveAll(bson.M{"id": bson.M{"$in": ids}})
+		if err != nil {
+			return err
+		}
+		n = info.Removed
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("mongodb: could not purge books: %v", err)
+	}
+	return n, nil
+}
+
+// ListRevisions returns the revisions of a given book by its ID, oldest
+// first.
+func (db *mongoDB) ListRevisions(ctx context.Context, id int64) ([]*Revision, error) {
+	var revs []*Revision
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		return db.revisionsOf(c).Find(bson.M{"bookid": id}).Sort("time", "_id").All(&revs)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mongodb: could not list revisions: %v", err)
+	}
+	return revs, nil
 }
 
 // UpdateBook updates the entry for a given book.
-func (db *mongoDB) UpdateBook(b *Book) error {
-	return db.c.Update(bson.D{{Name: "id", Value: b.ID}}, b)
+func (db *mongoDB) UpdateBook(ctx context.Context, b *Book) error {
+	if err := normalizeBook("mongodb", b); err != nil {
+		return err
+	}
+	selector := bson.M{"id": b.ID, "version": b.Version, "deletedat": notDeleted}
+	if b.Version == 0 {
+		// Books stored before versioning was introduced have no version field.
+		selector["version"] = bson.M{"$in": []interface{}{0, nil}}
+	}
+
+	updated := *b
+	updated.Version++
+	updated.DeletedAt = time.Time{}
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		// The update replaces the whole document, so carry the stored
+		// creation time over. It never changes, so it is safe to read first.
+		created, err := db.createdTimes(c, []int64{b.ID})
+		if err != nil {
+			return fmt.Errorf("mongodb: could not update book: %v", err)
+		}
+		updated.CreatedAt = created[b.ID]
+		err = c.Update(selector, &updated)
+		if err == nil {
+			return db.addRevision(ctx, c, RevisionUpdate, &updated)
+		}
+		if err != mgo.ErrNotFound {
+			return isbnTaken(err, b)
+		}
+		// Either the book does not exist or is in the trash, or its version
+		// has moved on.
+		n, err := c.Find(bson.M{"id": b.ID, "deletedat": notDeleted}).Count()
+		if err != nil {
+			return fmt.Errorf("mongodb: could not update book: %v", err)
+		}
+		if n == 0 {
+			return errorf(ErrNotFound, "mongodb: could not update book with ID %d, does not exist", b.ID)
+		}
+		return &ConflictError{ID: b.ID, Version: b.Version}
+	})
+	if err != nil {
+		return err
+	}
+	b.Version = updated.Version
+	return nil
+}
+
+// createdTimes returns the creation times of the stored books with the given
+// IDs.
+func (db *mongoDB) createdTimes(c *mgo.Collection, ids []int64) (map[int64]time.Time, error) {
+	var stored []Book
+	err := c.Find(bson.M{"id": bson.M{"$in": ids}}).
+		Select(bson.M{"id": 1, "createdat": 1}).All(&stored)
+	if err != nil {
+		return nil, err
+	}
+	created := make(map[int64]time.Time)
+	for _, s := range stored {
+		created[s.ID] = s.CreatedAt
+	}
+	return created, nil
+}
+
+// bulkErrors records the errors of a failed bulk operation in errs. ops maps
+// the index of each operation to the index of its book in errs; if it is
+// nil, they are the same. bulkErrors returns false if err does not say which
+// operations failed.
+func bulkErrors(err error, errs BatchError, ops []int) bool {
+	bulkErr, ok := err.(*mgo.BulkError)
+	if !ok {
+		return false
+	}
+	for _, c := range bulkErr.Cases() {
+		i := c.Index
+		if ops != nil && i >= 0 && i < len(ops) {
+			i = ops[i]
+		}
+		if i < 0 || i >= len(errs) {
+			return false
+		}
+		if mgo.IsDup(c.Err) {
+			errs[i] = errorf(ErrAlreadyExists, "mongodb: ISBN is taken by another book: %v", c.Err)
+			continue
+		}
+		errs[i] = fmt.Errorf("mongodb: %v", c.Err)
+	}
+	return true
+}
+
+// AddBooks saves the given books, assigning them new IDs.
+//
+// The books are saved with an unordered bulk insert, and each is saved or
+// fails on its own. Their revisions are then recorded with a second bulk
+// insert; as for AddBook, if that fails, the books stay saved.
+func (db *mongoDB) AddBooks(ctx context.Context, bs []*Book) ([]int64, error) {
+	errs := make(BatchError, len(bs))
+	added := make([]Book, len(bs))
+	now := creationTime()
+	for i, b := range bs {
+		errs[i] = normalizeBook("mongodb", b)
+		id, err := randomID()
+		if err != nil {
+			return nil, fmt.Errorf("mongodb: could not assign an new ID: %v", err)
+		}
+		added[i] = *b
+		added[i].ID = id
+		added[i].Version = 1
+		added[i].CreatedAt = now
+		added[i].DeletedAt = time.Time{}
+	}
+	if len(bs) == 0 {
+		return nil, nil
+	}
+
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		bulk := c.Bulk()
+		bulk.Unordered()
+		var ops []int
+		for i := range added {
+			if errs[i] != nil {
+				continue
+			}
+			ops = append(ops, i)
+			bulk.Insert(&added[i])
+		}
+		if len(ops) == 0 {
+			return nil
+		}
+		if _, err := bulk.Run(); err != nil && !bulkErrors(err, errs, ops) {
+			return err
+		}
+
+		revs := db.revisionsOf(c).Bulk()
+		n := 0
+		for i := range added {
+			if errs[i] == nil {
+				revs.Insert(newRevision(ctx, RevisionAdd, &added[i]))
+				n++
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		if _, err := revs.Run(); err != nil {
+			return fmt.Errorf("mongodb: could not record revisions: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mongodb: could not add books: %v", err)
+	}
+
+	ids := make([]int64, len(bs))
+	for i, b := range bs {
+		if errs[i] == nil {
+			*b = added[i]
+			ids[i] = b.ID
+		}
+	}
+	return ids, errs.orNil()
+}
+
+// UpdateBooks updates the entries for the given books.
+//
+// The books are updated with an unordered bulk update, and each is updated
+// or fails on its own. A bulk update only says how many books it matched, so
+// if some did not match, the books are read back to find out which: a book
+// whose version is now one more than it was is taken to be updated.
+func (db *mongoDB) UpdateBooks(ctx context.Context, bs []*Book) error {
+	errs := make(BatchError, len(bs))
+	for i, b := range bs {
+		errs[i] = normalizeBook("mongodb", b)
+	}
+	checkBatchIDs("mongodb", bookIDs(bs), errs)
+
+	updated := make([]Book, len(bs))
+	var ids []int64
+	for i, b := range bs {
+		if errs[i] != nil {
+			continue
+		}
+		updated[i] = *b
+		updated[i].Version++
+		updated[i].DeletedAt = time.Time{}
+		ids = append(ids, b.ID)
+	}
+	if len(ids) == 0 {
+		return errs.orNil()
+	}
+
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		created, err := db.createdTimes(c, ids)
+		if err != nil {
+			return err
+		}
+		bulk := c.Bulk()
+		bulk.Unordered()
+		var ops []int
+		for i, b := range bs {
+			if errs[i] != nil {
+				continue
+			}
+			updated[i].CreatedAt = created[b.ID]
+			ops = append(ops, i)
+			selector := bson.M{"id": b.ID, "version": b.Version, "deletedat": notDeleted}
+			if b.Version == 0 {
+				selector["version"] = bson.M{"$in": []interface{}{0, nil}}
+			}
+			bulk.Update(selector, &updated[i])
+		}
+		r, err := bulk.Run()
+		if err != nil && !bulkErrors(err, errs, ops) {
+			return err
+		}
+
+		if r == nil || r.Matched != len(ids) {
+			var stored []Book
+			err := c.Find(bson.M{"id": bson.M{"$in": ids}, "deletedat": notDeleted}).
+				Select(bson.M{"id": 1, "version": 1}).All(&stored)
+			if err != nil {
+				return err
+			}
+			versions := make(map[int64]int64)
+			for _, s := range stored {
+				versions[s.ID] = s.Version
+			}
+			for i, b := range bs {
+				if errs[i] != nil {
+					continue
+				}
+				if v, ok := versions[b.ID]; !ok {
+					errs[i] = errorf(ErrNotFound, "mongodb: could not update book with ID %d, does not exist", b.ID)
+				} else if v != updated[i].Version {
+					errs[i] = &ConflictError{ID: b.ID, Version: b.Version}
+				}
+			}
+		}
+
+		revs := db.revisionsOf(c).Bulk()
+		n := 0
+		for i := range updated {
+			if errs[i] == nil {
+				revs.Insert(newRevision(ctx, RevisionUpdate, &updated[i]))
+				n++
+			}
+		}
+		if n == 0 {
+			return nil
+		}
+		if _, err := revs.Run(); err != nil {
+			return fmt.Errorf("mongodb: could not record revisions: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("mongodb: could not update books: %v", err)
+	}
+
+	for i, b := range bs {
+		if errs[i] == nil {
+			b.Version = updated[i].Version
+		}
+	}
+	return errs.orNil()
+}
+
+// DeleteBooks moves the books with the given IDs to the trash.
+//
+// The books are moved with a single update, and each is moved or fails on
+// its own: books that do not exist or are already in the trash are reported
+// in the BatchError, while the others are moved.
+func (db *mongoDB) DeleteBooks(ctx context.Context, ids []int64) error {
+	errs := make(BatchError, len(ids))
+	checkBatchIDs("mongodb", ids, errs)
+	var valid []int64
+	for i, id := range ids {
+		if errs[i] == nil {
+			valid = append(valid, id)
+		}
+	}
+	if len(valid) == 0 {
+		return errs.orNil()
+	}
+
+	now := time.Now().UTC()
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		var books []*Book
+		if err := c.Find(bson.M{"id": bson.M{"$in": valid}, "deletedat": notDeleted}).All(&books); err != nil {
+			return err
+		}
+		found := make([]int64, len(books))
+		for i, b := range books {
+			found[i] = b.ID
+		}
+		info, err := c.UpdateAll(bson.M{"id": bson.M{"$in": found}, "deletedat": notDeleted},
+			bson.M{"$set": bson.M{"deletedat": now}})
+		if err != nil {
+			return err
+		}
+		if info.Updated != len(found) {
+			// Some of the books were deleted concurrently: keep those moved
+			// at now.
+			var moved []Book
+			if err := c.Find(bson.M{"id": bson.M{"$in": found}, "deletedat": now}).
+				Select(bson.M{"id": 1}).All(&moved); err != nil {
+				return err
+			}
+			isMoved := make(map[int64]bool)
+			for _, m := range moved {
+				isMoved[m.ID] = true
+			}
+			var ours []*Book
+			for _, b := range books {
+				if isMoved[b.ID] {
+					ours = append(ours, b)
+				}
+			}
+			books = ours
+		}
+
+		deleted := make(map[int64]bool)
+		revs := db.revisionsOf(c).Bulk()
+		for _, b := range books {
+			deleted[b.ID] = true
+			b.DeletedAt = now
+			revs.Insert(newRevision(ctx, RevisionDelete, b))
+		}
+		for i, id := range ids {
+			if errs[i] == nil && !deleted[id] {
+				errs[i] = errorf(ErrNotFound, "mongodb: could not delete book with ID %d, does not exist", id)
+			}
+		}
+		if len(books) == 0 {
+			return nil
+		}
+		if _, err := revs.Run(); err != nil {
+			return fmt.Errorf("mongodb: could not record revisions: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("mongodb: could not delete books: %v", err)
+	}
+	return errs.orNil()
 }
 
 // ListBooks returns a list of books, ordered by title.
-func (db *mongoDB) ListBooks() ([]*Book, error) {
+func (db *mongoDB) ListBooks(ctx context.Context) ([]*Book, error) {
 	var result []*Book
-	if err := db.c.Find(nil).Sort("title").All(&result); err != nil {
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		return c.Find(bson.M{"deletedat": notDeleted}).Sort("title").All(&result)
+	})
+	if err != nil {
 		return nil, err
 	}
 	return result, nil
@@ -103,10 +773,125 @@ func (db *mongoDB) ListBooks() ([]*Book, error) {
 
 // ListBooksCreatedBy returns a list of books, ordered by title, filtered by
 // the user who created the book entry.
-func (db *mongoDB) ListBooksCreatedBy(userID string) ([]*Book, error) {
+func (db *mongoDB) ListBooksCreatedBy(ctx context.Context, userID string) ([]*Book, error) {
+	var result []*Book
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		return c.Find(bson.M{"createdbyid": userID, "deletedat": notDeleted}).Sort("title").All(&result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListBooksByTag returns the books with a given tag, ordered by title.
+func (db *mongoDB) ListBooksByTag(ctx context.Context, tag string) ([]*Book, error) {
+	tag, err := NormalizeTag(tag)
+	if err != nil {
+		return nil, err
+	}
 	var result []*Book
-	if err := db.c.Find(bson.D{{Name: "createdbyid", Value: userID}}).Sort("title").All(&result); err != nil {
+	err = db.run(ctx, func(c *mgo.Collection) error {
+		return c.Find(bson.M{"tags": tag, "deletedat": notDeleted}).Sort("title").All(&result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListTags returns the tags of the books outside the trash, with their
+// counts. They are counted by an aggregation pipeline.
+func (db *mongoDB) ListTags(ctx context.Context) ([]TagCount, error) {
+	var counts []struct {
+		Tag   string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		return c.Pipe([]bson.M{
+			{"$match": bson.M{"deletedat": notDeleted}},
+			{"$unwind": "$tags"},
+			{"$group": bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}},
+			{"$sort": bson.M{"_id": 1}},
+		}).All(&counts)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mongodb: could not list tags: %v", err)
+	}
+	tags := make([]TagCount, len(counts))
+	for i, c := range counts {
+		tags[i] = TagCount{Tag: c.Tag, Count: c.Count}
+	}
+	return tags, nil
+}
+
+// mongoSortFields maps each SortField to the document field it sorts by.
+var mongoSortFields = map[SortField]string{
+	SortByTitle:         "title",
+	SortByAuthor:        "author",
+	SortByPublishedDate: "publisheddate",
+	SortByCreatedAt:     "createdat",
+}
+
+// ListBooksPage returns a page of books, selected and ordered by opts,
+// starting at the given cursor.
+func (db *mongoDB) ListBooksPage(ctx context.Context, opts ListOptions, cursor string, pageSize int) (*BookPage, error) {
+	if err := opts.validate("mongodb"); err != nil {
 		return nil, err
 	}
+	cur, err := decodeCursor(cursor, &opts)
+	if err != nil {
+		return nil, err
+	}
+	pageSize = normalizePageSize(pageSize)
+
+	query := bson.M{"deletedat": notDeleted}
+	if opts.CreatedByID != "" {
+		query["createdbyid"] = opts.CreatedByID
+	}
+	if opts.Author != "" {
+		query["author"] = opts.Author
+	}
+	if from, to, ok := opts.publishedRange(); ok {
+		query["publisheddate"] = bson.M{"$gte": from, "$lt": to}
+	}
+
+	field := mongoSortFields[opts.sortBy()]
+	op, order := "$gt", []string{field, "id"}
+	if !opts.readsAscending(cur) {
+		op, order = "$lt", []string{"-" + field, "-id"}
+	}
+	if cur != nil {
+		query["$or"] = []bson.M{
+			{field: bson.M{op: cur.value()}},
+			{field: cur.value(), "id": bson.M{op: cur.ID}},
+		}
+	}
+
+	var books []*Book
+	err = db.run(ctx, func(c *mgo.Collection) error {
+		// Fetch one extra book to find out whether there is another page.
+		return c.Find(query).Sort(order...).Limit(pageSize + 1).All(&books)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mongodb: could not list books: %v", err)
+	}
+	return newBookPage(books, &opts, cur, pageSize), nil
+}
+
+// SearchBooks returns the books whose title, author or description match the
+// query, most relevant first.
+func (db *mongoDB) SearchBooks(ctx context.Context, query string) ([]*Book, error) {
+	var result []*Book
+	err := db.run(ctx, func(c *mgo.Collection) error {
+		return c.Find(bson.M{"$text": bson.M{"$search": query}, "deletedat": notDeleted}).
+			Select(bson.M{"score": bson.M{"$meta": "textScore"}}).
+			Sort("$textScore:score").
+			Limit(maxSearchResults).
+			All(&result)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mongodb: could not search books: %v", err)
+	}
 	return result, nil
 }
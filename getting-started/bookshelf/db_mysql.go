@@ -7,42 +7,15 @@ package bookshelf
 import (
 	"database/sql"
 	"database/sql/driver"
-	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net/url"
 
-	"github.com/go-sql-driver/mysql"
-)
-
-var createTableStatements = []string{
-	`CREATE DATABASE IF NOT EXISTS library DEFAULT CHARACTER SET = 'utf8' DEFAULT COLLATE 'utf8_general_ci';`,
-	`USE library;`,
-	`CREATE TABLE IF NOT EXISTS books (
-		id INT UNSIGNED NOT NULL AUTO_INCREMENT,
-		title VARCHAR(255) NULL,
-		author VARCHAR(255) NULL,
-		publishedDate VARCHAR(255) NULL,
-		imageUrl VARCHAR(255) NULL,
-		description TEXT NULL,
-		createdBy VARCHAR(255) NULL,
-		createdById VARCHAR(255) NULL,
-		PRIMARY KEY (id)
-	)`,
-}
-
-// mysqlDB persists books to a MySQL instance.
-type mysqlDB struct {
-	conn *sql.DB
-
-	list   *sql.Stmt
-	listBy *sql.Stmt
-	insert *sql.Stmt
-	get    *sql.Stmt
-	update *sql.Stmt
-	delete *sql.Stmt
-}
+	_ "github.com/go-sql-driver/mysql" // Registers the "mysql" driver.
 
-// Ensure mysqlDB conforms to the BookDatabase interface.
-var _ BookDatabase = &mysqlDB{}
+	"golang.org/x/net/context"
+)
 
 type MySQLConfig struct {
 	// Optional.
@@ -51,9 +24,14 @@ type MySQLConfig struct {
 	// Required.
 	Host string
 	Port int
+
+	// Optional. If set, newMySQLDB does not apply pending schema migrations,
+	// and fails if there are any. Run them with `bookshelf migrate` instead.
+	SkipMigrations bool
 }
 
-// dataStoreName returns a connection string suitable for sql.Open.
+// dataStoreName returns a connection string suitable for sql.Open. Timestamp
+// columns are read as time.Time values.
 func (c MySQLConfig) dataStoreName(databaseName string) string {
 	var cred string
 	// [username[:password]@]
@@ -65,262 +43,290 @@ func (c MySQLConfig) dataStoreName(databaseName string) string {
 		cred = cred + "@"
 	}
 
-	return fmt.Sprintf("%stcp([%s]:%d)/%s", cred, c.Host, c.Port, databaseName)
+	return fmt.Sprintf("%stcp([%s]:%d)/%s?parseTime=true", cred, c.Host, c.Port, databaseName)
 }
 
-// newMySQLDB creates a new BookDatabase backed by a given MySQL server.
-func newMySQLDB(config MySQLConfig) (BookDatabase, error) {
-	// Check database and table exists. If not, create it.
-	if err := config.ensureTableExists(); err != nil {
-		return nil, err
-	}
-
-	conn, err := sql.Open("mysql", config.dataStoreName("library"))
+// mysqlConfigFromURL parses a mysql://[user[:password]@]host[:port] data
+// source name.
+func mysqlConfigFromURL(u *url.URL) (MySQLConfig, error) {
+	host, port, err := splitHostPort(u.Host, 3306)
 	if err != nil {
-		return nil, fmt.Errorf("mysql: could not get a connection: %v", err)
-	}
-	if err := conn.Ping(); err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("mysql: could not establish a good connection: %v", err)
-	}
-
-	db := &mysqlDB{
-		conn: conn,
-	}
-
-	// Prepared statements. The actual SQL queries are in the code near the
-	// relevant method (e.g. addBook).
-	if db.list, err = conn.Prepare(listStatement); err != nil {
-		return nil, fmt.Errorf("mysql: prepare list: %v", err)
-	}
-	if db.listBy, err = conn.Prepare(listByStatement); err != nil {
-		return nil, fmt.Errorf("mysql: prepare listBy: %v", err)
-	}
-	if db.get, err = conn.Prepare(getStatement); err != nil {
-		return nil, fmt.Errorf("mysql: prepare get: %v", err)
+		return MySQLConfig{}, err
 	}
-	if db.insert, err = conn.Prepare(insertStatement); err != nil {
-		return nil, fmt.Errorf("mysql: prepare insert: %v", err)
+	config := MySQLConfig{Host: host, Port: port}
+	if u.User != nil {
+		config.Username = u.User.Username()
+		config.Password, _ = u.User.Password()
 	}
-	if db.update, err = conn.Prepare(updateStatement); err != nil {
-		return nil, fmt.Errorf("mysql: prepare update: %v", err)
-	}
-	if db.delete, err = conn.Prepare(deleteStatement); err != nil {
-		return nil, fmt.Errorf("mysql: prepare delete: %v", err)
-	}
-
-	return db, nil
-}
-
-// Close closes the database, freeing up any resources.
-func (db *mysqlDB) Close() {
-	db.conn.Close()
-}
-
-// rowScanner is implemented by sql.Row and sql.Rows
-type rowScanner interface {
-	Scan(dest ...interface{}) error
+	return config, nil
 }
 
-// scanBook reads a book from a sql.Row or sql.Rows
-func scanBook(s rowScanner) (*Book, error) {
-	var (
-		id            int64
-		title         sql.NullString
-		author        sql.NullString
-		publishedDate sql.NullString
-		imageURL      sql.NullString
-		description   sql.NullString
-		createdBy     sql.NullString
-		createdByID   sql.NullString
-	)
-	if err := s.Scan(&id, &title, &author, &publishedDate, &imageURL,
-		&description, &createdBy, &createdByID); err != nil {
-		return nil, err
-	}
-
-	book := &Book{
-		ID:            id,
-		Title:         title.String,
-		Author:        author.String,
-		PublishedDate: publishedDate.String,
-		ImageURL:      imageURL.String,
-		Description:   description.String,
-		CreatedBy:     createdBy.String,
-		CreatedByID:   createdByID.String,
-	}
-	return book, nil
-}
-
-const listStatement = `SELECT * FROM books ORDER BY title`
-
-// ListBooks returns a list of books, ordered by title.
-func (db *mysqlDB) ListBooks() ([]*Book, error) {
-	rows, err := db.list.Query()
+// newMySQLDB creates a new BookDatabase backed by a given MySQL server.
+func newMySQLDB(config MySQLConfig) (BookDatabase, error) {
+	conn, err := config.openLibrary(context.Background(), false, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var books []*Book
-	for rows.Next() {
-		book, err := scanBook(rows)
-		if err != nil {
-			return nil, fmt.Errorf("mysql: could not read row: %v", err)
-		}
-
-		books = append(books, book)
-	}
-
-	return books, nil
+	return newSQLDB(conn, mysqlDialect, config.SkipMigrations)
 }
 
-const listByStatement = `
-  SELECT * FROM books
-  WHERE createdById = ? ORDER BY title`
-
-// ListBooksCreatedBy returns a list of books, ordered by title, filtered by
-// the user who created the book entry.
-func (db *mysqlDB) ListBooksCreatedBy(userID string) ([]*Book, error) {
-	if userID == "" {
-		return db.ListBooks()
-	}
-
-	rows, err := db.listBy.Query(userID)
+// openLibrary connects to the library database, creating it if it does not
+// exist. In a dry run, the database is not created: the statement that
+// would create it is written to w and the returned connection is nil.
+func (c MySQLConfig) openLibrary(ctx context.Context, dryRun bool, w io.Writer) (*sql.DB, error) {
+	server, err := sql.Open("mysql", c.dataStoreName(""))
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("mysql: could not get a connection: %v", err)
 	}
-	defer rows.Close()
+	defer server.Close()
 
-	var books []*Book
-	for rows.Next() {
-		book, err := scanBook(rows)
-		if err != nil {
-			return nil, fmt.Errorf("mysql: could not read row: %v", err)
-		}
-
-		books = append(books, book)
+	// Check the connection.
+	if server.Ping() == driver.ErrBadConn {
+		return nil, fmt.Errorf("mysql: could not connect to the database. " +
+			"could be bad address, or this address is not whitelisted for access.")
 	}
 
-	return books, nil
-}
-
-const getStatement = "SELECT * FROM books WHERE id = ?"
-
-// GetBook retrieves a book by its ID.
-func (db *mysqlDB) GetBook(id int64) (*Book, error) {
-	book, err := scanBook(db.get.QueryRow(id))
-	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("mysql: could not find book with id %d", id)
-	}
+	var n int
+	err = server.QueryRowContext(ctx, `SELECT COUNT(*) FROM information_schema.schemata
+		WHERE schema_name = 'library'`).Scan(&n)
 	if err != nil {
-		return nil, fmt.Errorf("mysql: could not get book: %v", err)
+		return nil, fmt.Errorf("mysql: could not check database exists: %v", err)
 	}
-	return book, nil
-}
-
-const insertStatement = `
-  INSERT INTO books (
-    title, author, publishedDate, imageUrl, description, createdBy, createdById
-  ) VALUES (?, ?, ?, ?, ?, ?, ?)`
-
-// AddBook saves a given book, assigning it a new ID.
-func (db *mysqlDB) AddBook(b *Book) (id int64, err error) {
-	r, err := execAffectingOneRow(db.insert, b.Title, b.Author, b.PublishedDate,
-		b.ImageURL, b.Description, b.CreatedBy, b.CreatedByID)
-	if err != nil {
-		return 0, err
+	if n == 0 {
+		const create = `CREATE DATABASE library
+			DEFAULT CHARACTER SET = 'utf8' DEFAULT COLLATE 'utf8_general_ci'`
+		if w != nil {
+			fmt.Fprintf(w, "%s;\n", create)
+		}
+		if dryRun {
+			return nil, nil
+		}
+		if _, err := server.ExecContext(ctx, create); err != nil {
+			return nil, fmt.Errorf("mysql: could not create database: %v", err)
+		}
 	}
 
-	lastInsertID, err := r.LastInsertId()
+	conn, err := sql.Open("mysql", c.dataStoreName("library"))
 	if err != nil {
-		return 0, fmt.Errorf("mysql: could not get last insert ID: %v", err)
+		return nil, fmt.Errorf("mysql: could not get a connection: %v", err)
 	}
-	return lastInsertID, nil
-}
-
-const deleteStatement = `DELETE FROM books WHERE id = ?`
-
-// DeleteBook removes a given book by its ID.
-func (db *mysqlDB) DeleteBook(id int64) error {
-	if id == 0 {
-		return errors.New("memorydb: book with unassigned ID passed into deleteBook")
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mysql: could not establish a good connection: %v", err)
 	}
-	_, err := execAffectingOneRow(db.delete, id)
-	return err
+	return conn, nil
 }
 
-const updateStatement = `
-  UPDATE books
-  SET title=?, author=?, publishedDate=?, imageUrl=?, description=?,
-      createdBy=?, createdById=?
-  WHERE id = ?`
-
-// UpdateBook updates the entry for a given book.
-func (db *mysqlDB) UpdateBook(b *Book) error {
-	if b.ID == 0 {
-		return errors.New("memorydb: book with unassigned ID passed into updateBook")
-	}
-
-	_, err := execAffectingOneRow(db.update, b.Title, b.Author, b.PublishedDate,
-		b.ImageURL, b.Description, b.CreatedBy, b.CreatedByID, b.ID)
-	return err
+var mysqlDialect = &sqlDialect{
+	name:  "mysql",
+	maxID: math.MaxUint32,
+
+	// After a multi-row INSERT, MySQL returns the ID of the first row. The
+	// others follow it only if innodb_autoinc_lock_mode is 0 or 1 (it is 2
+	// by default since MySQL 8.0) and auto_increment_increment is 1.
+	insertRowByRow: true,
+
+	importStatement: `
+  INSERT INTO books (tenant, ` + bookColumns + `)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+  ON DUPLICATE KEY UPDATE
+    title=VALUES(title), author=VALUES(author),
+    publishedDate=VALUES(publishedDate), imageUrl=VALUES(imageUrl),
+    description=VALUES(description), createdBy=VALUES(createdBy),
+    createdById=VALUES(createdById), version=VALUES(version),
+    deletedAt=VALUES(deletedAt), isbn=VALUES(isbn), tags=VALUES(tags),
+    createdAt=VALUES(createdAt)`,
+
+	searchStatement: `
+  SELECT ` + bookColumns + ` FROM books
+  WHERE MATCH (title, author, description) AGAINST (?)
+    AND tenant = ? AND deletedAt IS NULL
+  ORDER BY MATCH (title, author, description) AGAINST (?) DESC
+  LIMIT ?`,
+
+	tableExistsQuery: `SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name = ?`,
+
+	// Named locks are server-wide, so the name includes the database's.
+	lockMigrationsQuery:       `SELECT GET_LOCK(CONCAT(DATABASE(), '.bookshelf_migrate'), -1)`,
+	unlockMigrationsStatement: `DO RELEASE_LOCK(CONCAT(DATABASE(), '.bookshelf_migrate'))`,
+
+	migrations: []migration{
+		{
+			Version:     1,
+			Description: "create books table",
+			Up: []string{`CREATE TABLE books (
+			id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+			title VARCHAR(255) NULL,
+			author VARCHAR(255) NULL,
+			publishedDate VARCHAR(255) NULL,
+			imageUrl VARCHAR(255) NULL,
+			description TEXT NULL,
+			createdBy VARCHAR(255) NULL,
+			createdById VARCHAR(255) NULL,
+			PRIMARY KEY (id)
+		)`},
+			Down: []string{`DROP TABLE books`},
+		},
+		{
+			Version:     2,
+			Description: "add full-text search index",
+			Up: []string{`ALTER TABLE books
+			ADD FULLTEXT KEY books_search (title, author, description)`},
+			Down: []string{`ALTER TABLE books DROP INDEX books_search`},
+		},
+		{
+			Version:     3,
+			Description: "add version column",
+			Up: []string{`ALTER TABLE books
+			ADD COLUMN version BIGINT UNSIGNED NOT NULL DEFAULT 1`},
+			Down: []string{`ALTER TABLE books DROP COLUMN version`},
+		},
+		{
+			Version:     4,
+			Description: "add trash",
+			Up: []string{`ALTER TABLE books
+			ADD COLUMN deletedAt DATETIME(6) NULL,
+			ADD INDEX books_deleted (deletedAt)`},
+			Down: []string{`ALTER TABLE books
+			DROP INDEX books_deleted,
+			DROP COLUMN deletedAt`},
+		},
+		{
+			Version:     5,
+			Description: "create revisions table",
+			Up: []string{`CREATE TABLE revisions (
+			seq BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+			action VARCHAR(16) NOT NULL,
+			actor VARCHAR(255) NOT NULL,
+			changedAt DATETIME(6) NOT NULL,
+			id INT UNSIGNED NOT NULL,
+			title VARCHAR(255) NULL,
+			author VARCHAR(255) NULL,
+			publishedDate VARCHAR(255) NULL,
+			imageUrl VARCHAR(255) NULL,
+			description TEXT NULL,
+			createdBy VARCHAR(255) NULL,
+			createdById VARCHAR(255) NULL,
+			version BIGINT UNSIGNED NOT NULL,
+			deletedAt DATETIME(6) NULL,
+			PRIMARY KEY (seq),
+			KEY revisions_book (id)
+		)`},
+			Down: []string{`DROP TABLE revisions`},
+		},
+		{
+			Version:     6,
+			Description: "add ISBN column",
+			Up: []string{
+				`ALTER TABLE books
+			ADD COLUMN isbn CHAR(13) NULL,
+			ADD UNIQUE INDEX books_isbn (isbn)`,
+				`ALTER TABLE revisions ADD COLUMN isbn CHAR(13) NULL`,
+			},
+			Down: []string{
+				`ALTER TABLE revisions DROP COLUMN isbn`,
+				`ALTER TABLE books
+			DROP INDEX books_isbn,
+			DROP COLUMN isbn`,
+			},
+		},
+		{
+			Version:     7,
+			Description: "add tags",
+			// The tags column holds a book's tags, comma-separated, for
+			// reading books and their revisions; book_tags indexes them.
+			Up: []string{
+				`ALTER TABLE books ADD COLUMN tags TEXT NULL`,
+				`ALTER TABLE revisions ADD COLUMN tags TEXT NULL`,
+				`CREATE TABLE book_tags (
+			bookId INT UNSIGNED NOT NULL,
+			tag VARCHAR(64) NOT NULL,
+			PRIMARY KEY (bookId, tag),
+			KEY book_tags_tag (tag)
+		)`,
+			},
+			Down: []string{
+				`DROP TABLE book_tags`,
+				`ALTER TABLE revisions DROP COLUMN tags`,
+				`ALTER TABLE books DROP COLUMN tags`,
+			},
+		},
+		{
+			Version:     8,
+			Description: "add creation time and list indexes",
+			// Existing books are taken to have been created at their first
+			// revision, or now if they have none.
+			Up: []string{
+				`ALTER TABLE books
+			ADD COLUMN createdAt DATETIME(6) NULL,
+			ADD INDEX books_author (author),
+			ADD INDEX books_published (publishedDate),
+			ADD INDEX books_created (createdAt)`,
+				`ALTER TABLE revisions ADD COLUMN createdAt DATETIME(6) NULL`,
+				`UPDATE books SET createdAt = COALESCE(
+			(SELECT MIN(changedAt) FROM revisions WHERE revisions.id = books.id),
+			UTC_TIMESTAMP(6))`,
+			},
+			Down: []string{
+				`ALTER TABLE revisions DROP COLUMN createdAt`,
+				`ALTER TABLE books
+			DROP INDEX books_created,
+			DROP INDEX books_published,
+			DROP INDEX books_author,
+			DROP COLUMN createdAt`,
+			},
+		},
+		{
+			Version:     9,
+			Description: "add tenants",
+			// Existing books belong to the default tenant, named by the
+			// empty string. ISBNs are unique within a tenant.
+			Up: []string{
+				`ALTER TABLE books
+			ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT '',
+			DROP INDEX books_isbn,
+			ADD UNIQUE INDEX books_isbn (tenant, isbn),
+			ADD INDEX books_tenant (tenant, deletedAt)`,
+				`ALTER TABLE revisions ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT ''`,
+			},
+			Down: []string{
+				`ALTER TABLE revisions DROP COLUMN tenant`,
+				`ALTER TABLE books
+			DROP INDEX books_tenant,
+			DROP INDEX books_isbn,
+			ADD UNIQUE INDEX books_isbn (isbn),
+			DROP COLUMN tenant`,
+			},
+		},
+	},
+
+	legacyVersion: mysqlLegacyVersion,
 }
 
-// ensureTableExists checks the table exists. If not, it creates it.
-func (config MySQLConfig) ensureTableExists() error {
-	conn, err := sql.Open("mysql", config.dataStoreName(""))
-	if err != nil {
-		return fmt.Errorf("mysql: could not get a connection: %v", err)
-	}
-	defer conn.Close()
-
-	// Check the connection.
-	if conn.Ping() == driver.ErrBadConn {
-		return fmt.Errorf("mysql: could not connect to the database. " +
-			"could be bad address, or this address is not whitelisted for access.")
+// mysqlLegacyVersion inspects a database created before the schema_version
+// table was introduced, to find which migrations its schema already reflects.
+func mysqlLegacyVersion(ctx context.Context, conn *sql.DB) (int, error) {
+	checks := []string{
+		`SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name = 'books'`,
+		`SELECT COUNT(*) FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = 'books'
+			AND index_name = 'books_search'`,
+		`SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = 'books'
+			AND column_name = 'version'`,
 	}
-
-	if _, err := conn.Exec("USE library"); err != nil {
-		// MySQL error 1049 is "database does not exist"
-		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1049 {
-			return createTable(conn)
+	v := 0
+	for _, q := range checks {
+		var n int
+		if err := conn.QueryRowContext(ctx, q).Scan(&n); err != nil {
+			return 0, fmt.Errorf("mysql: could not inspect schema: %v", err)
 		}
-	}
-
-	if _, err := conn.Exec("DESCRIBE books"); err != nil {
-		// MySQL error 1146 is "table does not exist"
-		if mErr, ok := err.(*mysql.MySQLError); ok && mErr.Number == 1146 {
-			return createTable(conn)
-		}
-		// Unknown error.
-		return fmt.Errorf("mysql: could not connect to the database: %v", err)
-	}
-	return nil
-}
-
-// createTable creates the table, and if necessary, the database.
-func createTable(conn *sql.DB) error {
-	for _, stmt := range createTableStatements {
-		_, err := conn.Exec(stmt)
-		if err != nil {
-			return err
+		if n == 0 {
+			break
 		}
+		v++
 	}
-	return nil
-}
-
-// execAffectingOneRow executes a given statement, expecting one row to be affected.
-func execAffectingOneRow(stmt *sql.Stmt, args ...interface{}) (sql.Result, error) {
-	r, err := stmt.Exec(args...)
-	if err != nil {
-		return r, fmt.Errorf("mysql: could not execute statement: %v", err)
-	}
-	rowsAffected, err := r.RowsAffected()
-	if err != nil {
-		return r, fmt.Errorf("mysql: could not get rows affected: %v", err)
-	} else if rowsAffected != 1 {
-		return r, fmt.Errorf("mysql: expected 1 row affected, got %d", rowsAffected)
-	}
-	return r, nil
+	return v, nil
 }
@@ -0,0 +1,291 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq" // Registers the "postgres" driver.
+)
+
+// PostgresConfig describes how to connect to a PostgreSQL server, such as
+// Cloud SQL for PostgreSQL.
+type PostgresConfig struct {
+	// Optional.
+	Username, Password string
+
+	// Required. Host may also be the directory of a Unix socket, such as
+	// /cloudsql/project:region:instance.
+	Host string
+	Port int
+
+	// Optional. The name of the database, which must exist. Defaults to
+	// "library".
+	Database string
+
+	// Optional. The SSL mode (see the lib/pq package docs). Defaults to
+	// "require".
+	SSLMode string
+
+	// Optional. If set, newPostgresDB does not apply pending schema
+	// migrations, and fails if there are any.
+	SkipMigrations bool
+}
+
+// dataSourceName returns a connection string suitable for sql.Open.
+func (c PostgresConfig) dataSourceName() string {
+	database := c.Database
+	if database == "" {
+		database = "library"
+	}
+	u := &url.URL{Scheme: "postgres", Path: "/" + database}
+	params := url.Values{}
+	if c.SSLMode != "" {
+		params.Set("sslmode", c.SSLMode)
+	}
+	if strings.HasPrefix(c.Host, "/") {
+		// lib/pq takes Unix socket directories as a parameter.
+		params.Set("host", c.Host)
+	} else {
+		u.Host = c.Host
+		if c.Port != 0 {
+			u.Host += ":" + strconv.Itoa(c.Port)
+		}
+	}
+	u.RawQuery = params.Encode()
+	switch {
+	case c.Username != "" && c.Password != "":
+		u.User = url.UserPassword(c.Username, c.Password)
+	case c.Username != "":
+		u.User = url.User(c.Username)
+	}
+	return u.String()
+}
+
+// postgresConfigFromURL parses a
+// postgres://[user[:password]@]host[:port][/database][?sslmode=mode] data
+// source name.
+func postgresConfigFromURL(u *url.URL) PostgresConfig {
+	host, port, _ := splitHostPort(u.Host, 5432)
+	config := PostgresConfig{
+		Host:     host,
+		Port:     port,
+		Database: strings.TrimPrefix(u.Path, "/"),
+		SSLMode:  u.Query().Get("sslmode"),
+	}
+	if u.User != nil {
+		config.Username = u.User.Username()
+		config.Password, _ = u.User.Password()
+	}
+	return config
+}
+
+// newPostgresDB creates a new BookDatabase backed by a given PostgreSQL
+// server.
+func newPostgresDB(config PostgresConfig) (BookDatabase, error) {
+	conn, err := config.open()
+	if err != nil {
+		return nil, err
+	}
+	return newSQLDB(conn, postgresDialect, config.SkipMigrations)
+}
+
+// open connects to the database.
+func (c PostgresConfig) open() (*sql.DB, error) {
+	conn, err := sql.Open("postgres", c.dataSourceName())
+	if err != nil {
+		return nil, fmt.Errorf("postgres: could not get a connection: %v", err)
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("postgres: could not establish a good connection: %v", err)
+	}
+	return conn, nil
+}
+
+// postgresSearchVector is the weighted text of a book that SearchBooks
+// matches queries against.
+const postgresSearchVector = `
+  setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+  setweight(to_tsvector('english', coalesce(author, '')), 'B') ||
+  setweight(to_tsvector('english', coalesce(description, '')), 'C')`
+
+var postgresDialect = &sqlDialect{
+	name:            "postgres",
+	numberedParams:  true,
+	insertReturnsID: true,
+	maxID:           math.MaxInt64,
+
+	importStatement: `
+  INSERT INTO books (tenant, ` + bookColumns + `)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+  ON CONFLICT (id) DO UPDATE SET
+    title=EXCLUDED.title, author=EXCLUDED.author,
+    publishedDate=EXCLUDED.publishedDate, imageUrl=EXCLUDED.imageUrl,
+    description=EXCLUDED.description, createdBy=EXCLUDED.createdBy,
+    createdById=EXCLUDED.createdById, version=EXCLUDED.version,
+    deletedAt=EXCLUDED.deletedAt, isbn=EXCLUDED.isbn, tags=EXCLUDED.tags,
+    createdAt=EXCLUDED.createdAt`,
+
+	// Imported IDs are not drawn from the id column's sequence, so move the
+	// sequence past them for AddBook.
+	afterImport: `
+  SELECT setval(pg_get_serial_sequence('books', 'id'),
+    GREATEST((SELECT MAX(id) FROM books), 1))`,
+
+	searchStatement: `
+  SELECT ` + bookColumns + ` FROM books
+  WHERE (` + postgresSearchVector + `) @@ plainto_tsquery('english', ?)
+    AND tenant = ? AND deletedAt IS NULL
+  ORDER BY ts_rank(` + postgresSearchVector + `,
+    plainto_tsquery('english', ?)) DESC
+  LIMIT ?`,
+
+	tableExistsQuery: `SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name = ?`,
+
+	// Advisory locks are per database, and keyed by an arbitrary number.
+	lockMigrationsQuery:       `SELECT 1 FROM (SELECT pg_advisory_lock(20160501)) AS l`,
+	unlockMigrationsStatement: `SELECT pg_advisory_unlock(20160501)`,
+
+	migrations: []migration{
+		{
+			Version:     1,
+			Description: "create books table",
+			Up: []string{`CREATE TABLE books (
+			id BIGSERIAL PRIMARY KEY,
+			title VARCHAR(255) NULL,
+			author VARCHAR(255) NULL,
+			publishedDate VARCHAR(255) NULL,
+			imageUrl VARCHAR(255) NULL,
+			description TEXT NULL,
+			createdBy VARCHAR(255) NULL,
+			createdById VARCHAR(255) NULL,
+			version BIGINT NOT NULL DEFAULT 1
+		)`,
+				`CREATE INDEX books_search ON books USING GIN ((` + postgresSearchVector + `))`,
+			},
+			Down: []string{`DROP TABLE books`},
+		},
+		{
+			Version:     2,
+			Description: "add trash",
+			Up: []string{
+				`ALTER TABLE books ADD COLUMN deletedAt TIMESTAMP WITH TIME ZONE NULL`,
+				`CREATE INDEX books_deleted ON books (deletedAt)`,
+			},
+			Down: []string{
+				`DROP INDEX books_deleted`,
+				`ALTER TABLE books DROP COLUMN deletedAt`,
+			},
+		},
+		{
+			Version:     3,
+			Description: "create revisions table",
+			Up: []string{`CREATE TABLE revisions (
+			seq BIGSERIAL PRIMARY KEY,
+			action VARCHAR(16) NOT NULL,
+			actor VARCHAR(255) NOT NULL,
+			changedAt TIMESTAMP WITH TIME ZONE NOT NULL,
+			id BIGINT NOT NULL,
+			title VARCHAR(255) NULL,
+			author VARCHAR(255) NULL,
+			publishedDate VARCHAR(255) NULL,
+			imageUrl VARCHAR(255) NULL,
+			description TEXT NULL,
+			createdBy VARCHAR(255) NULL,
+			createdById VARCHAR(255) NULL,
+			version BIGINT NOT NULL,
+			deletedAt TIMESTAMP WITH TIME ZONE NULL
+		)`,
+				`CREATE INDEX revisions_book ON revisions (id)`,
+			},
+			Down: []string{`DROP TABLE revisions`},
+		},
+		{
+			Version:     4,
+			Description: "add ISBN column",
+			Up: []string{
+				`ALTER TABLE books ADD COLUMN isbn CHAR(13) NULL`,
+				`CREATE UNIQUE INDEX books_isbn ON books (isbn)`,
+				`ALTER TABLE revisions ADD COLUMN isbn CHAR(13) NULL`,
+			},
+			Down: []string{
+				`ALTER TABLE revisions DROP COLUMN isbn`,
+				`DROP INDEX books_isbn`,
+				`ALTER TABLE books DROP COLUMN isbn`,
+			},
+		},
+		{
+			Version:     5,
+			Description: "add tags",
+			// The tags column holds a book's tags, comma-separated, for
+			// reading books and their revisions; book_tags indexes them.
+			Up: []string{
+				`ALTER TABLE books ADD COLUMN tags TEXT NULL`,
+				`ALTER TABLE revisions ADD COLUMN tags TEXT NULL`,
+				`CREATE TABLE book_tags (
+			bookId BIGINT NOT NULL,
+			tag VARCHAR(64) NOT NULL,
+			PRIMARY KEY (bookId, tag)
+		)`,
+				`CREATE INDEX book_tags_tag ON book_tags (tag)`,
+			},
+			Down: []string{
+				`DROP TABLE book_tags`,
+				`ALTER TABLE revisions DROP COLUMN tags`,
+				`ALTER TABLE books DROP COLUMN tags`,
+			},
+		},
+		{
+			Version:     6,
+			Description: "add creation time and list indexes",
+			// Existing books are taken to have been created at their first
+			// revision, or now if they have none.
+			Up: []string{
+				`ALTER TABLE books ADD COLUMN createdAt TIMESTAMP WITH TIME ZONE NULL`,
+				`ALTER TABLE revisions ADD COLUMN createdAt TIMESTAMP WITH TIME ZONE NULL`,
+				`UPDATE books SET createdAt = COALESCE(
+			(SELECT MIN(changedAt) FROM revisions WHERE revisions.id = books.id),
+			NOW())`,
+				`CREATE INDEX books_author ON books (author)`,
+				`CREATE INDEX books_published ON books (publishedDate)`,
+				`CREATE INDEX books_created ON books (createdAt)`,
+			},
+			Down: []string{
+				`DROP INDEX books_created`,
+				`DROP INDEX books_published`,
+				`DROP INDEX books_author`,
+				`ALTER TABLE revisions DROP COLUMN createdAt`,
+				`ALTER TABLE books DROP COLUMN createdAt`,
+			},
+		},
+		{
+			Version:     7,
+			Description: "add tenants",
+			// Existing books belong to the default tenant, named by the
+			// empty string. ISBNs are unique within a tenant.
+			Up: []string{
+				`ALTER TABLE books ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT ''`,
+				`ALTER TABLE revisions ADD COLUMN tenant VARCHAR(64) NOT NULL DEFAULT ''`,
+				`DROP INDEX books_isbn`,
+				`CREATE UNIQUE INDEX books_isbn ON books (tenant, isbn)`,
+				`CREATE INDEX books_tenant ON books (tenant, deletedAt)`,
+			},
+			Down: []string{
+				`DROP INDEX books_tenant`,
+				`DROP INDEX books_isbn`,
+				`CREATE UNIQUE INDEX books_isbn ON books (isbn)`,
+				`ALTER TABLE revisions DROP COLUMN tenant`,
+				`ALTER TABLE books DROP COLUMN tenant`,
+			},
+		},
+	},
+}
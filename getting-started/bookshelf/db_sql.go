@@ -0,0 +1,1352 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// sqlDialect describes how to talk to a particular SQL database server.
+//
+// Statements are written with ? placeholders, which sqlDB rewrites for
+// dialects that number their placeholders.
+type sqlDialect struct {
+	// name is the name of the database/sql driver. It also prefixes errors.
+	name string
+
+	// numberedParams is set if placeholders are written $1, $2, and so on.
+	numberedParams bool
+
+	// insertReturnsID is set if the ID of an inserted book is read with
+	// INSERT ... RETURNING id rather than sql.Result.LastInsertId.
+	insertReturnsID bool
+
+	// insertRowByRow is set if the IDs of the rows of a multi-row INSERT
+	// cannot be told from sql.Result.LastInsertId, so AddBooks inserts books
+	// one at a time. Otherwise, LastInsertId is taken to be the ID of the
+	// last row, and the rows to have consecutive IDs.
+	insertRowByRow bool
+
+	// maxID is the largest ID the id column can hold.
+	maxID int64
+
+	// importStatement inserts a book with a given ID, or replaces the book
+	// with that ID. Its parameters are the book's tenant and then
+	// bookColumns, in order.
+	importStatement string
+
+	// afterImport, if set, runs after a book is imported, such as to move an
+	// ID sequence past the imported ID.
+	afterImport string
+
+	// searchStatement finds the books of a tenant outside the trash matching
+	// a query, most relevant first. Its parameters are the query, the
+	// tenant, the query again and the maximum number of books. If it is
+	// empty, SearchBooks matches and ranks books itself.
+	searchStatement string
+
+	// tableExistsQuery counts the tables named by its parameter.
+	tableExistsQuery string
+
+	// lockMigrationsQuery waits for the lock that lets one process at a time
+	// migrate the database, and returns 1 once it holds it. The lock is held
+	// by the connection until unlockMigrationsStatement runs or the
+	// connection closes. If it is empty, migrations are not locked.
+	lockMigrationsQuery       string
+	unlockMigrationsStatement string
+
+	// migrations build the schema. See migration.
+	migrations []migration
+
+	// legacyVersion, if set, returns the schema version of a database that
+	// predates the schema_version table.
+	legacyVersion func(ctx context.Context, conn *sql.DB) (int, error)
+}
+
+// latestVersion returns the schema version sqlDB expects.
+func (d *sqlDialect) latestVersion() int {
+	return d.migrations[len(d.migrations)-1].Version
+}
+
+// rebind rewrites the ? placeholders of a statement for the dialect.
+func (d *sqlDialect) rebind(stmt string) string {
+	if !d.numberedParams {
+		return stmt
+	}
+	var buf bytes.Buffer
+	n := 0
+	for _, r := range stmt {
+		if r == '?' {
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// sqlDB persists books to a SQL database.
+//
+// The books of every tenant share the tables, and each book and revision
+// row holds its tenant in the tenant column. Every statement is restricted
+// to the tenant of the call's context. Book IDs are unique across tenants.
+type sqlDB struct {
+	conn    *sql.DB
+	dialect *sqlDialect
+
+	list    *sql.Stmt
+	listBy  *sql.Stmt
+	insert  *sql.Stmt
+	imprt   *sql.Stmt
+	get     *sql.Stmt
+	getISBN *sql.Stmt
+	listTag *sql.Stmt
+	tags    *sql.Stmt
+	update  *sql.Stmt
+	delete  *sql.Stmt
+	restore *sql.Stmt
+	purge   *sql.Stmt
+	search  *sql.Stmt // nil if the dialect has no searchStatement.
+
+	getAny    *sql.Stmt // Gets a book whether or not it is in the trash.
+	insertRev *sql.Stmt
+	listRevs  *sql.Stmt
+	purgeRevs *sql.Stmt
+	purgeTags *sql.Stmt
+}
+
+// Ensure sqlDB conforms to the BookDatabase and BookImporter interfaces.
+var (
+	_ BookDatabase = &sqlDB{}
+	_ BookImporter = &sqlDB{}
+)
+
+// newSQLDB creates a new BookDatabase backed by a given connection.
+//
+// Pending schema migrations are applied first, unless skipMigrations is set,
+// in which case newSQLDB fails if there are any. Processes starting together
+// take turns to migrate (see migrateSQL), so only the first one does.
+func newSQLDB(conn *sql.DB, d *sqlDialect, skipMigrations bool) (*sqlDB, error) {
+	ctx := context.Background()
+	v, err := sqlSchemaVersion(ctx, conn, d)
+	if err != nil {
+		return nil, err
+	}
+	if v != d.latestVersion() {
+		if skipMigrations {
+			return nil, fmt.Errorf("%s: schema is at version %d, want %d; run `bookshelf migrate`",
+				d.name, v, d.latestVersion())
+		}
+		if err := migrateSQL(ctx, conn, d, d.latestVersion(), false, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	db := &sqlDB{
+		conn:    conn,
+		dialect: d,
+	}
+
+	insert := insertStatement
+	if d.insertReturnsID {
+		insert += " RETURNING id"
+	}
+
+	// Prepared statements. The actual SQL queries are in the code near the
+	// relevant method (e.g. addBook).
+	stmts := []struct {
+		name string
+		stmt **sql.Stmt
+		sql  string
+	}{
+		{"list", &db.list, listStatement},
+		{"listBy", &db.listBy, listByStatement},
+		{"get", &db.get, getStatement},
+		{"getISBN", &db.getISBN, getByISBNStatement},
+		{"listTag", &db.listTag, listByTagStatement},
+		{"tags", &db.tags, listTagsStatement},
+		{"insert", &db.insert, insert},
+		{"import", &db.imprt, d.importStatement},
+		{"update", &db.update, updateStatement},
+		{"delete", &db.delete, deleteStatement},
+		{"restore", &db.restore, restoreStatement},
+		{"purge", &db.purge, purgeStatement},
+		{"search", &db.search, d.searchStatement},
+		{"getAny", &db.getAny, getAnyStatement},
+		{"insertRev", &db.insertRev, insertRevisionStatement},
+		{"listRevs", &db.listRevs, listRevisionsStatement},
+		{"purgeRevs", &db.purgeRevs, purgeRevisionsStatement},
+		{"purgeTags", &db.purgeTags, purgeTagsStatement},
+	}
+	for _, s := range stmts {
+		if s.sql == "" {
+			continue
+		}
+		var err error
+		if *s.stmt, err = conn.Prepare(d.rebind(s.sql)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s: prepare %s: %v", d.name, s.name, err)
+		}
+	}
+
+	return db, nil
+}
+
+// Close closes the database, freeing up any resources.
+func (db *sqlDB) Close() {
+	db.conn.Close()
+}
+
+// errorf returns an error whose message is prefixed by the dialect's name.
+func (db *sqlDB) errorf(format string, v ...interface{}) error {
+	return fmt.Errorf(db.dialect.name+": "+format, v...)
+}
+
+// rowScanner is implemented by sql.Row and sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// bookColumns lists the columns read by scanBook, in order.
+const bookColumns = `id, title, author, publishedDate, imageUrl, description,
+  createdBy, createdById, version, deletedAt, isbn, tags, createdAt`
+
+// nullTime scans a timestamp column that may be NULL, which is read as the
+// zero time.
+type nullTime struct {
+	time.Time
+}
+
+// Scan implements the sql.Scanner interface.
+func (t *nullTime) Scan(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = v
+	default:
+		return fmt.Errorf("cannot scan %T into a time", v)
+	}
+	return nil
+}
+
+// sqlTime returns the column value storing t: NULL for the zero time.
+func sqlTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// sqlISBN returns the column value storing an ISBN: NULL for none, so that
+// the unique index on the column allows any number of books without one.
+func sqlISBN(isbn string) interface{} {
+	if isbn == "" {
+		return nil
+	}
+	return isbn
+}
+
+// sqlTags returns the column value storing a book's tags: NULL for none, and
+// otherwise the tags separated by commas, which a tag cannot contain.
+func sqlTags(tags []string) interface{} {
+	if len(tags) == 0 {
+		return nil
+	}
+	return strings.Join(tags, ",")
+}
+
+// bookArgs returns the values of a book's bookColumns, in order.
+func bookArgs(b *Book) []interface{} {
+	return []interface{}{b.ID, b.Title, b.Author, b.PublishedDate, b.ImageURL,
+		b.Description, b.CreatedBy, b.CreatedByID, b.Version, sqlTime(b.DeletedAt),
+		sqlISBN(b.ISBN), sqlTags(b.Tags), sqlTime(b.CreatedAt)}
+}
+
+// scanBook reads a book from a sql.Row or sql.Rows. If the row has columns
+// before bookColumns, they are read into extra.
+func scanBook(s rowScanner, extra ...interface{}) (*Book, error) {
+	var (
+		id            int64
+		title         sql.NullString
+		author        sql.NullString
+		publishedDate sql.NullString
+		imageURL      sql.NullString
+		description   sql.NullString
+		createdBy     sql.NullString
+		createdByID   sql.NullString
+		version       int64
+		deletedAt     nullTime
+		isbn          sql.NullString
+		tags          sql.NullString
+		createdAt     nullTime
+	)
+	dest := append(extra, &id, &title, &author, &publishedDate, &imageURL,
+		&description, &createdBy, &createdByID, &version, &deletedAt, &isbn, &tags,
+		&createdAt)
+	if err := s.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	book := &Book{
+		ID:            id,
+		Title:         title.String,
+		Author:        author.String,
+		PublishedDate: publishedDate.String,
+		ImageURL:      imageURL.String,
+		Description:   description.String,
+		CreatedBy:     createdBy.String,
+		CreatedByID:   createdByID.String,
+		Version:       version,
+		CreatedAt:     createdAt.Time,
+		DeletedAt:     deletedAt.Time,
+		ISBN:          isbn.String,
+	}
+	if tags.String != "" {
+		book.Tags = strings.Split(tags.String, ",")
+	}
+	return book, nil
+}
+
+// scanBooks reads all the books from rows, and closes it.
+func (db *sqlDB) scanBooks(rows *sql.Rows) ([]*Book, error) {
+	defer rows.Close()
+
+	var books []*Book
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			return nil, db.errorf("could not read row: %v", err)
+		}
+
+		books = append(books, book)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, db.errorf("could not read rows: %v", err)
+	}
+
+	return books, nil
+}
+
+const listStatement = `
+  SELECT ` + bookColumns + ` FROM books
+  WHERE tenant = ? AND deletedAt IS NULL ORDER BY title`
+
+// ListBooks returns a list of books, ordered by title.
+func (db *sqlDB) ListBooks(ctx context.Context) ([]*Book, error) {
+	rows, err := db.list.QueryContext(ctx, TenantFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return db.scanBooks(rows)
+}
+
+const listByTagStatement = `
+  SELECT ` + bookColumns + ` FROM books
+  JOIN book_tags ON book_tags.bookId = books.id
+  WHERE book_tags.tag = ? AND tenant = ? AND deletedAt IS NULL
+  ORDER BY title`
+
+// ListBooksByTag returns the books with a given tag, ordered by title.
+func (db *sqlDB) ListBooksByTag(ctx context.Context, tag string) ([]*Book, error) {
+	tag, err := NormalizeTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.listTag.QueryContext(ctx, tag, TenantFromContext(ctx))
+	if err != nil {
+		return nil, db.errorf("could not list books: %v", err)
+	}
+	return db.scanBooks(rows)
+}
+
+const listTagsStatement = `
+  SELECT tag, COUNT(*) FROM book_tags
+  JOIN books ON books.id = book_tags.bookId
+  WHERE tenant = ? AND deletedAt IS NULL GROUP BY tag ORDER BY tag`
+
+// ListTags returns the tags of the books outside the trash, with their
+// counts.
+func (db *sqlDB) ListTags(ctx context.Context) ([]TagCount, error) {
+	rows, err := db.tags.QueryContext(ctx, TenantFromContext(ctx))
+	if err != nil {
+		return nil, db.errorf("could not list tags: %v", err)
+	}
+	defer rows.Close()
+
+	var tags []TagCount
+	for rows.Next() {
+		var t TagCount
+		if err := rows.Scan(&t.Tag, &t.Count); err != nil {
+			return nil, db.errorf("could not read row: %v", err)
+		}
+		tags = append(tags, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, db.errorf("could not read rows: %v", err)
+	}
+	return tags, nil
+}
+
+// setTags replaces, in tx, the rows of book_tags for the books with the
+// given IDs by rows for their tags.
+func (db *sqlDB) setTags(ctx context.Context, tx *sql.Tx, ids []int64, bs []*Book) error {
+	var rows []interface{}
+	for start := 0; start < len(ids); start += sqlBatchSize {
+		end := start + sqlBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		args := make([]interface{}, end-start)
+		for i, id := range ids[start:end] {
+			args[i] = id
+			for _, t := range bs[start+i].Tags {
+				rows = append(rows, id, t)
+			}
+		}
+		in := "bookId IN (" + repeatValues("?", end-start) + ")"
+		if _, err := tx.ExecContext(ctx, db.dialect.rebind("DELETE FROM book_tags WHERE "+in), args...); err != nil {
+			return db.errorf("could not delete tags: %v", err)
+		}
+	}
+	for start := 0; start < len(rows); start += 2 * sqlBatchSize {
+		end := start + 2*sqlBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		stmt := "INSERT INTO book_tags (bookId, tag) VALUES " + repeatValues("(?, ?)", (end-start)/2)
+		if _, err := tx.ExecContext(ctx, db.dialect.rebind(stmt), rows[start:end]...); err != nil {
+			return db.errorf("could not insert tags: %v", err)
+		}
+	}
+	return nil
+}
+
+const listByStatement = `
+  SELECT ` + bookColumns + ` FROM books
+  WHERE tenant = ? AND createdById = ? AND deletedAt IS NULL ORDER BY title`
+
+// ListBooksCreatedBy returns a list of books, ordered by title, filtered by
+// the user who created the book entry.
+func (db *sqlDB) ListBooksCreatedBy(ctx context.Context, userID string) ([]*Book, error) {
+	if userID == "" {
+		return db.ListBooks(ctx)
+	}
+
+	rows, err := db.listBy.QueryContext(ctx, TenantFromContext(ctx), userID)
+	if err != nil {
+		return nil, err
+	}
+	return db.scanBooks(rows)
+}
+
+// sqlSortColumns maps each SortField to the column it sorts by.
+var sqlSortColumns = map[SortField]string{
+	SortByTitle:         "title",
+	SortByAuthor:        "author",
+	SortByPublishedDate: "publishedDate",
+	SortByCreatedAt:     "createdAt",
+}
+
+// ListBooksPage returns a page of books, selected and ordered by opts,
+// starting at the given cursor.
+func (db *sqlDB) ListBooksPage(ctx context.Context, opts ListOptions, cursor string, pageSize int) (*BookPage, error) {
+	if err := opts.validate(db.dialect.name); err != nil {
+		return nil, err
+	}
+	c, err := decodeCursor(cursor, &opts)
+	if err != nil {
+		return nil, err
+	}
+	pageSize = normalizePageSize(pageSize)
+
+	// The query depends on which of the filters are present, so it is built
+	// here rather than prepared up front.
+	var (
+		where = []string{"tenant = ?", "deletedAt IS NULL"}
+		args  = []interface{}{TenantFromContext(ctx)}
+	)
+	if opts.CreatedByID != "" {
+		where = append(where, "createdById = ?")
+		args = append(args, opts.CreatedByID)
+	}
+	if opts.Author != "" {
+		where = append(where, "author = ?")
+		args = append(args, opts.Author)
+	}
+	if from, to, ok := opts.publishedRange(); ok {
+		where = append(where, "publishedDate >= ? AND publishedDate < ?")
+		args = append(args, from, to)
+	}
+
+	col := sqlSortColumns[opts.sortBy()]
+	op, dir := ">", ""
+	if !opts.readsAscending(c) {
+		op, dir = "<", " DESC"
+	}
+	if c != nil {
+		where = append(where, fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", col, op, col, op))
+		args = append(args, c.value(), c.value(), c.ID)
+	}
+
+	query := "SELECT " + bookColumns + " FROM books WHERE " + strings.Join(where, " AND ") +
+		" ORDER BY " + col + dir + ", id" + dir + " LIMIT ?"
+	// Fetch one extra row to find out whether there is another page.
+	args = append(args, pageSize+1)
+
+	rows, err := db.conn.QueryContext(ctx, db.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, db.errorf("could not list books: %v", err)
+	}
+	books, err := db.scanBooks(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return newBookPage(books, &opts, c, pageSize), nil
+}
+
+// SearchBooks returns the books whose title, author or description match the
+// query, most relevant first.
+func (db *sqlDB) SearchBooks(ctx context.Context, query string) ([]*Book, error) {
+	if db.search == nil {
+		return db.rankSearch(ctx, query)
+	}
+	rows, err := db.search.QueryContext(ctx, query, TenantFromContext(ctx), query, maxSearchResults)
+	if err != nil {
+		return nil, db.errorf("could not search books: %v", err)
+	}
+	return db.scanBooks(rows)
+}
+
+// rankSearch implements SearchBooks for dialects without full-text search.
+// It reads the books containing any of the query's terms and ranks them the
+// same way memoryDB does.
+func (db *sqlDB) rankSearch(ctx context.Context, query string) ([]*Book, error) {
+	terms := queryTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	// Terms hold only letters and digits, so they need no escaping in LIKE
+	// patterns. LIKE also matches terms within longer words, which are
+	// filtered out when ranking.
+	tenant := TenantFromContext(ctx)
+	var (
+		where []string
+		args  = []interface{}{tenant}
+	)
+	for _, t := range terms {
+		where = append(where, "title LIKE ? OR author LIKE ? OR description LIKE ?")
+		p := "%" + t + "%"
+		args = append(args, p, p, p)
+	}
+	rows, err := db.conn.QueryContext(ctx, db.dialect.rebind(
+		"SELECT "+bookColumns+" FROM books WHERE tenant = ? AND deletedAt IS NULL AND ("+strings.Join(where, " OR ")+")"), args...)
+	if err != nil {
+		return nil, db.errorf("could not search books: %v", err)
+	}
+	candidates, err := db.scanBooks(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int
+	if err := db.conn.QueryRowContext(ctx, db.dialect.rebind(
+		"SELECT COUNT(*) FROM books WHERE tenant = ? AND deletedAt IS NULL"), tenant).Scan(&total); err != nil {
+		return nil, db.errorf("could not search books: %v", err)
+	}
+
+	bookTermFreqs := make([]map[string]int, len(candidates))
+	docFreq := make(map[string]int)
+	for i, b := range candidates {
+		bookTermFreqs[i] = bookTerms(b)
+		for _, t := range terms {
+			if bookTermFreqs[i][t] > 0 {
+				docFreq[t]++
+			}
+		}
+	}
+
+	var hits []searchHit
+	for i, b := range candidates {
+		var score float64
+		for _, t := range terms {
+			if n := bookTermFreqs[i][t]; n > 0 {
+				score += float64(n) * inverseDocFreq(docFreq[t], total)
+			}
+		}
+		if score > 0 {
+			hits = append(hits, searchHit{book: b, score: score})
+		}
+	}
+	return rankHits(hits), nil
+}
+
+const getStatement = "SELECT " + bookColumns + " FROM books WHERE id = ? AND tenant = ? AND deletedAt IS NULL"
+
+// GetBook retrieves a book by its ID.
+func (db *sqlDB) GetBook(ctx context.Context, id int64) (*Book, error) {
+	book, err := scanBook(db.get.QueryRowContext(ctx, id, TenantFromContext(ctx)))
+	if err == sql.ErrNoRows {
+		return nil, errorf(ErrNotFound, "%s: could not find book with id %d", db.dialect.name, id)
+	}
+	if err != nil {
+		return nil, db.errorf("could not get book: %v", err)
+	}
+	return book, nil
+}
+
+const getByISBNStatement = "SELECT " + bookColumns + " FROM books WHERE isbn = ? AND tenant = ? AND deletedAt IS NULL"
+
+// GetBookByISBN retrieves a book by its ISBN.
+func (db *sqlDB) GetBookByISBN(ctx context.Context, isbn string) (*Book, error) {
+	isbn, err := NormalizeISBN(isbn)
+	if err != nil {
+		return nil, err
+	}
+	book, err := scanBook(db.getISBN.QueryRowContext(ctx, isbn, TenantFromContext(ctx)))
+	if err == sql.ErrNoRows {
+		return nil, errorf(ErrNotFound, "%s: could not find book with ISBN %s", db.dialect.name, isbn)
+	}
+	if err != nil {
+		return nil, db.errorf("could not get book: %v", err)
+	}
+	return book, nil
+}
+
+// isbnOwners returns the IDs of the tenant's stored books, including those
+// in the trash, that have the ISBNs of the given books, keyed by ISBN. The
+// unique index on the tenant and isbn columns would reject a duplicate
+// anyway, but checking first lets the methods report it as ErrAlreadyExists.
+func (db *sqlDB) isbnOwners(ctx context.Context, tx *sql.Tx, bs []*Book) (map[string]int64, error) {
+	var isbns []interface{}
+	for _, b := range bs {
+		if b.ISBN != "" {
+			isbns = append(isbns, b.ISBN)
+		}
+	}
+	owners := make(map[string]int64)
+	for start := 0; start < len(isbns); start += sqlBatchSize {
+		end := start + sqlBatchSize
+		if end > len(isbns) {
+			end = len(isbns)
+		}
+		in := "isbn IN (" + repeatValues("?", end-start) + ")"
+		args := append([]interface{}{TenantFromContext(ctx)}, isbns[start:end]...)
+		rows, err := tx.QueryContext(ctx, db.dialect.rebind("SELECT id, isbn FROM books WHERE tenant = ? AND "+in), args...)
+		if err != nil {
+			return nil, db.errorf("could not look up ISBNs: %v", err)
+		}
+		for rows.Next() {
+			var (
+				id   int64
+				isbn string
+			)
+			if err := rows.Scan(&id, &isbn); err != nil {
+				rows.Close()
+				return nil, db.errorf("could not read row: %v", err)
+			}
+			owners[isbn] = id
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, db.errorf("could not read rows: %v", err)
+		}
+	}
+	return owners, nil
+}
+
+// checkISBN returns an ErrAlreadyExists error if a stored book other than b
+// has b's ISBN.
+func (db *sqlDB) checkISBN(ctx context.Context, tx *sql.Tx, b *Book) error {
+	owners, err := db.isbnOwners(ctx, tx, []*Book{b})
+	if err != nil {
+		return err
+	}
+	return checkISBN(db.dialect.name, b.ISBN, b.ID, owners)
+}
+
+// insertPrefix and insertValues make up a statement inserting a new book.
+// Its parameters are the book's tenant and its fields other than ID, Version
+// and DeletedAt, as returned by insertArgs.
+const (
+	insertPrefix = `
+  INSERT INTO books (
+    tenant, title, author, publishedDate, imageUrl, description, createdBy,
+    createdById, isbn, tags, createdAt, version
+  ) VALUES `
+	insertValues    = `(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)`
+	insertStatement = insertPrefix + insertValues
+)
+
+// insertArgs returns the parameters of insertValues for a book of a tenant.
+func insertArgs(tenant string, b *Book) []interface{} {
+	return []interface{}{tenant, b.Title, b.Author, b.PublishedDate, b.ImageURL,
+		b.Description, b.CreatedBy, b.CreatedByID, sqlISBN(b.ISBN), sqlTags(b.Tags),
+		sqlTime(b.CreatedAt)}
+}
+
+// sqlBatchSize is the largest number of rows a batch method writes or reads
+// with a single statement. It keeps the number of parameters within the
+// limits of every dialect.
+const sqlBatchSize = 50
+
+// repeatValues returns n copies of a list of values, such as "(?, ?)",
+// separated by commas.
+func repeatValues(values string, n int) string {
+	return strings.TrimSuffix(strings.Repeat(values+", ", n), ", ")
+}
+
+// AddBook saves a given book, assigning it a new ID.
+func (db *sqlDB) AddBook(ctx context.Context, b *Book) (id int64, err error) {
+	if err := normalizeBook(db.dialect.name, b); err != nil {
+		return 0, err
+	}
+	b.CreatedAt = creationTime()
+	args := insertArgs(TenantFromContext(ctx), b)
+	err = db.inTx(ctx, func(tx *sql.Tx) error {
+		if err := db.checkISBN(ctx, tx, &Book{ISBN: b.ISBN}); err != nil {
+			return err
+		}
+		insert := tx.StmtContext(ctx, db.insert)
+		if db.dialect.insertReturnsID {
+			if err := insert.QueryRowContext(ctx, args...).Scan(&id); err != nil {
+				return db.errorf("could not insert book: %v", err)
+			}
+		} else {
+			r, err := db.execAffectingOneRow(ctx, insert, args...)
+			if err != nil {
+				return err
+			}
+			if id, err = r.LastInsertId(); err != nil {
+				return db.errorf("could not get last insert ID: %v", err)
+			}
+		}
+		if err := db.setTags(ctx, tx, []int64{id}, []*Book{b}); err != nil {
+			return err
+		}
+		added := *b
+		added.ID = id
+		added.Version = 1
+		added.DeletedAt = time.Time{}
+		return db.addRevision(ctx, tx, newRevision(ctx, RevisionAdd, &added))
+	})
+	if err != nil {
+		return 0, err
+	}
+	b.Version = 1
+	b.DeletedAt = time.Time{}
+	return id, nil
+}
+
+// AddBooks saves the given books, assigning them new IDs. The books are
+// inserted sqlBatchSize at a time with multi-row INSERT statements (or one
+// by one, for dialects that insert row by row), and the batch is written all
+// or nothing, in a single transaction. As a multi-row INSERT does not say
+// which row failed, only invalid and duplicate ISBNs, which are checked
+// beforehand, are reported as a BatchError.
+func (db *sqlDB) AddBooks(ctx context.Context, bs []*Book) ([]int64, error) {
+	errs := make(BatchError, len(bs))
+	now := creationTime()
+	for i, b := range bs {
+		errs[i] = normalizeBook(db.dialect.name, b)
+		b.CreatedAt = now
+	}
+	ids := make([]int64, len(bs))
+	err := db.inTx(ctx, func(tx *sql.Tx) error {
+		owners, err := db.isbnOwners(ctx, tx, bs)
+		if err != nil {
+			return err
+		}
+		checkBatchISBNs(db.dialect.name, bs, ids, owners, errs)
+		if err := errs.abort(); err != nil {
+			return err
+		}
+		for start := 0; start < len(bs); start += sqlBatchSize {
+			end := start + sqlBatchSize
+			if end > len(bs) {
+				end = len(bs)
+			}
+			if err := db.insertBooks(ctx, tx, bs[start:end], ids[start:end]); err != nil {
+				return err
+			}
+		}
+		if err := db.setTags(ctx, tx, ids, bs); err != nil {
+			return err
+		}
+		revs := make([]*Revision, len(bs))
+		for i, b := range bs {
+			added := *b
+			added.ID = ids[i]
+			added.Version = 1
+			added.DeletedAt = time.Time{}
+			revs[i] = newRevision(ctx, RevisionAdd, &added)
+		}
+		return db.addRevisions(ctx, tx, revs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bs {
+		b.Version = 1
+		b.DeletedAt = time.Time{}
+	}
+	return ids, nil
+}
+
+// insertBooks inserts books with a single statement in tx, or one statement
+// per book if the dialect inserts row by row, and stores their IDs in ids.
+func (db *sqlDB) insertBooks(ctx context.Context, tx *sql.Tx, bs []*Book, ids []int64) error {
+	if db.dialect.insertRowByRow {
+		insert := tx.StmtContext(ctx, db.insert)
+		for i, b := range bs {
+			r, err := db.execAffectingOneRow(ctx, insert, insertArgs(TenantFromContext(ctx), b)...)
+			if err != nil {
+				return err
+			}
+			if ids[i], err = r.LastInsertId(); err != nil {
+				return db.errorf("could not get last insert ID: %v", err)
+			}
+		}
+		return nil
+	}
+
+	var args []interface{}
+	for _, b := range bs {
+		args = append(args, insertArgs(TenantFromContext(ctx), b)...)
+	}
+	stmt := insertPrefix + repeatValues(insertValues, len(bs))
+
+	if db.dialect.insertReturnsID {
+		rows, err := tx.QueryContext(ctx, db.dialect.rebind(stmt+" RETURNING id"), args...)
+		if err != nil {
+			return db.errorf("could not insert books: %v", err)
+		}
+		defer rows.Close()
+		n := 0
+		for ; rows.Next() && n < len(ids); n++ {
+			if err := rows.Scan(&ids[n]); err != nil {
+				return db.errorf("could not read inserted ID: %v", err)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return db.errorf("could not read inserted IDs: %v", err)
+		}
+		if n != len(bs) {
+			return db.errorf("inserted %d books, got %d IDs", len(bs), n)
+		}
+		return nil
+	}
+
+	r, err := tx.ExecContext(ctx, db.dialect.rebind(stmt), args...)
+	if err != nil {
+		return db.errorf("could not insert books: %v", err)
+	}
+	if n, err := r.RowsAffected(); err != nil || n != int64(len(bs)) {
+		return db.errorf("inserted %d books, expected %d rows affected (%v)", len(bs), n, err)
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return db.errorf("could not get last insert ID: %v", err)
+	}
+	id -= int64(len(bs) - 1)
+	for i := range ids {
+		ids[i] = id + int64(i)
+	}
+	return nil
+}
+
+// ImportBook saves a book under its existing ID. IDs assigned by other
+// backends may be too large for the database, or taken by a book of another
+// tenant, in which case ImportBook fails with an ErrInvalidArgument error.
+func (db *sqlDB) ImportBook(ctx context.Context, b *Book) error {
+	if b.ID <= 0 || b.ID > db.dialect.maxID {
+		return errorf(ErrInvalidArgument, "%s: cannot import book with ID %d", db.dialect.name, b.ID)
+	}
+	if err := normalizeBook(db.dialect.name, b); err != nil {
+		return err
+	}
+	if b.CreatedAt.IsZero() {
+		b.CreatedAt = creationTime()
+	}
+	tenant := TenantFromContext(ctx)
+	err := db.inTx(ctx, func(tx *sql.Tx) error {
+		var owner string
+		err := tx.QueryRowContext(ctx, db.dialect.rebind("SELECT tenant FROM books WHERE id = ?"), b.ID).Scan(&owner)
+		if err == nil && owner != tenant {
+			return errorf(ErrInvalidArgument, "%s: cannot import book with ID %d, which another tenant has", db.dialect.name, b.ID)
+		} else if err != nil && err != sql.ErrNoRows {
+			return db.errorf("could not get book: %v", err)
+		}
+		if err := db.checkISBN(ctx, tx, b); err != nil {
+			return err
+		}
+		args := append([]interface{}{tenant}, bookArgs(b)...)
+		if _, err := tx.StmtContext(ctx, db.imprt).ExecContext(ctx, args...); err != nil {
+			return db.errorf("could not import book: %v", err)
+		}
+		return db.setTags(ctx, tx, []int64{b.ID}, []*Book{b})
+	})
+	if err != nil {
+		return err
+	}
+	if db.dialect.afterImport != "" {
+		if _, err := db.conn.ExecContext(ctx, db.dialect.afterImport); err != nil {
+			return db.errorf("could not import book: %v", err)
+		}
+	}
+	return nil
+}
+
+const deleteStatement = `
+  UPDATE books SET deletedAt = ? WHERE id = ? AND tenant = ? AND deletedAt IS NULL`
+
+// DeleteBook moves a given book to the trash by its ID.
+func (db *sqlDB) DeleteBook(ctx context.Context, id int64) error {
+	if id == 0 {
+		return errorf(ErrInvalidArgument, "%s: book with unassigned ID passed into deleteBook", db.dialect.name)
+	}
+	return db.inTx(ctx, func(tx *sql.Tx) error {
+		r, err := tx.StmtContext(ctx, db.delete).ExecContext(ctx, time.Now().UTC(), id, TenantFromContext(ctx))
+		if err != nil {
+			return db.errorf("could not execute statement: %v", err)
+		}
+		rowsAffected, err := r.RowsAffected()
+		if err != nil {
+			return db.errorf("could not get rows affected: %v", err)
+		}
+		if rowsAffected == 0 {
+			return errorf(ErrNotFound, "%s: could not delete book with id %d, does not exist", db.dialect.name, id)
+		}
+		return db.recordChange(ctx, tx, RevisionDelete, id)
+	})
+}
+
+// DeleteBooks moves the books with the given IDs to the trash. The batch is
+// written all or nothing, in a single transaction that reads and then moves
+// sqlBatchSize books at a time.
+func (db *sqlDB) DeleteBooks(ctx context.Context, ids []int64) error {
+	errs := make(BatchError, len(ids))
+	checkBatchIDs(db.dialect.name, ids, errs)
+	if err := errs.abort(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	return db.inTx(ctx, func(tx *sql.Tx) error {
+		var revs []*Revision
+		for start := 0; start < len(ids); start += sqlBatchSize {
+			end := start + sqlBatchSize
+			if end > len(ids) {
+				end = len(ids)
+			}
+			in := "id IN (" + repeatValues("?", end-start) + ")"
+			args := []interface{}{TenantFromContext(ctx)}
+			for _, id := range ids[start:end] {
+				args = append(args, id)
+			}
+
+			rows, err := tx.QueryContext(ctx, db.dialect.rebind(
+				"SELECT "+bookColumns+" FROM books WHERE tenant = ? AND deletedAt IS NULL AND "+in), args...)
+			if err != nil {
+				return db.errorf("could not get books: %v", err)
+			}
+			books, err := db.scanBooks(rows)
+			if err != nil {
+				return err
+			}
+			found := make(map[int64]*Book)
+			for _, b := range books {
+				found[b.ID] = b
+			}
+			for i, id := range ids[start:end] {
+				b, ok := found[id]
+				if !ok {
+					errs[start+i] = errorf(ErrNotFound, "%s: could not delete book with id %d, does not exist", db.dialect.name, id)
+					continue
+				}
+				b.DeletedAt = now
+				revs = append(revs, newRevision(ctx, RevisionDelete, b))
+			}
+			if errs.failed() {
+				// Keep reading, to report every missing book.
+				continue
+			}
+
+			r, err := tx.ExecContext(ctx, db.dialect.rebind(
+				"UPDATE books SET deletedAt = ? WHERE tenant = ? AND deletedAt IS NULL AND "+in), append([]interface{}{now}, args...)...)
+			if err != nil {
+				return db.errorf("could not execute statement: %v", err)
+			}
+			if n, err := r.RowsAffected(); err != nil || n != int64(end-start) {
+				return db.errorf("could not delete books: %d of %d were changed concurrently (%v)", int64(end-start)-n, end-start, err)
+			}
+		}
+		if err := errs.abort(); err != nil {
+			return err
+		}
+		return db.addRevisions(ctx, tx, revs)
+	})
+}
+
+// ListDeletedBooks returns the books in the trash, most recently deleted
+// first, optionally filtered by the user who created the book entry.
+func (db *sqlDB) ListDeletedBooks(ctx context.Context, userID string) ([]*Book, error) {
+	query := "SELECT " + bookColumns + " FROM books WHERE tenant = ? AND deletedAt IS NOT NULL"
+	args := []interface{}{TenantFromContext(ctx)}
+	if userID != "" {
+		query += " AND createdById = ?"
+		args = append(args, userID)
+	}
+	query += " ORDER BY deletedAt DESC, id"
+
+	rows, err := db.conn.QueryContext(ctx, db.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, db.errorf("could not list deleted books: %v", err)
+	}
+	return db.scanBooks(rows)
+}
+
+const restoreStatement = `
+  UPDATE books SET deletedAt = NULL WHERE id = ? AND tenant = ? AND deletedAt IS NOT NULL`
+
+// RestoreBook takes a given book out of the trash by its ID.
+func (db *sqlDB) RestoreBook(ctx context.Context, id int64) error {
+	return db.inTx(ctx, func(tx *sql.Tx) error {
+		r, err := tx.StmtContext(ctx, db.restore).ExecContext(ctx, id, TenantFromContext(ctx))
+		if err != nil {
+			return db.errorf("could not execute statement: %v", err)
+		}
+		rowsAffected, err := r.RowsAffected()
+		if err != nil {
+			return db.errorf("could not get rows affected: %v", err)
+		}
+		if rowsAffected == 0 {
+			return errorf(ErrNotFound, "%s: could not restore book with id %d, not in the trash", db.dialect.name, id)
+		}
+		return db.recordChange(ctx, tx, RevisionRestore, id)
+	})
+}
+
+const purgeStatement = `DELETE FROM books WHERE tenant = ? AND deletedAt < ?`
+
+const purgeTagsStatement = `
+  DELETE FROM book_tags
+  WHERE bookId IN (SELECT id FROM books WHERE tenant = ? AND deletedAt < ?)`
+
+const purgeRevisionsStatement = `
+  DELETE FROM revisions
+  WHERE id IN (SELECT id FROM books WHERE tenant = ? AND deletedAt < ?)`
+
+// PurgeBooks permanently removes the books moved to the trash before a given
+// time, their revisions and their tags.
+func (db *sqlDB) PurgeBooks(ctx context.Context, before time.Time) (n int, err error) {
+	tenant := TenantFromContext(ctx)
+	before = before.UTC()
+	err = db.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.StmtContext(ctx, db.purgeRevs).ExecContext(ctx, tenant, before); err != nil {
+			return db.errorf("could not purge revisions: %v", err)
+		}
+		if _, err := tx.StmtContext(ctx, db.purgeTags).ExecContext(ctx, tenant, before); err != nil {
+			return db.errorf("could not purge tags: %v", err)
+		}
+		r, err := tx.StmtContext(ctx, db.purge).ExecContext(ctx, tenant, before)
+		if err != nil {
+			return db.errorf("could not purge books: %v", err)
+		}
+		rowsAffected, err := r.RowsAffected()
+		if err != nil {
+			return db.errorf("could not get rows affected: %v", err)
+		}
+		n = int(rowsAffected)
+		return nil
+	})
+	return n, err
+}
+
+// updateStatement updates a book unless it has changed since the caller
+// read it. Its parameters are updateArgs.
+const updateStatement = `
+  UPDATE books
+  SET title=?, author=?, publishedDate=?, imageUrl=?, description=?,
+      createdBy=?, createdById=?, isbn=?, tags=?, version=version+1
+  WHERE id = ? AND version = ? AND tenant = ? AND deletedAt IS NULL`
+
+// updateArgs returns the parameters of updateStatement for a book of a
+// tenant.
+func updateArgs(tenant string, b *Book) []interface{} {
+	return []interface{}{b.Title, b.Author, b.PublishedDate, b.ImageURL,
+		b.Description, b.CreatedBy, b.CreatedByID, sqlISBN(b.ISBN), sqlTags(b.Tags),
+		b.ID, b.Version, tenant}
+}
+
+// UpdateBook updates the entry for a given book.
+func (db *sqlDB) UpdateBook(ctx context.Context, b *Book) error {
+	if b.ID == 0 {
+		return errorf(ErrInvalidArgument, "%s: book with unassigned ID passed into updateBook", db.dialect.name)
+	}
+	if err := normalizeBook(db.dialect.name, b); err != nil {
+		return err
+	}
+
+	err := db.inTx(ctx, func(tx *sql.Tx) error {
+		if err := db.checkISBN(ctx, tx, b); err != nil {
+			return err
+		}
+		r, err := tx.StmtContext(ctx, db.update).ExecContext(ctx, updateArgs(TenantFromContext(ctx), b)...)
+		if err != nil {
+			return db.errorf("could not execute statement: %v", err)
+		}
+		rowsAffected, err := r.RowsAffected()
+		if err != nil {
+			return db.errorf("could not get rows affected: %v", err)
+		}
+		if rowsAffected == 0 {
+			return db.updateFailure(ctx, tx, b)
+		}
+		if err := db.setTags(ctx, tx, []int64{b.ID}, []*Book{b}); err != nil {
+			return err
+		}
+		return db.recordChange(ctx, tx, RevisionUpdate, b.ID)
+	})
+	if err != nil {
+		return err
+	}
+	b.Version++
+	return nil
+}
+
+// updateFailure returns the reason the update statement changed no row for
+// a book: either the book does not exist or is in the trash, or its version
+// has moved on.
+func (db *sqlDB) updateFailure(ctx context.Context, tx *sql.Tx, b *Book) error {
+	if _, err := scanBook(tx.StmtContext(ctx, db.get).QueryRowContext(ctx, b.ID, TenantFromContext(ctx))); err == sql.ErrNoRows {
+		return errorf(ErrNotFound, "%s: could not update book with id %d, does not exist", db.dialect.name, b.ID)
+	} else if err != nil {
+		return db.errorf("could not get book: %v", err)
+	}
+	return &ConflictError{ID: b.ID, Version: b.Version}
+}
+
+// UpdateBooks updates the entries for the given books. The batch is written
+// all or nothing, in a single transaction, with a statement per book.
+func (db *sqlDB) UpdateBooks(ctx context.Context, bs []*Book) error {
+	errs := make(BatchError, len(bs))
+	for i, b := range bs {
+		errs[i] = normalizeBook(db.dialect.name, b)
+	}
+	checkBatchIDs(db.dialect.name, bookIDs(bs), errs)
+
+	err := db.inTx(ctx, func(tx *sql.Tx) error {
+		owners, err := db.isbnOwners(ctx, tx, bs)
+		if err != nil {
+			return err
+		}
+		checkBatchISBNs(db.dialect.name, bs, bookIDs(bs), owners, errs)
+		update := tx.StmtContext(ctx, db.update)
+		for i, b := range bs {
+			if errs[i] != nil {
+				continue
+			}
+			r, err := update.ExecContext(ctx, updateArgs(TenantFromContext(ctx), b)...)
+			if err != nil {
+				return db.errorf("could not execute statement: %v", err)
+			}
+			rowsAffected, err := r.RowsAffected()
+			if err != nil {
+				return db.errorf("could not get rows affected: %v", err)
+			}
+			if rowsAffected == 0 {
+				errs[i] = db.updateFailure(ctx, tx, b)
+			}
+		}
+		if err := errs.abort(); err != nil {
+			return err
+		}
+		if err := db.setTags(ctx, tx, bookIDs(bs), bs); err != nil {
+			return err
+		}
+		// Read the books back for their revisions, as the update leaves
+		// fields such as CreatedAt as they were stored.
+		updated, err := db.getBooksIn(ctx, tx, bookIDs(bs))
+		if err != nil {
+			return err
+		}
+		revs := make([]*Revision, len(bs))
+		for i, b := range bs {
+			revs[i] = newRevision(ctx, RevisionUpdate, updated[b.ID])
+		}
+		return db.addRevisions(ctx, tx, revs)
+	})
+	if err != nil {
+		return err
+	}
+	for _, b := range bs {
+		b.Version++
+	}
+	return nil
+}
+
+// getBooksIn reads the tenant's books with the given IDs in tx,
+// sqlBatchSize at a time, whether or not they are in the trash. Books that
+// do not exist are missing from the map.
+func (db *sqlDB) getBooksIn(ctx context.Context, tx *sql.Tx, ids []int64) (map[int64]*Book, error) {
+	found := make(map[int64]*Book)
+	for start := 0; start < len(ids); start += sqlBatchSize {
+		end := start + sqlBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		args := []interface{}{TenantFromContext(ctx)}
+		for _, id := range ids[start:end] {
+			args = append(args, id)
+		}
+		rows, err := tx.QueryContext(ctx, db.dialect.rebind(
+			"SELECT "+bookColumns+" FROM books WHERE tenant = ? AND id IN ("+repeatValues("?", end-start)+")"), args...)
+		if err != nil {
+			return nil, db.errorf("could not get books: %v", err)
+		}
+		books, err := db.scanBooks(rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range books {
+			found[b.ID] = b
+		}
+	}
+	return found, nil
+}
+
+const getAnyStatement = "SELECT " + bookColumns + " FROM books WHERE id = ? AND tenant = ?"
+
+// recordChange records a revision of the book with the given ID, as it is
+// stored after a change made in tx.
+func (db *sqlDB) recordChange(ctx context.Context, tx *sql.Tx, action string, id int64) error {
+	b, err := scanBook(tx.StmtContext(ctx, db.getAny).QueryRowContext(ctx, id, TenantFromContext(ctx)))
+	if err != nil {
+		return db.errorf("could not get book: %v", err)
+	}
+	return db.addRevision(ctx, tx, newRevision(ctx, action, b))
+}
+
+// revisionColumns lists the columns of a revision that precede the columns
+// of the book it records. In the revisions table, id is the book's ID.
+const revisionColumns = `action, actor, changedAt`
+
+// insertRevisionPrefix and insertRevisionValues make up a statement
+// inserting a revision. Its parameters are revisionArgs.
+const (
+	insertRevisionPrefix = `
+  INSERT INTO revisions (tenant, ` + revisionColumns + `, ` + bookColumns + `)
+  VALUES `
+	insertRevisionValues    = `(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	insertRevisionStatement = insertRevisionPrefix + insertRevisionValues
+)
+
+// revisionArgs returns the tenant of a revision, then the values of its
+// revisionColumns and bookColumns, in order.
+func revisionArgs(tenant string, r *Revision) []interface{} {
+	return append([]interface{}{tenant, r.Action, r.Actor, r.Time}, bookArgs(&r.Book)...)
+}
+
+// addRevision saves a revision in tx.
+func (db *sqlDB) addRevision(ctx context.Context, tx *sql.Tx, r *Revision) error {
+	if _, err := tx.StmtContext(ctx, db.insertRev).ExecContext(ctx, revisionArgs(TenantFromContext(ctx), r)...); err != nil {
+		return db.errorf("could not record revision: %v", err)
+	}
+	return nil
+}
+
+// addRevisions saves revisions in tx, sqlBatchSize at a time.
+func (db *sqlDB) addRevisions(ctx context.Context, tx *sql.Tx, revs []*Revision) error {
+	for start := 0; start < len(revs); start += sqlBatchSize {
+		end := start + sqlBatchSize
+		if end > len(revs) {
+			end = len(revs)
+		}
+		var args []interface{}
+		for _, r := range revs[start:end] {
+			args = append(args, revisionArgs(TenantFromContext(ctx), r)...)
+		}
+		stmt := insertRevisionPrefix + repeatValues(insertRevisionValues, end-start)
+		if _, err := tx.ExecContext(ctx, db.dialect.rebind(stmt), args...); err != nil {
+			return db.errorf("could not record revisions: %v", err)
+		}
+	}
+	return nil
+}
+
+const listRevisionsStatement = `
+  SELECT ` + revisionColumns + `, ` + bookColumns + ` FROM revisions
+  WHERE id = ? AND tenant = ? ORDER BY seq`
+
+// ListRevisions returns the revisions of a given book by its ID, oldest
+// first.
+func (db *sqlDB) ListRevisions(ctx context.Context, id int64) ([]*Revision, error) {
+	rows, err := db.listRevs.QueryContext(ctx, id, TenantFromContext(ctx))
+	if err != nil {
+		return nil, db.errorf("could not list revisions: %v", err)
+	}
+	defer rows.Close()
+
+	var revs []*Revision
+	for rows.Next() {
+		r := &Revision{BookID: id}
+		var changedAt nullTime
+		b, err := scanBook(rows, &r.Action, &r.Actor, &changedAt)
+		if err != nil {
+			return nil, db.errorf("could not read row: %v", err)
+		}
+		r.Time = changedAt.Time
+		r.Book = *b
+		revs = append(revs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, db.errorf("could not read rows: %v", err)
+	}
+	return revs, nil
+}
+
+// inTx calls f in a transaction, which is committed if f succeeds and rolled
+// back otherwise.
+func (db *sqlDB) inTx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return db.errorf("could not begin transaction: %v", err)
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return db.errorf("could not commit transaction: %v", err)
+	}
+	return nil
+}
+
+// execAffectingOneRow executes a given statement, expecting one row to be affected.
+func (db *sqlDB) execAffectingOneRow(ctx context.Context, stmt *sql.Stmt, args ...interface{}) (sql.Result, error) {
+	r, err := stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return r, db.errorf("could not execute statement: %v", err)
+	}
+	rowsAffected, err := r.RowsAffected()
+	if err != nil {
+		return r, db.errorf("could not get rows affected: %v", err)
+	} else if rowsAffected != 1 {
+		return r, db.errorf("expected 1 row affected, got %d", rowsAffected)
+	}
+	return r, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+
+	_ "github.com/mattn/go-sqlite3" // Registers the "sqlite3" driver.
+)
+
+// newSQLiteDB creates a new BookDatabase stored in the SQLite database file at
+// the given path, which is created if it does not exist. It needs no server,
+// which makes it suitable for offline tests.
+func newSQLiteDB(path string) (BookDatabase, error) {
+	conn, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	return newSQLDB(conn, sqliteDialect, false)
+}
+
+// openSQLite connects to the SQLite database file at path.
+func openSQLite(path string) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite3: could not open %s: %v", path, err)
+	}
+	// SQLite allows a single writer at a time, and each connection to an
+	// in-memory database sees a different database, so use one connection.
+	conn.SetMaxOpenConns(1)
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sqlite3: could not open %s: %v", path, err)
+	}
+	return conn, nil
+}
+
+var sqliteDialect = &sqlDialect{
+	name:  "sqlite3",
+	maxID: math.MaxInt64,
+
+	importStatement: `
+  INSERT OR REPLACE INTO books (tenant, ` + bookColumns + `)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+
+	// SQLite's full-text search is an optional extension, so SearchBooks
+	// ranks books itself.
+
+	tableExistsQuery: `SELECT COUNT(*) FROM sqlite_master
+		WHERE type = 'table' AND name = ?`,
+
+	// A SQLite database is used by a single process, which opens it once,
+	// so its migrations are not locked.
+
+	migrations: []migration{
+		{
+			Version:     1,
+			Description: "create books table",
+			// AUTOINCREMENT stops IDs of deleted books being reused.
+			Up: []string{`CREATE TABLE books (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			title TEXT NULL,
+			author TEXT NULL,
+			publishedDate TEXT NULL,
+			imageUrl TEXT NULL,
+			description TEXT NULL,
+			createdBy TEXT NULL,
+			createdById TEXT NULL,
+			version INTEGER NOT NULL DEFAULT 1
+		)`},
+			Down: []string{`DROP TABLE books`},
+		},
+		{
+			Version:     2,
+			Description: "add trash",
+			// The TIMESTAMP type makes the driver read the column as a
+			// time.Time. Times are stored as UTC text, which sorts in time
+			// order.
+			Up: []string{
+				`ALTER TABLE books ADD COLUMN deletedAt TIMESTAMP NULL`,
+				`CREATE INDEX books_deleted ON books (deletedAt)`,
+			},
+			Down: []string{
+				`DROP INDEX books_deleted`,
+				`ALTER TABLE books DROP COLUMN deletedAt`,
+			},
+		},
+		{
+			Version:     3,
+			Description: "create revisions table",
+			Up: []string{`CREATE TABLE revisions (
+			seq INTEGER PRIMARY KEY AUTOINCREMENT,
+			action TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			changedAt TIMESTAMP NOT NULL,
+			id INTEGER NOT NULL,
+			title TEXT NULL,
+			author TEXT NULL,
+			publishedDate TEXT NULL,
+			imageUrl TEXT NULL,
+			description TEXT NULL,
+			createdBy TEXT NULL,
+			createdById TEXT NULL,
+			version INTEGER NOT NULL,
+			deletedAt TIMESTAMP NULL
+		)`,
+				`CREATE INDEX revisions_book ON revisions (id)`,
+			},
+			Down: []string{`DROP TABLE revisions`},
+		},
+		{
+			Version:     4,
+			Description: "add ISBN column",
+			Up: []string{
+				`ALTER TABLE books ADD COLUMN isbn TEXT NULL`,
+				`CREATE UNIQUE INDEX books_isbn ON books (isbn)`,
+				`ALTER TABLE revisions ADD COLUMN isbn TEXT NULL`,
+			},
+			Down: []string{
+				`ALTER TABLE revisions DROP COLUMN isbn`,
+				`DROP INDEX books_isbn`,
+				`ALTER TABLE books DROP COLUMN isbn`,
+			},
+		},
+		{
+			Version:     5,
+			Description: "add tags",
+			// The tags column holds a book's tags, comma-separated, for
+			// reading books and their revisions; book_tags indexes them.
+			Up: []string{
+				`ALTER TABLE books ADD COLUMN tags TEXT NULL`,
+				`ALTER TABLE revisions ADD COLUMN tags TEXT NULL`,
+				`CREATE TABLE book_tags (
+			bookId INTEGER NOT NULL,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (bookId, tag)
+		)`,
+				`CREATE INDEX book_tags_tag ON book_tags (tag)`,
+			},
+			Down: []string{
+				`DROP TABLE book_tags`,
+				`ALTER TABLE revisions DROP COLUMN tags`,
+				`ALTER TABLE books DROP COLUMN tags`,
+			},
+		},
+		{
+			Version:     6,
+			Description: "add creation time and list indexes",
+			// Existing books are taken to have been created at their first
+			// revision, or now if they have none. CURRENT_TIMESTAMP is UTC,
+			// without fractional seconds, which the driver also reads.
+			Up: []string{
+				`ALTER TABLE books ADD COLUMN createdAt TIMESTAMP NULL`,
+				`ALTER TABLE revisions ADD COLUMN createdAt TIMESTAMP NULL`,
+				`UPDATE books SET createdAt = COALESCE(
+			(SELECT MIN(changedAt) FROM revisions WHERE revisions.id = books.id),
+			CURRENT_TIMESTAMP)`,
+				`CREATE INDEX books_author ON books (author)`,
+				`CREATE INDEX books_published ON books (publishedDate)`,
+				`CREATE INDEX books_created ON books (createdAt)`,
+			},
+			Down: []string{
+				`DROP INDEX books_created`,
+				`DROP INDEX books_published`,
+				`DROP INDEX books_author`,
+				`ALTER TABLE revisions DROP COLUMN createdAt`,
+				`ALTER TABLE books DROP COLUMN createdAt`,
+			},
+		},
+		{
+			Version:     7,
+			Description: "add tenants",
+			// Existing books belong to the default tenant, named by the
+			// empty string. ISBNs are unique within a tenant.
+			Up: []string{
+				`ALTER TABLE books ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`,
+				`ALTER TABLE revisions ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`,
+				`DROP INDEX books_isbn`,
+				`CREATE UNIQUE INDEX books_isbn ON books (tenant, isbn)`,
+				`CREATE INDEX books_tenant ON books (tenant, deletedAt)`,
+			},
+			Down: []string{
+				`DROP INDEX books_tenant`,
+				`DROP INDEX books_isbn`,
+				`CREATE UNIQUE INDEX books_isbn ON books (isbn)`,
+				`ALTER TABLE revisions DROP COLUMN tenant`,
+				`ALTER TABLE books DROP COLUMN tenant`,
+			},
+		},
+	},
+}
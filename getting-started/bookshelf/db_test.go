@@ -6,8 +6,13 @@ package bookshelf
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,42 +26,851 @@ import (
 func testDB(t *testing.T, db BookDatabase) {
 	defer db.Close()
 
+	ctx := context.Background()
+
 	b := &Book{
 		Author:      "testy mc testface",
 		Title:       fmt.Sprintf("t-%d", time.Now().Unix()),
 		Description: "desc",
 	}
 
-	id, err := db.AddBook(b)
+	id, err := db.AddBook(ctx, b)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	b.ID = id
 	b.Description = "newdesc"
-	if err := db.UpdateBook(b); err != nil {
+	if err := db.UpdateBook(ctx, b); err != nil {
 		t.Error(err)
 	}
 
-	gotBook, err := db.GetBook(id)
+	gotBook, err := db.GetBook(ctx, id)
 	if err != nil {
 		t.Error(err)
 	}
 	if got, want := gotBook.Description, b.Description; got != want {
 		t.Errorf("Update description: got %q, want %q", got, want)
 	}
+	if got, want := gotBook.Version, int64(2); got != want {
+		t.Errorf("Update version: got %d, want %d", got, want)
+	}
 
-	if err := db.DeleteBook(id); err != nil {
+	// An update based on the version before the last update must fail.
+	stale := *b
+	stale.Version = 1
+	stale.Description = "stale"
+	if err, ok := db.UpdateBook(ctx, &stale).(*ConflictError); !ok {
+		t.Errorf("Stale update: got err %v, want *ConflictError", err)
+	}
+
+	if err := db.DeleteBook(ctx, id); err != nil {
 		t.Error(err)
 	}
 
-	if _, err := db.GetBook(id); err == nil {
-		t.Error("want non-nil err")
+	if _, err := db.GetBook(ctx, id); ErrorKind(err) != ErrNotFound {
+		t.Errorf("GetBook of deleted book: got err %v, want kind ErrNotFound", err)
+	}
+	if err := db.DeleteBook(ctx, id); ErrorKind(err) != ErrNotFound {
+		t.Errorf("DeleteBook of deleted book: got err %v, want kind ErrNotFound", err)
+	}
+
+	// Calls with a cancelled context fail.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := db.ListBooks(cancelled); err == nil {
+		t.Error("ListBooks with cancelled context: want non-nil err")
+	}
+
+	testListBooksPage(t, db)
+	testListOptions(t, db)
+	testSearchBooks(t, db)
+	testTrash(t, db)
+	testRevisions(t, db)
+	testBatch(t, db)
+	testISBN(t, db)
+	testTags(t, db)
+	testTenants(t, db)
+	if importer, ok := db.(BookImporter); ok {
+		testImportBook(t, db, importer)
+	}
+}
+
+func testImportBook(t *testing.T, db BookDatabase, importer BookImporter) {
+	// A tenant of its own, so that purging the imported book leaves other
+	// books alone.
+	ctx := WithTenant(context.Background(), "import-test")
+	purge := func() {
+		db.PurgeBooks(ctx, time.Now().Add(time.Hour))
+	}
+
+	// Import under the ID of a purged book, which is free and, unlike a
+	// made-up ID, does not move the ID counter of backends that keep one.
+	id, err := db.AddBook(ctx, &Book{Title: "to purge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteBook(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	purge()
+	b := &Book{ID: id, Title: "imported", Version: 7}
+	if err := importer.ImportBook(ctx, b); err != nil {
+		t.Fatalf("ImportBook: %v", err)
+	}
+	defer func() {
+		db.DeleteBook(ctx, b.ID)
+		purge()
+	}()
+
+	got, err := db.GetBook(ctx, b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != b.Title || got.Version != b.Version {
+		t.Errorf("GetBook of imported book: got %+v, want %+v", got, b)
+	}
+
+	// Importing again replaces the book.
+	b.Title = "reimported"
+	if err := importer.ImportBook(ctx, b); err != nil {
+		t.Fatalf("ImportBook: %v", err)
+	}
+	if got, err := db.GetBook(ctx, b.ID); err != nil || got.Title != b.Title {
+		t.Errorf("GetBook of reimported book: got %+v, %v; want title %q", got, err, b.Title)
+	}
+
+	if err := importer.ImportBook(ctx, &Book{}); ErrorKind(err) != ErrInvalidArgument {
+		t.Errorf("ImportBook with no ID: got err %v, want kind ErrInvalidArgument", err)
+	}
+}
+
+// testTenants checks that the books of one tenant are hidden from another.
+func testTenants(t *testing.T, db BookDatabase) {
+	bg := context.Background()
+	a := WithTenant(bg, "tenant-a.example")
+	b := WithTenant(bg, "tenant-b")
+
+	// A creator, tag and ISBN unique to this run, as the database may be
+	// shared.
+	run := time.Now().UnixNano()
+	userID := fmt.Sprintf("tenant-user-%d", run)
+	word := fmt.Sprintf("zq%d", run)
+	isbn := newISBNs(1)[0]
+
+	title := "tenant a " + word
+	id, err := db.AddBook(a, &Book{Title: title, ISBN: isbn, CreatedByID: userID, Tags: []string{word}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db.DeleteBook(a, id)
+		db.PurgeBooks(a, time.Now().Add(time.Hour))
+	}()
+
+	// The ISBN is only taken within tenant a.
+	if _, err := db.AddBook(b, &Book{Title: "tenant b", ISBN: isbn, CreatedByID: userID}); err != nil {
+		t.Fatalf("AddBook with an ISBN taken in another tenant: %v", err)
+	}
+	defer db.PurgeBooks(b, time.Now().Add(time.Hour))
+
+	// Some backends number the books of each tenant separately, so another
+	// tenant may have a book with the same ID, but not tenant a's book.
+	for _, ctx := range []context.Context{b, bg} {
+		tenant := fmt.Sprintf("tenant %q", TenantFromContext(ctx))
+		if got, err := db.GetBook(ctx, id); err == nil && got.Title == title {
+			t.Errorf("GetBook in %s got tenant a's book", tenant)
+		}
+		for _, got := range listAll(t, ctx, db, ListOptions{CreatedByID: userID}) {
+			if got.Title == title {
+				t.Errorf("ListBooksPage in %s listed tenant a's book", tenant)
+			}
+		}
+		if books, err := db.ListBooksByTag(ctx, word); err != nil || len(books) != 0 {
+			t.Errorf("ListBooksByTag in %s = %d books, %v; want none", tenant, len(books), err)
+		}
+		if books, err := db.SearchBooks(ctx, word); err != nil || len(books) != 0 {
+			t.Errorf("SearchBooks in %s = %d books, %v; want none", tenant, len(books), err)
+		}
+		revs, err := db.ListRevisions(ctx, id)
+		if err != nil {
+			t.Errorf("ListRevisions in %s: %v", tenant, err)
+		}
+		for _, r := range revs {
+			if r.Book.Title == title {
+				t.Errorf("ListRevisions in %s listed a revision of tenant a's book", tenant)
+			}
+		}
+	}
+
+	// Changes made in tenant b do not reach tenant a's book, and purging
+	// tenant b's trash leaves tenant a's alone.
+	db.UpdateBook(b, &Book{ID: id, Title: "hijacked", Version: 1})
+	db.DeleteBook(b, id)
+	if got, err := db.GetBook(a, id); err != nil || got.Title != title {
+		t.Errorf("GetBook in tenant a after changes in tenant b = %+v, %v; want title %q", got, err, title)
+	}
+	if err := db.DeleteBook(a, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PurgeBooks(b, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RestoreBook(a, id); err != nil {
+		t.Errorf("RestoreBook in tenant a after purging tenant b: %v", err)
+	}
+}
+
+func testTrash(t *testing.T, db BookDatabase) {
+	ctx := context.Background()
+
+	userID := fmt.Sprintf("trash-%d", time.Now().UnixNano())
+	b := &Book{Title: "trashed book", CreatedByID: userID}
+	id, err := db.AddBook(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteBook(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	// A deleted book is only seen in the trash.
+	if _, err := db.GetBook(ctx, id); ErrorKind(err) != ErrNotFound {
+		t.Errorf("GetBook of deleted book: got err %v, want kind ErrNotFound", err)
+	}
+	b.ID = id
+	if err := db.UpdateBook(ctx, b); ErrorKind(err) != ErrNotFound {
+		t.Errorf("UpdateBook of deleted book: got err %v, want kind ErrNotFound", err)
+	}
+	if books, err := db.ListBooksCreatedBy(ctx, userID); err != nil || len(books) != 0 {
+		t.Errorf("ListBooksCreatedBy after delete: got %d books, %v; want none", len(books), err)
+	}
+	if page, err := db.ListBooksPage(ctx, ListOptions{CreatedByID: userID}, "", 10); err != nil || len(page.Books) != 0 {
+		t.Errorf("ListBooksPage after delete: got %+v, %v; want no books", page, err)
+	}
+	trash, err := db.ListDeletedBooks(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].ID != id || trash[0].DeletedAt.IsZero() {
+		t.Errorf("ListDeletedBooks: got %+v, want book %d with a DeletedAt time", trash, id)
+	}
+	if trash, err := db.ListDeletedBooks(ctx, userID+"-other"); err != nil || len(trash) != 0 {
+		t.Errorf("ListDeletedBooks of another user: got %d books, %v; want none", len(trash), err)
+	}
+
+	if err := db.RestoreBook(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.GetBook(ctx, id); err != nil || !got.DeletedAt.IsZero() {
+		t.Errorf("GetBook of restored book: got %+v, %v; want a book outside the trash", got, err)
+	}
+	if err := db.RestoreBook(ctx, id); ErrorKind(err) != ErrNotFound {
+		t.Errorf("RestoreBook of book outside the trash: got err %v, want kind ErrNotFound", err)
+	}
+
+	// Purging removes only the books deleted before the given time.
+	if err := db.DeleteBook(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PurgeBooks(ctx, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if trash, err := db.ListDeletedBooks(ctx, userID); err != nil || len(trash) != 1 {
+		t.Errorf("ListDeletedBooks after early purge: got %d books, %v; want 1", len(trash), err)
+	}
+	if n, err := db.PurgeBooks(ctx, time.Now().Add(time.Hour)); err != nil || n < 1 {
+		t.Errorf("PurgeBooks: got %d, %v; want at least 1 book purged", n, err)
+	}
+	if trash, err := db.ListDeletedBooks(ctx, userID); err != nil || len(trash) != 0 {
+		t.Errorf("ListDeletedBooks after purge: got %d books, %v; want none", len(trash), err)
+	}
+	if err := db.RestoreBook(ctx, id); ErrorKind(err) != ErrNotFound {
+		t.Errorf("RestoreBook of purged book: got err %v, want kind ErrNotFound", err)
+	}
+	if revs, err := db.ListRevisions(ctx, id); err != nil || len(revs) != 0 {
+		t.Errorf("ListRevisions of purged book: got %d revisions, %v; want none", len(revs), err)
+	}
+}
+
+// checkBatchEntry checks the entry of a BatchError for a book that did not
+// fail itself, which depends on whether the backend writes batches all or
+// nothing. It returns whether the book was written.
+func checkBatchEntry(t *testing.T, batchErr BatchError, i int) (written bool) {
+	switch err := batchErr[i]; err {
+	case nil:
+		return true
+	case ErrBatchAborted:
+		return false
+	default:
+		t.Errorf("batch entry %d: got err %v, want nil or ErrBatchAborted", i, err)
+		return false
+	}
+}
+
+func testBatch(t *testing.T, db BookDatabase) {
+	ctx := context.Background()
+
+	if ids, err := db.AddBooks(ctx, nil); err != nil || len(ids) != 0 {
+		t.Errorf("AddBooks of no books = %v, %v; want no IDs", ids, err)
+	}
+
+	// Enough books to need more than one statement or transaction.
+	books := make([]*Book, 60)
+	for i := range books {
+		books[i] = &Book{Title: fmt.Sprintf("batch book %d", i)}
+	}
+	ids, err := db.AddBooks(ctx, books)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(books) {
+		t.Fatalf("AddBooks: got %d IDs, want %d", len(ids), len(books))
+	}
+	seen := make(map[int64]bool)
+	for i, id := range ids {
+		if id == 0 || seen[id] {
+			t.Fatalf("AddBooks: got IDs %v, want distinct non-zero IDs", ids)
+		}
+		seen[id] = true
+		got, err := db.GetBook(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != books[i].Title || got.Version != 1 {
+			t.Errorf("GetBook(%d) = %+v, want title %q and version 1", id, got, books[i].Title)
+		}
+		books[i].ID = id
+	}
+	if revs, err := db.ListRevisions(ctx, ids[0]); err != nil || len(revs) != 1 || revs[0].Action != RevisionAdd {
+		t.Errorf("ListRevisions of batch-added book = %v, %v; want one %q revision", revs, err, RevisionAdd)
+	}
+
+	for _, b := range books {
+		b.Description = "updated in a batch"
+	}
+	if err := db.UpdateBooks(ctx, books); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range books {
+		got, err := db.GetBook(ctx, b.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Description != b.Description || got.Version != 2 || b.Version != 2 {
+			t.Errorf("after UpdateBooks: got %+v, want description %q and version 2", got, b.Description)
+		}
+	}
+
+	// A stale version fails its own book, and may abort the others.
+	stale := *books[1]
+	stale.Version = 1
+	fresh := books[0]
+	fresh.Title = "updated again"
+	err = db.UpdateBooks(ctx, []*Book{fresh, &stale})
+	batchErr, ok := err.(BatchError)
+	if !ok || len(batchErr) != 2 {
+		t.Fatalf("UpdateBooks with a stale version: got err %v, want a BatchError of 2", err)
+	}
+	if ErrorKind(batchErr[1]) != ErrConflict {
+		t.Errorf("UpdateBooks with a stale version: got err %v, want kind ErrConflict", batchErr[1])
+	}
+	got, err := db.GetBook(ctx, fresh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written := checkBatchEntry(t, batchErr, 0); written != (got.Title == "updated again") {
+		t.Errorf("UpdateBooks reported written = %v, but the stored title is %q", written, got.Title)
+	}
+
+	// A missing book fails its own deletion, and may abort the others.
+	const missingID = 1 << 40
+	err = db.DeleteBooks(ctx, []int64{ids[2], missingID})
+	batchErr, ok = err.(BatchError)
+	if !ok || len(batchErr) != 2 {
+		t.Fatalf("DeleteBooks with a missing book: got err %v, want a BatchError of 2", err)
+	}
+	if ErrorKind(batchErr[1]) != ErrNotFound {
+		t.Errorf("DeleteBooks with a missing book: got err %v, want kind ErrNotFound", batchErr[1])
+	}
+	_, err = db.GetBook(ctx, ids[2])
+	if written := checkBatchEntry(t, batchErr, 0); written != (ErrorKind(err) == ErrNotFound) {
+		t.Errorf("DeleteBooks reported written = %v, but GetBook returned %v", written, err)
+	}
+
+	err = db.DeleteBooks(ctx, []int64{ids[3], ids[3]})
+	if batchErr, ok := err.(BatchError); !ok || ErrorKind(batchErr[1]) != ErrInvalidArgument {
+		t.Errorf("DeleteBooks of a repeated ID: got err %v, want ErrInvalidArgument for the repeat", err)
+	}
+
+	var live []int64
+	for _, id := range ids {
+		if _, err := db.GetBook(ctx, id); err == nil {
+			live = append(live, id)
+		}
+	}
+	if err := db.DeleteBooks(ctx, live); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range live {
+		if _, err := db.GetBook(ctx, id); ErrorKind(err) != ErrNotFound {
+			t.Errorf("GetBook after DeleteBooks: got err %v, want kind ErrNotFound", err)
+		}
+	}
+	if revs, err := db.ListRevisions(ctx, ids[0]); err != nil || len(revs) == 0 || revs[len(revs)-1].Action != RevisionDelete {
+		t.Errorf("ListRevisions of batch-deleted book = %v, %v; want a %q revision last", revs, err, RevisionDelete)
+	}
+}
+
+// newISBNs returns n ISBN-13s that no earlier test run has used, as the
+// books of a run keep theirs in the trash.
+func newISBNs(n int) []string {
+	base := time.Now().UnixNano() / 1000 % 1e9
+	isbns := make([]string, n)
+	for i := range isbns {
+		s := fmt.Sprintf("978%09d", (base+int64(i))%1e9)
+		isbns[i] = s + string(isbn13CheckDigit(s))
+	}
+	return isbns
+}
+
+func testISBN(t *testing.T, db BookDatabase) {
+	ctx := context.Background()
+	isbns := newISBNs(4)
+
+	// The ISBN is stored normalized, and found in either form.
+	b := &Book{Title: "isbn book", ISBN: "  " + ISBN10(isbns[0])[:3] + "-" + ISBN10(isbns[0])[3:]}
+	id, err := db.AddBook(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteBook(ctx, id)
+	b.ID = id
+	for _, isbn := range []string{isbns[0], ISBN10(isbns[0])} {
+		got, err := db.GetBookByISBN(ctx, isbn)
+		if err != nil || got.ID != id || got.ISBN != isbns[0] {
+			t.Errorf("GetBookByISBN(%q) = %+v, %v; want book %d with ISBN %s", isbn, got, err, id, isbns[0])
+		}
+	}
+	if _, err := db.GetBookByISBN(ctx, isbns[1]); ErrorKind(err) != ErrNotFound {
+		t.Errorf("GetBookByISBN of unknown ISBN: got err %v, want kind ErrNotFound", err)
+	}
+	if _, err := db.GetBookByISBN(ctx, "not an isbn"); ErrorKind(err) != ErrInvalidArgument {
+		t.Errorf("GetBookByISBN of malformed ISBN: got err %v, want kind ErrInvalidArgument", err)
+	}
+
+	if _, err := db.AddBook(ctx, &Book{Title: "bad isbn", ISBN: "0-306-40615-3"}); ErrorKind(err) != ErrInvalidArgument {
+		t.Errorf("AddBook with bad ISBN: got err %v, want kind ErrInvalidArgument", err)
+	}
+	if _, err := db.AddBook(ctx, &Book{Title: "same isbn", ISBN: isbns[0]}); ErrorKind(err) != ErrAlreadyExists {
+		t.Errorf("AddBook with taken ISBN: got err %v, want kind ErrAlreadyExists", err)
+	}
+
+	// Changing a book's ISBN frees the old one.
+	other := &Book{Title: "other isbn book", ISBN: isbns[1]}
+	otherID, err := db.AddBook(ctx, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteBook(ctx, otherID)
+	other.ID = otherID
+	other.ISBN = isbns[0]
+	if err := db.UpdateBook(ctx, other); ErrorKind(err) != ErrAlreadyExists {
+		t.Errorf("UpdateBook to taken ISBN: got err %v, want kind ErrAlreadyExists", err)
+	}
+	b.ISBN = isbns[2]
+	if err := db.UpdateBook(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateBook(ctx, other); err != nil {
+		t.Errorf("UpdateBook to freed ISBN: %v", err)
+	}
+
+	// Books in the trash keep their ISBN.
+	if err := db.DeleteBook(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetBookByISBN(ctx, isbns[2]); ErrorKind(err) != ErrNotFound {
+		t.Errorf("GetBookByISBN of deleted book: got err %v, want kind ErrNotFound", err)
+	}
+	if _, err := db.AddBook(ctx, &Book{Title: "trashed isbn", ISBN: isbns[2]}); ErrorKind(err) != ErrAlreadyExists {
+		t.Errorf("AddBook with ISBN of deleted book: got err %v, want kind ErrAlreadyExists", err)
+	}
+
+	// A batch may not repeat an ISBN.
+	batch := []*Book{
+		{Title: "batch isbn 1", ISBN: isbns[3]},
+		{Title: "batch isbn 2", ISBN: isbns[3]},
+	}
+	ids, err := db.AddBooks(ctx, batch)
+	batchErr, ok := err.(BatchError)
+	if !ok || len(batchErr) != len(batch) {
+		t.Fatalf("AddBooks with repeated ISBN: got err %v, want a BatchError", err)
+	}
+	if ErrorKind(batchErr[1]) != ErrAlreadyExists {
+		t.Errorf("AddBooks with repeated ISBN: got err %v for the repeat, want kind ErrAlreadyExists", batchErr[1])
+	}
+	if checkBatchEntry(t, batchErr, 0) {
+		db.DeleteBook(ctx, ids[0])
+	}
+}
+
+// tagCount returns the count of a tag listed by db.ListTags, or 0.
+func tagCount(t *testing.T, db BookDatabase, tag string) int {
+	tags, err := db.ListTags(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range tags {
+		if tc.Tag == tag {
+			return tc.Count
+		}
+	}
+	return 0
+}
+
+// taggedTitles returns the titles of the books db.ListBooksByTag lists.
+func taggedTitles(t *testing.T, db BookDatabase, tag string) []string {
+	books, err := db.ListBooksByTag(context.Background(), tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, b := range books {
+		titles = append(titles, b.Title)
+	}
+	return titles
+}
+
+func testTags(t *testing.T, db BookDatabase) {
+	ctx := context.Background()
+	// Tags unique to this run, as the database may be shared.
+	tag := fmt.Sprintf("tag %d", time.Now().UnixNano())
+	batchTag := tag + " batch"
+
+	b := &Book{Title: "tagged b", Tags: []string{"  " + strings.ToUpper(tag), "fiction", tag}}
+	id, err := db.AddBook(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteBook(ctx, id)
+	b.ID = id
+	if got, err := db.GetBook(ctx, id); err != nil || !reflect.DeepEqual(got.Tags, []string{"fiction", tag}) {
+		t.Errorf("GetBook of tagged book = %+v, %v; want tags %q", got, err, []string{"fiction", tag})
+	}
+
+	a := &Book{Title: "tagged a", Tags: []string{tag}}
+	aID, err := db.AddBook(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteBook(ctx, aID)
+	a.ID = aID
+
+	if got, want := taggedTitles(t, db, strings.ToUpper(tag)), []string{"tagged a", "tagged b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListBooksByTag: got %q, want %q", got, want)
+	}
+	if got := tagCount(t, db, tag); got != 2 {
+		t.Errorf("ListTags: got count %d for %q, want 2", got, tag)
+	}
+
+	a.Tags = nil
+	if err := db.UpdateBook(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := taggedTitles(t, db, tag), []string{"tagged b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListBooksByTag after untagging: got %q, want %q", got, want)
+	}
+
+	// Books in the trash are not listed.
+	if err := db.DeleteBook(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if got := taggedTitles(t, db, tag); len(got) != 0 {
+		t.Errorf("ListBooksByTag after deleting: got %q, want none", got)
+	}
+	if got := tagCount(t, db, tag); got != 0 {
+		t.Errorf("ListTags after deleting: got count %d for %q, want 0", got, tag)
+	}
+
+	ids, err := db.AddBooks(ctx, []*Book{
+		{Title: "batch tagged 2", Tags: []string{batchTag}},
+		{Title: "batch tagged 1", Tags: []string{batchTag, tag}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		defer db.DeleteBook(ctx, id)
+	}
+	if got, want := taggedTitles(t, db, batchTag), []string{"batch tagged 1", "batch tagged 2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListBooksByTag of batch-added books: got %q, want %q", got, want)
+	}
+
+	if _, err := db.AddBook(ctx, &Book{Title: "bad tag", Tags: []string{"a/b"}}); ErrorKind(err) != ErrInvalidArgument {
+		t.Errorf("AddBook with bad tag: got err %v, want kind ErrInvalidArgument", err)
+	}
+	if _, err := db.ListBooksByTag(ctx, " "); ErrorKind(err) != ErrInvalidArgument {
+		t.Errorf("ListBooksByTag of empty tag: got err %v, want kind ErrInvalidArgument", err)
+	}
+}
+
+func testRevisions(t *testing.T, db BookDatabase) {
+	ctx := WithActor(context.Background(), "user-1")
+
+	b := &Book{Title: "first title"}
+	id, err := db.AddBook(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteBook(ctx, id)
+
+	b.ID = id
+	b.Title = "second title"
+	if err := db.UpdateBook(WithActor(ctx, WorkerActor), b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteBook(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RestoreBook(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	revs, err := db.ListRevisions(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		action, actor, title string
+		version              int64
+		deleted              bool
+	}{
+		{RevisionAdd, "user-1", "first title", 1, false},
+		{RevisionUpdate, WorkerActor, "second title", 2, false},
+		{RevisionDelete, "user-1", "second title", 2, true},
+		{RevisionRestore, "user-1", "second title", 2, false},
+	}
+	if len(revs) != len(want) {
+		t.Fatalf("ListRevisions: got %d revisions, want %d", len(revs), len(want))
+	}
+	for i, w := range want {
+		r := revs[i]
+		if r.BookID != id || r.Action != w.action || r.Actor != w.actor || r.Book.ID != id ||
+			r.Book.Title != w.title || r.Book.Version != w.version || r.Book.DeletedAt.IsZero() != !w.deleted {
+			t.Errorf("revision %d: got %+v, want %+v", i, r, w)
+		}
+		if r.Time.IsZero() {
+			t.Errorf("revision %d: got zero Time", i)
+		}
+	}
+}
+
+func testSearchBooks(t *testing.T, db BookDatabase) {
+	ctx := context.Background()
+
+	// Use a unique word so that books already in the database do not match.
+	word := fmt.Sprintf("zyzzyva%d", time.Now().UnixNano())
+
+	books := []*Book{
+		{Title: "unrelated", Description: "nothing to see here"},
+		{Title: "plain", Description: "mentions " + word},
+		{Title: "The " + word + " book", Author: "someone"},
+	}
+	var ids []int64
+	for _, b := range books {
+		id, err := db.AddBook(ctx, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	defer func() {
+		for _, id := range ids {
+			db.DeleteBook(ctx, id)
+		}
+	}()
+
+	got, err := db.SearchBooks(ctx, strings.ToUpper(word))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("SearchBooks: got %d books, want 2", len(got))
+	}
+	// A match in the title ranks above a match in the description.
+	if got, want := got[0].ID, ids[2]; got != want {
+		t.Errorf("SearchBooks: first result: got ID %d, want %d", got, want)
+	}
+	if got, want := got[1].ID, ids[1]; got != want {
+		t.Errorf("SearchBooks: second result: got ID %d, want %d", got, want)
+	}
+}
+
+func testListBooksPage(t *testing.T, db BookDatabase) {
+	ctx := context.Background()
+
+	// Use a unique creator so that books already in the database are not listed.
+	userID := fmt.Sprintf("pager-%d", time.Now().UnixNano())
+
+	// Two books share a title, to check that ties are paged through correctly.
+	titles := []string{"d", "a", "c", "b", "c"}
+	var ids []int64
+	for _, title := range titles {
+		id, err := db.AddBook(ctx, &Book{Title: title, CreatedByID: userID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	defer func() {
+		for _, id := range ids {
+			db.DeleteBook(ctx, id)
+		}
+	}()
+
+	var got []string
+	var pages []*BookPage
+	cursor := ""
+	for {
+		page, err := db.ListBooksPage(ctx, ListOptions{CreatedByID: userID}, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Books) > 2 {
+			t.Fatalf("ListBooksPage: got %d books, want at most 2", len(page.Books))
+		}
+		for _, b := range page.Books {
+			got = append(got, b.Title)
+		}
+		pages = append(pages, page)
+		if page.NextCursor == "" {
+			break
+		}
+		if len(pages) > len(titles) {
+			t.Fatal("ListBooksPage: too many pages")
+		}
+		cursor = page.NextCursor
+	}
+	if got, want := strings.Join(got, ","), "a,b,c,c,d"; got != want {
+		t.Errorf("ListBooksPage: got titles %q, want %q", got, want)
+	}
+	if pages[0].PrevCursor != "" {
+		t.Errorf("ListBooksPage: first page has previous cursor %q", pages[0].PrevCursor)
+	}
+
+	// Page backwards from the last page.
+	last := pages[len(pages)-1]
+	prev, err := db.ListBooksPage(ctx, ListOptions{CreatedByID: userID}, last.PrevCursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pages[len(pages)-2]
+	if len(prev.Books) != len(want.Books) {
+		t.Fatalf("ListBooksPage backwards: got %d books, want %d", len(prev.Books), len(want.Books))
+	}
+	for i := range want.Books {
+		if got, want := prev.Books[i].ID, want.Books[i].ID; got != want {
+			t.Errorf("ListBooksPage backwards: book %d: got ID %d, want %d", i, got, want)
+		}
+	}
+
+	if _, err := db.ListBooksPage(ctx, ListOptions{CreatedByID: userID}, "not a cursor", 2); ErrorKind(err) != ErrInvalidArgument {
+		t.Errorf("ListBooksPage with bad cursor: got err %v, want kind ErrInvalidArgument", err)
 	}
 }
 
 func TestMemoryDB(t *testing.T) {
-	testDB(t, newMemoryDB())
+	testDB(t, newTenantMemoryDB())
+}
+
+func TestFileDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookshelf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := newFileDB(filepath.Join(dir, "books.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB(t, db)
+}
+
+// TestFileDBShared checks that several handles on the same file, as held by
+// the app and the Pub/Sub worker, see each other's changes.
+func TestFileDBShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookshelf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "books.json")
+
+	ctx := context.Background()
+	var dbs []*fileDB
+	for i := 0; i < 3; i++ {
+		db, err := newFileDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbs = append(dbs, db)
+	}
+
+	const perDB = 10
+	var wg sync.WaitGroup
+	errc := make(chan error, len(dbs)*perDB)
+	for i, db := range dbs {
+		wg.Add(1)
+		go func(i int, db *fileDB) {
+			defer wg.Done()
+			for j := 0; j < perDB; j++ {
+				_, err := db.AddBook(ctx, &Book{Title: fmt.Sprintf("book %d-%d", i, j)})
+				errc <- err
+			}
+		}(i, db)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every book was saved, under distinct IDs, and is visible to a handle
+	// opened afterwards.
+	reopened, err := newFileDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	books, err := reopened.ListBooks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(books), len(dbs)*perDB; got != want {
+		t.Fatalf("got %d books, want %d", got, want)
+	}
+	for i := 1; i < len(books); i++ {
+		if books[i-1].Title > books[i].Title {
+			t.Errorf("books not ordered by title: %q before %q", books[i-1].Title, books[i].Title)
+		}
+	}
+
+	// An update made through one handle is seen by the others.
+	b := books[0]
+	b.Title = "updated"
+	if err := dbs[0].UpdateBook(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	got, err := dbs[1].GetBook(ctx, b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "updated" {
+		t.Errorf("GetBook via another handle: got title %q, want %q", got.Title, "updated")
+	}
 }
 
 func TestDatastoreDB(t *testing.T) {
@@ -76,6 +890,73 @@ func TestDatastoreDB(t *testing.T) {
 	testDB(t, db)
 }
 
+func TestSQLiteDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookshelf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := newSQLiteDB(filepath.Join(dir, "books.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB(t, db)
+}
+
+// TestSQLiteDBRowByRow runs the batch tests against SQLite inserting books
+// one at a time, as MySQL does.
+func TestSQLiteDBRowByRow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookshelf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conn, err := openSQLite(filepath.Join(dir, "books.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := *sqliteDialect
+	d.insertRowByRow = true
+	db, err := newSQLDB(conn, &d, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testBatch(t, db)
+}
+
+func TestPostgresDB(t *testing.T) {
+	t.Parallel()
+
+	host := os.Getenv("GOLANG_SAMPLES_POSTGRES_HOST")
+	port := os.Getenv("GOLANG_SAMPLES_POSTGRES_PORT")
+
+	if host == "" {
+		t.Skip("GOLANG_SAMPLES_POSTGRES_HOST not set.")
+	}
+	if port == "" {
+		port = "5432"
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("Could not parse port: %v", err)
+	}
+
+	db, err := newPostgresDB(PostgresConfig{
+		Username: "postgres",
+		Host:     host,
+		Port:     p,
+		SSLMode:  "disable",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB(t, db)
+}
+
 func TestMySQLDB(t *testing.T) {
 	t.Parallel()
 
@@ -104,3 +985,139 @@ func TestMySQLDB(t *testing.T) {
 	}
 	testDB(t, db)
 }
+
+// listAll pages through the books listed by opts, two at a time.
+func listAll(t *testing.T, ctx context.Context, db BookDatabase, opts ListOptions) []*Book {
+	var books []*Book
+	cursor := ""
+	for i := 0; ; i++ {
+		page, err := db.ListBooksPage(ctx, opts, cursor, 2)
+		if err != nil {
+			t.Fatalf("ListBooksPage(%+v): %v", opts, err)
+		}
+		books = append(books, page.Books...)
+		if page.NextCursor == "" {
+			return books
+		}
+		if i > 10 {
+			t.Fatalf("ListBooksPage(%+v): too many pages", opts)
+		}
+		cursor = page.NextCursor
+	}
+}
+
+func testListOptions(t *testing.T, db BookDatabase) {
+	ctx := context.Background()
+
+	// Use a unique creator so that books already in the database are not listed.
+	userID := fmt.Sprintf("lister-%d", time.Now().UnixNano())
+	start := time.Now().Add(-time.Second)
+	books := []*Book{
+		{Title: "c", Author: "Xu", PublishedDate: "2001-05-01"},
+		{Title: "a", Author: "Yang", PublishedDate: "1999"},
+		{Title: "b", Author: "Xu", PublishedDate: "2010-01-02"},
+		{Title: "d", Author: "Zhao", PublishedDate: "May 2005"},
+	}
+	for _, b := range books {
+		b.CreatedByID = userID
+		id, err := db.AddBook(ctx, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.DeleteBook(ctx, id)
+		b.ID = id
+		// Space the books out, so that they are created in order.
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	titles := func(books []*Book) string {
+		var s []string
+		for _, b := range books {
+			s = append(s, b.Title)
+		}
+		return strings.Join(s, ",")
+	}
+	authors := func(books []*Book) string {
+		var s []string
+		for _, b := range books {
+			s = append(s, b.Author)
+		}
+		return strings.Join(s, ",")
+	}
+	tests := []struct {
+		opts  ListOptions
+		field func([]*Book) string
+		want  string
+	}{
+		{ListOptions{}, titles, "a,b,c,d"},
+		{ListOptions{Descending: true}, titles, "d,c,b,a"},
+		{ListOptions{SortBy: SortByAuthor}, authors, "Xu,Xu,Yang,Zhao"},
+		{ListOptions{SortBy: SortByAuthor, Descending: true}, authors, "Zhao,Yang,Xu,Xu"},
+		{ListOptions{SortBy: SortByPublishedDate}, titles, "a,c,b,d"},
+		{ListOptions{SortBy: SortByCreatedAt}, titles, "c,a,b,d"},
+		{ListOptions{SortBy: SortByCreatedAt, Descending: true}, titles, "d,b,a,c"},
+		{ListOptions{Author: "Xu"}, titles, "b,c"},
+		{ListOptions{Author: "Xu", SortBy: SortByPublishedDate, Descending: true}, titles, "b,c"},
+		{ListOptions{MinYear: 2000}, titles, "b,c"},
+		{ListOptions{MaxYear: 2005}, titles, "a,c"},
+		{ListOptions{MinYear: 2000, MaxYear: 2009}, titles, "c"},
+		{ListOptions{MinYear: 1999, MaxYear: 1999}, titles, "a"},
+		{ListOptions{Author: "Xu", MaxYear: 2000}, titles, ""},
+	}
+	for _, tt := range tests {
+		tt.opts.CreatedByID = userID
+		if got := tt.field(listAll(t, ctx, db, tt.opts)); got != tt.want {
+			t.Errorf("ListBooksPage(%+v): got %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+
+	// Page backwards through a descending listing.
+	opts := ListOptions{CreatedByID: userID, SortBy: SortByCreatedAt, Descending: true}
+	first, err := db.ListBooksPage(ctx, opts, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.ListBooksPage(ctx, opts, first.NextCursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev, err := db.ListBooksPage(ctx, opts, second.PrevCursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := titles(prev.Books), titles(first.Books); got != want {
+		t.Errorf("ListBooksPage backwards: got %q, want %q", got, want)
+	}
+
+	// A cursor only works with the order it was made for.
+	if _, err := db.ListBooksPage(ctx, ListOptions{CreatedByID: userID}, first.NextCursor, 2); ErrorKind(err) != ErrInvalidArgument {
+		t.Errorf("ListBooksPage with cursor of another order: got err %v, want kind ErrInvalidArgument", err)
+	}
+	for _, opts := range []ListOptions{
+		{SortBy: "bogus"},
+		{MinYear: 2010, MaxYear: 2000},
+		{MaxYear: 10000},
+	} {
+		if _, err := db.ListBooksPage(ctx, opts, "", 2); ErrorKind(err) != ErrInvalidArgument {
+			t.Errorf("ListBooksPage(%+v): got err %v, want kind ErrInvalidArgument", opts, err)
+		}
+	}
+
+	// Books get their creation time when added, and keep it when updated.
+	got, err := db.GetBook(ctx, books[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CreatedAt.Before(start) || got.CreatedAt.After(time.Now()) {
+		t.Errorf("GetBook: got CreatedAt %v, want a time since %v", got.CreatedAt, start)
+	}
+	created := got.CreatedAt
+	got.CreatedAt = time.Time{}
+	got.Description = "updated"
+	if err := db.UpdateBook(ctx, got); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.GetBook(ctx, books[0].ID); err != nil || !got.CreatedAt.Equal(created) {
+		t.Errorf("GetBook after update: got %+v, %v; want CreatedAt %v", got, err, created)
+	}
+}
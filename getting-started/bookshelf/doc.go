@@ -3,4 +3,12 @@
 // license that can be found in the LICENSE file.
 
 // Package bookshelf contains the bookshelf database and app configuration, shared by the main app module and the worker module.
+//
+// Breaking change: every BookDatabase method now takes a context.Context as
+// its first argument, so that a cancelled request or an expired deadline
+// stops the database work it started. The methods without a context were
+// removed rather than kept alongside, as an interface cannot hold both.
+// Callers outside this repository must pass a context, context.Background()
+// if they have none, and implementations must accept one and give up when it
+// is done.
 package bookshelf
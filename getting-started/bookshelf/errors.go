@@ -0,0 +1,166 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of error returned by a BookDatabase. The backends report them wrapped
+// in an *Error that carries a more specific message, so use ErrorKind to
+// test for them.
+var (
+	// ErrNotFound means the requested book does not exist.
+	ErrNotFound = errors.New("bookshelf: book not found")
+
+	// ErrInvalidArgument means the caller passed a malformed value, such as
+	// an unassigned book ID or a corrupt page cursor.
+	ErrInvalidArgument = errors.New("bookshelf: invalid argument")
+
+	// ErrConflict means the book was modified concurrently. See ConflictError.
+	ErrConflict = errors.New("bookshelf: book was modified concurrently")
+
+	// ErrAlreadyExists means another book, possibly one in the trash, has
+	// the same ISBN.
+	ErrAlreadyExists = errors.New("bookshelf: a book with the same ISBN already exists")
+)
+
+// errClosed is returned by calls made to a BookDatabase after it is closed.
+var errClosed = errors.New("bookshelf: database is closed")
+
+// Error is an error of a particular kind returned by a BookDatabase.
+type Error struct {
+	Kind error // ErrNotFound, ErrInvalidArgument, ErrConflict or ErrAlreadyExists.
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// errorf returns an *Error of the given kind, formatting its message
+// according to a format specifier.
+func errorf(kind error, format string, v ...interface{}) error {
+	return &Error{Kind: kind, Msg: fmt.Sprintf(format, v...)}
+}
+
+// ErrorKind returns the kind of err: ErrNotFound, ErrInvalidArgument,
+// ErrConflict or ErrAlreadyExists. It returns nil if err is not of any of
+// those kinds.
+func ErrorKind(err error) error {
+	switch e := err.(type) {
+	case *Error:
+		return e.Kind
+	case *ConflictError:
+		return ErrConflict
+	}
+	switch err {
+	case ErrNotFound, ErrInvalidArgument, ErrConflict, ErrAlreadyExists:
+		return err
+	}
+	return nil
+}
+
+// ConflictError is returned by BookDatabase.UpdateBook when the stored book
+// has been modified since the caller read it. Its kind is ErrConflict.
+type ConflictError struct {
+	ID      int64
+	Version int64 // The stale version the caller tried to update.
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("bookshelf: book with ID %d was modified concurrently (version %d is out of date)",
+		e.ID, e.Version)
+}
+
+// ErrBatchAborted is reported in a BatchError for the books that were not
+// written because another book of the batch failed.
+var ErrBatchAborted = errors.New("bookshelf: not written because another book in the batch failed")
+
+// BatchError is returned by the batch methods of a BookDatabase, such as
+// AddBooks, when some books of the batch were not written. It has an entry
+// for each book, in the order they were passed: nil if the book was written,
+// ErrBatchAborted if it was not written because another book failed, and
+// otherwise the reason the book could not be written.
+type BatchError []error
+
+func (e BatchError) Error() string {
+	var (
+		failed int
+		first  error
+	)
+	for _, err := range e {
+		if err == nil {
+			continue
+		}
+		failed++
+		if first == nil && err != ErrBatchAborted {
+			first = err
+		}
+	}
+	if first == nil {
+		first = ErrBatchAborted
+	}
+	return fmt.Sprintf("bookshelf: %d of %d books not written: %v", failed, len(e), first)
+}
+
+// failed reports whether any book of the batch was not written.
+func (e BatchError) failed() bool {
+	for _, err := range e {
+		if err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// orNil returns e, or nil if every book of the batch was written.
+func (e BatchError) orNil() error {
+	if e.failed() {
+		return e
+	}
+	return nil
+}
+
+// abort marks every book without an error as not written because of the
+// others, for backends that write a batch all or nothing. It returns nil if
+// no book failed.
+func (e BatchError) abort() error {
+	if !e.failed() {
+		return nil
+	}
+	for i, err := range e {
+		if err == nil {
+			e[i] = ErrBatchAborted
+		}
+	}
+	return e
+}
+
+// checkBatchIDs records an ErrInvalidArgument error in errs for each ID of a
+// batch that is unassigned or repeats an earlier one. name prefixes the
+// errors' messages.
+func checkBatchIDs(name string, ids []int64, errs BatchError) {
+	seen := make(map[int64]bool)
+	for i, id := range ids {
+		switch {
+		case id == 0:
+			errs[i] = errorf(ErrInvalidArgument, "%s: book with unassigned ID passed in a batch", name)
+		case seen[id]:
+			errs[i] = errorf(ErrInvalidArgument, "%s: book with ID %d passed twice in a batch", name, id)
+		}
+		seen[id] = true
+	}
+}
+
+// bookIDs returns the IDs of a batch of books.
+func bookIDs(bs []*Book) []int64 {
+	ids := make([]int64, len(bs))
+	for i, b := range bs {
+		ids[i] = b.ID
+	}
+	return ids
+}
@@ -0,0 +1,19 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package bookshelf
+
+import (
+	"errors"
+	"runtime"
+)
+
+// lockFile is not implemented on this platform, so the file database cannot
+// be used.
+func lockFile(path string, exclusive bool) (unlock func(), err error) {
+	return nil, errors.New("file locking is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,134 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"strings"
+)
+
+// NormalizeISBN checks the check digit of an ISBN-10 or ISBN-13, which may
+// contain hyphens and spaces, and returns it as a 13-digit ISBN-13. An
+// ISBN-10 is converted by prefixing it with 978. If the ISBN is malformed,
+// the error's kind is ErrInvalidArgument.
+func NormalizeISBN(isbn string) (string, error) {
+	s := strings.ToUpper(strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, isbn))
+
+	switch len(s) {
+	case 10:
+		if !isDigits(s[:9]) || !(isDigits(s[9:]) || s[9] == 'X') {
+			break
+		}
+		if isbn10CheckDigit(s[:9]) != s[9] {
+			return "", errorf(ErrInvalidArgument, "bookshelf: ISBN %q has a bad check digit", isbn)
+		}
+		s13 := "978" + s[:9]
+		return s13 + string(isbn13CheckDigit(s13)), nil
+
+	case 13:
+		if !isDigits(s) || !(strings.HasPrefix(s, "978") || strings.HasPrefix(s, "979")) {
+			break
+		}
+		if isbn13CheckDigit(s[:12]) != s[12] {
+			return "", errorf(ErrInvalidArgument, "bookshelf: ISBN %q has a bad check digit", isbn)
+		}
+		return s, nil
+	}
+	return "", errorf(ErrInvalidArgument, "bookshelf: %q is not an ISBN-10 or ISBN-13", isbn)
+}
+
+// ISBN10 returns the ISBN-10 form of a normalized ISBN, or the empty string
+// if it has none, as is the case for ISBNs starting with 979.
+func ISBN10(isbn string) string {
+	if len(isbn) != 13 || !strings.HasPrefix(isbn, "978") {
+		return ""
+	}
+	return isbn[3:12] + string(isbn10CheckDigit(isbn[3:12]))
+}
+
+// isbn10CheckDigit returns the check digit of the first nine digits of an
+// ISBN-10.
+func isbn10CheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(digits[i]-'0')
+	}
+	switch d := (11 - sum%11) % 11; d {
+	case 10:
+		return 'X'
+	default:
+		return byte('0' + d)
+	}
+}
+
+// isbn13CheckDigit returns the check digit of the first twelve digits of an
+// ISBN-13.
+func isbn13CheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		w := 1
+		if i%2 == 1 {
+			w = 3
+		}
+		sum += w * int(digits[i]-'0')
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeBookISBN normalizes the ISBN of a book about to be written, if
+// it has one. name prefixes the error's message.
+func normalizeBookISBN(name string, b *Book) error {
+	if b.ISBN == "" {
+		return nil
+	}
+	isbn, err := NormalizeISBN(b.ISBN)
+	if err != nil {
+		return errorf(ErrInvalidArgument, "%s: book has an invalid ISBN %q", name, b.ISBN)
+	}
+	b.ISBN = isbn
+	return nil
+}
+
+// checkISBN returns an ErrAlreadyExists error if a book other than the one
+// with the given ID has the ISBN. owners maps ISBNs to the IDs of the stored
+// books that have them. name prefixes the error's message.
+func checkISBN(name, isbn string, id int64, owners map[string]int64) error {
+	if other, ok := owners[isbn]; ok && isbn != "" && other != id {
+		return errorf(ErrAlreadyExists, "%s: ISBN %s is taken by the book with ID %d", name, isbn, other)
+	}
+	return nil
+}
+
+// checkBatchISBNs records an ErrAlreadyExists error in errs for each book of
+// a batch whose ISBN is taken by another book, either stored or earlier in
+// the batch. ids holds the IDs of the books, which are 0 for new books, and
+// owners is as for checkISBN. Books that already have an error are skipped.
+func checkBatchISBNs(name string, bs []*Book, ids []int64, owners map[string]int64, errs BatchError) {
+	batch := make(map[string]bool)
+	for i, b := range bs {
+		if errs[i] != nil || b.ISBN == "" {
+			continue
+		}
+		if batch[b.ISBN] {
+			errs[i] = errorf(ErrAlreadyExists, "%s: ISBN %s passed twice in a batch", name, b.ISBN)
+			continue
+		}
+		batch[b.ISBN] = true
+		errs[i] = checkISBN(name, b.ISBN, ids[i], owners)
+	}
+}
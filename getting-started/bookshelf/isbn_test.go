@@ -0,0 +1,55 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import "testing"
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"0-306-40615-2", "9780306406157"},
+		{"978-0-306-40615-7", "9780306406157"},
+		{"9780306406157", "9780306406157"},
+		{"080442957X", "9780804429573"},
+		{"0 8044 2957 x", "9780804429573"},
+		{"979-10-90636-07-1", "9791090636071"},
+	}
+	for _, tt := range tests {
+		if got, err := NormalizeISBN(tt.in); err != nil || got != tt.want {
+			t.Errorf("NormalizeISBN(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"0-306-40615-3",     // Bad ISBN-10 check digit.
+		"978-0-306-40615-8", // Bad ISBN-13 check digit.
+		"977-0-306-40615-1", // Not a book.
+		"X306406152",
+		"030640615",
+		"isbn 0306406152",
+	} {
+		if got, err := NormalizeISBN(in); ErrorKind(err) != ErrInvalidArgument {
+			t.Errorf("NormalizeISBN(%q) = %q, %v; want kind ErrInvalidArgument", in, got, err)
+		}
+	}
+}
+
+func TestISBN10(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"9780306406157", "0306406152"},
+		{"9780804429573", "080442957X"},
+		{"9791090636071", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := ISBN10(tt.in); got != tt.want {
+			t.Errorf("ISBN10(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
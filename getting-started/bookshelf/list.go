@@ -0,0 +1,172 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SortField is a field that ListBooksPage can order books by.
+type SortField string
+
+const (
+	SortByTitle         SortField = "title"
+	SortByAuthor        SortField = "author"
+	SortByPublishedDate SortField = "published"
+	SortByCreatedAt     SortField = "created"
+)
+
+// ListOptions selects and orders the books listed by
+// BookDatabase.ListBooksPage. The zero value lists every book outside the
+// trash by title.
+type ListOptions struct {
+	// SortBy is the field the books are ordered by, SortByTitle if empty.
+	// Books with the same value are ordered by ID.
+	SortBy SortField
+
+	// Descending reverses the order.
+	Descending bool
+
+	// Author and CreatedByID, if not empty, list only the books with exactly
+	// that author, or created by that user.
+	Author      string
+	CreatedByID string
+
+	// MinYear and MaxYear, if not zero, list only the books published in or
+	// after MinYear, and in or before MaxYear. The year is read from the
+	// start of PublishedDate, so when either is set, books whose published
+	// date does not start with a four-digit year are left out.
+	MinYear, MaxYear int
+}
+
+// maxYear is the largest year a ListOptions can filter by.
+const maxYear = 9999
+
+// sortBy returns the field the books are ordered by.
+func (o *ListOptions) sortBy() SortField {
+	if o.SortBy == "" {
+		return SortByTitle
+	}
+	return o.SortBy
+}
+
+// validate checks that the options can be listed. name prefixes the error's
+// message.
+func (o *ListOptions) validate(name string) error {
+	switch o.sortBy() {
+	case SortByTitle, SortByAuthor, SortByPublishedDate, SortByCreatedAt:
+	default:
+		return errorf(ErrInvalidArgument, "%s: cannot sort books by %q", name, o.SortBy)
+	}
+	if o.MinYear < 0 || o.MinYear > maxYear || o.MaxYear < 0 || o.MaxYear > maxYear {
+		return errorf(ErrInvalidArgument, "%s: years must be between 1 and %d", name, maxYear)
+	}
+	if o.MinYear != 0 && o.MaxYear != 0 && o.MinYear > o.MaxYear {
+		return errorf(ErrInvalidArgument, "%s: year range %d to %d is empty", name, o.MinYear, o.MaxYear)
+	}
+	return nil
+}
+
+// publishedRange returns the range of PublishedDate values, from inclusive
+// and to exclusive, of books published within the year filter. ok is false
+// if there is no year filter.
+func (o *ListOptions) publishedRange() (from, to string, ok bool) {
+	if o.MinYear == 0 && o.MaxYear == 0 {
+		return "", "", false
+	}
+	from = fmt.Sprintf("%04d", o.MinYear)
+	// ":" sorts just after "9", and so after every date starting with a year.
+	to = ":"
+	if o.MaxYear != 0 && o.MaxYear < maxYear {
+		to = fmt.Sprintf("%04d", o.MaxYear+1)
+	}
+	return from, to, true
+}
+
+// matches reports whether b passes the filters of the options. It does not
+// check whether b is in the trash.
+func (o *ListOptions) matches(b *Book) bool {
+	if o.Author != "" && b.Author != o.Author {
+		return false
+	}
+	if o.CreatedByID != "" && b.CreatedByID != o.CreatedByID {
+		return false
+	}
+	if from, to, ok := o.publishedRange(); ok && (b.PublishedDate < from || b.PublishedDate >= to) {
+		return false
+	}
+	return true
+}
+
+// readsAscending reports whether a listing starting at cursor c reads books
+// in ascending order, which it does when it pages forwards through an
+// ascending listing or backwards through a descending one.
+func (o *ListOptions) readsAscending(c *pageCursor) bool {
+	return o.Descending == (c != nil && c.Before)
+}
+
+// sortKey returns the value of the field b is sorted by when it is a
+// string, and the empty string when it is CreatedAt.
+func sortKey(sort SortField, b *Book) string {
+	switch sort {
+	case SortByAuthor:
+		return b.Author
+	case SortByPublishedDate:
+		return b.PublishedDate
+	case SortByCreatedAt:
+		return ""
+	}
+	return b.Title
+}
+
+// compareBooks compares a and b by a sort field and then by ID, returning
+// -1, 0 or 1.
+func compareBooks(sort SortField, a, b *Book) int {
+	if sort == SortByCreatedAt {
+		if c := compareTimes(a.CreatedAt, b.CreatedAt); c != 0 {
+			return c
+		}
+	} else if c := strings.Compare(sortKey(sort, a), sortKey(sort, b)); c != 0 {
+		return c
+	}
+	switch {
+	case a.ID < b.ID:
+		return -1
+	case a.ID > b.ID:
+		return 1
+	}
+	return 0
+}
+
+// compareTimes compares two times, returning -1, 0 or 1.
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// booksBy implements sort.Interface, ordering books by a sort field and then
+// by ID, ascending or descending.
+type booksBy struct {
+	books []*Book
+	sort  SortField
+	asc   bool
+}
+
+func (s booksBy) Len() int      { return len(s.books) }
+func (s booksBy) Swap(i, j int) { s.books[i], s.books[j] = s.books[j], s.books[i] }
+func (s booksBy) Less(i, j int) bool {
+	c := compareBooks(s.sort, s.books[i], s.books[j])
+	if s.asc {
+		return c < 0
+	}
+	return c > 0
+}
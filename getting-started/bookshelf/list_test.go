@@ -0,0 +1,67 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListOptionsMatchesYears(t *testing.T) {
+	tests := []struct {
+		min, max int
+		date     string
+		want     bool
+	}{
+		{0, 0, "", true},
+		{0, 0, "May 2005", true},
+		{2000, 0, "2000", true},
+		{2000, 0, "1999-12-31", false},
+		{2000, 0, "9999", true},
+		{2000, 0, "May 2005", false},
+		{0, 2005, "2005-12-31", true},
+		{0, 2005, "2006", false},
+		{0, 2005, "", false},
+		{0, 2005, "May 2005", false},
+		{2000, 2005, "2003-01-01", true},
+		{1, 9999, "9999-12-31", true},
+	}
+	for _, tt := range tests {
+		o := &ListOptions{MinYear: tt.min, MaxYear: tt.max}
+		if got := o.matches(&Book{PublishedDate: tt.date}); got != tt.want {
+			t.Errorf("ListOptions{MinYear: %d, MaxYear: %d}.matches(%q) = %t, want %t", tt.min, tt.max, tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	b := &Book{ID: 7, Author: "Xu", CreatedAt: time.Date(2016, 5, 1, 12, 0, 0, 5e6, time.UTC)}
+	for _, o := range []*ListOptions{
+		{},
+		{SortBy: SortByAuthor, Descending: true},
+		{SortBy: SortByCreatedAt},
+	} {
+		c, err := decodeCursor(newCursor(o, b, true).String(), o)
+		if err != nil {
+			t.Errorf("%+v: %v", o, err)
+			continue
+		}
+		if c.admits(b) {
+			t.Errorf("%+v: cursor at a book admits it", o)
+		}
+		if c.admits(&Book{ID: b.ID + 1, Author: b.Author, CreatedAt: b.CreatedAt}) != o.Descending {
+			t.Errorf("%+v: cursor paging backwards misorders a tie", o)
+		}
+	}
+
+	// Cursors from before listings could be ordered are for the title order.
+	old := "eyJ0IjoiYSIsImkiOjF9" // {"t":"a","i":1}
+	if _, err := decodeCursor(old, &ListOptions{}); err != nil {
+		t.Errorf("decodeCursor of old cursor: %v", err)
+	}
+	if _, err := decodeCursor(old, &ListOptions{SortBy: SortByAuthor}); ErrorKind(err) != ErrInvalidArgument {
+		t.Errorf("decodeCursor of old cursor for author order: got err %v, want kind ErrInvalidArgument", err)
+	}
+}
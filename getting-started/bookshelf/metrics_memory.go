@@ -0,0 +1,33 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import "time"
+
+// Ensure MemoryMetrics conforms to the MetricsSink interface.
+var _ MetricsSink = &MemoryMetrics{}
+
+// MemoryMetrics is a MetricsSink that keeps the metrics in memory, where
+// tests and the app's /debug/metrics page can read them. It holds the calls
+// made since it was created, by this process only.
+type MemoryMetrics struct {
+	table metricsTable
+}
+
+// NewMemoryMetrics creates an empty MemoryMetrics.
+func NewMemoryMetrics() *MemoryMetrics {
+	return &MemoryMetrics{}
+}
+
+// RecordCall records a call of the named method.
+func (m *MemoryMetrics) RecordCall(method string, latency time.Duration, failed bool) {
+	m.table.RecordCall(method, latency, failed)
+}
+
+// Snapshot returns the metrics of each method called so far, ordered by
+// method.
+func (m *MemoryMetrics) Snapshot() []MethodMetrics {
+	return m.table.snapshot()
+}
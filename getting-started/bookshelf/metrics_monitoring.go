@@ -0,0 +1,254 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+
+	"google.golang.org/api/monitoring/v3"
+)
+
+// Ensure monitoringSink conforms to the MetricsSink interface.
+var _ MetricsSink = &monitoringSink{}
+
+// The custom metrics written by a monitoringSink. Each has a "method" label
+// naming the BookDatabase method, and an "instance" label naming the program
+// that made the calls and its host. Each instance writes its own totals,
+// since it started, so their series must be kept apart: the calls of the app
+// are the sum over the instances.
+const (
+	callsMetricType   = "custom.googleapis.com/bookshelf/database/calls"
+	errorsMetricType  = "custom.googleapis.com/bookshelf/database/errors"
+	latencyMetricType = "custom.googleapis.com/bookshelf/database/latency"
+)
+
+// monitoringSink is a MetricsSink that writes the metrics to Cloud Monitoring
+// as custom metrics. It accumulates the calls in memory, and writes the
+// totals since it was created every interval, so the metrics are cumulative.
+// Writing them is best effort: failures are logged, and the totals are
+// written again at the next interval.
+type monitoringSink struct {
+	service   *monitoring.Service
+	projectID string
+	instance  string                        // The value of the "instance" label; see instanceID.
+	resource  *monitoring.MonitoredResource // See monitoredResource.
+	start     time.Time                     // The start of the cumulative metrics' interval.
+	table     metricsTable
+}
+
+// newMonitoringSink creates a MetricsSink that writes the metrics of a
+// project every interval, creating their descriptors first.
+func newMonitoringSink(projectID string, interval time.Duration) (*monitoringSink, error) {
+	ctx := context.Background()
+	hc, err := google.DefaultClient(ctx, monitoring.MonitoringScope)
+	if err != nil {
+		return nil, err
+	}
+	service, err := monitoring.New(hc)
+	if err != nil {
+		return nil, err
+	}
+	s := &monitoringSink{
+		service:   service,
+		projectID: projectID,
+		instance:  instanceID(),
+		resource:  monitoredResource(projectID),
+		start:     time.Now(),
+	}
+	if err := s.createMetrics(); err != nil {
+		return nil, err
+	}
+	go s.run(interval)
+	return s, nil
+}
+
+// RecordCall records a call of the named method, to be written at the next
+// interval.
+func (s *monitoringSink) RecordCall(method string, latency time.Duration, failed bool) {
+	s.table.RecordCall(method, latency, failed)
+}
+
+// instanceID returns a name for this process that tells it apart from the
+// other instances of the app and the worker: its host name and program name.
+// Unlike a process ID, the name survives restarts, so a restarted process
+// continues its series, from a new start time, rather than adding new ones.
+func instanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return host + "/" + filepath.Base(os.Args[0])
+}
+
+// monitoredResource returns the resource the metrics are written for: the
+// Compute Engine instance the process runs on, as on App Engine flexible and
+// Kubernetes Engine, or the project's global resource elsewhere.
+func monitoredResource(projectID string) *monitoring.MonitoredResource {
+	if !metadata.OnGCE() {
+		return globalResource(projectID)
+	}
+	id, err := metadata.InstanceID()
+	if err != nil {
+		log.Printf("monitoring: could not get instance ID, writing global metrics: %v", err)
+		return globalResource(projectID)
+	}
+	zone, err := metadata.Zone()
+	if err != nil {
+		log.Printf("monitoring: could not get zone, writing global metrics: %v", err)
+		return globalResource(projectID)
+	}
+	return &monitoring.MonitoredResource{
+		Type: "gce_instance",
+		Labels: map[string]string{
+			"project_id":  projectID,
+			"instance_id": id,
+			"zone":        zone,
+		},
+	}
+}
+
+// globalResource returns the global resource of a project.
+func globalResource(projectID string) *monitoring.MonitoredResource {
+	return &monitoring.MonitoredResource{
+		Type:   "global",
+		Labels: map[string]string{"project_id": projectID},
+	}
+}
+
+func (s *monitoringSink) projectResource() string {
+	return "projects/" + s.projectID
+}
+
+// createMetrics creates the descriptors of the custom metrics. Creating a
+// descriptor that exists already is harmless.
+func (s *monitoringSink) createMetrics() error {
+	method := &monitoring.LabelDescriptor{
+		Key:         "method",
+		ValueType:   "STRING",
+		Description: "The BookDatabase method called",
+	}
+	instance := &monitoring.LabelDescriptor{
+		Key:         "instance",
+		ValueType:   "STRING",
+		Description: "The program that made the calls, and its host",
+	}
+	labels := []*monitoring.LabelDescriptor{method, instance}
+	descriptors := []*monitoring.MetricDescriptor{
+		{
+			Type:        callsMetricType,
+			Labels:      labels,
+			MetricKind:  "CUMULATIVE",
+			ValueType:   "INT64",
+			Unit:        "1",
+			Description: "Calls made to the bookshelf database",
+			DisplayName: "Bookshelf database calls",
+		},
+		{
+			Type:        errorsMetricType,
+			Labels:      labels,
+			MetricKind:  "CUMULATIVE",
+			ValueType:   "INT64",
+			Unit:        "1",
+			Description: "Calls to the bookshelf database that failed",
+			DisplayName: "Bookshelf database errors",
+		},
+		{
+			Type:        latencyMetricType,
+			Labels:      labels,
+			MetricKind:  "CUMULATIVE",
+			ValueType:   "DISTRIBUTION",
+			Unit:        "ms",
+			Description: "Latency of the calls to the bookshelf database",
+			DisplayName: "Bookshelf database latency",
+		},
+	}
+	for _, md := range descriptors {
+		if _, err := s.service.Projects.MetricDescriptors.Create(s.projectResource(), md).Do(); err != nil {
+			return fmt.Errorf("monitoring: could not create metric %s: %v", md.Type, err)
+		}
+	}
+	return nil
+}
+
+// run writes the metrics every interval, forever.
+func (s *monitoringSink) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.write(time.Now()); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// write writes the metrics accumulated up to now.
+func (s *monitoringSink) write(now time.Time) error {
+	ts := s.timeSeries(now, s.table.snapshot())
+	if len(ts) == 0 {
+		return nil
+	}
+	req := &monitoring.CreateTimeSeriesRequest{TimeSeries: ts}
+	if _, err := s.service.Projects.TimeSeries.Create(s.projectResource(), req).Do(); err != nil {
+		return fmt.Errorf("monitoring: could not write time series: %v", err)
+	}
+	return nil
+}
+
+// timeSeries returns the points of each metric of each method at now.
+func (s *monitoringSink) timeSeries(now time.Time, ms []MethodMetrics) []*monitoring.TimeSeries {
+	interval := &monitoring.TimeInterval{
+		StartTime: s.start.UTC().Format(time.RFC3339Nano),
+		EndTime:   now.UTC().Format(time.RFC3339Nano),
+	}
+	series := func(metricType, method string, v *monitoring.TypedValue) *monitoring.TimeSeries {
+		return &monitoring.TimeSeries{
+			Metric: &monitoring.Metric{
+				Type:   metricType,
+				Labels: map[string]string{"method": method, "instance": s.instance},
+			},
+			Resource: s.resource,
+			Points:   []*monitoring.Point{{Interval: interval, Value: v}},
+		}
+	}
+
+	var ts []*monitoring.TimeSeries
+	for _, m := range ms {
+		calls, errors := m.Calls, m.Errors
+		ts = append(ts,
+			series(callsMetricType, m.Method, &monitoring.TypedValue{Int64Value: &calls}),
+			series(errorsMetricType, m.Method, &monitoring.TypedValue{Int64Value: &errors}),
+			series(latencyMetricType, m.Method, &monitoring.TypedValue{DistributionValue: distributionValue(m.Latency)}),
+		)
+	}
+	return ts
+}
+
+// distributionValue converts a Distribution to the Cloud Monitoring form, in
+// milliseconds.
+func distributionValue(d Distribution) *monitoring.Distribution {
+	bounds := make([]float64, len(latencyBounds))
+	for i, b := range latencyBounds {
+		bounds[i] = milliseconds(b)
+	}
+	return &monitoring.Distribution{
+		Count:        d.Count,
+		Mean:         milliseconds(d.Mean()),
+		BucketCounts: d.Buckets,
+		BucketOptions: &monitoring.BucketOptions{
+			ExplicitBuckets: &monitoring.Explicit{Bounds: bounds},
+		},
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
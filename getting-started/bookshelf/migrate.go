@@ -0,0 +1,277 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// migration is a numbered change to a SQL schema. Up applies the change and
+// Down reverts it.
+//
+// Each dialect has its own list of migrations, as the schemas were created at
+// different times. Versions start at 1 and are consecutive. Once released, a
+// migration must not be edited; change the schema by appending a new one
+// instead.
+type migration struct {
+	Version     int
+	Description string
+	Up, Down    []string
+}
+
+// planMigrations returns the migrations that move a schema from one version
+// to another, in the order they must run. If down is true, their Down
+// statements must be run rather than their Up statements.
+func planMigrations(migrations []migration, from, to int) (steps []migration, down bool, err error) {
+	latest := migrations[len(migrations)-1].Version
+	if from < 0 || from > latest {
+		return nil, false, fmt.Errorf("bookshelf: schema version %d is unknown (latest is %d)", from, latest)
+	}
+	if to < 0 || to > latest {
+		return nil, false, fmt.Errorf("bookshelf: cannot migrate to unknown schema version %d (latest is %d)", to, latest)
+	}
+	if to >= from {
+		// Version v is at index v-1.
+		return migrations[from:to], false, nil
+	}
+	for i := from - 1; i >= to; i-- {
+		steps = append(steps, migrations[i])
+	}
+	return steps, true, nil
+}
+
+// MigrateDB migrates the schema of the SQL database described by a data
+// source name (see OpenDB) to the given version, running up migrations to
+// move forward and down migrations to move back. A negative version means
+// the latest version.
+//
+// The applied migrations are recorded in the schema_version table. MySQL
+// databases created before migrations were introduced have their version
+// deduced from their schema the first time they are migrated. MySQL and
+// Postgres databases are locked while they are migrated, so that processes
+// migrating at the same time take turns.
+//
+// If dryRun is true, the SQL that would be run is written to w and the
+// database is left untouched. Otherwise the SQL is written to w as it runs;
+// w may be nil.
+func MigrateDB(ctx context.Context, dsn string, version int, dryRun bool, w io.Writer) error {
+	conn, d, err := openSQLForMigration(ctx, dsn, dryRun, w)
+	if err != nil {
+		return err
+	}
+	if conn != nil {
+		defer conn.Close()
+	}
+	if version < 0 {
+		version = d.latestVersion()
+	}
+	return migrateSQL(ctx, conn, d, version, dryRun, w)
+}
+
+// SchemaVersion returns the current schema version of the SQL database
+// described by a data source name, and the latest version known.
+func SchemaVersion(ctx context.Context, dsn string) (current, latest int, err error) {
+	conn, d, err := openSQLForMigration(ctx, dsn, true, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if conn != nil {
+		defer conn.Close()
+	}
+	current, err = sqlSchemaVersion(ctx, conn, d)
+	return current, d.latestVersion(), err
+}
+
+// openSQLForMigration connects to the SQL database described by a data
+// source name. The connection is nil in a dry run if the database does not
+// exist yet.
+func openSQLForMigration(ctx context.Context, dsn string, dryRun bool, w io.Writer) (*sql.DB, *sqlDialect, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bookshelf: invalid data source name %q: %v", dsn, err)
+	}
+	switch u.Scheme {
+	case "mysql":
+		config, err := mysqlConfigFromURL(u)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bookshelf: invalid data source name %q: %v", dsn, err)
+		}
+		conn, err := config.openLibrary(ctx, dryRun, w)
+		return conn, mysqlDialect, err
+	case "postgres":
+		conn, err := postgresConfigFromURL(u).open()
+		return conn, postgresDialect, err
+	case "sqlite":
+		conn, err := openSQLite(pathFromURL(u))
+		return conn, sqliteDialect, err
+	}
+	return nil, nil, fmt.Errorf("bookshelf: %q does not describe a SQL database", dsn)
+}
+
+// migrateSQL migrates the schema of the database on conn to the given
+// version. conn may be nil in a dry run, for a database that does not exist
+// yet. See MigrateDB.
+//
+// The version is read once the dialect's migration lock is held, so that a
+// process that waited for another to migrate finds nothing left to do.
+func migrateSQL(ctx context.Context, conn *sql.DB, d *sqlDialect, version int, dryRun bool, w io.Writer) error {
+	if conn != nil && !dryRun && d.lockMigrationsQuery != "" {
+		unlock, err := lockMigrations(ctx, conn, d)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	m := &sqlMigrator{conn: conn, dialect: d, dryRun: dryRun, w: w}
+	from, err := m.currentVersion(ctx)
+	if err != nil {
+		return err
+	}
+	steps, down, err := planMigrations(d.migrations, from, version)
+	if err != nil {
+		return err
+	}
+	for _, mig := range steps {
+		if err := m.run(ctx, mig, down); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockMigrations waits for the dialect's migration lock on a connection of
+// its own, which is held until the returned function is called.
+func lockMigrations(ctx context.Context, conn *sql.DB, d *sqlDialect) (unlock func(), err error) {
+	c, err := conn.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not lock migrations: %v", d.name, err)
+	}
+	var locked sql.NullInt64
+	if err := c.QueryRowContext(ctx, d.lockMigrationsQuery).Scan(&locked); err != nil || locked.Int64 != 1 {
+		c.Close()
+		if err == nil {
+			err = fmt.Errorf("lock not granted")
+		}
+		return nil, fmt.Errorf("%s: could not lock migrations: %v", d.name, err)
+	}
+	return func() {
+		// Closing the connection would release the lock too, but it goes
+		// back to the pool instead.
+		c.ExecContext(context.Background(), d.unlockMigrationsStatement)
+		c.Close()
+	}, nil
+}
+
+// sqlSchemaVersion returns the schema version of the database on conn, which
+// may be nil for a database that does not exist yet.
+func sqlSchemaVersion(ctx context.Context, conn *sql.DB, d *sqlDialect) (int, error) {
+	// Reading the version of an unversioned database would record its
+	// deduced version, so do it as a dry run.
+	m := &sqlMigrator{conn: conn, dialect: d, dryRun: true}
+	return m.currentVersion(ctx)
+}
+
+// sqlMigrator runs migrations against a database.
+type sqlMigrator struct {
+	conn    *sql.DB // nil in a dry run against a database that does not exist.
+	dialect *sqlDialect
+
+	dryRun bool
+	w      io.Writer
+}
+
+// exec runs a statement, printing it to m.w. In a dry run, the statement is
+// only printed.
+func (m *sqlMigrator) exec(ctx context.Context, stmt string) error {
+	if m.w != nil {
+		fmt.Fprintf(m.w, "%s;\n", stmt)
+	}
+	if m.dryRun {
+		return nil
+	}
+	if _, err := m.conn.ExecContext(ctx, stmt); err != nil {
+		return fmt.Errorf("%s: could not execute %q: %v", m.dialect.name, stmt, err)
+	}
+	return nil
+}
+
+// run applies a migration, or reverts it if down is true, and records the
+// resulting version.
+//
+// Not every database can change its schema in a transaction, so migrations
+// are not run in one. If one of its statements fails, the schema must be
+// repaired by hand before migrating again.
+func (m *sqlMigrator) run(ctx context.Context, mig migration, down bool) error {
+	stmts, record := mig.Up, fmt.Sprintf("INSERT INTO schema_version (version) VALUES (%d)", mig.Version)
+	if down {
+		stmts, record = mig.Down, fmt.Sprintf("DELETE FROM schema_version WHERE version = %d", mig.Version)
+	}
+	if m.w != nil {
+		direction := "up"
+		if down {
+			direction = "down"
+		}
+		fmt.Fprintf(m.w, "-- Migration %d (%s): %s\n", mig.Version, direction, mig.Description)
+	}
+	for _, stmt := range stmts {
+		if err := m.exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return m.exec(ctx, record)
+}
+
+// currentVersion returns the schema version of the database.
+//
+// A database without a schema_version table is given one, recording the
+// migrations its schema already reflects.
+func (m *sqlMigrator) currentVersion(ctx context.Context) (int, error) {
+	v := 0
+	if m.conn != nil {
+		var exists int
+		err := m.conn.QueryRowContext(ctx, m.dialect.rebind(m.dialect.tableExistsQuery), "schema_version").Scan(&exists)
+		if err != nil {
+			return 0, fmt.Errorf("%s: could not inspect schema: %v", m.dialect.name, err)
+		}
+		if exists > 0 {
+			err := m.conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&v)
+			if err != nil {
+				return 0, fmt.Errorf("%s: could not read schema version: %v", m.dialect.name, err)
+			}
+			return v, nil
+		}
+		if m.dialect.legacyVersion != nil {
+			if v, err = m.dialect.legacyVersion(ctx, m.conn); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	err := m.exec(ctx, `CREATE TABLE schema_version (
+			version INT NOT NULL,
+			applied TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (version)
+		)`)
+	if err != nil {
+		return 0, err
+	}
+	if v > 0 {
+		versions := make([]string, v)
+		for i := range versions {
+			versions[i] = fmt.Sprintf("(%d)", i+1)
+		}
+		err := m.exec(ctx, "INSERT INTO schema_version (version) VALUES "+strings.Join(versions, ", "))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMigrations(t *testing.T) {
+	for _, d := range []*sqlDialect{mysqlDialect, postgresDialect, sqliteDialect} {
+		for i, m := range d.migrations {
+			if m.Version != i+1 {
+				t.Errorf("%s: migration %d has version %d, want %d", d.name, i, m.Version, i+1)
+			}
+			if len(m.Up) == 0 || len(m.Down) == 0 {
+				t.Errorf("%s: migration %d: want both up and down statements", d.name, m.Version)
+			}
+		}
+	}
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bookshelf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsn := "sqlite:" + filepath.Join(dir, "books.db")
+	ctx := context.Background()
+
+	// A dry run prints the schema without creating it.
+	var buf bytes.Buffer
+	if err := MigrateDB(ctx, dsn, -1, true, &buf); err != nil {
+		t.Fatalf("MigrateDB dry run: %v", err)
+	}
+	if !strings.Contains(buf.String(), "CREATE TABLE books") {
+		t.Errorf("MigrateDB dry run printed %q, want CREATE TABLE books", buf.String())
+	}
+	if v, _, err := SchemaVersion(ctx, dsn); err != nil || v != 0 {
+		t.Errorf("SchemaVersion after dry run = %d, %v; want 0", v, err)
+	}
+
+	latest := sqliteDialect.latestVersion()
+	for _, version := range []int{latest, 0, latest} {
+		if err := MigrateDB(ctx, dsn, version, false, nil); err != nil {
+			t.Fatalf("MigrateDB to %d: %v", version, err)
+		}
+		if v, _, err := SchemaVersion(ctx, dsn); err != nil || v != version {
+			t.Errorf("SchemaVersion = %d, %v; want %d", v, err, version)
+		}
+	}
+
+	if err := MigrateDB(ctx, dsn, latest+1, false, nil); err == nil {
+		t.Error("MigrateDB to unknown version: want non-nil err")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	const stmt = "SELECT a FROM t WHERE b = ? AND c = ?"
+	if got := mysqlDialect.rebind(stmt); got != stmt {
+		t.Errorf("mysql rebind: got %q, want %q", got, stmt)
+	}
+	want := "SELECT a FROM t WHERE b = $1 AND c = $2"
+	if got := postgresDialect.rebind(stmt); got != want {
+		t.Errorf("postgres rebind: got %q, want %q", got, want)
+	}
+}
+
+func TestPlanMigrations(t *testing.T) {
+	migrations := []migration{{Version: 1}, {Version: 2}, {Version: 3}}
+
+	tests := []struct {
+		from, to     int
+		wantVersions []int
+		wantDown     bool
+	}{
+		{0, 3, []int{1, 2, 3}, false},
+		{1, 3, []int{2, 3}, false},
+		{3, 3, nil, false},
+		{3, 1, []int{3, 2}, true},
+		{2, 0, []int{2, 1}, true},
+	}
+	for _, tt := range tests {
+		steps, down, err := planMigrations(migrations, tt.from, tt.to)
+		if err != nil {
+			t.Errorf("planMigrations(%d, %d): %v", tt.from, tt.to, err)
+			continue
+		}
+		var versions []int
+		for _, m := range steps {
+			versions = append(versions, m.Version)
+		}
+		if !reflect.DeepEqual(versions, tt.wantVersions) || down != tt.wantDown {
+			t.Errorf("planMigrations(%d, %d) = %v, down=%v; want %v, down=%v",
+				tt.from, tt.to, versions, down, tt.wantVersions, tt.wantDown)
+		}
+	}
+
+	if _, _, err := planMigrations(migrations, 4, 3); err == nil {
+		t.Error("planMigrations from unknown version: want non-nil err")
+	}
+	if _, _, err := planMigrations(migrations, 0, 4); err == nil {
+		t.Error("planMigrations to unknown version: want non-nil err")
+	}
+}
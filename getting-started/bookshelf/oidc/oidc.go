@@ -0,0 +1,309 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package oidc signs users in with OpenID Connect providers, such as Google.
+// It discovers the endpoints of a provider from its issuer URL, and verifies
+// the ID tokens the provider issues, which must be signed with RS256:
+//
+//	p, err := oidc.Discover(ctx, "google", "https://accounts.google.com", oauth2.Config{
+//		ClientID:     clientID,
+//		ClientSecret: clientSecret,
+//		RedirectURL:  "https://example.com/oauth2callback",
+//	})
+//	...
+//	http.Redirect(w, r, p.AuthCodeURL(state, nonce), http.StatusFound)
+//	...
+//	// In the handler of the redirect URL:
+//	claims, err := p.Exchange(ctx, r.FormValue("code"), nonce)
+package oidc
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+	"golang.org/x/oauth2"
+)
+
+// GoogleIssuer is the issuer URL of Google's accounts.
+const GoogleIssuer = "https://accounts.google.com"
+
+// Provider is an OpenID Connect provider, with the OAuth client the app
+// signs users in with.
+type Provider struct {
+	// Name names the provider in the app, such as in its login URLs.
+	Name string
+
+	// Issuer is the provider's issuer URL, which its ID tokens must name.
+	Issuer string
+
+	// Config is the OAuth client, with the provider's endpoints.
+	Config *oauth2.Config
+
+	jwksURL string
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey // By key ID.
+}
+
+// discovery holds the fields used of a provider's discovery document.
+type discovery struct {
+	Issuer        string `json:"issuer"`
+	AuthEndpoint  string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURL       string `json:"jwks_uri"`
+}
+
+// Discover fetches the discovery document of the provider whose issuer URL
+// is issuer, and returns the provider, named name. The client's endpoints
+// are set from the document, and its scopes to "openid", "email" and
+// "profile" if it has none.
+func Discover(ctx context.Context, name, issuer string, client oauth2.Config) (*Provider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	var d discovery
+	if err := getJSON(ctx, issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("oidc: could not discover %s: %v", issuer, err)
+	}
+	if d.Issuer != issuer {
+		return nil, fmt.Errorf("oidc: %s claims to be the issuer %q", issuer, d.Issuer)
+	}
+	if d.AuthEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURL == "" {
+		return nil, fmt.Errorf("oidc: discovery document of %s lacks endpoints", issuer)
+	}
+
+	client.Endpoint = oauth2.Endpoint{AuthURL: d.AuthEndpoint, TokenURL: d.TokenEndpoint}
+	if len(client.Scopes) == 0 {
+		client.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &Provider{
+		Name:    name,
+		Issuer:  issuer,
+		Config:  &client,
+		jwksURL: d.JWKSURL,
+	}, nil
+}
+
+// AuthCodeURL returns the URL of the provider's page that signs the user in
+// and redirects them back to the client's redirect URL with a code. The
+// state is sent back with it, and the nonce is put in the ID token.
+func (p *Provider) AuthCodeURL(state, nonce string) string {
+	return p.Config.AuthCodeURL(state, oauth2.SetAuthURLParam("nonce", nonce))
+}
+
+// Exchange exchanges the code the provider sent back for an ID token, and
+// returns its claims once verified. nonce is the nonce given to AuthCodeURL.
+func (p *Provider) Exchange(ctx context.Context, code, nonce string) (*Claims, error) {
+	tok, err := p.Config.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: could not exchange code: %v", err)
+	}
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("oidc: token response has no ID token")
+	}
+	return p.Verify(ctx, raw, nonce)
+}
+
+// Claims holds the claims of an ID token used by the bookshelf.
+type Claims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"` // The user's ID at the provider.
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expiry          int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+
+	Name         string `json:"name"`
+	Email        string `json:"email"`
+	Picture      string `json:"picture"`
+	HostedDomain string `json:"hd"` // The user's Google Apps domain.
+}
+
+// audience is the "aud" claim, which is either a string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// timeNow is replaced by tests.
+var timeNow = time.Now
+
+// clockSkew is how far the provider's clock may be ahead of ours.
+const clockSkew = 5 * time.Minute
+
+// Verify checks that rawIDToken is an ID token issued by the provider to the
+// client, that it has not expired and that it holds nonce, and returns its
+// claims.
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (*Claims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("oidc: malformed ID token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("oidc: ID token signed with %q, want RS256", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("oidc: malformed ID token signature: %v", err)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("oidc: ID token has a bad signature")
+	}
+
+	var c Claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, fmt.Errorf("oidc: malformed ID token claims: %v", err)
+	}
+	now := timeNow()
+	switch {
+	case !p.issuedBy(c.Issuer):
+		return nil, fmt.Errorf("oidc: ID token issued by %q, want %q", c.Issuer, p.Issuer)
+	case !c.Audience.contains(p.Config.ClientID):
+		return nil, fmt.Errorf("oidc: ID token issued to %q, want %q", c.Audience, p.Config.ClientID)
+	case len(c.Audience) > 1 && c.AuthorizedParty != p.Config.ClientID:
+		return nil, fmt.Errorf("oidc: ID token authorizes %q, want %q", c.AuthorizedParty, p.Config.ClientID)
+	case time.Unix(c.Expiry, 0).Before(now):
+		return nil, errors.New("oidc: ID token has expired")
+	case time.Unix(c.IssuedAt, 0).After(now.Add(clockSkew)):
+		return nil, errors.New("oidc: ID token issued in the future")
+	case nonce == "" || c.Nonce != nonce:
+		return nil, errors.New("oidc: ID token has the wrong nonce")
+	case c.Subject == "":
+		return nil, errors.New("oidc: ID token has no subject")
+	}
+	return &c, nil
+}
+
+// issuedBy reports whether iss, the issuer claim of an ID token, names the
+// provider. Google's ID tokens may name it without the scheme.
+func (p *Provider) issuedBy(iss string) bool {
+	if p.Issuer == GoogleIssuer && iss == "accounts.google.com" {
+		return true
+	}
+	return iss == p.Issuer
+}
+
+// key returns the provider's public key with the given ID, fetching the
+// provider's keys if it is not known, as the provider may have rotated them.
+// An empty ID names the provider's only key.
+func (p *Provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if k := p.lookupKey(kid); k != nil {
+		return k, nil
+	}
+	keys, err := fetchKeys(ctx, p.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	if k := p.lookupKey(kid); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("oidc: ID token signed with unknown key %q", kid)
+}
+
+func (p *Provider) lookupKey(kid string) *rsa.PublicKey {
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k
+		}
+	}
+	return p.keys[kid]
+}
+
+// fetchKeys fetches the RSA keys of a JSON Web Key Set.
+func fetchKeys(ctx context.Context, url string) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, url, &set); err != nil {
+		return nil, fmt.Errorf("oidc: could not fetch keys: %v", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("oidc: malformed key %q: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("oidc: malformed key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of a JWT into v.
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	resp, err := ctxhttp.Get(ctx, nil, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
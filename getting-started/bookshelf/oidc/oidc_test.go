@@ -0,0 +1,195 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package oidc
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf/oidc/oidctest"
+)
+
+func newIssuer(t *testing.T) (*oidctest.Issuer, *Provider) {
+	issuer, err := oidctest.NewIssuer("client", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Discover(context.Background(), "test", issuer.URL, oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.example.com/oauth2callback",
+	})
+	if err != nil {
+		issuer.Close()
+		t.Fatal(err)
+	}
+	return issuer, p
+}
+
+func TestDiscover(t *testing.T) {
+	issuer, p := newIssuer(t)
+	defer issuer.Close()
+
+	if p.Name != "test" || p.Issuer != issuer.URL {
+		t.Errorf("got provider %q of %q, want %q of %q", p.Name, p.Issuer, "test", issuer.URL)
+	}
+	if got, want := p.Config.Endpoint.TokenURL, issuer.URL+"/token"; got != want {
+		t.Errorf("TokenURL: got %q, want %q", got, want)
+	}
+	if got := strings.Join(p.Config.Scopes, " "); got != "openid email profile" {
+		t.Errorf("Scopes: got %q, want the default scopes", got)
+	}
+
+	// The document must name the issuer it was fetched from.
+	impostor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer": %q, "authorization_endpoint": "a", "token_endpoint": "t", "jwks_uri": "k"}`, issuer.URL)
+	}))
+	defer impostor.Close()
+	if _, err := Discover(context.Background(), "impostor", impostor.URL, oauth2.Config{}); err == nil {
+		t.Error("Discover of impostor: want non-nil err")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	issuer, p := newIssuer(t)
+	defer issuer.Close()
+	other, err := oidctest.NewIssuer("client", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   issuer.URL,
+			"aud":   "client",
+			"sub":   "1234",
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+			"nonce": "nonce",
+		}
+		for k, v := range changes {
+			c[k] = v
+		}
+		return c
+	}
+	tampered := func(token string) string {
+		parts := strings.Split(token, ".")
+		evil := issuer.Sign(claims(map[string]interface{}{"sub": "evil"}))
+		return parts[0] + "." + strings.Split(evil, ".")[1] + "." + parts[2]
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		strings.Split(issuer.Sign(claims(nil)), ".")[1] + "."
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+		ok    bool
+	}{
+		{"valid", issuer.Sign(claims(nil)), "nonce", true},
+		{"audience list", issuer.Sign(claims(map[string]interface{}{"aud": []string{"client", "other"}, "azp": "client"})), "nonce", true},
+		{"wrong nonce", issuer.Sign(claims(nil)), "other nonce", false},
+		{"no nonce", issuer.Sign(claims(map[string]interface{}{"nonce": ""})), "", false},
+		{"expired", issuer.Sign(claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), "nonce", false},
+		{"issued in the future", issuer.Sign(claims(map[string]interface{}{"iat": now.Add(time.Hour).Unix()})), "nonce", false},
+		{"other audience", issuer.Sign(claims(map[string]interface{}{"aud": "other"})), "nonce", false},
+		{"other authorized party", issuer.Sign(claims(map[string]interface{}{"aud": []string{"client", "other"}, "azp": "other"})), "nonce", false},
+		{"other issuer", issuer.Sign(claims(map[string]interface{}{"iss": other.URL})), "nonce", false},
+		{"no subject", issuer.Sign(claims(map[string]interface{}{"sub": ""})), "nonce", false},
+		{"signed by other key", other.Sign(claims(nil)), "nonce", false},
+		{"tampered", tampered(issuer.Sign(claims(nil))), "nonce", false},
+		{"unsigned", unsigned, "nonce", false},
+		{"malformed", "not.a.token", "nonce", false},
+	}
+	for _, tt := range tests {
+		c, err := p.Verify(context.Background(), tt.token, tt.nonce)
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s: Verify: %v", tt.name, err)
+		case tt.ok && c.Subject != "1234":
+			t.Errorf("%s: got subject %q, want 1234", tt.name, c.Subject)
+		case !tt.ok && err == nil:
+			t.Errorf("%s: Verify: got claims %+v, want non-nil err", tt.name, c)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	issuer, p := newIssuer(t)
+	defer issuer.Close()
+	issuer.Claims["hd"] = "example.com"
+
+	// Sign in, stopping at the redirect back to the app.
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(p.AuthCodeURL("state", "nonce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := back.Query().Get("state"); got != "state" {
+		t.Errorf("got state %q, want %q", got, "state")
+	}
+	code := back.Query().Get("code")
+
+	ctx := context.Background()
+	c, err := p.Exchange(ctx, code, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Subject != "1234" || c.Name != "Test User" || c.HostedDomain != "example.com" {
+		t.Errorf("got claims %+v, want those of the test user", c)
+	}
+	if _, err := p.Exchange(ctx, code, "nonce"); err == nil {
+		t.Error("Exchange of used code: want non-nil err")
+	}
+}
+
+func TestVerifyGoogleIssuer(t *testing.T) {
+	issuer, err := oidctest.NewIssuer("client", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer issuer.Close()
+	// Google's keys, as served by the fake issuer.
+	p := &Provider{
+		Name:    "google",
+		Issuer:  GoogleIssuer,
+		Config:  &oauth2.Config{ClientID: "client"},
+		jwksURL: issuer.URL + "/keys",
+	}
+
+	for _, tt := range []struct {
+		iss string
+		ok  bool
+	}{
+		{"https://accounts.google.com", true},
+		{"accounts.google.com", true},
+		{"http://accounts.google.com", false},
+		{"accounts.example.com", false},
+	} {
+		issuer.Claims["iss"] = tt.iss
+		_, err := p.Verify(context.Background(), issuer.IDToken("nonce"), "nonce")
+		if got := err == nil; got != tt.ok {
+			t.Errorf("Verify of token issued by %q: got err %v, want ok %v", tt.iss, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"gopkg.in/mgo.v2"
+)
+
+// OpenDB opens the BookDatabase described by a data source name, which is a
+// URL whose scheme selects the backend:
+//
+//	memory:                                 a new, empty in-memory database
+//	file:path                               a database file on the local disk
+//	mysql://[user[:password]@]host[:port]   the library database on a MySQL server
+//	postgres://[user[:password]@]host[:port][/database][?sslmode=mode]
+//	                                        a database on a PostgreSQL server
+//	sqlite:path                             a SQLite database file
+//	mongodb://[user[:password]@]host[:port] the bookshelf database on a MongoDB server
+//	datastore://project-id                  Cloud Datastore in a project
+func OpenDB(dsn string) (BookDatabase, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("bookshelf: invalid data source name %q: %v", dsn, err)
+	}
+
+	switch u.Scheme {
+	case "memory":
+		return newTenantMemoryDB(), nil
+
+	case "file":
+		path := pathFromURL(u)
+		if path == "" {
+			return nil, fmt.Errorf("bookshelf: data source name %q has no path", dsn)
+		}
+		return newFileDB(path)
+
+	case "mysql":
+		config, err := mysqlConfigFromURL(u)
+		if err != nil {
+			return nil, fmt.Errorf("bookshelf: invalid data source name %q: %v", dsn, err)
+		}
+		return newMySQLDB(config)
+
+	case "postgres":
+		return newPostgresDB(postgresConfigFromURL(u))
+
+	case "sqlite":
+		path := pathFromURL(u)
+		if path == "" {
+			return nil, fmt.Errorf("bookshelf: data source name %q has no path", dsn)
+		}
+		return newSQLiteDB(path)
+
+	case "mongodb":
+		var cred *mgo.Credential
+		if u.User != nil {
+			password, _ := u.User.Password()
+			cred = &mgo.Credential{Username: u.User.Username(), Password: password}
+		}
+		return newMongoDB(u.Host, cred)
+
+	case "datastore":
+		if u.Host == "" {
+			return nil, fmt.Errorf("bookshelf: data source name %q has no project ID", dsn)
+		}
+		return configureDatastoreDB(u.Host)
+	}
+	return nil, fmt.Errorf("bookshelf: unknown database %q in data source name %q", u.Scheme, dsn)
+}
+
+// pathFromURL returns the file path of a data source name. Both
+// scheme:relative/path and scheme:///absolute/path are accepted.
+func pathFromURL(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Path
+}
+
+// splitHostPort splits a host[:port] address, using defaultPort if the
+// address has none.
+func splitHostPort(addr string, defaultPort int) (host string, port int, err error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Assume the address has no port.
+		return addr, defaultPort, nil
+	}
+	port, err = strconv.Atoi(p)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad port %q", p)
+	}
+	return host, port, nil
+}
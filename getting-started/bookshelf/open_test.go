@@ -0,0 +1,43 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import "testing"
+
+func TestOpenDB(t *testing.T) {
+	db, err := OpenDB("memory:")
+	if err != nil {
+		t.Fatalf("OpenDB(memory:): %v", err)
+	}
+	if _, ok := db.(*tenantMemoryDB); !ok {
+		t.Errorf("OpenDB(memory:) = %T, want *tenantMemoryDB", db)
+	}
+	db.Close()
+
+	for _, dsn := range []string{"", "bogus://host", "datastore://", "mysql://host:port"} {
+		if _, err := OpenDB(dsn); err == nil {
+			t.Errorf("OpenDB(%q): want non-nil err", dsn)
+		}
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		addr     string
+		wantHost string
+		wantPort int
+	}{
+		{"localhost", "localhost", 3306},
+		{"localhost:3307", "localhost", 3307},
+		{"[::1]:3307", "::1", 3307},
+	}
+	for _, tt := range tests {
+		host, port, err := splitHostPort(tt.addr, 3306)
+		if err != nil || host != tt.wantHost || port != tt.wantPort {
+			t.Errorf("splitHostPort(%q) = %q, %d, %v; want %q, %d",
+				tt.addr, host, port, err, tt.wantHost, tt.wantPort)
+		}
+	}
+}
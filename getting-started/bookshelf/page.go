@@ -0,0 +1,178 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// DefaultPageSize is the number of books returned by ListBooksPage when the
+// caller does not ask for a specific page size.
+const DefaultPageSize = 20
+
+// maxPageSize bounds the page size a caller can request.
+const maxPageSize = 100
+
+// BookPage is a single page of a book listing.
+type BookPage struct {
+	Books []*Book
+
+	// NextCursor and PrevCursor are opaque cursors for the pages following
+	// and preceding this one. They are empty if there is no such page.
+	NextCursor string
+	PrevCursor string
+}
+
+// pageCursor is a position within a listing ordered by a sort field and then
+// ID. It is handed to clients as an opaque, URL-safe string.
+type pageCursor struct {
+	// Key is the sort field's value at the position. For SortByCreatedAt it
+	// is the creation time, formatted as RFC 3339, which decodeCursor parses
+	// into at.
+	Key string `json:"t"`
+	ID  int64  `json:"i"`
+
+	// Sort and Desc record the order of the listing, so that a cursor is not
+	// used with another. Cursors from before listings could be ordered have
+	// neither, and are for the default order, by ascending title.
+	Sort SortField `json:"s,omitempty"`
+	Desc bool      `json:"d,omitempty"`
+
+	// Before is set for cursors that page backwards, i.e. the page ends just
+	// before the position rather than starting just after it.
+	Before bool `json:"b,omitempty"`
+
+	at time.Time
+}
+
+// newCursor returns the cursor at book b within the listing ordered by o.
+func newCursor(o *ListOptions, b *Book, before bool) *pageCursor {
+	c := &pageCursor{ID: b.ID, Desc: o.Descending, Before: before}
+	if sort := o.sortBy(); sort != SortByTitle {
+		c.Sort = sort
+	}
+	if c.sort() == SortByCreatedAt {
+		c.at = b.CreatedAt.UTC()
+		c.Key = c.at.Format(time.RFC3339Nano)
+	} else {
+		c.Key = sortKey(c.sort(), b)
+	}
+	return c
+}
+
+// sort returns the field the cursor's listing is ordered by.
+func (c *pageCursor) sort() SortField {
+	if c.Sort == "" {
+		return SortByTitle
+	}
+	return c.Sort
+}
+
+// value returns the sort field's value at the position, as stored by the
+// database: a time.Time for SortByCreatedAt, and otherwise a string.
+func (c *pageCursor) value() interface{} {
+	if c.sort() == SortByCreatedAt {
+		return c.at
+	}
+	return c.Key
+}
+
+// String encodes the cursor for use in URLs.
+func (c *pageCursor) String() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		// A pageCursor always marshals.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses a cursor produced by pageCursor.String for the listing
+// ordered by o. An empty string decodes to a nil cursor, which denotes the
+// first page.
+func decodeCursor(s string, o *ListOptions) (*pageCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errorf(ErrInvalidArgument, "bookshelf: invalid cursor %q", s)
+	}
+	c := &pageCursor{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, errorf(ErrInvalidArgument, "bookshelf: invalid cursor %q", s)
+	}
+	if c.sort() != o.sortBy() || c.Desc != o.Descending {
+		return nil, errorf(ErrInvalidArgument, "bookshelf: cursor %q is for a listing in another order", s)
+	}
+	if c.sort() == SortByCreatedAt {
+		if c.at, err = time.Parse(time.RFC3339Nano, c.Key); err != nil {
+			return nil, errorf(ErrInvalidArgument, "bookshelf: invalid cursor %q", s)
+		}
+	}
+	return c, nil
+}
+
+// admits reports whether b lies beyond the cursor in the direction of paging.
+func (c *pageCursor) admits(b *Book) bool {
+	at := &Book{ID: c.ID, CreatedAt: c.at}
+	switch c.sort() {
+	case SortByTitle:
+		at.Title = c.Key
+	case SortByAuthor:
+		at.Author = c.Key
+	case SortByPublishedDate:
+		at.PublishedDate = c.Key
+	}
+	cmp := compareBooks(c.sort(), b, at)
+	if c.Desc == c.Before {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// normalizePageSize clamps a requested page size to a sensible range.
+func normalizePageSize(n int) int {
+	if n <= 0 {
+		return DefaultPageSize
+	}
+	if n > maxPageSize {
+		return maxPageSize
+	}
+	return n
+}
+
+// newBookPage builds a BookPage from books read starting at cursor c, in the
+// listing ordered by o.
+//
+// books must hold up to pageSize+1 books in the order they were read: in the
+// listing's order, or the reverse when c pages backwards. The extra book, if
+// present, signals that there is another page in that direction.
+func newBookPage(books []*Book, o *ListOptions, c *pageCursor, pageSize int) *BookPage {
+	more := len(books) > pageSize
+	if more {
+		books = books[:pageSize]
+	}
+	backward := c != nil && c.Before
+	if backward {
+		for i, j := 0, len(books)-1; i < j; i, j = i+1, j-1 {
+			books[i], books[j] = books[j], books[i]
+		}
+	}
+
+	p := &BookPage{Books: books}
+	if len(books) == 0 {
+		return p
+	}
+	if more || backward {
+		p.NextCursor = newCursor(o, books[len(books)-1], false).String()
+	}
+	if (more && backward) || (c != nil && !backward) {
+		p.PrevCursor = newCursor(o, books[0], true).String()
+	}
+	return p
+}
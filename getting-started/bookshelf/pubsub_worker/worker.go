@@ -14,6 +14,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 
@@ -37,8 +38,11 @@ var (
 func main() {
 	ctx := context.Background()
 
+	if err := bookshelf.Init(); err != nil {
+		log.Fatal(err)
+	}
 	if bookshelf.PubsubClient == nil {
-		log.Fatal("You must configure the Pub/Sub client in config.go before running pubsub_worker.")
+		log.Fatal("You must configure the Pub/Sub project (BOOKSHELF_PUBSUB_PROJECT_ID) before running pubsub_worker.")
 	}
 
 	var err error
@@ -88,10 +92,30 @@ func subscribe() {
 			msg.Done(true)
 			continue
 		}
+		// The book is looked up in the tenant it was added or modified in.
+		tenant, err := bookshelf.NormalizeTenant(msg.Attributes[bookshelf.PubsubTenantAttribute])
+		if err != nil {
+			log.Printf("[ID %d] bad tenant: %v", id, err)
+			msg.Done(true)
+			continue
+		}
 
-		log.Printf("[ID %d] Processing.", id)
+		log.Printf("[ID %d] Processing for tenant %q.", id, tenant)
 		go func() {
-			if err := update(id); err != nil {
+			// Each message gets its own deadline, so that a stuck update does
+			// not hold on to the message forever.
+			ctx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+			defer cancel()
+			ctx = bookshelf.WithTenant(ctx, tenant)
+
+			err := update(ctx, id)
+			if bookshelf.ErrorKind(err) == bookshelf.ErrNotFound {
+				// The book was deleted; there is nothing left to update.
+				log.Printf("[ID %d] book no longer exists, ACK", id)
+				msg.Done(true)
+				return
+			}
+			if err != nil {
 				log.Printf("[ID %d] could not update: %v", id, err)
 				msg.Done(false) // NACK
 				return
@@ -107,15 +131,31 @@ func subscribe() {
 	}
 }
 
+// updateTimeout bounds the time spent processing a single message.
+const updateTimeout = time.Minute
+
+// maxUpdateAttempts is the number of times update tries to save a book's
+// details when the book keeps being modified concurrently.
+const maxUpdateAttempts = 5
+
 // update retrieves the book with the given ID, finds metata from the Books
 // server and updates the database with the book's details.
-func update(bookID int64) error {
-	book, err := bookshelf.DB.GetBook(bookID)
+func update(ctx context.Context, bookID int64) error {
+	// Record the worker's changes as such in the book's history, so that a
+	// user can revert them.
+	ctx = bookshelf.WithActor(ctx, bookshelf.WorkerActor)
+
+	book, err := bookshelf.DB.GetBook(ctx, bookID)
 	if err != nil {
 		return err
 	}
 
-	vols, err := booksClient.Volumes.List(book.Title).Do()
+	// An ISBN identifies the edition, so prefer it to the title.
+	query := book.Title
+	if book.ISBN != "" {
+		query = "isbn:" + book.ISBN
+	}
+	vols, err := booksClient.Volumes.List(query).Context(ctx).Do()
 	if err != nil {
 		return err
 	}
@@ -124,18 +164,57 @@ func update(bookID int64) error {
 		return nil
 	}
 
-	info := vols.Items[0].VolumeInfo
+	return saveDetails(ctx, book, vols.Items[0].VolumeInfo)
+}
+
+// saveDetails fills in a book, as read from the database, with the details
+// of a Books API volume and saves it.
+func saveDetails(ctx context.Context, book *bookshelf.Book, info *books.VolumeVolumeInfo) error {
+	fillDetails(book, info)
+	for attempt := 1; ; attempt++ {
+		err := bookshelf.DB.UpdateBook(ctx, book)
+		if _, ok := err.(*bookshelf.ConflictError); !ok || attempt == maxUpdateAttempts {
+			return err
+		}
+
+		// The book was modified since it was read (e.g. edited by a user).
+		// Their changes win: only the details still missing from the latest
+		// version are filled in.
+		log.Printf("[ID %d] Conflicting update, retrying.", book.ID)
+		if book, err = bookshelf.DB.GetBook(ctx, book.ID); err != nil {
+			return err
+		}
+		if !fillMissing(book, info) {
+			return nil
+		}
+	}
+}
+
+// fillDetails populates a book with the details of a Books API volume.
+func fillDetails(book *bookshelf.Book, info *books.VolumeVolumeInfo) {
 	book.Title = info.Title
 	book.Author = strings.Join(info.Authors, ", ")
 	book.PublishedDate = info.PublishedDate
-	if book.Description == "" {
-		book.Description = info.Description
+	fillMissing(book, info)
+}
+
+// fillMissing populates the empty fields of a book with the details of a
+// Books API volume, and reports whether it changed any.
+func fillMissing(book *bookshelf.Book, info *books.VolumeVolumeInfo) bool {
+	changed := false
+	fill := func(field *string, value string) {
+		if *field == "" && value != "" {
+			*field = value
+			changed = true
+		}
 	}
-	if book.ImageURL == "" && info.ImageLinks != nil {
-		url := info.ImageLinks.Thumbnail
+	fill(&book.Title, info.Title)
+	fill(&book.Author, strings.Join(info.Authors, ", "))
+	fill(&book.PublishedDate, info.PublishedDate)
+	fill(&book.Description, info.Description)
+	if info.ImageLinks != nil {
 		// Replace http with https to prevent Content Security errors on the page.
-		book.ImageURL = strings.Replace(url, "http://", "https://", 1)
+		fill(&book.ImageURL, strings.Replace(info.ImageLinks.Thumbnail, "http://", "https://", 1))
 	}
-
-	return bookshelf.DB.UpdateBook(book)
+	return changed
 }
@@ -0,0 +1,60 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/api/books/v1"
+
+	"github.com/GoogleCloudPlatform/golang-samples/getting-started/bookshelf"
+)
+
+func TestSaveDetailsAfterUserEdit(t *testing.T) {
+	if err := bookshelf.Configure(&bookshelf.Config{Database: "memory:"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	id, err := bookshelf.DB.AddBook(ctx, &bookshelf.Book{Title: "moby dick"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The worker reads the book, then a user edits it before the worker
+	// saves its details.
+	read, err := bookshelf.DB.GetBook(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := *read
+	edited.Title = "Moby-Dick; or, The Whale"
+	edited.Author = "Herman Melville"
+	if err := bookshelf.DB.UpdateBook(ctx, &edited); err != nil {
+		t.Fatal(err)
+	}
+
+	info := &books.VolumeVolumeInfo{
+		Title:         "Moby Dick",
+		Authors:       []string{"H. Melville"},
+		PublishedDate: "1851",
+		Description:   "A whale of a tale.",
+	}
+	if err := saveDetails(ctx, read, info); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := bookshelf.DB.GetBook(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != edited.Title || got.Author != edited.Author {
+		t.Errorf("got %q by %q, want the user's %q by %q", got.Title, got.Author, edited.Title, edited.Author)
+	}
+	if got.PublishedDate != "1851" || got.Description != info.Description {
+		t.Errorf("got published date %q and description %q, want the missing details filled in", got.PublishedDate, got.Description)
+	}
+}
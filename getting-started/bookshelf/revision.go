@@ -0,0 +1,63 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Actions recorded in a Revision.
+const (
+	RevisionAdd     = "add"
+	RevisionUpdate  = "update"
+	RevisionDelete  = "delete"
+	RevisionRestore = "restore"
+)
+
+// WorkerActor is the actor recorded for changes made by the Pub/Sub worker.
+const WorkerActor = "worker"
+
+// Revision is an immutable record of a change made to a book through a
+// BookDatabase.
+type Revision struct {
+	BookID int64
+	Action string // RevisionAdd, RevisionUpdate, RevisionDelete or RevisionRestore.
+
+	// Actor identifies who made the change: the ID of a user, "anonymous"
+	// or WorkerActor. See WithActor.
+	Actor string
+	Time  time.Time
+
+	// Book is the book as it was after the change. Its Version identifies
+	// the revision's content; deleting and restoring a book do not change it.
+	Book Book
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx that carries the actor to record in the
+// revisions written by BookDatabase calls made with it.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor carried by ctx, or the empty string.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// newRevision records a change to b made with ctx.
+func newRevision(ctx context.Context, action string, b *Book) *Revision {
+	return &Revision{
+		BookID: b.ID,
+		Action: action,
+		Actor:  ActorFromContext(ctx),
+		Time:   time.Now().UTC(),
+		Book:   *b,
+	}
+}
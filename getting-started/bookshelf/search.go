@@ -0,0 +1,97 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maxSearchResults is the maximum number of books returned by SearchBooks.
+const maxSearchResults = 50
+
+// Field weights used when ranking search results: a match in a book's title
+// counts for more than a match in its author or description.
+const (
+	titleWeight       = 3
+	authorWeight      = 2
+	descriptionWeight = 1
+)
+
+// tokenize splits s into lower-cased words, for indexing and searching.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// queryTerms returns the distinct terms of a search query.
+func queryTerms(query string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, t := range tokenize(query) {
+		if !seen[t] {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// bookTerms returns the searchable terms of a book, mapped to their frequency
+// weighted by the field they appear in.
+func bookTerms(b *Book) map[string]int {
+	terms := make(map[string]int)
+	for _, t := range tokenize(b.Title) {
+		terms[t] += titleWeight
+	}
+	for _, t := range tokenize(b.Author) {
+		terms[t] += authorWeight
+	}
+	for _, t := range tokenize(b.Description) {
+		terms[t] += descriptionWeight
+	}
+	return terms
+}
+
+// inverseDocFreq weighs a term found in n out of total books, so that rare
+// terms contribute more to a book's score than common ones.
+func inverseDocFreq(n, total int) float64 {
+	return math.Log(1 + float64(total)/float64(n))
+}
+
+// searchHit is a book matching a search, with its relevance score.
+type searchHit struct {
+	book  *Book
+	score float64
+}
+
+// hitsByScore implements sort.Interface, ordering hits by descending score
+// and then by title.
+type hitsByScore []searchHit
+
+func (s hitsByScore) Len() int      { return len(s) }
+func (s hitsByScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s hitsByScore) Less(i, j int) bool {
+	if s[i].score != s[j].score {
+		return s[i].score > s[j].score
+	}
+	return s[i].book.Title < s[j].book.Title
+}
+
+// rankHits returns the books of the most relevant hits, most relevant first.
+func rankHits(hits []searchHit) []*Book {
+	sort.Sort(hitsByScore(hits))
+	if len(hits) > maxSearchResults {
+		hits = hits[:maxSearchResults]
+	}
+	books := make([]*Book, len(hits))
+	for i, h := range hits {
+		books[i] = h.book
+	}
+	return books
+}
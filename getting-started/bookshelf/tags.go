@@ -0,0 +1,88 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"sort"
+	"strings"
+)
+
+// maxTagLength is the longest tag, in bytes, that a book may have.
+const maxTagLength = 64
+
+// TagCount is a tag and the number of books outside the trash that have it,
+// as returned by BookDatabase.ListTags.
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// NormalizeTag trims a tag, collapses the spaces within it and lowercases
+// it, so that tags differing only in case or spacing are the same. A tag
+// that is empty, too long or contains a comma or a slash, which would not
+// survive the book form or a /tags/ URL, is malformed, and the error's kind
+// is ErrInvalidArgument.
+func NormalizeTag(tag string) (string, error) {
+	t := strings.ToLower(strings.Join(strings.Fields(tag), " "))
+	switch {
+	case t == "":
+		return "", errorf(ErrInvalidArgument, "bookshelf: empty tag")
+	case len(t) > maxTagLength:
+		return "", errorf(ErrInvalidArgument, "bookshelf: tag %q is longer than %d bytes", tag, maxTagLength)
+	case strings.ContainsAny(t, ",/"):
+		return "", errorf(ErrInvalidArgument, "bookshelf: tag %q contains a comma or a slash", tag)
+	}
+	return t, nil
+}
+
+// normalizeBookTags normalizes the tags of a book about to be written, and
+// sorts them and removes duplicates. name prefixes the error's message.
+func normalizeBookTags(name string, b *Book) error {
+	if len(b.Tags) == 0 {
+		b.Tags = nil
+		return nil
+	}
+	seen := make(map[string]bool)
+	tags := make([]string, 0, len(b.Tags))
+	for _, tag := range b.Tags {
+		t, err := NormalizeTag(tag)
+		if err != nil {
+			return errorf(ErrInvalidArgument, "%s: book has an invalid tag %q", name, tag)
+		}
+		if !seen[t] {
+			seen[t] = true
+			tags = append(tags, t)
+		}
+	}
+	sort.Strings(tags)
+	b.Tags = tags
+	return nil
+}
+
+// normalizeBook normalizes the fields of a book about to be written that
+// the BookDatabase normalizes: its ISBN and its tags.
+func normalizeBook(name string, b *Book) error {
+	if err := normalizeBookISBN(name, b); err != nil {
+		return err
+	}
+	return normalizeBookTags(name, b)
+}
+
+// tagCounts returns the counts of tags, sorted by tag.
+func tagCounts(counts map[string]int) []TagCount {
+	tags := make([]TagCount, 0, len(counts))
+	for t, n := range counts {
+		tags = append(tags, TagCount{Tag: t, Count: n})
+	}
+	sort.Sort(tagsByName(tags))
+	return tags
+}
+
+// tagsByName implements sort.Interface, ordering tags alphabetically.
+type tagsByName []TagCount
+
+func (s tagsByName) Len() int           { return len(s) }
+func (s tagsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s tagsByName) Less(i, j int) bool { return s[i].Tag < s[j].Tag }
@@ -0,0 +1,47 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"fiction", "fiction"},
+		{"  Science   Fiction ", "science fiction"},
+		{"TO\tREAD", "to read"},
+	}
+	for _, tt := range tests {
+		if got, err := NormalizeTag(tt.in); err != nil || got != tt.want {
+			t.Errorf("NormalizeTag(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "   ", "a,b", "a/b", strings.Repeat("x", maxTagLength+1)} {
+		if got, err := NormalizeTag(in); ErrorKind(err) != ErrInvalidArgument {
+			t.Errorf("NormalizeTag(%q) = %q, %v; want kind ErrInvalidArgument", in, got, err)
+		}
+	}
+}
+
+func TestNormalizeBookTags(t *testing.T) {
+	b := &Book{Tags: []string{"To Read", "fiction", "to  read", "Fiction"}}
+	if err := normalizeBookTags("test", b); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"fiction", "to read"}; !reflect.DeepEqual(b.Tags, want) {
+		t.Errorf("got tags %q, want %q", b.Tags, want)
+	}
+
+	b = &Book{Tags: []string{}}
+	if err := normalizeBookTags("test", b); err != nil || b.Tags != nil {
+		t.Errorf("empty tags: got %q, %v; want nil", b.Tags, err)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultTenant is the tenant of calls whose context carries none. Books
+// stored before tenants were introduced belong to it.
+const DefaultTenant = ""
+
+// maxTenantLength is the longest tenant name. It keeps the Mongo database
+// name of a tenant within Mongo's limit of 64 bytes.
+const maxTenantLength = 40
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx that scopes the BookDatabase calls made
+// with it to the books of a tenant, such as one of the organizations sharing
+// an instance of the app. A tenant sees only its own books: each backend
+// keeps them apart, in a Datastore namespace, a tenant column or a Mongo
+// database of their own. The tenant must be normalized by NormalizeTenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant carried by ctx, or DefaultTenant.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// NormalizeTenant returns the tenant named by s, such as a host name label
+// or an email domain, in lower case. A tenant name is made of letters,
+// digits, hyphens and dots, and is at most 40 bytes long; other names are an
+// error of kind ErrInvalidArgument. The empty string names DefaultTenant.
+func NormalizeTenant(s string) (string, error) {
+	t := strings.ToLower(s)
+	if len(t) > maxTenantLength {
+		return "", errorf(ErrInvalidArgument, "tenant %q is longer than %d bytes", s, maxTenantLength)
+	}
+	for _, r := range t {
+		if !('a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '-' || r == '.') {
+			return "", errorf(ErrInvalidArgument, "tenant %q may only contain letters, digits, hyphens and dots", s)
+		}
+	}
+	if strings.HasPrefix(t, ".") || strings.HasSuffix(t, ".") || strings.Contains(t, "..") {
+		return "", errorf(ErrInvalidArgument, "tenant %q has an empty label", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package bookshelf
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestNormalizeTenant(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", DefaultTenant},
+		{"acme", "acme"},
+		{"Example.COM", "example.com"},
+		{"eng-2", "eng-2"},
+	}
+	for _, tt := range tests {
+		if got, err := NormalizeTenant(tt.in); err != nil || got != tt.want {
+			t.Errorf("NormalizeTenant(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"a b", "a_b", "a/b", "a:b", ".a", "a.", "a..b", strings.Repeat("x", maxTenantLength+1)} {
+		if got, err := NormalizeTenant(in); ErrorKind(err) != ErrInvalidArgument {
+			t.Errorf("NormalizeTenant(%q) = %q, %v; want kind ErrInvalidArgument", in, got, err)
+		}
+	}
+}
+
+func TestTenantPaths(t *testing.T) {
+	db := &fileDB{path: "/data/books.json"}
+	ctx := context.Background()
+	if got, want := db.tenantPath(ctx), db.path; got != want {
+		t.Errorf("tenantPath of the default tenant = %q, want %q", got, want)
+	}
+	if got, want := db.tenantPath(WithTenant(ctx, "acme")), "/data/books.acme.json"; got != want {
+		t.Errorf("tenantPath of acme = %q, want %q", got, want)
+	}
+	if got, want := mongoDatabaseName("eng.example.com"), "bookshelf_eng_example_com"; got != want {
+		t.Errorf("mongoDatabaseName = %q, want %q", got, want)
+	}
+}